@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// belongsToMaster reports whether pubkey is one of the master's derived
+// children within MaxDerivationIndex, or of the retired master's during a
+// seed rotation.
+func belongsToMaster(pubkey string) bool {
+	if registry == nil {
+		return false
+	}
+	_, belongs, err := registry.Lookup(pubkey)
+	if err != nil {
+		slog.Error("Error checking key against master", "pubkey", pubkey, "err", err)
+	}
+	if belongs {
+		return !isRevokedPubkey(pubkey)
+	}
+	return isRetiredDerivedKey(pubkey)
+}
+
+// isPublicKindFilter reports whether filter only asks for kinds listed in
+// READS_PUBLIC_KINDS, which restricted reads still serve to anyone.
+func isPublicKindFilter(filter nostr.Filter) bool {
+	if len(filter.Kinds) == 0 || len(config.ReadsPublicKinds) == 0 {
+		return false
+	}
+	for _, kind := range filter.Kinds {
+		if !slices.Contains(config.ReadsPublicKinds, kind) {
+			return false
+		}
+	}
+	return true
+}
+
+// maxRestrictedIDs bounds the lookup an id filter costs under restricted reads.
+const maxRestrictedIDs = 500
+
+// rejectRestrictedIDs refuses an id filter under restricted reads unless every
+// stored event it names is by a member or tags one. Ids not stored here reveal
+// nothing and don't count against it.
+func rejectRestrictedIDs(ctx context.Context, ids []string) (bool, string) {
+	if len(ids) > maxRestrictedIDs {
+		return true, fmt.Sprintf("reads restricted: at most %d ids per filter", maxRestrictedIDs)
+	}
+	ch, err := db.QueryEvents(ctx, nostr.Filter{IDs: ids})
+	if err != nil {
+		return true, fmt.Sprintf("error validating ids: %v", err)
+	}
+	reject := false
+	for evt := range ch {
+		if !reject && !isMember(evt.PubKey) && !tagsMember(evt) {
+			reject = true // keep draining the channel
+		}
+	}
+	if reject {
+		return true, "event not allowed by read restrictions"
+	}
+	return false, ""
+}
+
+// allMembers reports whether every one of pubkeys is a member.
+func allMembers(pubkeys []string) bool {
+	return !slices.ContainsFunc(pubkeys, func(pk string) bool { return !isMember(pk) })
+}
+
+// tagsMember reports whether evt p-tags a member.
+func tagsMember(evt *nostr.Event) bool {
+	for _, tag := range evt.Tags {
+		if len(tag) >= 2 && tag[0] == "p" && isMember(tag[1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// isTeamMember reports whether pubkey is listed in the team's nostr.json, in
+// the admin's TEAM_LIST or was added through the admin members API.
+func isTeamMember(pubkey string) bool {
+	return containsValue(data.Names, pubkey) || isListedMember(pubkey) || isManagedMember(pubkey)
+}
+
+// teamRestricted reports whether non-derived keys must be team members (or
+// paying subscribers, or trusted): when TEAM_DOMAIN or TEAM_LIST is set,
+// members were added through the admin API, PAID_ACCESS is on or the web of
+// trust is.
+func teamRestricted() bool {
+	return config.TeamDomain != "" || config.TeamListKind != 0 || hasManagedMembers() || config.PaidAccess || config.WoTDepth > 0
+}
+
+// isMember reports whether pubkey is either derived from master or a team member.
+func isMember(pubkey string) bool {
+	if isRevokedPubkey(pubkey) {
+		return false
+	}
+	return belongsToMaster(pubkey) || isTeamMember(pubkey)
+}
+
+// memberPubkeys returns every pubkey the relay currently treats as a member:
+// the derived children up to MaxDerivationIndex and the team list.
+func memberPubkeys() []string {
+	seen := make(map[string]bool)
+	var pubkeys []string
+	add := func(pk string) {
+		if pk != "" && !seen[pk] {
+			seen[pk] = true
+			pubkeys = append(pubkeys, pk)
+		}
+	}
+
+	if registry != nil {
+		derived, err := registry.Pubkeys()
+		if err != nil {
+			slog.Error("Error deriving member keys", "err", err)
+		}
+		for _, pk := range derived {
+			if !isRevokedPubkey(pk) {
+				add(pk)
+			}
+		}
+	}
+	for _, pk := range data.Names {
+		add(pk)
+	}
+	for _, pk := range listedMembers() {
+		add(pk)
+	}
+	managedMu.RLock()
+	for pk := range managedMembers {
+		add(pk)
+	}
+	managedMu.RUnlock()
+	return pubkeys
+}
+
+// normalizePubkey converts an npub into hex and lowercases hex keys, so keys
+// from config, nostr.json and the admin API compare equal whatever their
+// format. Invalid values come back trimmed but otherwise unchanged.
+func normalizePubkey(pubkey string) string {
+	pubkey = strings.TrimSpace(pubkey)
+	if prefix, decoded, err := nip19.Decode(pubkey); err == nil && prefix == "npub" {
+		return decoded.(string)
+	}
+	return strings.ToLower(pubkey)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// In archive mode, deleted events are removed from the store (so they vanish
+// from every query) but an encrypted copy is kept as a tombstone for
+// ARCHIVE_RETENTION_DAYS, recoverable by an admin.
+
+// Tombstone describes an archived event without revealing its content.
+type Tombstone struct {
+	EventID   string `json:"event_id"`
+	Pubkey    string `json:"pubkey"`
+	Kind      int    `json:"kind"`
+	Reason    string `json:"reason"`
+	DeletedAt int64  `json:"deleted_at"`
+	PurgeAt   int64  `json:"purge_at"`
+}
+
+func tombstoneCipher() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(deriver.DeriveSecret("higher/tombstone"))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// removeEvent deletes evt from the store, keeping a tombstone first when
+// archive mode is enabled. Moderation paths should use this instead of
+// calling db.DeleteEvent directly.
+func removeEvent(ctx context.Context, evt *nostr.Event, reason string) error {
+	if config.ArchiveMode {
+		if err := tombstoneEvent(ctx, evt, reason); err != nil {
+			return fmt.Errorf("failed to archive event %s: %w", evt.ID, err)
+		}
+	}
+	return db.DeleteEvent(ctx, evt)
+}
+
+// tombstoneEvent stores an encrypted copy of evt as an internal event.
+func tombstoneEvent(ctx context.Context, evt *nostr.Event, reason string) error {
+	aead, err := tombstoneCipher()
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	plaintext, err := json.Marshal(evt)
+	if err != nil {
+		return err
+	}
+	sealed := aead.Seal(nonce, nonce, plaintext, []byte(evt.ID))
+
+	purgeAt := time.Now().AddDate(0, 0, config.ArchiveRetentionDays).Unix()
+	return saveInternalEvent(ctx, &nostr.Event{
+		Kind: kindTombstone,
+		Tags: nostr.Tags{
+			{"e", evt.ID},
+			{"p", evt.PubKey},
+			{"k", strconv.Itoa(evt.Kind)},
+			{"reason", reason},
+			{"purge_at", strconv.FormatInt(purgeAt, 10)},
+		},
+		Content: base64.StdEncoding.EncodeToString(sealed),
+	})
+}
+
+func parseTombstone(t *nostr.Event) Tombstone {
+	ts := Tombstone{DeletedAt: int64(t.CreatedAt)}
+	for _, tag := range t.Tags {
+		if len(tag) < 2 {
+			continue
+		}
+		switch tag[0] {
+		case "e":
+			ts.EventID = tag[1]
+		case "p":
+			ts.Pubkey = tag[1]
+		case "k":
+			ts.Kind, _ = strconv.Atoi(tag[1])
+		case "reason":
+			ts.Reason = tag[1]
+		case "purge_at":
+			ts.PurgeAt, _ = strconv.ParseInt(tag[1], 10, 64)
+		}
+	}
+	return ts
+}
+
+// restoreTombstone decrypts a tombstone and puts the original event back.
+func restoreTombstone(ctx context.Context, t *nostr.Event) (*nostr.Event, error) {
+	aead, err := tombstoneCipher()
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(t.Content)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("corrupted tombstone")
+	}
+	ts := parseTombstone(t)
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(ts.EventID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt tombstone: %w", err)
+	}
+
+	var evt nostr.Event
+	if err := json.Unmarshal(plaintext, &evt); err != nil {
+		return nil, err
+	}
+	if ok, _ := evt.CheckSignature(); !ok {
+		return nil, fmt.Errorf("archived event has an invalid signature")
+	}
+	if err := db.SaveEvent(ctx, &evt); err != nil {
+		return nil, err
+	}
+	if err := db.DeleteEvent(ctx, t); err != nil {
+		slog.Warn("Archive: restored event but failed to drop its tombstone", "event_id", evt.ID, "err", err)
+	}
+	return &evt, nil
+}
+
+// purgeExpiredTombstones permanently drops tombstones past their compliance window.
+func purgeExpiredTombstones(ctx context.Context) {
+	tombstones, err := queryInternalEvents(ctx, kindTombstone, nil)
+	if err != nil {
+		slog.Error("Archive: failed to query tombstones", "err", err)
+		return
+	}
+	now := time.Now().Unix()
+	purged := 0
+	for _, t := range tombstones {
+		if parseTombstone(t).PurgeAt <= now {
+			if err := db.DeleteEvent(ctx, t); err == nil {
+				purged++
+			}
+		}
+	}
+	if purged > 0 {
+		slog.Info("Archive: purged expired tombstones", "count", purged)
+	}
+}
+
+// setupArchiveMode tombstones NIP-09 deletions, runs the purge job and
+// exposes the admin recovery API.
+func setupArchiveMode(relay *khatru.Relay) {
+	relay.OverwriteDeletionOutcome = append(relay.OverwriteDeletionOutcome,
+		func(ctx context.Context, target *nostr.Event, deletion *nostr.Event) (bool, string) {
+			// same rule khatru applies by default: only authors delete their events
+			if target.PubKey != deletion.PubKey {
+				return false, "you are not the author of this event"
+			}
+			if err := tombstoneEvent(ctx, target, "nip09"); err != nil {
+				eventLogger(ctx, target).Error("Archive: failed to tombstone", "err", err)
+				return false, "error: failed to archive event"
+			}
+			return true, ""
+		})
+
+	go func() {
+		for {
+			purgeExpiredTombstones(context.Background())
+			time.Sleep(1 * time.Hour)
+		}
+	}()
+
+	relay.Router().HandleFunc("/admin/tombstones", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		events, err := queryInternalEvents(r.Context(), kindTombstone, nil)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		tombstones := make([]Tombstone, 0, len(events))
+		for _, t := range events {
+			tombstones = append(tombstones, parseTombstone(t))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tombstones)
+	}))
+
+	// POST /admin/tombstones/{event_id}/restore
+	relay.Router().HandleFunc("/admin/tombstones/", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/admin/tombstones/"), "/")
+		if r.Method != "POST" || action != "restore" {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		events, err := queryInternalEvents(r.Context(), kindTombstone, nostr.TagMap{"e": []string{id}})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(events) == 0 {
+			http.Error(w, "Tombstone not found", http.StatusNotFound)
+			return
+		}
+		evt, err := restoreTombstone(r.Context(), events[0])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logger(r.Context()).Info("Archive: restored event", "event_id", evt.ID)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(evt)
+	}))
+
+	slog.Info("Archive mode: ENABLED", "retention_days", config.ArchiveRetentionDays)
+}
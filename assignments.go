@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+)
+
+// Which derivation index is assigned to whom. Each entry records the member's
+// name and NIP-05, when the index was handed out and, once revoked, when. A
+// revoked index no longer makes its pubkey a member: the key still derives
+// from the master, but the relay treats it as any outside key, and the index
+// is never handed out again. Claimed and delivered provisions are recorded
+// here; indices handed out some other way can be added at
+// PUT /admin/assignments/{index}.
+
+const assignmentsStateKey = "index_assignments"
+
+// Assignment is the holder of one derivation index.
+type Assignment struct {
+	Index      uint32 `json:"index"`
+	Pubkey     string `json:"pubkey"`
+	Name       string `json:"name,omitempty"`
+	NIP05      string `json:"nip05,omitempty"`
+	AssignedBy string `json:"assigned_by,omitempty"`
+	AssignedAt int64  `json:"assigned_at,omitempty"`
+	RevokedBy  string `json:"revoked_by,omitempty"`
+	RevokedAt  int64  `json:"revoked_at,omitempty"`
+}
+
+var (
+	assignmentsMu  sync.RWMutex
+	assignments    = map[uint32]*Assignment{}
+	revokedPubkeys = map[string]bool{}
+)
+
+func loadAssignments(ctx context.Context) {
+	var list []*Assignment
+	if _, err := loadState(ctx, assignmentsStateKey, &list); err != nil {
+		slog.Error("Assignments: failed to load", "err", err)
+		return
+	}
+	assignmentsMu.Lock()
+	defer assignmentsMu.Unlock()
+	for _, a := range list {
+		assignments[a.Index] = a
+		if a.RevokedAt != 0 {
+			revokedPubkeys[a.Pubkey] = true
+		}
+	}
+}
+
+// persistAssignments saves the registry; assignmentsMu must be held.
+func persistAssignments(ctx context.Context) error {
+	list := make([]*Assignment, 0, len(assignments))
+	for _, a := range assignments {
+		list = append(list, a)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Index < list[j].Index })
+	return saveState(ctx, assignmentsStateKey, list)
+}
+
+// isRevokedPubkey reports whether pubkey is the key of a revoked index.
+func isRevokedPubkey(pubkey string) bool {
+	assignmentsMu.RLock()
+	defer assignmentsMu.RUnlock()
+	return revokedPubkeys[pubkey]
+}
+
+// isAssignedIndex reports whether index is handed out or revoked, either way
+// not available to a new member.
+func isAssignedIndex(index uint32) bool {
+	assignmentsMu.RLock()
+	defer assignmentsMu.RUnlock()
+	_, ok := assignments[index]
+	return ok
+}
+
+// assignIndex records index as held by name. Revoked indices can't be
+// assigned again.
+func assignIndex(ctx context.Context, index uint32, name, nip05, by string) (*Assignment, error) {
+	pubkey, err := deriver.DerivePublicKey(index)
+	if err != nil {
+		return nil, err
+	}
+
+	assignmentsMu.Lock()
+	defer assignmentsMu.Unlock()
+	a, ok := assignments[index]
+	if ok && a.RevokedAt != 0 {
+		return nil, fmt.Errorf("index %d has been revoked", index)
+	}
+	if !ok {
+		a = &Assignment{Index: index, Pubkey: pubkey, AssignedBy: by, AssignedAt: time.Now().Unix()}
+		assignments[index] = a
+	}
+	a.Name, a.NIP05 = name, nip05
+	if err := persistAssignments(ctx); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// revokeIndex revokes index, whether or not it was assigned.
+func revokeIndex(ctx context.Context, index uint32, by string) (*Assignment, error) {
+	pubkey, err := deriver.DerivePublicKey(index)
+	if err != nil {
+		return nil, err
+	}
+
+	assignmentsMu.Lock()
+	a, ok := assignments[index]
+	if !ok {
+		a = &Assignment{Index: index, Pubkey: pubkey}
+		assignments[index] = a
+	}
+	if a.RevokedAt == 0 {
+		a.RevokedBy, a.RevokedAt = by, time.Now().Unix()
+	}
+	revokedPubkeys[pubkey] = true
+	err = persistAssignments(ctx)
+	assignmentsMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	onMembersRemoved([]string{pubkey}, "revoked")
+	return a, nil
+}
+
+// setupAssignmentsAPI loads the registry and serves
+//
+//	GET    /admin/assignments          all assigned and revoked indices
+//	PUT    /admin/assignments/{index}  {"name": "...", "nip05": "..."}
+//	DELETE /admin/assignments/{index}  revokes the index
+func setupAssignmentsAPI(relay *khatru.Relay) {
+	loadAssignments(context.Background())
+
+	relay.Router().HandleFunc("/admin/assignments", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		assignmentsMu.RLock()
+		list := make([]Assignment, 0, len(assignments))
+		for _, a := range assignments {
+			list = append(list, *a)
+		}
+		assignmentsMu.RUnlock()
+		sort.Slice(list, func(i, j int) bool { return list[i].Index < list[j].Index })
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	}))
+
+	relay.Router().HandleFunc("/admin/assignments/", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		index, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/admin/assignments/"), 10, 32)
+		if err != nil || uint32(index) > registry.MaxIndex() {
+			http.Error(w, "Invalid derivation index", http.StatusBadRequest)
+			return
+		}
+		auth, _ := readHTTPAuth(r)
+
+		var a *Assignment
+		switch r.Method {
+		case "PUT":
+			var req struct {
+				Name  string `json:"name"`
+				NIP05 string `json:"nip05"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid JSON", http.StatusBadRequest)
+				return
+			}
+			a, err = assignIndex(r.Context(), uint32(index), strings.TrimSpace(req.Name), strings.TrimSpace(req.NIP05), auth.PubKey)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			logger(r.Context()).Info("Assignments: index assigned", "index", index, "name", a.Name, "by", auth.PubKey)
+		case "DELETE":
+			a, err = revokeIndex(r.Context(), uint32(index), auth.PubKey)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			logger(r.Context()).Info("Assignments: index revoked", "index", index, "pubkey", a.Pubkey, "by", auth.PubKey)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(a)
+	}))
+}
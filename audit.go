@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Rejection audit log: every event, filter and upload refused by a policy
+// hook is recorded with its time, pubkey, kind, reason and client IP, so
+// operators can see why a member can't post without going through the logs.
+// The last AUDIT_LOG_SIZE rejections are kept, persisted every few minutes
+// and on shutdown, and served to admins at GET /admin/rejections and on the
+// /admin/audit dashboard.
+
+const (
+	rejectionsStateKey  = "rejection_audit"
+	rejectionsSaveEvery = 5 * time.Minute
+)
+
+// Rejection is one refused event, filter or upload.
+type Rejection struct {
+	At      int64  `json:"at"`
+	Type    string `json:"type"` // event, filter or upload
+	Pubkey  string `json:"pubkey,omitempty"`
+	Kind    *int   `json:"kind,omitempty"`
+	EventID string `json:"event_id,omitempty"`
+	Filter  string `json:"filter,omitempty"`
+	Size    int    `json:"size,omitempty"` // of an upload
+	Reason  string `json:"reason"`
+	IP      string `json:"ip,omitempty"`
+}
+
+// rejectionLog is a ring buffer of the latest rejections.
+type rejectionLog struct {
+	mu      sync.Mutex
+	entries []Rejection
+	next    int
+	dirty   bool
+}
+
+var rejections *rejectionLog
+
+func (l *rejectionLog) add(r Rejection) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.entries) < config.AuditLogSize {
+		l.entries = append(l.entries, r)
+	} else {
+		l.entries[l.next] = r
+		l.next = (l.next + 1) % len(l.entries)
+	}
+	l.dirty = true
+}
+
+// newest returns up to limit rejections matching keep, newest first.
+func (l *rejectionLog) newest(limit int, keep func(Rejection) bool) []Rejection {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	list := []Rejection{}
+	for i := range len(l.entries) {
+		r := l.entries[(l.next-1-i+2*len(l.entries))%len(l.entries)]
+		if keep(r) {
+			list = append(list, r)
+			if len(list) == limit {
+				break
+			}
+		}
+	}
+	return list
+}
+
+// ordered returns the rejections oldest first; l.mu must be held.
+func (l *rejectionLog) ordered() []Rejection {
+	return append(append([]Rejection{}, l.entries[l.next:]...), l.entries[:l.next]...)
+}
+
+func persistRejections(ctx context.Context) {
+	if rejections == nil {
+		return
+	}
+	rejections.mu.Lock()
+	defer rejections.mu.Unlock()
+	if !rejections.dirty {
+		return
+	}
+	if err := saveState(ctx, rejectionsStateKey, rejections.ordered()); err != nil {
+		slog.Error("Audit: failed to save rejections", "err", err)
+		return
+	}
+	rejections.dirty = false
+}
+
+// setupRejectionAudit wraps the policy hooks registered so far, so it must be
+// called once all of them are in place; bl is nil without Blossom.
+func setupRejectionAudit(relay *khatru.Relay, bl *blossom.BlossomServer) {
+	rejections = &rejectionLog{}
+	var stored []Rejection
+	if _, err := loadState(context.Background(), rejectionsStateKey, &stored); err != nil {
+		slog.Error("Audit: failed to load rejections", "err", err)
+	}
+	for _, r := range stored {
+		rejections.add(r)
+	}
+	rejections.dirty = false
+
+	for i, reject := range relay.RejectEvent {
+		relay.RejectEvent[i] = func(ctx context.Context, event *nostr.Event) (bool, string) {
+			rejected, msg := reject(ctx, event)
+			if rejected {
+				kind := event.Kind
+				rejections.add(Rejection{At: time.Now().Unix(), Type: "event", Pubkey: event.PubKey, Kind: &kind,
+					EventID: event.ID, Reason: msg, IP: contextIP(ctx)})
+			}
+			return rejected, msg
+		}
+	}
+	for i, reject := range relay.RejectFilter {
+		relay.RejectFilter[i] = func(ctx context.Context, filter nostr.Filter) (bool, string) {
+			rejected, msg := reject(ctx, filter)
+			if rejected {
+				rejections.add(Rejection{At: time.Now().Unix(), Type: "filter", Pubkey: khatru.GetAuthed(ctx),
+					Filter: filter.String(), Reason: msg, IP: contextIP(ctx)})
+			}
+			return rejected, msg
+		}
+	}
+	if bl != nil {
+		for i, reject := range bl.RejectUpload {
+			bl.RejectUpload[i] = func(ctx context.Context, auth *nostr.Event, size int, ext string) (bool, string, int) {
+				rejected, msg, status := reject(ctx, auth, size, ext)
+				if rejected {
+					r := Rejection{At: time.Now().Unix(), Type: "upload", Size: size, Reason: msg, IP: contextIP(ctx)}
+					if auth != nil {
+						r.Pubkey = auth.PubKey
+					}
+					rejections.add(r)
+				}
+				return rejected, msg, status
+			}
+		}
+	}
+
+	go func() {
+		for range time.Tick(rejectionsSaveEvery) {
+			persistRejections(context.Background())
+		}
+	}()
+
+	relay.Router().HandleFunc("/admin/rejections", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		q := r.URL.Query()
+		limit, err := strconv.Atoi(q.Get("limit"))
+		if err != nil || limit <= 0 {
+			limit = 100
+		}
+		pubkey := normalizePubkey(q.Get("pubkey"))
+		kind, kindErr := strconv.Atoi(q.Get("kind"))
+		list := rejections.newest(limit, func(rej Rejection) bool {
+			return (q.Get("type") == "" || rej.Type == q.Get("type")) &&
+				(pubkey == "" || rej.Pubkey == pubkey) &&
+				(q.Get("ip") == "" || rej.IP == q.Get("ip")) &&
+				(kindErr != nil || (rej.Kind != nil && *rej.Kind == kind))
+		})
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	}))
+
+	// the dashboard itself is public; its API calls are signed by the admin's
+	// NIP-07 browser extension
+	relay.Router().HandleFunc("/admin/audit", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, auditDashboard)
+	})
+
+	slog.Info("Rejection audit log: ENABLED", "size", config.AuditLogSize, "dashboard", "/admin/audit")
+}
+
+const auditDashboard = `<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>Rejections</title>
+    <style>
+        body { font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, sans-serif; background: #0f172a; color: #e5e7eb; margin: 0; padding: 2rem; }
+        h1 { margin-top: 0; }
+        input, select { padding: 0.4rem; margin-right: 0.5rem; }
+        button { background: #7c3aed; color: white; border: 0; border-radius: 4px; padding: 0.4rem 0.8rem; cursor: pointer; }
+        table { border-collapse: collapse; width: 100%; margin-top: 1rem; font-size: 0.85rem; }
+        th, td { text-align: left; padding: 0.4rem; border-bottom: 1px solid #374151; vertical-align: top; }
+        td.mono { font-family: monospace; word-break: break-all; }
+        #status { color: #fbbf24; }
+    </style>
+</head>
+<body>
+    <h1>Rejections</h1>
+    <p id="status">Sign in with your NIP-07 extension to load rejected events, filters and uploads.</p>
+    <select id="type"><option value="">all</option><option>event</option><option>filter</option><option>upload</option></select>
+    <input id="pubkey" placeholder="npub or hex pubkey">
+    <button onclick="load()">Load</button>
+    <table>
+        <thead><tr><th>Time</th><th>Type</th><th>Pubkey</th><th>Kind</th><th>Reason</th><th>IP</th></tr></thead>
+        <tbody id="rows"></tbody>
+    </table>
+<script>
+async function authHeader(path, method) {
+    const event = await window.nostr.signEvent({
+        kind: 27235,
+        created_at: Math.floor(Date.now() / 1000),
+        tags: [["u", location.origin + path], ["method", method]],
+        content: ""
+    });
+    return "Nostr " + btoa(JSON.stringify(event));
+}
+
+function cell(tr, text, cls) {
+    const td = document.createElement("td");
+    td.textContent = text;
+    if (cls) td.className = cls;
+    tr.appendChild(td);
+}
+
+async function load() {
+    const status = document.getElementById("status");
+    if (!window.nostr) { status.textContent = "No NIP-07 extension found."; return; }
+    const params = new URLSearchParams({ limit: "500" });
+    const type = document.getElementById("type").value;
+    const pubkey = document.getElementById("pubkey").value.trim();
+    if (type) params.set("type", type);
+    if (pubkey) params.set("pubkey", pubkey);
+    const path = "/admin/rejections?" + params;
+    try {
+        const res = await fetch(path, { headers: { "Authorization": await authHeader(path, "GET") } });
+        if (!res.ok) throw new Error(await res.text());
+        const list = await res.json();
+        const rows = document.getElementById("rows");
+        rows.replaceChildren();
+        for (const r of list) {
+            const tr = document.createElement("tr");
+            cell(tr, new Date(r.at * 1000).toLocaleString());
+            cell(tr, r.type);
+            cell(tr, r.pubkey || "", "mono");
+            cell(tr, r.kind !== undefined ? String(r.kind) : (r.filter || ""), "mono");
+            cell(tr, r.reason);
+            cell(tr, r.ip || "", "mono");
+            rows.appendChild(tr);
+        }
+        status.textContent = list.length + " rejections";
+    } catch (e) {
+        status.textContent = e.message;
+    }
+}
+</script>
+</body>
+</html>
+`
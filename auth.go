@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// readBlossomAuth parses a BUD-01 authorization event (kind 24242) for action,
+// its "t" tag, from the "Authorization: Nostr <base64>" header. Browsers
+// cannot set headers on websocket upgrades, so the same base64 payload is also
+// accepted from the "auth" query parameter. Returns nil, nil when no
+// authorization is present.
+func readBlossomAuth(r *http.Request, action string) (*nostr.Event, error) {
+	token := r.Header.Get("Authorization")
+	if strings.HasPrefix(token, "Nostr ") {
+		token = strings.TrimPrefix(token, "Nostr ")
+	} else if q := r.URL.Query().Get("auth"); q != "" {
+		token = q
+	} else {
+		return nil, nil
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		// tolerate URL-safe encodings coming from query strings
+		raw, err = base64.URLEncoding.DecodeString(token)
+		if err != nil {
+			return nil, fmt.Errorf("invalid authorization encoding")
+		}
+	}
+
+	var evt nostr.Event
+	if err := json.Unmarshal(raw, &evt); err != nil || evt.Kind != 24242 || len(evt.ID) != 64 || !evt.CheckID() {
+		return nil, fmt.Errorf("invalid event")
+	}
+	if ok, _ := evt.CheckSignature(); !ok {
+		return nil, fmt.Errorf("invalid signature")
+	}
+
+	expirationTag := evt.Tags.GetFirst([]string{"expiration", ""})
+	if expirationTag == nil {
+		return nil, fmt.Errorf("missing \"expiration\" tag")
+	}
+	expiration, _ := strconv.ParseInt((*expirationTag)[1], 10, 64)
+	if nostr.Timestamp(expiration) < nostr.Now() {
+		return nil, fmt.Errorf("event expired")
+	}
+	if !evt.Tags.ContainsAny("t", []string{action}) {
+		return nil, fmt.Errorf("authorization event \"t\" tag must be %q", action)
+	}
+
+	return &evt, nil
+}
+
+// readHTTPAuth validates a NIP-98 HTTP authorization event (kind 27235) from
+// the "Authorization: Nostr <base64>" header, checking that it was made for
+// this request's path and method within the last minute.
+func readHTTPAuth(r *http.Request) (*nostr.Event, error) {
+	token := r.Header.Get("Authorization")
+	if !strings.HasPrefix(token, "Nostr ") {
+		return nil, nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(token, "Nostr "))
+	if err != nil {
+		return nil, fmt.Errorf("invalid authorization encoding")
+	}
+
+	var evt nostr.Event
+	if err := json.Unmarshal(raw, &evt); err != nil || evt.Kind != 27235 || len(evt.ID) != 64 || !evt.CheckID() {
+		return nil, fmt.Errorf("invalid event")
+	}
+	if ok, _ := evt.CheckSignature(); !ok {
+		return nil, fmt.Errorf("invalid signature")
+	}
+
+	if age := time.Since(evt.CreatedAt.Time()); age > time.Minute || age < -time.Minute {
+		return nil, fmt.Errorf("authorization event is too old or in the future")
+	}
+
+	// the "u" tag must point at this endpoint; compare paths only since the
+	// scheme and host may differ behind a reverse proxy
+	uTag := evt.Tags.GetFirst([]string{"u", ""})
+	if uTag == nil {
+		return nil, fmt.Errorf("missing \"u\" tag")
+	}
+	u, err := url.Parse((*uTag)[1])
+	if err != nil || strings.TrimSuffix(u.Path, "/") != strings.TrimSuffix(r.URL.Path, "/") {
+		return nil, fmt.Errorf("\"u\" tag does not match request URL")
+	}
+
+	methodTag := evt.Tags.GetFirst([]string{"method", ""})
+	if methodTag == nil || !strings.EqualFold((*methodTag)[1], r.Method) {
+		return nil, fmt.Errorf("\"method\" tag does not match request method")
+	}
+
+	return &evt, nil
+}
+
+// maxAuthedBody bounds the body read to check a NIP-98 "payload" tag.
+const maxAuthedBody = 4 << 20
+
+// usedHTTPAuths remembers the NIP-98 events already accepted by requireAdmin,
+// requireMember and /mirror, for as long as readHTTPAuth would accept them.
+var usedHTTPAuths = struct {
+	sync.Mutex
+	seen      map[string]time.Time
+	lastPrune time.Time
+}{seen: map[string]time.Time{}}
+
+// checkHTTPAuthUse completes readHTTPAuth for requests acting on the
+// authorization: when a body is sent, the "payload" tag must hold its sha256,
+// and each authorization event is good for one request only, so a captured
+// header can't be replayed, with the same body or another.
+func checkHTTPAuthUse(r *http.Request, evt *nostr.Event) error {
+	if r.Body != nil && r.Body != http.NoBody {
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxAuthedBody+1))
+		r.Body.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read request body")
+		}
+		if len(body) > maxAuthedBody {
+			return fmt.Errorf("request body is too large")
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		if len(body) > 0 {
+			sum := sha256.Sum256(body)
+			payloadTag := evt.Tags.GetFirst([]string{"payload", ""})
+			if payloadTag == nil || !strings.EqualFold((*payloadTag)[1], hex.EncodeToString(sum[:])) {
+				return fmt.Errorf("\"payload\" tag does not match request body")
+			}
+		}
+	}
+
+	now := time.Now()
+	usedHTTPAuths.Lock()
+	defer usedHTTPAuths.Unlock()
+	if now.Sub(usedHTTPAuths.lastPrune) > time.Minute {
+		for id, at := range usedHTTPAuths.seen {
+			if now.Sub(at) > 2*time.Minute {
+				delete(usedHTTPAuths.seen, id)
+			}
+		}
+		usedHTTPAuths.lastPrune = now
+	}
+	if _, used := usedHTTPAuths.seen[evt.ID]; used {
+		return fmt.Errorf("authorization event was already used")
+	}
+	usedHTTPAuths.seen[evt.ID] = now
+	return nil
+}
+
+// isAdmin reports whether pubkey is one of the configured relay operators.
+func isAdmin(pubkey string) bool {
+	for _, admin := range config.AdminPubkeys {
+		if admin == pubkey {
+			return true
+		}
+	}
+	return false
+}
+
+// requireAdmin wraps an admin API handler with NIP-98 authentication.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth, err := readHTTPAuth(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if auth == nil {
+			http.Error(w, "Missing authorization", http.StatusUnauthorized)
+			return
+		}
+		if !isAdmin(auth.PubKey) {
+			http.Error(w, "Not an admin", http.StatusForbidden)
+			return
+		}
+		if err := checkHTTPAuthUse(r, auth); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// requireMember wraps a handler with NIP-98 authentication, letting through
+// members and admins.
+func requireMember(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth, err := readHTTPAuth(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if auth == nil {
+			http.Error(w, "Missing authorization", http.StatusUnauthorized)
+			return
+		}
+		if !isMember(auth.PubKey) && !isAdmin(auth.PubKey) {
+			http.Error(w, "Not a member", http.StatusForbidden)
+			return
+		}
+		if err := checkHTTPAuthUse(r, auth); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestReadBlossomAuthAction(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+	expiration := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+
+	cases := []struct {
+		name    string
+		tags    nostr.Tags
+		action  string
+		wantErr bool
+	}{
+		{"matching action", nostr.Tags{{"t", "upload"}}, "upload", false},
+		{"list for upload", nostr.Tags{{"t", "list"}}, "upload", true},
+		{"upload for delete", nostr.Tags{{"t", "upload"}}, "delete", true},
+		{"get for list", nostr.Tags{{"t", "get"}}, "list", true},
+		{"no t tag", nil, "get", true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			evt := nostr.Event{Kind: 24242, CreatedAt: nostr.Now(), Tags: append(nostr.Tags{{"expiration", expiration}}, tc.tags...)}
+			if err := evt.Sign(sk); err != nil {
+				t.Fatal(err)
+			}
+			raw, _ := json.Marshal(evt)
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("Authorization", "Nostr "+base64.StdEncoding.EncodeToString(raw))
+
+			auth, err := readBlossomAuth(r, tc.action)
+			if tc.wantErr != (err != nil) {
+				t.Fatalf("readBlossomAuth(%q) error = %v, want error %v", tc.action, err, tc.wantErr)
+			}
+			if err == nil && auth.ID != evt.ID {
+				t.Errorf("readBlossomAuth returned event %s, want %s", auth.ID, evt.ID)
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	// BUD-03 user server list
+	kindBlossomServerList = 10063
+	// bounds a remote server's BUD-02 blob list
+	maxRemoteListSize = 16 << 20
+)
+
+// serverListMirror copies members' blobs from the Blossom servers listed in
+// their kind 10063 events onto this server, so media they reference never
+// 404s locally.
+type serverListMirror struct {
+	bl       *blossom.BlossomServer
+	inflight sync.Map // pubkey -> struct{}, prevents concurrent syncs per member
+}
+
+// setupServerListMirroring watches kind 10063 events from members and
+// periodically re-syncs every stored server list.
+func setupServerListMirroring(relay *khatru.Relay, bl *blossom.BlossomServer) {
+	m := &serverListMirror{bl: bl}
+
+	relay.OnEventSaved = append(relay.OnEventSaved, func(ctx context.Context, event *nostr.Event) {
+		if event.Kind != kindBlossomServerList || !isMember(event.PubKey) {
+			return
+		}
+		go m.sync(context.Background(), event)
+	})
+
+	go func() {
+		interval := time.Duration(config.AutoMirrorIntervalMinutes) * time.Minute
+		for {
+			time.Sleep(interval)
+			m.syncAll(context.Background())
+		}
+	}()
+
+	slog.Info("Blossom auto-mirror: ENABLED", "interval_minutes", config.AutoMirrorIntervalMinutes)
+}
+
+// syncAll re-syncs every member's server list. The lists are read first, so
+// the query isn't held open across the downloads.
+func (m *serverListMirror) syncAll(ctx context.Context) {
+	ch, err := db.QueryEvents(ctx, nostr.Filter{Kinds: []int{kindBlossomServerList}})
+	if err != nil {
+		slog.Error("Blossom auto-mirror: failed to query server lists", "err", err)
+		return
+	}
+	var lists []*nostr.Event
+	for evt := range ch {
+		if isMember(evt.PubKey) {
+			lists = append(lists, evt)
+		}
+	}
+	for _, evt := range lists {
+		m.sync(ctx, evt)
+	}
+}
+
+// sync mirrors every blob the member has on the servers listed in event.
+func (m *serverListMirror) sync(ctx context.Context, event *nostr.Event) {
+	if _, busy := m.inflight.LoadOrStore(event.PubKey, struct{}{}); busy {
+		return
+	}
+	defer m.inflight.Delete(event.PubKey)
+
+	ownURL := strings.TrimSuffix(*config.BlossomURL, "/")
+	mirrored := 0
+	for _, tag := range event.Tags {
+		if len(tag) < 2 || tag[0] != "server" {
+			continue
+		}
+		server := strings.TrimSuffix(tag[1], "/")
+		if server == "" || server == ownURL {
+			continue
+		}
+
+		blobs, err := listRemoteBlobs(ctx, server, event.PubKey)
+		if err != nil {
+			slog.Warn("Blossom auto-mirror: failed to list blobs", "pubkey", event.PubKey, "server", server, "err", err)
+			continue
+		}
+
+		for _, bd := range blobs {
+			if len(bd.SHA256) != 64 {
+				continue
+			}
+			if bd.Size > config.MaxUploadSizeMB*1024*1024 {
+				continue
+			}
+			if !blobExists(bd.SHA256) {
+				source := bd.URL
+				if source == "" {
+					source = server + "/" + bd.SHA256
+				}
+				if _, err := mirrorBlob(ctx, m.bl, source, bd.SHA256, nil); err != nil {
+					blobLogger(ctx, bd.SHA256).Warn("Blossom auto-mirror: failed to mirror", "source", source, "err", err)
+					continue
+				}
+				mirrored++
+			}
+
+			// make sure the member owns the local copy in the blob index
+			local := blossom.BlobDescriptor{
+				URL:      ownURL + "/" + bd.SHA256,
+				SHA256:   bd.SHA256,
+				Size:     bd.Size,
+				Type:     bd.Type,
+				Uploaded: bd.Uploaded,
+			}
+			if local.Uploaded == 0 {
+				local.Uploaded = nostr.Now()
+			}
+			if err := m.bl.Store.Keep(ctx, local, event.PubKey); err != nil {
+				blobLogger(ctx, bd.SHA256).Error("Blossom auto-mirror: failed to index", "err", err)
+			}
+		}
+	}
+
+	if mirrored > 0 {
+		slog.Info("Blossom auto-mirror: mirrored blobs", "pubkey", event.PubKey, "count", mirrored)
+	}
+}
+
+// listRemoteBlobs fetches the BUD-02 blob list for pubkey from a remote server.
+func listRemoteBlobs(ctx context.Context, server string, pubkey string) ([]blossom.BlobDescriptor, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", server+"/list/"+pubkey, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := blobFetchClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server returned %d", resp.StatusCode)
+	}
+
+	var blobs []blossom.BlobDescriptor
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxRemoteListSize)).Decode(&blobs); err != nil {
+		return nil, fmt.Errorf("invalid list response: %w", err)
+	}
+	return blobs, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// outboxBackfill pulls members' recent events from the write relays in their
+// NIP-65 relay lists (kind 10002), so the team relay stays a complete archive
+// even when members publish elsewhere first.
+type outboxBackfill struct {
+	relay *khatru.Relay
+	pool  *nostr.SimplePool
+}
+
+func setupOutboxBackfill(relay *khatru.Relay) {
+	b := &outboxBackfill{
+		relay: relay,
+		pool:  nostr.NewSimplePool(context.Background()),
+	}
+
+	go func() {
+		interval := time.Duration(config.BackfillIntervalMinutes) * time.Minute
+		for {
+			b.run(context.Background())
+			time.Sleep(interval)
+		}
+	}()
+
+	slog.Info("Outbox backfill: ENABLED",
+		"interval_minutes", config.BackfillIntervalMinutes, "lookback_hours", config.BackfillLookbackHours)
+}
+
+func (b *outboxBackfill) run(ctx context.Context) {
+	since := nostr.Timestamp(time.Now().Add(-time.Duration(config.BackfillLookbackHours) * time.Hour).Unix())
+	stored := 0
+
+	for _, pubkey := range memberPubkeys() {
+		relays := b.writeRelays(ctx, pubkey)
+		if len(relays) == 0 {
+			continue
+		}
+
+		fetchCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		filter := nostr.Filter{Authors: []string{pubkey}, Since: &since}
+		for ie := range b.pool.SubManyEose(fetchCtx, relays, nostr.Filters{filter}) {
+			if ie.Event == nil || ie.Event.PubKey != pubkey {
+				continue
+			}
+			// go through the normal pipeline so write policies still apply
+			skipBroadcast, err := b.relay.AddEvent(fetchCtx, ie.Event)
+			if err != nil {
+				continue
+			}
+			if !skipBroadcast {
+				b.relay.BroadcastEvent(ie.Event)
+				stored++
+			}
+		}
+		cancel()
+	}
+
+	if stored > 0 {
+		slog.Info("Outbox backfill: stored events from members' write relays", "count", stored)
+	}
+}
+
+// writeRelays returns the outbox relays for pubkey, read from the locally
+// stored kind 10002 or, failing that, from the configured bootstrap relays.
+func (b *outboxBackfill) writeRelays(ctx context.Context, pubkey string) []string {
+	filter := nostr.Filter{Kinds: []int{nostr.KindRelayListMetadata}, Authors: []string{pubkey}, Limit: 1}
+
+	var list *nostr.Event
+	if ch, err := db.QueryEvents(ctx, filter); err == nil {
+		for evt := range ch {
+			if list == nil || evt.CreatedAt > list.CreatedAt {
+				list = evt
+			}
+		}
+	}
+	if list == nil && len(config.BackfillBootstrapRelays) > 0 {
+		fetchCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		if ie := b.pool.QuerySingle(fetchCtx, config.BackfillBootstrapRelays, filter); ie != nil {
+			list = ie.Event
+		}
+		cancel()
+	}
+	if list == nil {
+		return nil
+	}
+
+	var relays []string
+	for _, tag := range list.Tags {
+		if len(tag) < 2 || tag[0] != "r" {
+			continue
+		}
+		// no marker means both read and write
+		if len(tag) >= 3 && tag[2] != "write" {
+			continue
+		}
+		url := nostr.NormalizeURL(tag[1])
+		if url == "" || b.isSelf(url) {
+			continue
+		}
+		// members choose these URLs; keep the relay off internal hosts
+		if err := checkRelayURL(ctx, url); err != nil {
+			slog.Debug("Outbox backfill: skipping write relay", "pubkey", pubkey, "relay", url, "err", err)
+			continue
+		}
+		relays = append(relays, url)
+	}
+	return relays
+}
+
+// isSelf avoids backfilling from our own websocket endpoint.
+func (b *outboxBackfill) isSelf(url string) bool {
+	if config.WebsocketURL != nil && nostr.NormalizeURL(*config.WebsocketURL) == url {
+		return true
+	}
+	return config.TeamDomain != "" && strings.TrimSuffix(url, "/") == "wss://"+config.TeamDomain
+}
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Scheduled encrypted backups. Every BACKUP_INTERVAL_HOURS the event store is
+// snapshotted (badger's online backup, pg_dump for postgres, JSON lines for
+// lmdb) together with the blob index, packed into a tar.gz, encrypted with a
+// key derived from the master seed and uploaded to the BACKUP_S3_* bucket,
+// where the newest BACKUP_KEEP backups are kept. Admins can list them and run
+// one now at /admin/backups; `higher backup fetch` downloads and decrypts
+// one, so restoring needs nothing but the bucket and the seed.
+
+const (
+	backupStateKey  = "backup_status"
+	backupObjPrefix = "higher-backup-"
+	backupObjSuffix = ".tar.gz.enc"
+	// plaintext bytes per encrypted chunk
+	backupChunkSize = 64 << 10
+)
+
+// backupMagic starts every encrypted backup, followed by an 8-byte random
+// nonce prefix and the chunks.
+var backupMagic = []byte("HIGHERBK1\n")
+
+// BackupStatus is the outcome of the last backup run.
+type BackupStatus struct {
+	Name       string `json:"name,omitempty"`
+	Size       int64  `json:"size,omitempty"`
+	Engine     string `json:"engine,omitempty"`
+	StartedAt  int64  `json:"started_at"`
+	FinishedAt int64  `json:"finished_at"`
+	Error      string `json:"error,omitempty"`
+}
+
+// backupManifest describes the files of a backup archive.
+type backupManifest struct {
+	CreatedAt int64    `json:"created_at"`
+	Relay     string   `json:"relay"`
+	Engine    string   `json:"engine"`
+	Files     []string `json:"files"`
+}
+
+var backupMu sync.Mutex // one run at a time
+
+func backupS3() *s3Client {
+	return &s3Client{cfg: config.BackupS3, client: &http.Client{}}
+}
+
+// backupCipher returns the AEAD sealing backups, keyed from the master seed.
+func backupCipher() (cipher.AEAD, error) {
+	if deriver == nil {
+		return nil, errors.New("backups are encrypted with a key derived from the master seed, which is not configured")
+	}
+	key := deriver.DeriveSecret("higher/backup")
+	if key == nil {
+		return nil, errors.New("backups are encrypted with a key derived from the master seed, which a watch-only relay doesn't have")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce is the nonce of chunk i: the stream's random prefix and the
+// chunk counter.
+func chunkNonce(prefix []byte, i uint32) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[8:], i)
+	return nonce
+}
+
+// encryptBackup seals src in chunks. Each chunk is framed by its length, the
+// top bit marking the last one, which is also authenticated so a truncated
+// backup doesn't decrypt.
+func encryptBackup(dst io.Writer, src io.Reader, aead cipher.AEAD) error {
+	prefix := make([]byte, 8)
+	if _, err := rand.Read(prefix); err != nil {
+		return err
+	}
+	if _, err := dst.Write(append(append([]byte{}, backupMagic...), prefix...)); err != nil {
+		return err
+	}
+
+	br := bufio.NewReaderSize(src, backupChunkSize)
+	plain := make([]byte, backupChunkSize)
+	for i := uint32(0); ; i++ {
+		n, err := io.ReadFull(br, plain)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		_, peekErr := br.Peek(1)
+		final := byte(0)
+		if peekErr == io.EOF {
+			final = 1
+		}
+		sealed := aead.Seal(nil, chunkNonce(prefix, i), plain[:n], []byte{final})
+		frame := make([]byte, 4)
+		binary.BigEndian.PutUint32(frame, uint32(len(sealed))|uint32(final)<<31)
+		if _, err := dst.Write(append(frame, sealed...)); err != nil {
+			return err
+		}
+		if final == 1 {
+			return nil
+		}
+	}
+}
+
+// decryptBackup reverses encryptBackup.
+func decryptBackup(dst io.Writer, src io.Reader, aead cipher.AEAD) error {
+	header := make([]byte, len(backupMagic)+8)
+	if _, err := io.ReadFull(src, header); err != nil || string(header[:len(backupMagic)]) != string(backupMagic) {
+		return errors.New("not a higher backup")
+	}
+	prefix := header[len(backupMagic):]
+
+	frame := make([]byte, 4)
+	for i := uint32(0); ; i++ {
+		if _, err := io.ReadFull(src, frame); err != nil {
+			return errors.New("backup is truncated")
+		}
+		size := binary.BigEndian.Uint32(frame)
+		final := byte(size >> 31)
+		size &^= 1 << 31
+		if size > backupChunkSize+uint32(aead.Overhead()) {
+			return errors.New("backup is corrupted")
+		}
+		sealed := make([]byte, size)
+		if _, err := io.ReadFull(src, sealed); err != nil {
+			return errors.New("backup is truncated")
+		}
+		plain, err := aead.Open(nil, chunkNonce(prefix, i), sealed, []byte{final})
+		if err != nil {
+			return errors.New("backup doesn't decrypt with this master seed, or is corrupted")
+		}
+		if _, err := dst.Write(plain); err != nil {
+			return err
+		}
+		if final == 1 {
+			return nil
+		}
+	}
+}
+
+// pgDump runs pg_dump into path, passing the password in the environment
+// rather than on the command line.
+func pgDump(ctx context.Context, dsn, path string) error {
+	args := []string{"--format=custom", "--no-owner", "--file", path}
+	env := os.Environ()
+	if u, err := url.Parse(dsn); err == nil && u.User != nil {
+		if password, ok := u.User.Password(); ok {
+			env = append(env, "PGPASSWORD="+password)
+			u.User = url.User(u.User.Username())
+			dsn = u.String()
+		}
+	}
+	cmd := exec.CommandContext(ctx, "pg_dump", append(args, "--dbname", dsn)...)
+	cmd.Env = env
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("pg_dump: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// dumpEvents writes the events matching filter as JSON lines to path.
+func dumpEvents(ctx context.Context, filter nostr.Filter, path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	w := bufio.NewWriter(file)
+	enc := json.NewEncoder(w)
+	if err := forEachEvent(ctx, filter, func(evt *nostr.Event) error { return enc.Encode(evt) }); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// snapshotBackup writes the backup's files to dir, returning the manifest.
+func snapshotBackup(ctx context.Context, dir string) (*backupManifest, error) {
+	manifest := &backupManifest{CreatedAt: time.Now().Unix(), Relay: config.RelayName}
+	switch store := unwrapDB().(type) {
+	case *badgerBackend:
+		manifest.Engine = "badger"
+		file, err := os.Create(filepath.Join(dir, "events.badger"))
+		if err != nil {
+			return nil, err
+		}
+		_, err = store.DB.Backup(file, 0)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("badger backup: %w", err)
+		}
+		manifest.Files = append(manifest.Files, "events.badger")
+	case *postgresBackend:
+		manifest.Engine = "postgres"
+		if err := pgDump(ctx, store.DatabaseURL, filepath.Join(dir, "events.pgdump")); err != nil {
+			return nil, err
+		}
+		manifest.Files = append(manifest.Files, "events.pgdump")
+	default:
+		manifest.Engine = "lmdb"
+		if err := dumpEvents(ctx, nostr.Filter{}, filepath.Join(dir, "events.jsonl")); err != nil {
+			return nil, fmt.Errorf("event dump: %w", err)
+		}
+		manifest.Files = append(manifest.Files, "events.jsonl")
+	}
+
+	// the blob index is in the event store too; on its own it can be
+	// imported into another engine next to a copy of the blobs
+	if config.BlossomEnabled {
+		if err := dumpEvents(ctx, nostr.Filter{Kinds: []int{24242}}, filepath.Join(dir, "blob-index.jsonl")); err != nil {
+			return nil, fmt.Errorf("blob index dump: %w", err)
+		}
+		manifest.Files = append(manifest.Files, "blob-index.jsonl")
+	}
+
+	raw, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "manifest.json"), raw, 0600); err != nil {
+		return nil, err
+	}
+	manifest.Files = append(manifest.Files, "manifest.json")
+	return manifest, nil
+}
+
+// packBackup writes the files of dir as a tar.gz to w.
+func packBackup(w io.Writer, dir string, files []string) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, name := range files {
+		file, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		info, err := file.Stat()
+		if err == nil {
+			err = tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: info.Size(), ModTime: info.ModTime()})
+		}
+		if err == nil {
+			_, err = io.Copy(tw, file)
+		}
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// runBackup snapshots, encrypts and uploads a backup, then deletes the
+// oldest ones beyond BACKUP_KEEP. The outcome is kept in the relay state.
+func runBackup(ctx context.Context) (*BackupStatus, error) {
+	if !backupMu.TryLock() {
+		return nil, errors.New("a backup is already running")
+	}
+	defer backupMu.Unlock()
+
+	status := &BackupStatus{StartedAt: time.Now().Unix()}
+	err := func() error {
+		aead, err := backupCipher()
+		if err != nil {
+			return err
+		}
+		dir, err := os.MkdirTemp("", "higher-backup-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+
+		manifest, err := snapshotBackup(ctx, dir)
+		if err != nil {
+			return err
+		}
+		status.Engine = manifest.Engine
+
+		// pack and encrypt into one spool file, hashing it for the upload signature
+		spool, err := os.Create(filepath.Join(dir, "backup"+backupObjSuffix))
+		if err != nil {
+			return err
+		}
+		defer spool.Close()
+		h := sha256.New()
+		pr, pw := io.Pipe()
+		go func() { pw.CloseWithError(packBackup(pw, dir, manifest.Files)) }()
+		if err := encryptBackup(io.MultiWriter(spool, h), pr, aead); err != nil {
+			pr.CloseWithError(err)
+			return err
+		}
+		size, err := spool.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		if _, err := spool.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+
+		status.Name = backupObjPrefix + time.Unix(status.StartedAt, 0).UTC().Format("20060102T150405Z") + backupObjSuffix
+		status.Size = size
+		c := backupS3()
+		header := http.Header{}
+		header.Set("Content-Type", "application/octet-stream")
+		resp, err := c.doStream(ctx, "PUT", c.objectURL(c.cfg.Prefix+status.Name), header, spool, size, hex.EncodeToString(h.Sum(nil)))
+		if err != nil {
+			return fmt.Errorf("upload: %w", err)
+		}
+		resp.Body.Close()
+		return pruneBackups(ctx)
+	}()
+	status.FinishedAt = time.Now().Unix()
+	if err != nil {
+		status.Error = err.Error()
+	}
+	if err := saveState(ctx, backupStateKey, status); err != nil {
+		slog.Error("Backup: failed to save status", "err", err)
+	}
+	return status, err
+}
+
+// listBackups returns the stored backups, oldest first.
+func listBackups(ctx context.Context) ([]s3ListEntry, error) {
+	c := backupS3()
+	entries, err := c.listObjects(ctx, c.cfg.Prefix+backupObjPrefix)
+	if err != nil {
+		return nil, err
+	}
+	var backups []s3ListEntry
+	for _, e := range entries {
+		if strings.HasSuffix(e.Key, backupObjSuffix) {
+			e.Key = strings.TrimPrefix(e.Key, c.cfg.Prefix)
+			backups = append(backups, e)
+		}
+	}
+	// names sort by time
+	sort.Slice(backups, func(i, j int) bool { return backups[i].Key < backups[j].Key })
+	return backups, nil
+}
+
+// pruneBackups deletes the oldest backups beyond BACKUP_KEEP.
+func pruneBackups(ctx context.Context) error {
+	if config.BackupKeep <= 0 {
+		return nil
+	}
+	backups, err := listBackups(ctx)
+	if err != nil {
+		return fmt.Errorf("listing backups: %w", err)
+	}
+	c := backupS3()
+	for _, old := range backups[:max(len(backups)-config.BackupKeep, 0)] {
+		resp, err := c.do(ctx, "DELETE", c.objectURL(c.cfg.Prefix+old.Key), nil, nil, emptyPayloadHash)
+		if err != nil {
+			return fmt.Errorf("deleting %s: %w", old.Key, err)
+		}
+		resp.Body.Close()
+		slog.Info("Backup: old backup deleted", "name", old.Key)
+	}
+	return nil
+}
+
+// fetchBackup downloads backup name and writes it decrypted, as a tar.gz,
+// to w.
+func fetchBackup(ctx context.Context, name string, w io.Writer) error {
+	aead, err := backupCipher()
+	if err != nil {
+		return err
+	}
+	c := backupS3()
+	resp, err := c.do(ctx, "GET", c.objectURL(c.cfg.Prefix+name), nil, nil, emptyPayloadHash)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return decryptBackup(w, bufio.NewReader(resp.Body), aead)
+}
+
+// setupBackups exposes GET /admin/backups (stored backups and the last run)
+// and POST /admin/backups (run now, in the background), and schedules the
+// periodic backup.
+func setupBackups(relay *khatru.Relay) {
+	if _, err := backupCipher(); err != nil {
+		fatal("Configuration error: BACKUP_INTERVAL_HOURS needs the master seed", "err", err)
+	}
+
+	relay.Router().HandleFunc("/admin/backups", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			backups, err := listBackups(r.Context())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+			var last *BackupStatus
+			if _, err := loadState(r.Context(), backupStateKey, &last); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]any{"backups": backups, "last": last})
+		case "POST":
+			go func() {
+				if status, err := runBackup(context.Background()); err != nil {
+					slog.Error("Backup: run failed", "err", err)
+				} else {
+					slog.Info("Backup: uploaded", "name", status.Name, "size", status.Size)
+				}
+			}()
+			logger(r.Context()).Info("Backup: run requested by admin")
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}))
+
+	go func() {
+		for {
+			time.Sleep(time.Duration(config.BackupIntervalHours) * time.Hour)
+			if status, err := runBackup(context.Background()); err != nil {
+				slog.Error("Backup: run failed", "err", err)
+			} else {
+				slog.Info("Backup: uploaded", "name", status.Name, "size", status.Size)
+			}
+		}
+	}()
+	slog.Info("Backup: ENABLED", "interval_hours", config.BackupIntervalHours, "keep", config.BackupKeep,
+		"bucket", config.BackupS3.Bucket)
+}
+
+// runBackupCommand implements `higher backup run|list|fetch`.
+func runBackupCommand(args []string) {
+	if len(args) == 0 || (args[0] != "run" && args[0] != "list" && args[0] != "fetch") {
+		fmt.Fprintf(os.Stderr, cliUsage, os.Args[0])
+		os.Exit(2)
+	}
+
+	set := newFlagSet("backup "+args[0], "backup run | backup list | backup fetch [--output FILE] NAME")
+	envFile := set.String("env-file", ".env", "configuration file")
+	output := set.String("output", "", "file to write the decrypted tar.gz to (default NAME without .enc)")
+	set.Parse(args[1:])
+
+	log.SetOutput(os.Stderr)
+	flags.EnvFile = *envFile
+	relay = khatru.NewRelay()
+	config = LoadConfig()
+	defer db.Close()
+	if err := initDeriver(config); err != nil {
+		log.Fatalf("Failed to initialize key deriver: %v", err)
+	}
+	if config.BackupS3.Endpoint == "" || config.BackupS3.Bucket == "" {
+		log.Fatalf("Set BACKUP_S3_ENDPOINT, BACKUP_S3_BUCKET and the BACKUP_S3_* credentials")
+	}
+	ctx := context.Background()
+
+	switch args[0] {
+	case "run":
+		status, err := runBackup(ctx)
+		if err != nil {
+			log.Fatalf("Backup failed: %v", err)
+		}
+		log.Printf("Uploaded %s (%d bytes)", status.Name, status.Size)
+	case "list":
+		backups, err := listBackups(ctx)
+		if err != nil {
+			log.Fatalf("Failed to list backups: %v", err)
+		}
+		for _, b := range backups {
+			fmt.Printf("%s\t%d\t%s\n", b.Key, b.Size, b.LastModified.UTC().Format(time.RFC3339))
+		}
+	case "fetch":
+		if set.NArg() != 1 {
+			set.Usage()
+			os.Exit(2)
+		}
+		name := set.Arg(0)
+		path := *output
+		if path == "" {
+			path = strings.TrimSuffix(name, ".enc")
+		}
+		file, err := os.Create(path)
+		if err != nil {
+			log.Fatalf("Failed to create %s: %v", path, err)
+		}
+		if err := fetchBackup(ctx, name, file); err != nil {
+			file.Close()
+			os.Remove(path)
+			log.Fatalf("Failed to fetch %s: %v", name, err)
+		}
+		if err := file.Close(); err != nil {
+			log.Fatalf("Failed to write %s: %v", path, err)
+		}
+		log.Printf("Wrote %s", path)
+	}
+}
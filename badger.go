@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	badgerdb "github.com/dgraph-io/badger/v4"
+	"github.com/dgraph-io/badger/v4/options"
+	"github.com/fiatjaf/eventstore/badger"
+)
+
+// Badger event store. BADGER_VLOG_FILE_SIZE_MB, BADGER_COMPRESSION and
+// BADGER_BLOCK_CACHE_MB / BADGER_INDEX_CACHE_MB tune the database, and
+// BADGER_GC_INTERVAL_MINUTES runs value log garbage collection in the
+// background: Badger never reclaims the space of overwritten or deleted
+// values by itself, so without it db/ only grows on a busy relay.
+
+// badgerGCDiscardRatio is the share of stale data a value log file needs
+// before it is rewritten.
+const badgerGCDiscardRatio = 0.5
+
+// badgerBackend runs value log GC on top of the eventstore backend.
+type badgerBackend struct {
+	*badger.BadgerBackend
+	gcInterval time.Duration
+
+	stop chan struct{}
+	done sync.WaitGroup
+}
+
+func newBadgerBackend(cfg *Config) DBBackend {
+	compression, err := badgerCompression(cfg.BadgerCompression)
+	if err != nil {
+		fatal("Configuration error", "err", err)
+	}
+	if compression != options.None && cfg.BadgerBlockCacheMB <= 0 {
+		fatal("Configuration error: BADGER_BLOCK_CACHE_MB must be set when BADGER_COMPRESSION is enabled")
+	}
+	return &badgerBackend{
+		BadgerBackend: &badger.BadgerBackend{
+			Path: *cfg.DBPath,
+			BadgerOptionsModifier: func(opts badgerdb.Options) badgerdb.Options {
+				if cfg.BadgerVlogFileSizeMB > 0 {
+					opts = opts.WithValueLogFileSize(int64(cfg.BadgerVlogFileSizeMB) << 20)
+				}
+				return opts.
+					WithCompression(compression).
+					WithBlockCacheSize(int64(max(cfg.BadgerBlockCacheMB, 0)) << 20).
+					WithIndexCacheSize(int64(max(cfg.BadgerIndexCacheMB, 0)) << 20)
+			},
+		},
+		gcInterval: time.Duration(cfg.BadgerGCInterval) * time.Minute,
+	}
+}
+
+func badgerCompression(name string) (options.CompressionType, error) {
+	switch strings.ToLower(name) {
+	case "none":
+		return options.None, nil
+	case "", "snappy":
+		return options.Snappy, nil
+	case "zstd":
+		return options.ZSTD, nil
+	default:
+		return options.None, fmt.Errorf("BADGER_COMPRESSION must be none, snappy or zstd, got %q", name)
+	}
+}
+
+func (b *badgerBackend) Init() error {
+	if err := b.BadgerBackend.Init(); err != nil {
+		return err
+	}
+	if b.gcInterval > 0 {
+		b.stop = make(chan struct{})
+		b.done.Add(1)
+		go b.collectGarbage()
+	}
+	slog.Info("Badger: opened", "path", b.Path, "gc_interval", b.gcInterval)
+	return nil
+}
+
+// collectGarbage rewrites value log files until none has enough stale data
+// left, every gcInterval.
+func (b *badgerBackend) collectGarbage() {
+	defer b.done.Done()
+	ticker := time.NewTicker(b.gcInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+		}
+		start := time.Now()
+		rewritten := 0
+		for {
+			err := b.DB.RunValueLogGC(badgerGCDiscardRatio)
+			if err == nil {
+				rewritten++
+				continue
+			}
+			if !errors.Is(err, badgerdb.ErrNoRewrite) && !errors.Is(err, badgerdb.ErrRejected) {
+				slog.Warn("Badger: value log GC failed", "err", err)
+			}
+			break
+		}
+		lsm, vlog := b.DB.Size()
+		slog.Debug("Badger: value log GC done", "files_rewritten", rewritten, "lsm_bytes", lsm, "vlog_bytes", vlog,
+			"duration", time.Since(start))
+	}
+}
+
+func (b *badgerBackend) Close() {
+	if b.stop != nil {
+		close(b.stop)
+		b.done.Wait()
+	}
+	b.BadgerBackend.Close()
+}
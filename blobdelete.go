@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/fiatjaf/khatru/blossom"
+)
+
+// deleteBlobs serves BUD-02 DELETE /<sha256>[.ext] in place of the blossom
+// handler, which answers success even when the signer never uploaded the
+// blob. The authorization (t=delete, x=<sha256>) must come from one of the
+// blob's owners in the upload index, whose entry is removed, or from an
+// admin, which removes every entry. The file itself is deleted once no
+// owner is left.
+func deleteBlobs(bl *blossom.BlossomServer, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "DELETE" || !blobPathRe.MatchString(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		sha256, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), ".")
+		sha256 = strings.ToLower(sha256)
+		ctx := r.Context()
+
+		auth, err := readBlossomAuth(r, "delete")
+		if err != nil {
+			blossomError(w, "invalid \"Authorization\": "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if auth == nil {
+			blossomError(w, "missing \"Authorization\" header", http.StatusUnauthorized)
+			return
+		}
+		if !auth.Tags.ContainsAny("x", []string{sha256}) {
+			blossomError(w, "invalid \"Authorization\" event \"x\" tag", http.StatusForbidden)
+			return
+		}
+		for _, reject := range bl.RejectDelete {
+			if rejected, reason, code := reject(ctx, auth, sha256); rejected {
+				blossomError(w, reason, code)
+				return
+			}
+		}
+
+		owners := blobOwners(ctx, sha256)
+		if len(owners) == 0 {
+			blossomError(w, "blob not found", http.StatusNotFound)
+			return
+		}
+		admin := isAdmin(auth.PubKey)
+		if !admin && !slices.Contains(owners, auth.PubKey) {
+			blossomError(w, "only the uploader or an admin may delete this blob", http.StatusForbidden)
+			return
+		}
+
+		remaining := owners[:0]
+		for _, owner := range owners {
+			if owner != auth.PubKey && !admin {
+				remaining = append(remaining, owner)
+				continue
+			}
+			if err := bl.Store.Delete(ctx, sha256, owner); err != nil {
+				blossomError(w, "delete of blob entry failed: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		// the content goes away only when nobody else uploaded it too
+		if len(remaining) == 0 {
+			for _, del := range bl.DeleteBlob {
+				if err := del(ctx, sha256); err != nil {
+					blossomError(w, "failed to delete blob: "+err.Error(), http.StatusInternalServerError)
+					return
+				}
+			}
+			if isQuarantined(sha256) {
+				quarantineMu.Lock()
+				delete(quarantine, sha256)
+				quarantineMu.Unlock()
+				persistQuarantine(ctx)
+			}
+		}
+
+		blobLogger(ctx, sha256).Info("Blob deleted", "by", auth.PubKey, "admin", admin, "file_removed", len(remaining) == 0)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
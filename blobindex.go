@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Blob metadata comes from blossom's upload index in the event store: one
+// kind 24242 record per uploader and blob, with its hash, size, type and
+// upload time. Uploads, NIP-96 and mirrors add to it, deletes and GC remove
+// from it, so listings and stats never have to scan or sniff the blob store.
+
+const (
+	defaultListLimit = 1000
+	maxListLimit     = 1000
+)
+
+// readListAuth returns the event authorizing a listing: a NIP-98 event for
+// this URL, or a Blossom authorization with a "list" t tag.
+func readListAuth(r *http.Request) (*nostr.Event, error) {
+	if authorizationKind(r) == 27235 {
+		return readHTTPAuth(r)
+	}
+	return readBlossomAuth(r, "list")
+}
+
+// authorizationKind peeks at the kind of the event in the Authorization
+// header, 0 when there is none.
+func authorizationKind(r *http.Request) int {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(r.Header.Get("Authorization"), "Nostr "))
+	if err != nil {
+		return 0
+	}
+	var evt struct {
+		Kind int `json:"kind"`
+	}
+	json.Unmarshal(raw, &evt)
+	return evt.Kind
+}
+
+// listCursor marks the last blob of a page: listings are ordered by upload
+// time, newest first, then by hash.
+type listCursor struct {
+	uploaded nostr.Timestamp
+	sha256   string
+}
+
+func (c listCursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%s", c.uploaded, c.sha256)))
+}
+
+func parseListCursor(value string) (listCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return listCursor{}, fmt.Errorf("invalid cursor")
+	}
+	ts, sha, _ := strings.Cut(string(raw), ":")
+	uploaded, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || !isBlobHash(sha) {
+		return listCursor{}, fmt.Errorf("invalid cursor")
+	}
+	return listCursor{uploaded: nostr.Timestamp(uploaded), sha256: sha}, nil
+}
+
+// after reports whether bd comes after the cursor in listing order.
+func (c listCursor) after(bd blossom.BlobDescriptor) bool {
+	return bd.Uploaded < c.uploaded || (bd.Uploaded == c.uploaded && bd.SHA256 > c.sha256)
+}
+
+// listQuery is the paging of a /list request.
+type listQuery struct {
+	since, until *nostr.Timestamp
+	limit        int
+	cursor       *listCursor
+}
+
+func parseListQuery(q url.Values) (listQuery, error) {
+	query := listQuery{limit: defaultListLimit}
+	for _, param := range []struct {
+		name string
+		dst  **nostr.Timestamp
+	}{{"since", &query.since}, {"until", &query.until}} {
+		if v := q.Get(param.name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				return query, fmt.Errorf("invalid %s", param.name)
+			}
+			ts := nostr.Timestamp(n)
+			*param.dst = &ts
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return query, fmt.Errorf("invalid limit")
+		}
+		query.limit = min(n, maxListLimit)
+	}
+	if v := q.Get("cursor"); v != "" {
+		c, err := parseListCursor(v)
+		if err != nil {
+			return query, err
+		}
+		query.cursor = &c
+	}
+	return query, nil
+}
+
+// setupBlobList serves GET /list/{pubkey} from the index: the blobs pubkey
+// uploaded, newest first. The owner or an admin must authorize the request
+// (NIP-98, or Blossom with t=list). since and until bound the upload time,
+// limit caps the page at maxListLimit, and when more blobs remain the
+// X-Next-Cursor header carries the cursor parameter for the next page.
+func setupBlobList(relay *khatru.Relay, bl *blossom.BlossomServer) {
+	relay.Router().HandleFunc("/list/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		pubkey := normalizePubkey(strings.TrimPrefix(r.URL.Path, "/list/"))
+		if !nostr.IsValidPublicKey(pubkey) {
+			http.Error(w, "Invalid pubkey", http.StatusBadRequest)
+			return
+		}
+		auth, err := readListAuth(r)
+		if err != nil {
+			blossomError(w, "invalid \"Authorization\": "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if auth == nil {
+			blossomError(w, "missing \"Authorization\" header", http.StatusUnauthorized)
+			return
+		}
+		if auth.PubKey != pubkey && !isAdmin(auth.PubKey) {
+			blossomError(w, "only the owner or an admin may list these blobs", http.StatusForbidden)
+			return
+		}
+		query, err := parseListQuery(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		ch, err := bl.Store.List(r.Context(), pubkey)
+		if err != nil {
+			logger(r.Context()).Error("Error listing blob index", "err", err)
+			http.Error(w, "failed to list blobs", http.StatusInternalServerError)
+			return
+		}
+		blobs := []blossom.BlobDescriptor{}
+		for bd := range ch {
+			if (query.since != nil && bd.Uploaded < *query.since) || (query.until != nil && bd.Uploaded > *query.until) ||
+				(query.cursor != nil && !query.cursor.after(bd)) {
+				continue
+			}
+			blobs = append(blobs, bd)
+		}
+		sort.Slice(blobs, func(i, j int) bool {
+			if blobs[i].Uploaded != blobs[j].Uploaded {
+				return blobs[i].Uploaded > blobs[j].Uploaded
+			}
+			return blobs[i].SHA256 < blobs[j].SHA256
+		})
+		if len(blobs) > query.limit {
+			blobs = blobs[:query.limit]
+			last := blobs[len(blobs)-1]
+			w.Header().Set("X-Next-Cursor", listCursor{uploaded: last.Uploaded, sha256: last.SHA256}.String())
+		}
+
+		logger(r.Context()).Info("Returning blobs", "pubkey", pubkey, "count", len(blobs))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(blobs)
+	})
+}
+
+// indexedUploadTime returns when pubkey uploaded the blob, from its index entry.
+func indexedUploadTime(ctx context.Context, sha256, pubkey string) (nostr.Timestamp, bool) {
+	ch, err := db.QueryEvents(ctx, nostr.Filter{Authors: []string{pubkey}, Kinds: []int{24242}, Tags: nostr.TagMap{"x": []string{sha256}}, Limit: 1})
+	if err != nil {
+		return 0, false
+	}
+	for evt := range ch {
+		return evt.CreatedAt, true
+	}
+	return 0, false
+}
+
+// indexedBlobTotals counts the distinct blobs in the index and their size.
+func indexedBlobTotals(ctx context.Context) (int, int64, error) {
+	seen := map[string]bool{}
+	var bytes int64
+	err := forEachEvent(ctx, nostr.Filter{Kinds: []int{24242}}, func(evt *nostr.Event) error {
+		x := evt.Tags.GetFirst([]string{"x", ""})
+		if x == nil || seen[(*x)[1]] {
+			return nil
+		}
+		seen[(*x)[1]] = true
+		if size := evt.Tags.GetFirst([]string{"size", ""}); size != nil {
+			n, _ := strconv.ParseInt((*size)[1], 10, 64)
+			bytes += n
+		}
+		return nil
+	})
+	return len(seen), bytes, err
+}
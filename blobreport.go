@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// BUD-09 blob reports. PUT /report takes a signed kind 1984 event whose x
+// tags name blobs stored here; the blossom handler can't read the request
+// body, so this one runs in its place. Accepted reports are handed to the
+// ReceiveReport hooks, which file them through the relay like any other
+// NIP-56 report: stored with their x tags next to the blob's upload entries
+// and listed in the moderation queue, where deleting the content takes the
+// blob down.
+
+const maxReportSize = 64 << 10
+
+// receiveBlobReports serves PUT /report when MODERATION_ENABLED is set.
+func receiveBlobReports(bl *blossom.BlossomServer, next http.Handler) http.Handler {
+	if !config.ModerationEnabled {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PUT" || r.URL.Path != "/report" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := r.Context()
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxReportSize+1))
+		if err != nil {
+			blossomError(w, "failed to read report: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(body) > maxReportSize {
+			blossomError(w, "report is larger than "+strconv.Itoa(maxReportSize)+" bytes", http.StatusRequestEntityTooLarge)
+			return
+		}
+		var evt nostr.Event
+		if err := json.Unmarshal(body, &evt); err != nil || len(evt.ID) != 64 || !evt.CheckID() {
+			blossomError(w, "invalid report event is provided", http.StatusBadRequest)
+			return
+		}
+		if ok, _ := evt.CheckSignature(); !ok {
+			blossomError(w, "invalid report event signature", http.StatusBadRequest)
+			return
+		}
+		if evt.Kind != nostr.KindReporting {
+			blossomError(w, "report must be a kind 1984 event", http.StatusBadRequest)
+			return
+		}
+		blobs := reportedBlobs(&evt)
+		if len(blobs) == 0 {
+			blossomError(w, "report doesn't reference a blob stored here", http.StatusNotFound)
+			return
+		}
+
+		for _, receive := range bl.ReceiveReport {
+			if err := receive(ctx, &evt); err != nil {
+				code := http.StatusInternalServerError
+				if strings.HasPrefix(err.Error(), "blocked:") {
+					code = http.StatusForbidden
+				}
+				blossomError(w, "report not accepted: "+err.Error(), code)
+				return
+			}
+		}
+
+		logger(ctx).Info("Blob report received", "report", evt.ID, "reporter", evt.PubKey, "blobs", blobs)
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// reportedBlobs returns the blobs stored here that a report points at.
+func reportedBlobs(evt *nostr.Event) []string {
+	var blobs []string
+	for _, t := range reportTargets(evt) {
+		if t.Type == "blob" && blobExists(t.ID) {
+			blobs = append(blobs, t.ID)
+		}
+	}
+	return blobs
+}
+
+// fileBlobReport is the ReceiveReport hook that adds the report to the relay,
+// so it goes through the same policies as one published over the websocket.
+func fileBlobReport(relay *khatru.Relay) func(ctx context.Context, evt *nostr.Event) error {
+	return func(ctx context.Context, evt *nostr.Event) error {
+		_, err := relay.AddEvent(ctx, evt)
+		return err
+	}
+}
+
+// describeReportedBlob fills in what the upload index knows about a reported
+// blob and how many reports point at it.
+func describeReportedBlob(ctx context.Context, t *ReportTarget) {
+	ch, err := db.QueryEvents(ctx, nostr.Filter{Kinds: []int{24242}, Tags: nostr.TagMap{"x": []string{t.ID}}})
+	if err == nil {
+		for evt := range ch {
+			t.Owners = append(t.Owners, evt.PubKey)
+			if mimetype := evt.Tags.GetFirst([]string{"type", ""}); mimetype != nil {
+				t.MimeType = (*mimetype)[1]
+			}
+			if size := evt.Tags.GetFirst([]string{"size", ""}); size != nil {
+				t.Size, _ = strconv.ParseInt((*size)[1], 10, 64)
+			}
+		}
+	}
+	n, _ := db.CountEvents(ctx, nostr.Filter{Kinds: []int{nostr.KindReporting}, Tags: nostr.TagMap{"x": []string{t.ID}}})
+	t.Reports = int(n)
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// BlobInfo describes a stored blob.
+type BlobInfo struct {
+	SHA256   string
+	Size     int64
+	Modified time.Time
+}
+
+// BlobStore holds the contents of blossom blobs, selected by BLOSSOM_STORAGE.
+// The blob index (who uploaded what) stays in the event store either way.
+type BlobStore interface {
+	Put(ctx context.Context, sha256 string, body []byte) error
+	// PutFile moves a blob staged by stageBlob into the store.
+	PutFile(ctx context.Context, sha256 string, path string) error
+	Get(ctx context.Context, sha256 string) (io.ReadSeeker, error)
+	Delete(ctx context.Context, sha256 string) error
+	Stat(ctx context.Context, sha256 string) (BlobInfo, error)
+	List(ctx context.Context) ([]BlobInfo, error)
+}
+
+var blobStore BlobStore
+
+// newBlobStore builds the blob store configured by BLOSSOM_STORAGE.
+func newBlobStore(cfg Config) (BlobStore, error) {
+	switch cfg.BlossomStorage {
+	case "", "fs":
+		if cfg.BlossomPath == nil {
+			return nil, fmt.Errorf("blossom enabled but no path set")
+		}
+		if cfg.BlossomLayout != "flat" && cfg.BlossomLayout != "sharded" {
+			return nil, fmt.Errorf("unknown BLOSSOM_LAYOUT %q (expected flat or sharded)", cfg.BlossomLayout)
+		}
+		fs.MkdirAll(*cfg.BlossomPath, 0755)
+		store := &fsBlobStore{fs: fs, path: *cfg.BlossomPath, sharded: cfg.BlossomLayout == "sharded"}
+		go store.migrateLayout()
+		return store, nil
+	case "s3":
+		return newS3BlobStore(cfg.S3)
+	default:
+		return nil, fmt.Errorf("unknown BLOSSOM_STORAGE %q (expected fs or s3)", cfg.BlossomStorage)
+	}
+}
+
+var errBlobTooLarge = errors.New("blob exceeds the size limit")
+
+// stagedBlob is an incoming blob spooled to a temporary file and hashed as
+// it was written, so it never has to be held in memory.
+type stagedBlob struct {
+	path   string
+	SHA256 string
+	Size   int64
+}
+
+// blobStagingDir is where incoming blobs are spooled: next to the blobs for
+// the fs store, so moving them into place is a rename.
+func blobStagingDir() string {
+	if config.BlossomStorage != "s3" && config.BlossomPath != nil {
+		return *config.BlossomPath
+	}
+	return os.TempDir()
+}
+
+// stageBlob copies r into a temporary file, hashing it on the way, and fails
+// with errBlobTooLarge as soon as more than maxSize bytes arrive. The caller
+// must Remove the result once done with it.
+func stageBlob(r io.Reader, maxSize int64) (*stagedBlob, error) {
+	file, err := afero.TempFile(fs, blobStagingDir(), ".staging-")
+	if err != nil {
+		return nil, err
+	}
+	staged := &stagedBlob{path: file.Name()}
+	hasher := sha256.New()
+	n, err := io.Copy(io.MultiWriter(file, hasher), io.LimitReader(r, maxSize+1))
+	if err == nil && n > maxSize {
+		err = errBlobTooLarge
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		staged.Remove()
+		return nil, err
+	}
+	staged.SHA256 = hex.EncodeToString(hasher.Sum(nil))
+	staged.Size = n
+	return staged, nil
+}
+
+// Head returns the first bytes of the blob, for type sniffing.
+func (b *stagedBlob) Head() []byte {
+	file, err := fs.Open(b.path)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(file, head)
+	return head[:n]
+}
+
+// Remove deletes the temporary file; a no-op once it was moved into the store.
+func (b *stagedBlob) Remove() {
+	fs.Remove(b.path)
+}
+
+type stagedBlobKey struct{}
+
+// withStagedBlob tells the blob store StoreBlob hook to move staged into
+// place instead of writing the body it is given.
+func withStagedBlob(ctx context.Context, staged *stagedBlob) context.Context {
+	return context.WithValue(ctx, stagedBlobKey{}, staged)
+}
+
+// blobReader gives a StoreBlob hook the content being stored, and its size:
+// body when the caller had it in memory, otherwise the staged file or, once
+// that was moved into place, the stored blob. Readers that are io.Closers
+// must be closed.
+func blobReader(ctx context.Context, sha256 string, body []byte) (io.ReadSeeker, int64, error) {
+	staged, ok := ctx.Value(stagedBlobKey{}).(*stagedBlob)
+	if !ok || staged.SHA256 != sha256 {
+		return bytes.NewReader(body), int64(len(body)), nil
+	}
+	if file, err := fs.Open(staged.path); err == nil {
+		return file, staged.Size, nil
+	}
+	reader, err := blobStore.Get(ctx, sha256)
+	return reader, staged.Size, err
+}
+
+// storeBlob is the blob store's StoreBlob hook.
+func storeBlob(ctx context.Context, sha256 string, body []byte) error {
+	touchBlob(sha256)
+	if staged, ok := ctx.Value(stagedBlobKey{}).(*stagedBlob); ok && staged.SHA256 == sha256 {
+		return blobStore.PutFile(ctx, sha256, staged.path)
+	}
+	return blobStore.Put(ctx, sha256, body)
+}
+
+// isBlobHash reports whether name looks like a SHA256 hash (64 hex characters).
+func isBlobHash(name string) bool {
+	if len(name) != 64 {
+		return false
+	}
+	for _, char := range name {
+		if !((char >= '0' && char <= '9') || (char >= 'a' && char <= 'f') || (char >= 'A' && char <= 'F')) {
+			return false
+		}
+	}
+	return true
+}
+
+// fsBlobStore keeps blobs as files named by their hash under BLOSSOM_PATH:
+// all in that directory, or with BLOSSOM_LAYOUT=sharded two levels down by
+// the first two byte pairs of the hash (ab/cd/abcd...), which keeps
+// directories small on filesystems that slow down with many entries.
+// Blobs still in the other layout are found too, and migrateLayout moves
+// them over in the background.
+type fsBlobStore struct {
+	fs      afero.Fs
+	path    string
+	sharded bool
+}
+
+func (s *fsBlobStore) flatPath(sha256 string) string {
+	return s.path + sha256
+}
+
+func (s *fsBlobStore) shardedPath(sha256 string) string {
+	if len(sha256) < 4 {
+		return s.flatPath(sha256)
+	}
+	return filepath.Join(s.path, sha256[:2], sha256[2:4], sha256)
+}
+
+// blobPath is where the configured layout keeps a blob.
+func (s *fsBlobStore) blobPath(sha256 string) string {
+	if s.sharded {
+		return s.shardedPath(sha256)
+	}
+	return s.flatPath(sha256)
+}
+
+// otherPath is where the other layout kept a blob, before migration.
+func (s *fsBlobStore) otherPath(sha256 string) string {
+	if s.sharded {
+		return s.flatPath(sha256)
+	}
+	return s.shardedPath(sha256)
+}
+
+// findBlob returns the path of a stored blob in either layout.
+func (s *fsBlobStore) findBlob(sha256 string) (string, os.FileInfo, error) {
+	info, err := s.fs.Stat(s.blobPath(sha256))
+	if err == nil {
+		return s.blobPath(sha256), info, nil
+	}
+	if other, otherErr := s.fs.Stat(s.otherPath(sha256)); otherErr == nil {
+		return s.otherPath(sha256), other, nil
+	}
+	return "", nil, err
+}
+
+// walkBlobs calls fn for every blob file in either layout.
+func (s *fsBlobStore) walkBlobs(fn func(path string, info os.FileInfo)) error {
+	return afero.Walk(s.fs, s.path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && isBlobHash(info.Name()) {
+			fn(path, info)
+		}
+		return nil
+	})
+}
+
+// migrateLayout moves blobs stored in the other layout to where the
+// configured one expects them.
+func (s *fsBlobStore) migrateLayout() {
+	var pending []string
+	err := s.walkBlobs(func(path string, info os.FileInfo) {
+		if filepath.Clean(path) != filepath.Clean(s.blobPath(info.Name())) {
+			pending = append(pending, path)
+		}
+	})
+	if err != nil {
+		slog.Error("Blossom storage: failed to scan for layout migration", "err", err)
+		return
+	}
+	if len(pending) == 0 {
+		return
+	}
+
+	start := time.Now()
+	moved := 0
+	for _, path := range pending {
+		target := s.blobPath(filepath.Base(path))
+		if err := s.fs.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			slog.Error("Blossom storage: failed to create shard directory", "path", target, "err", err)
+			continue
+		}
+		if err := s.fs.Rename(path, target); err != nil {
+			slog.Error("Blossom storage: failed to move blob", "from", path, "to", target, "err", err)
+			continue
+		}
+		moved++
+	}
+	slog.Info("Blossom storage: migrated blobs to the configured layout", "sharded", s.sharded, "moved", moved, "took", time.Since(start).Round(time.Millisecond))
+}
+
+// blobWrites tracks blob files being written, so shutdown can wait for them.
+var blobWrites sync.WaitGroup
+
+// Put writes the blob to a temporary file and renames it into place once
+// synced, so an interrupted write never leaves a truncated blob behind.
+func (s *fsBlobStore) Put(ctx context.Context, sha256 string, body []byte) error {
+	blobWrites.Add(1)
+	defer blobWrites.Done()
+
+	// Create context with timeout for large file operations
+	storeCtx, cancel := context.WithTimeout(ctx, 10*time.Minute)
+	defer cancel()
+
+	target := s.blobPath(sha256)
+	if err := s.fs.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	tmpPath := target + ".tmp"
+	file, err := s.fs.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer s.fs.Remove(tmpPath) // no-op once renamed
+	defer file.Close()
+
+	// Use streaming copy with context checking for large files
+	buffer := make([]byte, 32*1024) // 32KB buffer for efficient copying
+	for len(body) > 0 {
+		select {
+		case <-storeCtx.Done():
+			return storeCtx.Err()
+		default:
+		}
+
+		n := copy(buffer, body)
+		if _, err := file.Write(buffer[:n]); err != nil {
+			return err
+		}
+		body = body[n:]
+	}
+
+	if err := file.Sync(); err != nil { // Ensure data is written to disk
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return s.fs.Rename(tmpPath, target)
+}
+
+// PutFile renames the staged file into place; stageBlob already synced it.
+// A staged file on another filesystem (the cold tier) is copied instead.
+func (s *fsBlobStore) PutFile(ctx context.Context, sha256 string, path string) error {
+	blobWrites.Add(1)
+	defer blobWrites.Done()
+	target := s.blobPath(sha256)
+	if err := s.fs.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	err := s.fs.Rename(path, target)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	return s.copyFile(path, target)
+}
+
+// copyFile copies path to target through a synced temporary file and
+// removes path.
+func (s *fsBlobStore) copyFile(path, target string) error {
+	src, err := s.fs.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmpPath := target + ".tmp"
+	dst, err := s.fs.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer s.fs.Remove(tmpPath) // no-op once renamed
+	defer dst.Close()
+	if _, err := io.Copy(dst, src); err != nil {
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	if err := s.fs.Rename(tmpPath, target); err != nil {
+		return err
+	}
+	return s.fs.Remove(path)
+}
+
+func (s *fsBlobStore) Get(ctx context.Context, sha256 string) (io.ReadSeeker, error) {
+	filePath, _, err := s.findBlob(sha256)
+	if err != nil {
+		blobLogger(ctx, sha256).Debug("LoadBlob: blob not found", "err", err)
+		return nil, err
+	}
+	blobLogger(ctx, sha256).Debug("LoadBlob: opening file", "path", filePath)
+	file, err := s.fs.Open(filePath)
+	if err != nil {
+		blobLogger(ctx, sha256).Debug("LoadBlob: failed to open file", "path", filePath, "err", err)
+		return nil, err
+	}
+	blobLogger(ctx, sha256).Debug("LoadBlob: opened file", "path", filePath)
+	return file, nil
+}
+
+func (s *fsBlobStore) Delete(ctx context.Context, sha256 string) error {
+	err := s.fs.Remove(s.blobPath(sha256))
+	if otherErr := s.fs.Remove(s.otherPath(sha256)); otherErr == nil {
+		err = nil
+	}
+	return err
+}
+
+func (s *fsBlobStore) Stat(ctx context.Context, sha256 string) (BlobInfo, error) {
+	_, info, err := s.findBlob(sha256)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	return BlobInfo{SHA256: sha256, Size: info.Size(), Modified: info.ModTime()}, nil
+}
+
+func (s *fsBlobStore) List(ctx context.Context) ([]BlobInfo, error) {
+	var blobs []BlobInfo
+	err := s.walkBlobs(func(path string, info os.FileInfo) {
+		blobs = append(blobs, BlobInfo{
+			SHA256:   strings.ToLower(info.Name()),
+			Size:     info.Size(),
+			Modified: info.ModTime(),
+		})
+	})
+	return blobs, err
+}
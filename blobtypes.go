@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Upload type policy: BLOSSOM_ALLOWED_TYPES and BLOSSOM_BLOCKED_TYPES are
+// matched against the type sniffed from the first bytes of the content
+// (http.DetectContentType), not against the name or the declared type.
+// Patterns are full types ("image/png") or prefixes ("image/*").
+
+type sniffedTypeKey struct{}
+
+// withSniffedType records the detected type of an upload body in ctx, so the
+// RejectUpload hook can check it.
+func withSniffedType(ctx context.Context, mimetype string) context.Context {
+	return context.WithValue(ctx, sniffedTypeKey{}, mimetype)
+}
+
+// detectBlobType sniffs the type of a blob from its first bytes.
+func detectBlobType(head []byte) string {
+	mimetype, _, _ := strings.Cut(http.DetectContentType(head[:min(len(head), 512)]), ";")
+	return mimetype
+}
+
+func matchesTypePattern(pattern, mimetype string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+		return strings.HasPrefix(mimetype, prefix+"/")
+	}
+	return pattern == "*" || pattern == mimetype
+}
+
+// checkBlobType applies the type policy to a sniffed type.
+func checkBlobType(mimetype string) error {
+	for _, pattern := range config.BlockedTypes {
+		if matchesTypePattern(pattern, mimetype) {
+			return fmt.Errorf("file type %s is not allowed", mimetype)
+		}
+	}
+	if len(config.AllowedTypes) == 0 {
+		return nil
+	}
+	for _, pattern := range config.AllowedTypes {
+		if matchesTypePattern(pattern, mimetype) {
+			return nil
+		}
+	}
+	return fmt.Errorf("file type %s is not allowed", mimetype)
+}
+
+// rejectBlobType is the RejectUpload side of the policy. Uploads were sniffed
+// by streamUploads; requests without a body (the HEAD /upload preflight) are
+// judged on the extension derived from the declared type.
+func rejectBlobType(ctx context.Context, ext string) (bool, string, int) {
+	if len(config.AllowedTypes) == 0 && len(config.BlockedTypes) == 0 {
+		return false, "", 0
+	}
+	mimetype, ok := ctx.Value(sniffedTypeKey{}).(string)
+	if !ok {
+		mimetype, _, _ = strings.Cut(mime.TypeByExtension(ext), ";")
+		if mimetype == "" {
+			mimetype = "application/octet-stream"
+		}
+	}
+	if err := checkBlobType(mimetype); err != nil {
+		return true, err.Error(), http.StatusUnsupportedMediaType
+	}
+	return false, "", 0
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/fiatjaf/khatru"
+)
+
+// Branding: the relay icon and banner shown on the front page, in link
+// previews and in the NIP-11 document. RELAY_ICON_PATH and RELAY_BANNER_PATH
+// name files in PUBLIC_DIR, which is served under /public/; RELAY_ICON_URL
+// and RELAY_BANNER_URL point somewhere else instead (a CDN, the team website).
+
+// BrandingConfig holds the branding settings.
+type BrandingConfig struct {
+	PublicDir  string
+	IconPath   string
+	IconURL    string
+	BannerPath string
+	BannerURL  string
+}
+
+func loadBrandingConfig() BrandingConfig {
+	return BrandingConfig{
+		PublicDir:  getEnvWithDefault("PUBLIC_DIR", "./public"),
+		IconPath:   strings.TrimPrefix(getEnvWithDefault("RELAY_ICON_PATH", "TeamHigher.jpg"), "/"),
+		IconURL:    getEnvWithDefault("RELAY_ICON_URL", ""),
+		BannerPath: strings.TrimPrefix(getEnvWithDefault("RELAY_BANNER_PATH", ""), "/"),
+		BannerURL:  getEnvWithDefault("RELAY_BANNER_URL", ""),
+	}
+}
+
+// relayHTTPURL is the public https:// (or http://) base URL of the relay,
+// taken from WEBSOCKET_URL, else TEAM_DOMAIN. Empty when neither is set.
+func relayHTTPURL() string {
+	if config.WebsocketURL != nil && strings.TrimSpace(*config.WebsocketURL) != "" {
+		base := strings.Replace(strings.Replace(strings.TrimSpace(*config.WebsocketURL), "wss://", "https://", 1), "ws://", "http://", 1)
+		return strings.TrimSuffix(base, "/")
+	}
+	if config.TeamDomain != "" {
+		return "https://" + config.TeamDomain
+	}
+	return ""
+}
+
+// assetURL resolves an asset configured either as a URL or as a file in
+// PUBLIC_DIR. Local files get an absolute URL when the relay's address is
+// known, since link previews and NIP-11 clients need one.
+func assetURL(url, file string) string {
+	if url != "" {
+		return url
+	}
+	if file == "" {
+		return ""
+	}
+	return relayHTTPURL() + "/public/" + path.Clean(file)
+}
+
+// Icon is the relay icon's URL, empty if none is configured.
+func (b BrandingConfig) Icon() string {
+	return assetURL(b.IconURL, b.IconPath)
+}
+
+// Banner is the banner image's URL, empty if none is configured.
+func (b BrandingConfig) Banner() string {
+	return assetURL(b.BannerURL, b.BannerPath)
+}
+
+// setupBranding serves PUBLIC_DIR under /public/ (without directory listings)
+// and advertises the icon in NIP-11.
+func setupBranding(relay *khatru.Relay) {
+	files := http.StripPrefix("/public/", http.FileServer(http.Dir(config.Branding.PublicDir)))
+	relay.Router().HandleFunc("/public/", func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		files.ServeHTTP(w, r)
+	})
+
+	relay.Info.Icon = config.Branding.Icon()
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip04"
+	"github.com/nbd-wtf/go-nostr/nip44"
+	"github.com/nbd-wtf/go-nostr/nip46"
+)
+
+// Built-in NIP-46 remote signer. Each derived member gets a bunker:// URI for
+// their index; clients send kind 24133 requests to the member's pubkey on this
+// relay and get answers signed with the derived key, so the nsec never leaves
+// the relay. A client has to connect with the index's secret once, after
+// which its pubkey is remembered in the relay state.
+
+const bunkerStateKey = "bunker-clients"
+
+var (
+	bunkerMu      sync.RWMutex
+	bunkerClients = map[string]uint32{} // client pubkey -> index it may sign for
+)
+
+// bunkerSecret is the connection secret for index. It is derived from the
+// master, so it never needs storing and can be handed out again any time.
+func bunkerSecret(index uint32) string {
+	mac := hmac.New(sha256.New, deriver.DeriveSecret("higher/bunker"))
+	binary.Write(mac, binary.BigEndian, index)
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// bunkerURI returns the bunker:// URI for the member at index.
+func bunkerURI(index uint32, relayURL string) (string, error) {
+	pubkey, err := deriver.DerivePublicKey(index)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("bunker://%s?relay=%s&secret=%s", pubkey, url.QueryEscape(relayURL), bunkerSecret(index)), nil
+}
+
+// bunkerTarget returns the derivation index of the member a NIP-46 request is
+// addressed to.
+func bunkerTarget(event *nostr.Event) (uint32, bool) {
+	if event.Kind != nostr.KindNostrConnect || registry == nil {
+		return 0, false
+	}
+	p := event.Tags.GetFirst([]string{"p", ""})
+	if p == nil {
+		return 0, false
+	}
+	index, ok, _ := registry.Lookup((*p)[1])
+	return index, ok && !isRevokedPubkey((*p)[1])
+}
+
+// isBunkerRequest reports whether event is a NIP-46 request for one of our
+// members, which clients may send with any throwaway key.
+func isBunkerRequest(event *nostr.Event) bool {
+	if !config.BunkerEnabled {
+		return false
+	}
+	_, ok := bunkerTarget(event)
+	return ok
+}
+
+// isBunkerFilter reports whether filter only asks for NIP-46 responses
+// addressed to specific clients.
+func isBunkerFilter(filter nostr.Filter) bool {
+	return config.BunkerEnabled && len(filter.Kinds) == 1 && filter.Kinds[0] == nostr.KindNostrConnect &&
+		len(filter.Tags["p"]) > 0
+}
+
+func isBunkerClient(client string, index uint32) bool {
+	bunkerMu.RLock()
+	defer bunkerMu.RUnlock()
+	authorized, ok := bunkerClients[client]
+	return ok && authorized == index
+}
+
+func authorizeBunkerClient(ctx context.Context, client string, index uint32) {
+	bunkerMu.Lock()
+	bunkerClients[client] = index
+	snapshot := make(map[string]uint32, len(bunkerClients))
+	for k, v := range bunkerClients {
+		snapshot[k] = v
+	}
+	bunkerMu.Unlock()
+
+	if err := saveState(ctx, bunkerStateKey, snapshot); err != nil {
+		slog.Error("Bunker: failed to persist clients", "err", err)
+	}
+}
+
+// conversationKey derives the NIP-44 conversation key from an ECDH secret.
+func conversationKey(shared []byte) ([32]byte, error) {
+	var ck [32]byte
+	prk, err := hkdf.Extract(sha256.New, shared, []byte("nip44-v2"))
+	if err != nil {
+		return ck, err
+	}
+	copy(ck[:], prk)
+	return ck, nil
+}
+
+// handleBunkerRequest answers a NIP-46 request with an event signed by the
+// member's key and broadcasts it to the waiting client.
+func handleBunkerRequest(ctx context.Context, event *nostr.Event) {
+	index, ok := bunkerTarget(event)
+	if !ok {
+		return
+	}
+	shared, err := deriver.SharedSecret(index, event.PubKey)
+	if err != nil {
+		return
+	}
+	ck, err := conversationKey(shared)
+	if err != nil {
+		return
+	}
+	pubkey, err := deriver.DerivePublicKey(index)
+	if err != nil {
+		return
+	}
+	session := nip46.Session{PublicKey: pubkey, SharedKey: shared, ConversationKey: ck}
+
+	req, err := session.ParseRequest(event)
+	if err != nil {
+		eventLogger(ctx, event).Warn("Bunker: unreadable request", "err", err)
+		return
+	}
+	result, callErr := bunkerCall(ctx, index, event.PubKey, req)
+	_, resp, err := session.MakeResponse(req.ID, event.PubKey, result, callErr)
+	if err != nil {
+		eventLogger(ctx, event).Error("Bunker: failed to build response", "err", err)
+		return
+	}
+	if err := deriver.SignEvent(index, &resp); err != nil {
+		eventLogger(ctx, event).Error("Bunker: failed to sign response", "err", err)
+		return
+	}
+	relay.BroadcastEvent(&resp)
+}
+
+// bunkerCall runs one NIP-46 method for the member at index on behalf of client.
+func bunkerCall(ctx context.Context, index uint32, client string, req nip46.Request) (string, error) {
+	switch req.Method {
+	case "connect":
+		if len(req.Params) < 2 || !hmac.Equal([]byte(req.Params[1]), []byte(bunkerSecret(index))) {
+			return "", errors.New("invalid secret")
+		}
+		authorizeBunkerClient(ctx, client, index)
+		slog.Info("Bunker: client connected", "client", client, "index", index)
+		return "ack", nil
+	case "ping":
+		return "pong", nil
+	}
+
+	if !isBunkerClient(client, index) {
+		return "", errors.New("unauthorized: connect with the secret from your bunker URI first")
+	}
+
+	switch req.Method {
+	case "get_public_key":
+		return deriver.DerivePublicKey(index)
+
+	case "sign_event":
+		if len(req.Params) != 1 {
+			return "", errors.New("sign_event takes one argument")
+		}
+		var evt nostr.Event
+		if err := json.Unmarshal([]byte(req.Params[0]), &evt); err != nil {
+			return "", fmt.Errorf("invalid event: %w", err)
+		}
+		if evt.Tags == nil {
+			evt.Tags = nostr.Tags{}
+		}
+		if err := deriver.SignEvent(index, &evt); err != nil {
+			return "", err
+		}
+		signed, err := json.Marshal(evt)
+		return string(signed), err
+
+	case "nip04_encrypt", "nip04_decrypt", "nip44_encrypt", "nip44_decrypt":
+		if len(req.Params) != 2 || !nostr.IsValidPublicKey(req.Params[0]) {
+			return "", fmt.Errorf("%s takes a pubkey and a text", req.Method)
+		}
+		shared, err := deriver.SharedSecret(index, req.Params[0])
+		if err != nil {
+			return "", err
+		}
+		text := req.Params[1]
+		switch req.Method {
+		case "nip04_encrypt":
+			return nip04.Encrypt(text, shared)
+		case "nip04_decrypt":
+			return nip04.Decrypt(text, shared)
+		}
+		ck, err := conversationKey(shared)
+		if err != nil {
+			return "", err
+		}
+		if req.Method == "nip44_encrypt" {
+			return nip44.Encrypt(text, ck)
+		}
+		return nip44.Decrypt(text, ck)
+	}
+	return "", fmt.Errorf("unsupported method %q", req.Method)
+}
+
+// setupBunker loads the authorized clients, answers NIP-46 requests and
+// serves GET /admin/bunker/{index} with the member's bunker URI.
+func setupBunker(relay *khatru.Relay) error {
+	if deriver == nil || deriver.IsWatchOnly() {
+		return errors.New("the bunker needs RELAY_MNEMONIC or RELAY_SEED_HEX")
+	}
+	if config.WebsocketURL == nil || *config.WebsocketURL == "" {
+		return errors.New("the bunker needs WEBSOCKET_URL for its URIs")
+	}
+
+	var clients map[string]uint32
+	if _, err := loadState(context.Background(), bunkerStateKey, &clients); err != nil {
+		return err
+	}
+	bunkerMu.Lock()
+	for client, index := range clients {
+		bunkerClients[client] = index
+	}
+	bunkerMu.Unlock()
+
+	relay.OnEphemeralEvent = append(relay.OnEphemeralEvent, handleBunkerRequest)
+
+	relay.Router().HandleFunc("/admin/bunker/", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		index, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/admin/bunker/"), 10, 32)
+		if err != nil || index > uint64(registry.MaxIndex()) {
+			http.Error(w, "Invalid index", http.StatusBadRequest)
+			return
+		}
+		uri, err := bunkerURI(uint32(index), *config.WebsocketURL)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"uri": uri})
+	}))
+
+	slog.Info("Bunker: NIP-46 signer ENABLED", "clients", len(clients))
+	return nil
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// What happens to a former member's content, set by MEMBER_CLEANUP_POLICY:
+//   - retain: nothing is touched, only a report is produced
+//   - hide:   their events are no longer served and blobs they alone own are frozen
+//   - purge:  their events and the blobs they alone own are deleted
+const (
+	cleanupRetain = "retain"
+	cleanupHide   = "hide"
+	cleanupPurge  = "purge"
+)
+
+// CleanupReport summarizes what a cleanup run did for one pubkey.
+type CleanupReport struct {
+	Pubkey    string `json:"pubkey"`
+	Policy    string `json:"policy"`
+	Trigger   string `json:"trigger"`
+	Events    int    `json:"events"`
+	Blobs     int    `json:"blobs"`
+	BlobBytes int64  `json:"blob_bytes"`
+	At        int64  `json:"at"`
+}
+
+const maxCleanupReports = 100
+
+// cleanupState is persisted so hidden pubkeys and frozen blobs survive restarts.
+type cleanupState struct {
+	Hidden  map[string]bool `json:"hidden"`
+	Frozen  map[string]bool `json:"frozen"`
+	Reports []CleanupReport `json:"reports"`
+}
+
+var (
+	cleanupMu sync.RWMutex
+	cleanup   = cleanupState{Hidden: map[string]bool{}, Frozen: map[string]bool{}}
+
+	// set when blossom is enabled so cleanups can handle blobs
+	blossomServer *blossom.BlossomServer
+)
+
+// isHiddenPubkey reports whether events from pubkey must not be served.
+func isHiddenPubkey(pubkey string) bool {
+	cleanupMu.RLock()
+	defer cleanupMu.RUnlock()
+	return cleanup.Hidden[pubkey]
+}
+
+// hiddenPubkeys returns the pubkeys whose events must not be served.
+func hiddenPubkeys() []string {
+	cleanupMu.RLock()
+	defer cleanupMu.RUnlock()
+	pubkeys := make([]string, 0, len(cleanup.Hidden))
+	for pk := range cleanup.Hidden {
+		pubkeys = append(pubkeys, pk)
+	}
+	return pubkeys
+}
+
+func isFrozenBlob(sha256 string) bool {
+	cleanupMu.RLock()
+	defer cleanupMu.RUnlock()
+	return cleanup.Frozen[sha256]
+}
+
+func loadCleanupState(ctx context.Context) {
+	var st cleanupState
+	if ok, err := loadState(ctx, "member_cleanup", &st); err != nil {
+		slog.Error("Member cleanup: failed to load state", "err", err)
+	} else if ok {
+		if st.Hidden == nil {
+			st.Hidden = map[string]bool{}
+		}
+		if st.Frozen == nil {
+			st.Frozen = map[string]bool{}
+		}
+		cleanupMu.Lock()
+		cleanup = st
+		cleanupMu.Unlock()
+	}
+}
+
+func persistCleanupState(ctx context.Context) {
+	cleanupMu.RLock()
+	defer cleanupMu.RUnlock()
+	if err := saveState(ctx, "member_cleanup", cleanup); err != nil {
+		slog.Error("Member cleanup: failed to persist state", "err", err)
+	}
+}
+
+// onMembersRemoved runs the cleanup policy for pubkeys that left the team.
+// Keys still derived from master, listed in TEAM_LIST or added by an admin are
+// never cleaned up.
+func onMembersRemoved(removed []string, trigger string) {
+	var gone []string
+	for _, pubkey := range removed {
+		if belongsToMaster(pubkey) || isListedMember(pubkey) || isManagedMember(pubkey) {
+			continue
+		}
+		gone = append(gone, pubkey)
+		go runMemberCleanup(context.Background(), pubkey, trigger)
+	}
+	if len(gone) > 0 {
+		go removeFromGroups(context.Background(), gone)
+	}
+}
+
+// onMemberRestored lifts a previous "hide" when a pubkey rejoins the team.
+func onMemberRestored(pubkey string) {
+	cleanupMu.Lock()
+	wasHidden := cleanup.Hidden[pubkey]
+	delete(cleanup.Hidden, pubkey)
+	cleanupMu.Unlock()
+
+	if wasHidden {
+		if blobs, err := ownedBlobs(context.Background(), pubkey); err == nil {
+			cleanupMu.Lock()
+			for _, bd := range blobs {
+				delete(cleanup.Frozen, bd.SHA256)
+			}
+			cleanupMu.Unlock()
+		}
+		persistCleanupState(context.Background())
+		slog.Info("Member cleanup: member rejoined, content is served again", "pubkey", pubkey)
+	}
+}
+
+// runMemberCleanup applies MEMBER_CLEANUP_POLICY to pubkey and records a report.
+func runMemberCleanup(ctx context.Context, pubkey string, trigger string) CleanupReport {
+	report := CleanupReport{
+		Pubkey:  pubkey,
+		Policy:  config.MemberCleanupPolicy,
+		Trigger: trigger,
+		At:      time.Now().Unix(),
+	}
+
+	// events
+	ch, err := db.QueryEvents(ctx, nostr.Filter{Authors: []string{pubkey}})
+	if err != nil {
+		slog.Error("Member cleanup: failed to query events", "pubkey", pubkey, "err", err)
+	} else {
+		var events []*nostr.Event
+		for evt := range ch {
+			events = append(events, evt)
+		}
+		report.Events = len(events)
+		if report.Policy == cleanupPurge {
+			for _, evt := range events {
+				if err := removeEvent(ctx, evt, "member removed"); err != nil {
+					eventLogger(ctx, evt).Error("Member cleanup: failed to delete", "err", err)
+				}
+			}
+		}
+	}
+
+	// blobs they alone own
+	blobs, err := ownedBlobs(ctx, pubkey)
+	if err != nil {
+		slog.Error("Member cleanup: failed to list blobs", "pubkey", pubkey, "err", err)
+	}
+	for _, bd := range blobs {
+		if len(blobOwners(ctx, bd.SHA256)) > 1 {
+			continue
+		}
+		report.Blobs++
+		report.BlobBytes += int64(bd.Size)
+
+		switch report.Policy {
+		case cleanupHide:
+			cleanupMu.Lock()
+			cleanup.Frozen[bd.SHA256] = true
+			cleanupMu.Unlock()
+		case cleanupPurge:
+			if err := blossomServer.Store.Delete(ctx, bd.SHA256, pubkey); err != nil {
+				blobLogger(ctx, bd.SHA256).Error("Member cleanup: failed to unindex blob", "pubkey", pubkey, "err", err)
+				continue
+			}
+			for _, del := range blossomServer.DeleteBlob {
+				if err := del(ctx, bd.SHA256); err != nil {
+					blobLogger(ctx, bd.SHA256).Error("Member cleanup: failed to delete blob", "err", err)
+				}
+			}
+		}
+	}
+
+	cleanupMu.Lock()
+	if report.Policy == cleanupHide {
+		cleanup.Hidden[pubkey] = true
+	}
+	cleanup.Reports = append(cleanup.Reports, report)
+	if len(cleanup.Reports) > maxCleanupReports {
+		cleanup.Reports = cleanup.Reports[len(cleanup.Reports)-maxCleanupReports:]
+	}
+	cleanupMu.Unlock()
+	persistCleanupState(ctx)
+
+	slog.Info("Member cleanup", "pubkey", pubkey, "policy", report.Policy, "trigger", trigger,
+		"events", report.Events, "blobs", report.Blobs, "bytes", report.BlobBytes)
+	return report
+}
+
+// ownedBlobs lists the blob descriptors indexed under pubkey.
+func ownedBlobs(ctx context.Context, pubkey string) ([]blossom.BlobDescriptor, error) {
+	if blossomServer == nil {
+		return nil, nil
+	}
+	ch, err := blossomServer.Store.List(ctx, pubkey)
+	if err != nil {
+		return nil, err
+	}
+	var blobs []blossom.BlobDescriptor
+	for bd := range ch {
+		blobs = append(blobs, bd)
+	}
+	return blobs, nil
+}
+
+// blobOwners returns every pubkey that has sha256 in its blob index.
+func blobOwners(ctx context.Context, sha256 string) []string {
+	ch, err := db.QueryEvents(ctx, nostr.Filter{Kinds: []int{24242}, Tags: nostr.TagMap{"x": []string{sha256}}})
+	if err != nil {
+		return nil
+	}
+	var owners []string
+	for evt := range ch {
+		owners = append(owners, evt.PubKey)
+	}
+	return owners
+}
+
+// setupMemberCleanup loads persisted cleanup state, hooks frozen blobs into
+// blossom and exposes the admin API for reports and manual cleanups.
+func setupMemberCleanup(relay *khatru.Relay) {
+	loadCleanupState(context.Background())
+
+	relay.Router().HandleFunc("/admin/cleanup/reports", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		cleanupMu.RLock()
+		reports := append([]CleanupReport{}, cleanup.Reports...)
+		cleanupMu.RUnlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(reports)
+	}))
+
+	// POST /admin/cleanup/{pubkey} runs the policy right away
+	relay.Router().HandleFunc("/admin/cleanup/", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		pubkey := normalizePubkey(strings.TrimPrefix(r.URL.Path, "/admin/cleanup/"))
+		if !nostr.IsValidPublicKey(pubkey) {
+			http.Error(w, "Invalid pubkey", http.StatusBadRequest)
+			return
+		}
+		report := runMemberCleanup(r.Context(), pubkey, "admin")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	}))
+
+	slog.Info("Member cleanup policy", "policy", config.MemberCleanupPolicy)
+}
+
+// setupFrozenBlobs refuses downloads of blobs frozen by a "hide" cleanup.
+func setupFrozenBlobs(bl *blossom.BlossomServer) {
+	blossomServer = bl
+	bl.RejectGet = append(bl.RejectGet, func(ctx context.Context, auth *nostr.Event, sha256 string) (bool, string, int) {
+		if isFrozenBlob(sha256) {
+			return true, "blob is no longer available", 410
+		}
+		return false, "", 0
+	})
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bitkarrot/higher/keyderivation"
+	"github.com/fiatjaf/khatru"
+	"github.com/joho/godotenv"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// The binary is organized in subcommands. Without one it serves the relay, so
+// existing deployments running plain `higher` keep working.
+
+const cliUsage = `Usage: %[1]s <command> [flags]
+
+Commands:
+  serve                   run the relay (default)
+  keys new                generate a new master mnemonic
+  keys derive             print keys derived from the master
+  keys check <pubkey>     tell whether a pubkey or npub is derived from the master
+  keys xpub               print the account xpub for a watch-only relay
+  keys bunker --index N   print the NIP-46 bunker:// URI of a member
+  keys roster             list the derived pubkeys and which have published events
+  keys max-index N        raise the persisted max derivation index (relay stopped)
+  export                  write stored events as JSON lines
+  import                  read events from a strfry, nostr-rs-relay or higher dump
+  verify                  re-hash stored blobs and report corrupted ones
+  db migrate              copy all events from one database engine to another
+  backup run|list|fetch   make, list or download and decrypt encrypted S3 backups
+  host --tenants FILE     serve several team relays, routed by Host or path prefix
+
+Run "%[1]s <command> --help" for the flags of a command.
+`
+
+func main() {
+	args := os.Args[1:]
+	command := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	switch command {
+	case "serve":
+		runServe(args)
+	case "keys":
+		runKeys(args)
+	case "export":
+		runExport(args)
+	case "import":
+		runImport(args)
+	case "verify":
+		runVerify(args)
+	case "db":
+		runDB(args)
+	case "backup":
+		runBackupCommand(args)
+	case "host":
+		runHost(args)
+	case "help":
+		fmt.Printf(cliUsage, os.Args[0])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n"+cliUsage, command, os.Args[0])
+		os.Exit(2)
+	}
+}
+
+// newFlagSet returns a flag set for a subcommand that exits on parse errors.
+func newFlagSet(name, usage string) *flag.FlagSet {
+	set := flag.NewFlagSet(name, flag.ExitOnError)
+	set.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s\n\n", os.Args[0], usage)
+		set.PrintDefaults()
+	}
+	return set
+}
+
+// keySource holds the flags choosing which master the keys commands work on.
+type keySource struct {
+	envFile      *string
+	mnemonic     *string
+	mnemonicFile *string
+	scheme       *string
+}
+
+func addKeySource(set *flag.FlagSet) keySource {
+	return keySource{
+		envFile:      set.String("env-file", ".env", "configuration file providing RELAY_MNEMONIC, RELAY_SEED_HEX or RELAY_XPUB"),
+		mnemonic:     set.String("mnemonic", "", "BIP-39 mnemonic, instead of the configured master"),
+		mnemonicFile: set.String("mnemonic-file", "", "file containing a BIP-39 mnemonic"),
+		scheme:       set.String("scheme", "", "derivation scheme: index, nip06 or a path template (default DERIVATION_SCHEME)"),
+	}
+}
+
+// loadDeriver builds the deriver from the flags, or from RELAY_MNEMONIC,
+// RELAY_SEED_HEX or RELAY_XPUB in the environment and the .env file.
+func (ks keySource) loadDeriver() *keyderivation.NostrKeyDeriver {
+	// the .env file is optional here, the environment may be enough
+	godotenv.Load(*ks.envFile)
+
+	mnemonic := strings.TrimSpace(*ks.mnemonic)
+	if mnemonic == "" && *ks.mnemonicFile != "" {
+		content, err := os.ReadFile(*ks.mnemonicFile)
+		if err != nil {
+			log.Fatalf("Failed to read mnemonic file: %v", err)
+		}
+		mnemonic = strings.TrimSpace(string(content))
+	}
+
+	cfg := Config{RelayMnemonic: &mnemonic, MnemonicPassphrase: getEnvWithDefault("RELAY_MNEMONIC_PASSPHRASE", "")}
+	if mnemonic == "" {
+		cfg.RelayMnemonic = getEnvNullable("RELAY_MNEMONIC")
+		cfg.RelaySeedHex = getEnvNullable("RELAY_SEED_HEX")
+		cfg.RelayXPub = getEnvNullable("RELAY_XPUB")
+	}
+	if *ks.scheme == "" {
+		*ks.scheme = getEnvWithDefault("DERIVATION_SCHEME", "index")
+	}
+	scheme, err := keyderivation.ParseDerivationScheme(*ks.scheme)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	cfg.DerivationScheme = scheme
+	if err := initDeriver(cfg); err != nil {
+		log.Fatalf("Failed to initialize key deriver: %v", err)
+	}
+	if deriver == nil {
+		log.Fatalf("No master configured: set RELAY_MNEMONIC, RELAY_SEED_HEX or RELAY_XPUB, or pass --mnemonic")
+	}
+	return deriver
+}
+
+func printKeyPair(label string, kp *keyderivation.NostrKeyPair) {
+	fmt.Printf("\n%s\n", label)
+	fmt.Printf("  Public (hex): %s\n", kp.PublicKey)
+	fmt.Printf("  Private (hex): %s\n", kp.PrivateKey)
+	fmt.Printf("  npub: %s\n", kp.PublicKeyNIP)
+	fmt.Printf("  nsec: %s\n", kp.PrivateKeyNIP)
+}
+
+func runKeys(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, cliUsage, os.Args[0])
+		os.Exit(2)
+	}
+
+	switch args[0] {
+	case "new":
+		set := newFlagSet("keys new", "keys new")
+		set.Parse(args[1:])
+
+		d, err := keyderivation.NewNostrKeyDeriver("")
+		if err != nil {
+			log.Fatalf("Failed to generate mnemonic: %v", err)
+		}
+		master, err := d.GetMasterKeyPair()
+		if err != nil {
+			log.Fatalf("Failed to derive master key: %v", err)
+		}
+		fmt.Printf("Mnemonic: %s\n", d.GetMnemonic())
+		printKeyPair("Master:", master)
+		fmt.Println("\nSet RELAY_MNEMONIC in .env to use it, and keep a copy somewhere safe.")
+
+	case "derive":
+		set := newFlagSet("keys derive", "keys derive [--start N] [--count N]")
+		source := addKeySource(set)
+		start := set.Uint("start", 0, "first derivation index")
+		count := set.Uint("count", 5, "number of keys to derive")
+		set.Parse(args[1:])
+
+		d := source.loadDeriver()
+		fmt.Printf("Derived keys (BIP32, path %s):\n", d.Scheme())
+		for i := uint32(*start); i < uint32(*start+*count); i++ {
+			if d.IsWatchOnly() {
+				pub, err := d.DerivePublicKey(i)
+				if err != nil {
+					log.Fatalf("Failed to derive key at index %d: %v", i, err)
+				}
+				npub, _ := nip19.EncodePublicKey(pub)
+				fmt.Printf("\nIndex: %d\n  Public (hex): %s\n  npub: %s\n", i, pub, npub)
+				continue
+			}
+			kp, err := d.DeriveKeyBIP32(i)
+			if err != nil {
+				log.Fatalf("Failed to derive key at index %d: %v", i, err)
+			}
+			printKeyPair(fmt.Sprintf("Index: %d", i), kp)
+		}
+
+	case "check":
+		set := newFlagSet("keys check", "keys check [--max N] <pubkey|npub>")
+		source := addKeySource(set)
+		maxIndex := set.Uint("max", 0, "highest index to search (default MAX_DERIVATION_INDEX or 100)")
+		set.Parse(args[1:])
+		if set.NArg() != 1 {
+			set.Usage()
+			os.Exit(2)
+		}
+
+		d := source.loadDeriver()
+		if *maxIndex == 0 {
+			*maxIndex = uint(getEnvIntWithDefault("MAX_DERIVATION_INDEX", 100))
+		}
+		found, index, err := d.CheckKeyBelongsToMaster(set.Arg(0), uint32(*maxIndex), true)
+		if err != nil {
+			log.Fatalf("Failed to check key: %v", err)
+		}
+		if !found {
+			fmt.Printf("%s is not derived from the master (searched indices 0..%d)\n", set.Arg(0), *maxIndex)
+			os.Exit(1)
+		}
+		fmt.Printf("%s is derived from the master at index %d\n", set.Arg(0), index)
+
+	case "xpub":
+		set := newFlagSet("keys xpub", "keys xpub")
+		source := addKeySource(set)
+		set.Parse(args[1:])
+
+		d := source.loadDeriver()
+		xpub, err := d.AccountXPub()
+		if err != nil {
+			log.Fatalf("Failed to export xpub: %v", err)
+		}
+		fmt.Println(xpub)
+
+	case "bunker":
+		set := newFlagSet("keys bunker", "keys bunker --index N [--relay URL]")
+		source := addKeySource(set)
+		index := set.Uint("index", 0, "derivation index of the member")
+		relayURL := set.String("relay", "", "relay URL in the URI (default WEBSOCKET_URL)")
+		set.Parse(args[1:])
+
+		d := source.loadDeriver()
+		if d.IsWatchOnly() {
+			log.Fatalf("Bunker URIs need the master seed, not an xpub")
+		}
+		if *relayURL == "" {
+			*relayURL = getEnvWithDefault("WEBSOCKET_URL", "")
+		}
+		if *relayURL == "" {
+			log.Fatalf("No relay URL: set WEBSOCKET_URL or pass --relay")
+		}
+		uri, err := bunkerURI(uint32(*index), *relayURL)
+		if err != nil {
+			log.Fatalf("Failed to build bunker URI: %v", err)
+		}
+		fmt.Println(uri)
+
+	case "roster":
+		set := newFlagSet("keys roster", "keys roster [--max N] [--used] [--json]")
+		source := addKeySource(set)
+		maxIndex := set.Uint("max", 0, "highest index to list (default MAX_DERIVATION_INDEX or 100)")
+		used := set.Bool("used", false, "only list indices that have published events")
+		asJSON := set.Bool("json", false, "print the roster as JSON")
+		set.Parse(args[1:])
+
+		log.SetOutput(os.Stderr)
+		flags.EnvFile = *source.envFile
+		relay = khatru.NewRelay()
+		config = LoadConfig()
+		defer db.Close()
+		d := source.loadDeriver()
+		if *maxIndex == 0 {
+			*maxIndex = uint(loadMaxDerivationIndex(context.Background(), config.MaxDerivationIndex))
+		}
+		r, err := keyderivation.NewKeyRegistry(d, uint32(*maxIndex))
+		if err != nil {
+			log.Fatalf("Failed to derive keys: %v", err)
+		}
+		pubkeys, err := r.Pubkeys()
+		if err != nil {
+			log.Fatalf("Failed to derive keys: %v", err)
+		}
+		roster, err := keyRoster(context.Background(), pubkeys)
+		if err != nil {
+			log.Fatalf("Failed to read the event store: %v", err)
+		}
+		if *used {
+			roster = usedRosterEntries(roster)
+		}
+		if *asJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			enc.Encode(roster)
+			return
+		}
+		for _, entry := range roster {
+			last := "never"
+			if entry.LastEventAt > 0 {
+				last = time.Unix(entry.LastEventAt, 0).UTC().Format(time.RFC3339)
+			}
+			fmt.Printf("%5d  %s  %s  %6d events, last %s\n", entry.Index, entry.Npub, entry.Pubkey, entry.Events, last)
+		}
+
+	case "max-index":
+		set := newFlagSet("keys max-index", "keys max-index N")
+		envFile := set.String("env-file", ".env", "configuration file")
+		set.Parse(args[1:])
+		if set.NArg() != 1 {
+			set.Usage()
+			os.Exit(2)
+		}
+		maxIndex, err := strconv.Atoi(set.Arg(0))
+		if err != nil {
+			log.Fatalf("Invalid index %q", set.Arg(0))
+		}
+
+		log.SetOutput(os.Stderr)
+		flags.EnvFile = *envFile
+		relay = khatru.NewRelay()
+		config = LoadConfig()
+		defer db.Close()
+		ctx := context.Background()
+		if err := checkMaxDerivationIndex(loadMaxDerivationIndex(ctx, config.MaxDerivationIndex), maxIndex); err != nil {
+			log.Fatalf("%v", err)
+		}
+		if err := saveState(ctx, maxDerivationIndexStateKey, maxIndex); err != nil {
+			log.Fatalf("Failed to save the max derivation index: %v", err)
+		}
+		fmt.Printf("Max derivation index raised to %d, effective at the next start\n", maxIndex)
+
+	default:
+		fmt.Fprintf(os.Stderr, "unknown keys command %q\n\n"+cliUsage, args[0], os.Args[0])
+		os.Exit(2)
+	}
+}
+
+// runExport writes stored events, one JSON object per line. Internal
+// bookkeeping events are left out unless --internal is given. The default
+// format lists them newest first; --format strfry writes them oldest first,
+// in the order `strfry export` does, for `strfry import` on another relay.
+func runExport(args []string) {
+	set := newFlagSet("export", "export [--output FILE] [--format jsonl|strfry] [--kinds 1,7] [--since TS] [--until TS]")
+	envFile := set.String("env-file", ".env", "configuration file")
+	output := set.String("output", "-", "file to write, - for stdout")
+	format := set.String("format", "jsonl", "jsonl (newest first) or strfry (oldest first)")
+	kinds := set.String("kinds", "", "comma-separated kinds to export (default all)")
+	since := set.Int64("since", 0, "only events created at or after this unix timestamp")
+	until := set.Int64("until", 0, "only events created at or before this unix timestamp")
+	internal := set.Bool("internal", false, "include the relay's internal bookkeeping events")
+	set.Parse(args)
+
+	// logs go to stderr, keep stdout for the events
+	log.SetOutput(os.Stderr)
+	switch *format {
+	case "jsonl":
+	case "strfry":
+		if *internal {
+			log.Fatalf("--internal can't be used with --format strfry, other relays have no use for them")
+		}
+	default:
+		log.Fatalf("Unknown format %q (expected jsonl or strfry)", *format)
+	}
+	flags.EnvFile = *envFile
+	relay = khatru.NewRelay()
+	config = LoadConfig()
+	defer db.Close()
+
+	filter := nostr.Filter{Kinds: parseAllowedKinds(kinds)}
+	if *since > 0 {
+		ts := nostr.Timestamp(*since)
+		filter.Since = &ts
+	}
+	if *until > 0 {
+		ts := nostr.Timestamp(*until)
+		filter.Until = &ts
+	}
+
+	var out io.Writer = os.Stdout
+	if *output != "-" {
+		file, err := os.Create(*output)
+		if err != nil {
+			log.Fatalf("Failed to create %s: %v", *output, err)
+		}
+		defer file.Close()
+		out = file
+	}
+	w := bufio.NewWriter(out)
+	defer w.Flush()
+
+	// events come newest first; for strfry they are spooled to a temporary
+	// file and written back in reverse
+	var spool *os.File
+	var offsets []int64
+	lines := io.Writer(w)
+	if *format == "strfry" {
+		var err error
+		if spool, err = os.CreateTemp("", "higher-export-*.jsonl"); err != nil {
+			log.Fatalf("Failed to create a temporary file: %v", err)
+		}
+		defer os.Remove(spool.Name())
+		defer spool.Close()
+		lines = spool
+	}
+
+	exported := 0
+	var written int64
+	err := forEachEvent(context.Background(), filter, func(evt *nostr.Event) error {
+		if isInternalKind(evt.Kind) && !*internal {
+			return nil
+		}
+		line, err := json.Marshal(evt)
+		if err != nil {
+			return err
+		}
+		offsets = append(offsets, written)
+		n, err := lines.Write(append(line, '\n'))
+		written += int64(n)
+		exported++
+		return err
+	})
+	if err != nil {
+		log.Fatalf("Export failed after %d events: %v", exported, err)
+	}
+	if spool != nil {
+		offsets = append(offsets, written)
+		for i := len(offsets) - 2; i >= 0; i-- {
+			line := make([]byte, offsets[i+1]-offsets[i])
+			if _, err := spool.ReadAt(line, offsets[i]); err != nil {
+				log.Fatalf("Export failed reading back the temporary file: %v", err)
+			}
+			if _, err := w.Write(line); err != nil {
+				log.Fatalf("Export failed: %v", err)
+			}
+		}
+	}
+	log.Printf("Exported %d events", exported)
+}
+
+func runVerify(args []string) {
+	set := newFlagSet("verify", "verify [--quarantine] [--json]")
+	envFile := set.String("env-file", ".env", "configuration file")
+	quarantineCorrupt := set.Bool("quarantine", false, "quarantine corrupted blobs so the relay stops serving them")
+	asJSON := set.Bool("json", false, "print the report as JSON")
+	set.Parse(args)
+
+	log.SetOutput(os.Stderr)
+	flags.EnvFile = *envFile
+	relay = khatru.NewRelay()
+	config = LoadConfig()
+	defer db.Close()
+	if blobStore == nil {
+		log.Fatalf("Blossom is not enabled, there are no blobs to verify")
+	}
+
+	ctx := context.Background()
+	if *quarantineCorrupt {
+		loadQuarantine(ctx)
+	}
+	report, err := verifyBlobs(ctx, *quarantineCorrupt)
+	if err != nil {
+		log.Fatalf("Verification failed after %d blobs: %v", report.Scanned, err)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	} else {
+		for _, c := range report.Corrupted {
+			fmt.Printf("%s  %s\n", c.SHA256, corruptionReason(c))
+		}
+		fmt.Printf("%d blobs (%d bytes) verified, %d corrupted\n", report.Scanned, report.Bytes, len(report.Corrupted))
+	}
+	if len(report.Corrupted) > 0 {
+		db.Close()
+		os.Exit(1)
+	}
+}
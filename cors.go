@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/rs/cors"
+)
+
+// Cross-origin access for web clients. One policy covers every HTTP endpoint
+// (Blossom, /list, /mirror, NIP-11, NIP-96 and the admin and REST APIs),
+// including the ones answered before the request reaches khatru, whose own
+// CORS layer would otherwise allow any origin. Websocket upgrades are not
+// subject to CORS. The NIP-05 document keeps "Access-Control-Allow-Origin: *"
+// as the NIP requires.
+
+// CORSConfig is the CORS policy, from the CORS_* settings.
+type CORSConfig struct {
+	AllowedOrigins []string // "*", origins like https://app.example.com, or https://*.example.com
+	AllowedMethods []string
+	AllowedHeaders []string // "*" allows any request header
+	MaxAgeSeconds  int      // how long browsers may cache a preflight answer
+}
+
+// corsExposedHeaders are the response headers clients may read besides the
+// CORS-safelisted ones: Blossom's error reason, the backoff hint and the
+// /list paging cursor.
+var corsExposedHeaders = []string{"X-Reason", "Retry-After", "X-Next-Cursor"}
+
+func loadCORSConfig() (CORSConfig, error) {
+	cfg := CORSConfig{
+		AllowedOrigins: parseList(getEnvNullable("CORS_ALLOWED_ORIGINS")),
+		AllowedMethods: parseList(getEnvNullable("CORS_ALLOWED_METHODS")),
+		AllowedHeaders: parseList(getEnvNullable("CORS_ALLOWED_HEADERS")),
+		MaxAgeSeconds:  getEnvIntWithDefault("CORS_MAX_AGE_SECONDS", 86400),
+	}
+	if len(cfg.AllowedOrigins) == 0 {
+		cfg.AllowedOrigins = []string{"*"}
+	}
+	if len(cfg.AllowedMethods) == 0 {
+		cfg.AllowedMethods = []string{"HEAD", "GET", "POST", "PUT", "PATCH", "DELETE"}
+	}
+	if len(cfg.AllowedHeaders) == 0 {
+		cfg.AllowedHeaders = []string{"*"}
+	}
+	for _, origin := range cfg.AllowedOrigins {
+		if origin != "*" && !strings.Contains(origin, "://") {
+			return cfg, fmt.Errorf("invalid CORS_ALLOWED_ORIGINS entry %q, expected * or scheme://host", origin)
+		}
+	}
+	for i, method := range cfg.AllowedMethods {
+		cfg.AllowedMethods[i] = strings.ToUpper(method)
+	}
+	if cfg.MaxAgeSeconds < 0 {
+		return cfg, fmt.Errorf("CORS_MAX_AGE_SECONDS must not be negative")
+	}
+	return cfg, nil
+}
+
+// withCORS applies the policy to every request and answers preflights itself.
+func withCORS(next http.Handler) http.Handler {
+	policy := cors.New(cors.Options{
+		AllowedOrigins: config.CORS.AllowedOrigins,
+		AllowedMethods: config.CORS.AllowedMethods,
+		AllowedHeaders: config.CORS.AllowedHeaders,
+		ExposedHeaders: corsExposedHeaders,
+		MaxAge:         config.CORS.MaxAgeSeconds,
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") == "websocket" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		policy.HandlerFunc(w, r)
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			return
+		}
+		// khatru's CORS layer leaves requests without an Origin alone, so it
+		// can't override the answer given here
+		r.Header.Del("Origin")
+		next.ServeHTTP(w, r)
+	})
+}
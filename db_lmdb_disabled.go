@@ -3,8 +3,9 @@
 package main
 
 // newLMDBBackend is a stub used when the "lmdb" build tag is not set.
-// If DB_ENGINE=lmdb is selected at runtime without the build tag, this
-// will panic with a clear message so users know how to enable it.
-func newLMDBBackend(path string) DBBackend {
-	panic("LMDB backend not included in this build. Rebuild with -tags lmdb to enable LMDB support.")
+// Selecting DB_ENGINE=lmdb in such a build stops the server at startup with
+// a message saying how to enable it.
+func newLMDBBackend(cfg *Config) DBBackend {
+	fatal("Configuration error: DB_ENGINE=lmdb but LMDB support is not included in this build; rebuild with -tags lmdb, or pick badger or postgres")
+	return nil
 }
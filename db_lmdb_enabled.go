@@ -7,6 +7,8 @@ import (
 )
 
 // newLMDBBackend is compiled only when the "lmdb" build tag is set.
-func newLMDBBackend(path string) DBBackend {
-	return &lmdb.LMDBBackend{Path: path}
+// LMDB_MAPSIZE_MB caps how large the database may grow; the reader table is
+// sized by the eventstore backend (1000 slots) and is not configurable.
+func newLMDBBackend(cfg *Config) DBBackend {
+	return &lmdb.LMDBBackend{Path: *cfg.DBPath, MapSize: int64(cfg.LMDBMapSizeMB) << 20}
 }
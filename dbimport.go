@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Importing the event history of another relay. `higher import` reads JSON
+// lines, as written by `strfry export`, by `higher export` or by
+//
+//	sqlite3 nostr.db "SELECT content FROM event WHERE hidden != 1"
+//
+// on a nostr-rs-relay database, into the configured DB_ENGINE. Lines may also
+// hold ["EVENT", ...] envelopes, as dumped by relay clients. Signatures are
+// checked; replaceable events keep only their newest version; ephemeral and
+// expired events, and events already stored, are skipped. Run it with the
+// relay stopped, as badger and lmdb are opened exclusively.
+
+// maxImportLine bounds one line of a dump.
+const maxImportLine = 16 << 20
+
+// parseDumpLine returns the event on one line of a dump.
+func parseDumpLine(line []byte) (*nostr.Event, error) {
+	raw := line
+	if line[0] == '[' {
+		var envelope []json.RawMessage
+		if err := json.Unmarshal(line, &envelope); err != nil {
+			return nil, err
+		}
+		var label string
+		if len(envelope) < 2 || json.Unmarshal(envelope[0], &label) != nil || label != "EVENT" {
+			return nil, errors.New("not an EVENT envelope")
+		}
+		raw = envelope[len(envelope)-1]
+	}
+	var evt nostr.Event
+	if err := json.Unmarshal(raw, &evt); err != nil {
+		return nil, err
+	}
+	if len(evt.ID) != 64 || len(evt.PubKey) != 64 {
+		return nil, errors.New("not an event")
+	}
+	return &evt, nil
+}
+
+// importEvent stores evt, reporting whether it was new. A replaceable event
+// older than the stored version counts as new but isn't kept.
+func importEvent(ctx context.Context, evt *nostr.Event) (bool, error) {
+	if nostr.IsRegularKind(evt.Kind) {
+		err := db.SaveEvent(ctx, evt)
+		if errors.Is(err, eventstore.ErrDupEvent) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	// ReplaceEvent doesn't tell whether the event was there already
+	ch, err := db.QueryEvents(ctx, nostr.Filter{IDs: []string{evt.ID}, Limit: 1})
+	if err != nil {
+		return false, err
+	}
+	present := false
+	for range ch {
+		present = true
+	}
+	if present {
+		return false, nil
+	}
+	return true, db.ReplaceEvent(ctx, evt)
+}
+
+func runImport(args []string) {
+	set := newFlagSet("import", "import [--input FILE] [--no-verify]")
+	envFile := set.String("env-file", ".env", "configuration file")
+	input := set.String("input", "-", "JSON lines file to read, - for stdin")
+	noVerify := set.Bool("no-verify", false, "skip checking ids and signatures, for trusted dumps")
+	set.Parse(args)
+
+	log.SetOutput(os.Stderr)
+	flags.EnvFile = *envFile
+	relay = khatru.NewRelay()
+	config = LoadConfig()
+	defer db.Close()
+
+	var in io.Reader = os.Stdin
+	if *input != "-" {
+		file, err := os.Open(*input)
+		if err != nil {
+			log.Fatalf("Failed to open %s: %v", *input, err)
+		}
+		defer file.Close()
+		in = file
+	}
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 0, 64<<10), maxImportLine)
+
+	ctx := context.Background()
+	start := time.Now()
+	lines, imported, present, skipped, invalid := 0, 0, 0, 0, 0
+	for scanner.Scan() {
+		lines++
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		evt, err := parseDumpLine(line)
+		if err == nil && !*noVerify {
+			if !evt.CheckID() {
+				err = errors.New("id is computed incorrectly")
+			} else if ok, _ := evt.CheckSignature(); !ok {
+				err = errors.New("invalid signature")
+			}
+		}
+		if err != nil {
+			invalid++
+			if invalid <= 10 {
+				log.Printf("Line %d: %v", lines, err)
+			}
+			continue
+		}
+		if nostr.IsEphemeralKind(evt.Kind) || isExpired(evt) {
+			skipped++
+			continue
+		}
+
+		stored, err := importEvent(ctx, evt)
+		if err != nil {
+			log.Fatalf("Import failed at line %d (event %s) after %d events: %v", lines, evt.ID, imported, err)
+		}
+		if stored {
+			imported++
+		} else {
+			present++
+		}
+		if lines%10000 == 0 {
+			log.Printf("%d lines, %d events imported, %.0f lines/s", lines, imported, float64(lines)/time.Since(start).Seconds())
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatalf("Import failed reading line %d after %d events: %v", lines+1, imported, err)
+	}
+	log.Printf("Imported %d events from %d lines in %s: %d already present, %d ephemeral or expired, %d invalid",
+		imported, lines, time.Since(start).Round(time.Second), present, skipped, invalid)
+	if invalid > 10 {
+		log.Printf("%d more invalid lines not shown", invalid-10)
+	}
+}
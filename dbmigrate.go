@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/joho/godotenv"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// `higher db migrate` copies every stored event from one database engine to
+// another, so DB_ENGINE can be changed without losing history. Events are
+// read newest first and written in batches; after each batch the oldest
+// timestamp copied so far is written to a checkpoint file, and a rerun with
+// the same checkpoint continues from there. Events the destination already
+// has are skipped, so overlapping a previous run is harmless.
+
+// migrateCheckpoint is the resume state of a migration.
+type migrateCheckpoint struct {
+	From   string          `json:"from"`
+	To     string          `json:"to"`
+	Until  nostr.Timestamp `json:"until"` // everything newer is copied
+	Copied int             `json:"copied"`
+}
+
+func runDB(args []string) {
+	if len(args) == 0 || args[0] != "migrate" {
+		fmt.Fprintf(os.Stderr, cliUsage, os.Args[0])
+		os.Exit(2)
+	}
+
+	set := newFlagSet("db migrate", "db migrate --from ENGINE --to ENGINE [--from-path DIR] [--to-path DIR]")
+	envFile := set.String("env-file", ".env", "configuration file with the Postgres settings")
+	from := set.String("from", "", "engine to read from: badger, lmdb or postgres")
+	to := set.String("to", "", "engine to write to: badger, lmdb or postgres")
+	fromPath := set.String("from-path", "", "badger/lmdb directory to read (default DB_PATH)")
+	toPath := set.String("to-path", "", "badger/lmdb directory to write (default DB_PATH)")
+	fromURL := set.String("from-url", "", "Postgres URL to read (default POSTGRES_URL or POSTGRES_*)")
+	toURL := set.String("to-url", "", "Postgres URL to write (default POSTGRES_URL or POSTGRES_*)")
+	batchSize := set.Int("batch", 500, "events written between checkpoints")
+	checkpointFile := set.String("checkpoint", "db-migrate.checkpoint", "file recording progress, for resuming")
+	set.Parse(args[1:])
+
+	log.SetOutput(os.Stderr)
+	if *from == "" || *to == "" {
+		set.Usage()
+		os.Exit(2)
+	}
+	// the .env file is optional here, flags may be enough
+	godotenv.Load(*envFile)
+	if err := setupLogging(getEnvWithDefault("LOG_FORMAT", "text"), getEnvWithDefault("LOG_LEVEL", "info")); err != nil {
+		log.Fatalf("Configuration error: %v", err)
+	}
+
+	source := migrationBackend(*from, *fromPath, *fromURL)
+	target := migrationBackend(*to, *toPath, *toURL)
+	if source.label == target.label {
+		log.Fatalf("Source and destination are the same database (%s)", source.label)
+	}
+	if err := source.db.Init(); err != nil {
+		log.Fatalf("Failed to open %s: %v", source.label, err)
+	}
+	defer source.db.Close()
+	if err := target.db.Init(); err != nil {
+		log.Fatalf("Failed to open %s: %v", target.label, err)
+	}
+	defer target.db.Close()
+
+	checkpoint := migrateCheckpoint{From: source.label, To: target.label}
+	if raw, err := os.ReadFile(*checkpointFile); err == nil {
+		var saved migrateCheckpoint
+		if err := json.Unmarshal(raw, &saved); err != nil {
+			log.Fatalf("Invalid checkpoint %s: %v", *checkpointFile, err)
+		}
+		if saved.From != checkpoint.From || saved.To != checkpoint.To {
+			log.Fatalf("Checkpoint %s belongs to a migration from %s to %s; remove it to start over", *checkpointFile, saved.From, saved.To)
+		}
+		checkpoint = saved
+		log.Printf("Resuming from %s: %d events copied, continuing at %s", *checkpointFile, checkpoint.Copied,
+			time.Unix(int64(checkpoint.Until), 0).UTC().Format(time.RFC3339))
+	}
+
+	if err := migrateEvents(context.Background(), source.db, target.db, &checkpoint, *batchSize, *checkpointFile); err != nil {
+		log.Fatalf("Migration failed after %d events (progress saved in %s, rerun to resume): %v", checkpoint.Copied, *checkpointFile, err)
+	}
+	os.Remove(*checkpointFile)
+	log.Printf("Migrated %d events from %s to %s. Set DB_ENGINE=%s to use it.", checkpoint.Copied, source.label, target.label, *to)
+}
+
+// migrationDB is one side of a migration.
+type migrationDB struct {
+	db    DBBackend
+	label string // engine and location, to tell the two sides apart
+}
+
+// migrationBackend opens an engine with the database settings from the
+// environment, the location overridden by path or dsn when given.
+func migrationBackend(engine, path, dsn string) migrationDB {
+	engine = strings.ToLower(engine)
+	var cfg Config
+	loadDatabaseConfig(&cfg)
+	cfg.DBEngine = &engine
+	if path != "" {
+		cfg.DBPath = &path
+	}
+	if dsn != "" {
+		// the replica in the environment belongs to the other database
+		cfg.PostgresURL, cfg.PostgresReadURL = dsn, ""
+	}
+
+	switch engine {
+	case "badger", "lmdb":
+		return migrationDB{db: newDBBackend(&cfg), label: engine + ":" + strings.TrimSuffix(*cfg.DBPath, "/")}
+	case "postgres":
+		pg := newDBBackend(&cfg).(*postgresBackend)
+		label := "postgres"
+		if u, err := url.Parse(pg.DatabaseURL); err == nil {
+			label += ":" + u.Redacted()
+		}
+		return migrationDB{db: pg, label: label}
+	default:
+		log.Fatalf("Unknown engine %q (expected badger, lmdb or postgres)", engine)
+		return migrationDB{}
+	}
+}
+
+// migrateEvents copies the events of source at or before checkpoint.Until
+// (everything, when unset) into target, saving the checkpoint after every
+// batch.
+func migrateEvents(ctx context.Context, source, target DBBackend, checkpoint *migrateCheckpoint, batchSize int, checkpointFile string) error {
+	filter := nostr.Filter{}
+	if checkpoint.Until > 0 {
+		until := checkpoint.Until
+		filter.Until = &until
+	}
+	total, err := source.CountEvents(ctx, filter)
+	if err != nil {
+		return fmt.Errorf("counting events: %w", err)
+	}
+	log.Printf("Copying %d events", total)
+
+	// forEachEvent pages through the global store
+	db = source
+	start := time.Now()
+	done, skipped, inBatch := 0, 0, 0
+	err = forEachEvent(ctx, filter, func(evt *nostr.Event) error {
+		if err := target.SaveEvent(ctx, evt); err != nil {
+			if !errors.Is(err, eventstore.ErrDupEvent) {
+				return fmt.Errorf("event %s: %w", evt.ID, err)
+			}
+			skipped++
+		}
+		done++
+		inBatch++
+		checkpoint.Copied++
+		checkpoint.Until = evt.CreatedAt
+		if inBatch < batchSize {
+			return nil
+		}
+		inBatch = 0
+		if err := saveMigrateCheckpoint(checkpointFile, checkpoint); err != nil {
+			return err
+		}
+		rate := float64(done) / time.Since(start).Seconds()
+		log.Printf("%d/%d events (%.1f%%), %d already present, %.0f events/s", done, total, 100*float64(done)/float64(max(total, 1)), skipped, rate)
+		return nil
+	})
+	if err != nil {
+		// the events of the last partial batch are written, but not checkpointed
+		return err
+	}
+	log.Printf("%d/%d events, %d already present, in %s", done, total, skipped, time.Since(start).Round(time.Second))
+	return nil
+}
+
+func saveMigrateCheckpoint(path string, checkpoint *migrateCheckpoint) error {
+	raw, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0600); err != nil {
+		return fmt.Errorf("saving checkpoint: %w", err)
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bitkarrot/higher/keyderivation"
+	"github.com/fiatjaf/khatru"
+)
+
+// Raising MAX_DERIVATION_INDEX at runtime. PUT /admin/derivation (or
+// `keys max-index` while the relay is stopped) sets a higher bound, which is
+// persisted and wins over a lower MAX_DERIVATION_INDEX at the next start. The
+// new keys are derived right away, so the first lookups don't pay for it.
+// The bound can only be raised: lowering it would lock out members already
+// handed a slot, so that stays a deliberate configuration change.
+
+const (
+	maxDerivationIndexStateKey = "max_derivation_index"
+	// maxDerivationIndexLimit keeps a typo from deriving millions of keys.
+	maxDerivationIndexLimit = 100000
+)
+
+// derivationMu serializes raises, which the admin API may run concurrently.
+var derivationMu sync.Mutex
+
+// loadMaxDerivationIndex returns the configured bound, or the persisted one
+// when an admin raised it past that.
+func loadMaxDerivationIndex(ctx context.Context, configured int) int {
+	var persisted int
+	if _, err := loadState(ctx, maxDerivationIndexStateKey, &persisted); err != nil {
+		slog.Error("Failed to load the persisted max derivation index", "err", err)
+	}
+	return max(configured, persisted)
+}
+
+// checkMaxDerivationIndex tells whether maxIndex may replace current.
+func checkMaxDerivationIndex(current, maxIndex int) error {
+	if maxIndex <= current {
+		return fmt.Errorf("max derivation index is already %d, it can only be raised", current)
+	}
+	if maxIndex > maxDerivationIndexLimit {
+		return fmt.Errorf("max derivation index can't exceed %d", maxDerivationIndexLimit)
+	}
+	return nil
+}
+
+// raiseMaxDerivationIndex persists the new bound, derives the keys up to it
+// and starts accepting them. config.MaxDerivationIndex follows, as the
+// registry of a seed retired later is built from it.
+func raiseMaxDerivationIndex(ctx context.Context, maxIndex int) error {
+	derivationMu.Lock()
+	defer derivationMu.Unlock()
+	if err := checkMaxDerivationIndex(int(registry.MaxIndex()), maxIndex); err != nil {
+		return err
+	}
+	if err := saveState(ctx, maxDerivationIndexStateKey, maxIndex); err != nil {
+		return err
+	}
+	config.MaxDerivationIndex = maxIndex
+
+	start := time.Now()
+	for _, r := range []*keyderivation.KeyRegistry{registry, retiredRegistry} {
+		if r == nil {
+			continue
+		}
+		r.SetMaxIndex(uint32(maxIndex))
+		// derive now rather than on the next lookup
+		if _, err := r.Pubkeys(); err != nil {
+			return err
+		}
+	}
+	logger(ctx).Info("Max derivation index raised", "max_derivation_index", maxIndex, "derived_in", time.Since(start))
+	return nil
+}
+
+// setupDerivationAPI serves GET and PUT /admin/derivation.
+func setupDerivationAPI(relay *khatru.Relay) {
+	relay.Router().HandleFunc("/admin/derivation", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+		case "PUT":
+			var req struct {
+				MaxDerivationIndex int `json:"max_derivation_index"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid JSON", http.StatusBadRequest)
+				return
+			}
+			if err := checkMaxDerivationIndex(int(registry.MaxIndex()), req.MaxDerivationIndex); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			// checked again under the lock, against a concurrent raise
+			if err := raiseMaxDerivationIndex(r.Context(), req.MaxDerivationIndex); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"max_derivation_index": registry.MaxIndex()})
+	}))
+}
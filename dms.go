@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Private DM mode, for NIP-17 messages. Gift wraps (kind 1059, and 1060) are
+// signed with throwaway keys, so they are accepted from anyone as long as
+// every recipient in their "p" tags is a member. Reading them requires NIP-42
+// authentication, and each member only ever gets the wraps addressed to them.
+
+const kindGiftWrapAlt = 1060
+
+func isGiftWrapKind(kind int) bool {
+	return kind == nostr.KindGiftWrap || kind == kindGiftWrapAlt
+}
+
+func giftWrapRecipients(evt *nostr.Event) []string {
+	var recipients []string
+	for _, tag := range evt.Tags {
+		if len(tag) >= 2 && tag[0] == "p" {
+			recipients = append(recipients, tag[1])
+		}
+	}
+	return recipients
+}
+
+// isGiftWrapForMember reports whether event is a gift wrap addressed only to
+// members, which is accepted whatever key wrapped it.
+func isGiftWrapForMember(event *nostr.Event) bool {
+	if !config.DMRelayMode || !isGiftWrapKind(event.Kind) {
+		return false
+	}
+	recipients := giftWrapRecipients(event)
+	if len(recipients) == 0 {
+		return false
+	}
+	for _, pubkey := range recipients {
+		if !isMember(pubkey) {
+			return false
+		}
+	}
+	return true
+}
+
+// rejectGiftWrap refuses wraps for anyone who is not a member, before the
+// team check would give a less helpful reason.
+func rejectGiftWrap(ctx context.Context, event *nostr.Event) (bool, string) {
+	if isGiftWrapKind(event.Kind) && !isGiftWrapForMember(event) {
+		return true, "restricted: this relay only accepts messages for its members"
+	}
+	return false, ""
+}
+
+// isOwnGiftWrapFilter reports whether filter asks only for gift wraps
+// addressed to the authenticated user.
+func isOwnGiftWrapFilter(ctx context.Context, filter nostr.Filter) bool {
+	if !config.DMRelayMode || len(filter.Kinds) == 0 || !slices.ContainsFunc(filter.Kinds, isGiftWrapKind) {
+		return false
+	}
+	authed := khatru.GetAuthed(ctx)
+	recipients := filter.Tags["p"]
+	return authed != "" && len(recipients) == 1 && recipients[0] == authed
+}
+
+// rejectGiftWrapFilter makes clients authenticate and name themselves as the
+// recipient when they ask for gift wraps.
+func rejectGiftWrapFilter(ctx context.Context, filter nostr.Filter) (bool, string) {
+	if !slices.ContainsFunc(filter.Kinds, isGiftWrapKind) {
+		return false, ""
+	}
+	if khatru.GetAuthed(ctx) == "" {
+		khatru.RequestAuth(ctx)
+		return true, "auth-required: messages are only served to their recipients"
+	}
+	if !isOwnGiftWrapFilter(ctx, filter) {
+		return true, "restricted: you may only read messages addressed to you"
+	}
+	return false, ""
+}
+
+// canReadGiftWrap keeps wraps out of broad queries: over a connection they
+// are only returned to the authenticated recipient.
+func canReadGiftWrap(ctx context.Context, evt *nostr.Event) bool {
+	if !config.DMRelayMode || !isGiftWrapKind(evt.Kind) || khatru.GetConnection(ctx) == nil {
+		return true
+	}
+	authed := khatru.GetAuthed(ctx)
+	return authed != "" && slices.Contains(giftWrapRecipients(evt), authed)
+}
+
+// setupDMRelay installs the private DM mode hooks.
+func setupDMRelay(relay *khatru.Relay) {
+	relay.RejectEvent = append(relay.RejectEvent, rejectGiftWrap)
+	relay.RejectFilter = append(relay.RejectFilter, rejectGiftWrapFilter)
+	relay.RejectCountFilter = append(relay.RejectCountFilter, rejectGiftWrapFilter)
+	slog.Info("DM relay mode: ENABLED", "kinds", []int{nostr.KindGiftWrap, kindGiftWrapAlt})
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip40"
+)
+
+// NIP-40: events carrying an "expiration" tag are refused once expired, never
+// served after that (see queryEvents) and deleted by a periodic sweep. khatru
+// tracks expirations itself too, but after a restart it only rescans the
+// first page of events, so the sweep pages through the whole store.
+
+// isExpired reports whether evt has an expiration tag in the past.
+func isExpired(evt *nostr.Event) bool {
+	expiration := nip40.GetExpiration(evt.Tags)
+	return expiration != -1 && expiration <= nostr.Now()
+}
+
+// sweepExpiredEvents deletes every stored event whose expiration has passed.
+func sweepExpiredEvents(ctx context.Context) (int, error) {
+	// collect first, deleting while paging through the same range would skip events
+	var expired []*nostr.Event
+	err := forEachEvent(ctx, nostr.Filter{}, func(evt *nostr.Event) error {
+		if isExpired(evt) {
+			expired = append(expired, evt)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, evt := range expired {
+		if err := db.DeleteEvent(ctx, evt); err != nil {
+			eventLogger(ctx, evt).Error("Expiration: failed to delete", "err", err)
+			continue
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// setupExpiration rejects already expired events and starts the sweeper.
+func setupExpiration(relay *khatru.Relay) {
+	relay.RejectEvent = append(relay.RejectEvent, func(ctx context.Context, event *nostr.Event) (bool, string) {
+		if isExpired(event) {
+			return true, "invalid: event has expired"
+		}
+		return false, ""
+	})
+
+	go func() {
+		for {
+			deleted, err := sweepExpiredEvents(context.Background())
+			if err != nil {
+				slog.Error("Expiration: sweep failed", "err", err)
+			} else if deleted > 0 {
+				slog.Info("Expiration: deleted expired events", "count", deleted)
+			}
+			time.Sleep(time.Duration(config.ExpirationSweepMinutes) * time.Minute)
+		}
+	}()
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bitkarrot/higher/keyderivation"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// federationPeer is a partner higher deployment we exchange member events with.
+// Each side authenticates to the other (NIP-42) with a service key derived
+// from its own master, and accepts events pushed by the authenticated peer
+// for the members on the roster that peer sent last.
+//
+// Events go out through an in-memory queue; what doesn't make it (the queue
+// was full, the peer refused it, the connection dropped, the relay
+// restarted) is sent by a catch-up, which pages through the member events
+// stored after the peer's persisted cursor. One runs on every connection and
+// before the next queued event after a miss.
+type federationPeer struct {
+	url    string
+	pubkey string // the peer's service pubkey
+	queue  chan *nostr.Event
+	// set when an event didn't fit in the queue or failed to publish, so a
+	// catch-up is due
+	behind atomic.Bool
+
+	// the newest event sent, guarded by federationMu
+	cursor federationCursor
+
+	rosterMu sync.RWMutex
+	roster   map[string]bool // the peer's members, from its last roster
+}
+
+// federationCursor orders events by (created_at, id), the order catch-up
+// sends them in.
+type federationCursor struct {
+	CreatedAt nostr.Timestamp `json:"created_at"`
+	ID        string          `json:"id"`
+}
+
+// before reports whether the cursor comes before evt.
+func (c federationCursor) before(evt *nostr.Event) bool {
+	return c.CreatedAt < evt.CreatedAt || (c.CreatedAt == evt.CreatedAt && c.ID < evt.ID)
+}
+
+const (
+	federationCursorsKey = "federation_cursors"
+	// kindFederationRoster carries a peer's member pubkeys, as a JSON array,
+	// signed by its service key. It is ephemeral, so never stored.
+	kindFederationRoster  = 29994
+	federationPageSize    = 500
+	federationRosterEvery = 10 * time.Minute
+	federationSaveEvery   = time.Minute
+)
+
+var (
+	federationPeers []*federationPeer
+	federationMu    sync.Mutex
+	federationDirty bool
+)
+
+// authedPeer returns the peer the connection in ctx is authenticated as.
+func authedPeer(ctx context.Context) *federationPeer {
+	authed := khatru.GetAuthed(ctx)
+	if authed == "" {
+		return nil
+	}
+	for _, p := range federationPeers {
+		if p.pubkey == authed {
+			return p
+		}
+	}
+	return nil
+}
+
+// isFederatedPeer reports whether the connection in ctx is authenticated as
+// one of the configured peers' service keys.
+func isFederatedPeer(ctx context.Context) bool {
+	return authedPeer(ctx) != nil
+}
+
+// isPeerMemberEvent reports whether event was pushed by an authenticated peer
+// on behalf of one of its members.
+func isPeerMemberEvent(ctx context.Context, event *nostr.Event) bool {
+	p := authedPeer(ctx)
+	if p == nil {
+		return false
+	}
+	p.rosterMu.RLock()
+	defer p.rosterMu.RUnlock()
+	return p.roster[event.PubKey]
+}
+
+// isFederationRoster reports whether event is the roster of the peer the
+// connection is authenticated as.
+func isFederationRoster(ctx context.Context, event *nostr.Event) bool {
+	p := authedPeer(ctx)
+	return p != nil && event.Kind == kindFederationRoster && event.PubKey == p.pubkey
+}
+
+// receiveRoster replaces a peer's roster with the one in event.
+func receiveRoster(ctx context.Context, event *nostr.Event) {
+	if !isFederationRoster(ctx, event) {
+		return
+	}
+	var pubkeys []string
+	if err := json.Unmarshal([]byte(event.Content), &pubkeys); err != nil {
+		slog.Warn("Federation: invalid roster", "peer", khatru.GetAuthed(ctx), "err", err)
+		return
+	}
+	roster := make(map[string]bool, len(pubkeys))
+	for _, pk := range pubkeys {
+		roster[pk] = true
+	}
+	p := authedPeer(ctx)
+	p.rosterMu.Lock()
+	p.roster = roster
+	p.rosterMu.Unlock()
+	slog.Info("Federation: roster received", "peer", p.url, "members", len(roster))
+}
+
+// parseFederationPeers reads entries of the form "wss://relay.example|<pubkey>".
+func parseFederationPeers(entries []string) []*federationPeer {
+	var peers []*federationPeer
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, "|", 2)
+		if len(parts) != 2 {
+			slog.Warn("Invalid FEDERATION_PEERS entry, expected url|pubkey", "entry", entry)
+			continue
+		}
+		pubkey := normalizePubkey(strings.TrimSpace(parts[1]))
+		if !nostr.IsValidPublicKey(pubkey) {
+			slog.Warn("Invalid pubkey in FEDERATION_PEERS entry", "entry", entry)
+			continue
+		}
+		peers = append(peers, &federationPeer{
+			url:    nostr.NormalizeURL(strings.TrimSpace(parts[0])),
+			pubkey: pubkey,
+			queue:  make(chan *nostr.Event, 1000),
+		})
+	}
+	return peers
+}
+
+// loadFederationCursors restores the peers' cursors. A peer without one
+// starts from now rather than being sent the whole history.
+func loadFederationCursors(ctx context.Context) {
+	cursors := map[string]federationCursor{}
+	if _, err := loadState(ctx, federationCursorsKey, &cursors); err != nil {
+		slog.Error("Federation: failed to load cursors", "err", err)
+	}
+	federationMu.Lock()
+	defer federationMu.Unlock()
+	for _, p := range federationPeers {
+		if c, ok := cursors[p.url]; ok {
+			p.cursor = c
+		} else {
+			p.cursor = federationCursor{CreatedAt: nostr.Now()}
+			federationDirty = true
+		}
+	}
+}
+
+func persistFederationCursors(ctx context.Context) {
+	federationMu.Lock()
+	defer federationMu.Unlock()
+	if !federationDirty {
+		return
+	}
+	cursors := make(map[string]federationCursor, len(federationPeers))
+	for _, p := range federationPeers {
+		cursors[p.url] = p.cursor
+	}
+	if err := saveState(ctx, federationCursorsKey, cursors); err != nil {
+		slog.Error("Federation: failed to save cursors", "err", err)
+		return
+	}
+	federationDirty = false
+}
+
+// markSent moves the peer's cursor to evt if it is newer.
+func (p *federationPeer) markSent(evt *nostr.Event) {
+	federationMu.Lock()
+	defer federationMu.Unlock()
+	if p.cursor.before(evt) {
+		p.cursor = federationCursor{CreatedAt: evt.CreatedAt, ID: evt.ID}
+		federationDirty = true
+	}
+}
+
+func (p *federationPeer) currentCursor() federationCursor {
+	federationMu.Lock()
+	defer federationMu.Unlock()
+	return p.cursor
+}
+
+// setupFederation derives our service key, starts a forwarding loop per peer
+// and pushes every newly stored member event to all peers.
+func setupFederation(relay *khatru.Relay) error {
+	servicePubkey, err := deriver.DerivePublicKey(uint32(config.FederationServiceIndex))
+	if err != nil {
+		return err
+	}
+	if deriver.IsWatchOnly() {
+		return keyderivation.ErrWatchOnly
+	}
+	federationPeers = parseFederationPeers(config.FederationPeers)
+	loadFederationCursors(context.Background())
+
+	relay.OnEphemeralEvent = append(relay.OnEphemeralEvent, receiveRoster)
+	relay.PreventBroadcast = append(relay.PreventBroadcast, func(ws *khatru.WebSocket, event *nostr.Event) bool {
+		return event.Kind == kindFederationRoster
+	})
+
+	relay.OnEventSaved = append(relay.OnEventSaved, func(ctx context.Context, event *nostr.Event) {
+		// only forward our own members' events, which also prevents echoing
+		// events that a peer just pushed to us back at it
+		if !isMember(event.PubKey) {
+			return
+		}
+		for _, p := range federationPeers {
+			select {
+			case p.queue <- event:
+			default:
+				p.behind.Store(true)
+				slog.Warn("Federation: queue is full, event left to the next catch-up", "peer", p.url, "event_id", event.ID)
+			}
+		}
+	})
+
+	for _, p := range federationPeers {
+		go p.run(context.Background())
+	}
+	go func() {
+		for range time.Tick(federationSaveEvery) {
+			persistFederationCursors(context.Background())
+		}
+	}()
+
+	slog.Info("Federation: ENABLED", "peers", len(federationPeers), "service_pubkey", servicePubkey)
+	return nil
+}
+
+// run keeps a connection to the peer open and forwards queued events,
+// reconnecting with backoff when the connection drops.
+func (p *federationPeer) run(ctx context.Context) {
+	backoff := time.Second
+	for {
+		rel, err := nostr.RelayConnect(ctx, p.url)
+		if err != nil {
+			slog.Warn("Federation: failed to connect", "peer", p.url, "err", err)
+			time.Sleep(backoff)
+			backoff = min(backoff*2, 5*time.Minute)
+			continue
+		}
+		backoff = time.Second
+
+		if err := p.sendRoster(ctx, rel); err != nil {
+			slog.Warn("Federation: failed to send roster", "peer", p.url, "err", err)
+		}
+		if err := p.catchUp(ctx, rel); err != nil {
+			slog.Warn("Federation: catch-up failed", "peer", p.url, "err", err)
+		} else {
+			p.forward(ctx, rel)
+		}
+		rel.Close()
+	}
+}
+
+// sendRoster tells the peer which pubkeys are our members, the only ones
+// whose events it will take from us.
+func (p *federationPeer) sendRoster(ctx context.Context, rel *nostr.Relay) error {
+	content, err := json.Marshal(memberPubkeys())
+	if err != nil {
+		return err
+	}
+	evt := &nostr.Event{Kind: kindFederationRoster, CreatedAt: nostr.Now(), Tags: nostr.Tags{}, Content: string(content)}
+	if err := deriver.SignEvent(uint32(config.FederationServiceIndex), evt); err != nil {
+		return err
+	}
+	return p.publish(ctx, rel, evt)
+}
+
+// catchUp sends the member events stored after the peer's cursor, oldest
+// first. It pages back from the newest with until, as queries return the
+// newest events and are capped by the backend.
+func (p *federationPeer) catchUp(ctx context.Context, rel *nostr.Relay) (err error) {
+	p.behind.Store(false)
+	defer func() {
+		if err != nil {
+			p.behind.Store(true)
+		}
+	}()
+	cursor := p.currentCursor()
+	authors := memberPubkeys()
+	if len(authors) == 0 {
+		return nil
+	}
+
+	var pending []*nostr.Event
+	seen := map[string]bool{}
+	var until *nostr.Timestamp
+	for {
+		filter := nostr.Filter{Authors: authors, Since: &cursor.CreatedAt, Until: until, Limit: federationPageSize}
+		ch, err := db.QueryEvents(ctx, filter)
+		if err != nil {
+			return err
+		}
+		n, added := 0, 0
+		oldest := nostr.Timestamp(0)
+		for evt := range ch {
+			n++
+			if oldest == 0 || evt.CreatedAt < oldest {
+				oldest = evt.CreatedAt
+			}
+			if seen[evt.ID] {
+				continue
+			}
+			seen[evt.ID] = true
+			added++
+			if cursor.before(evt) {
+				pending = append(pending, evt)
+			}
+		}
+		// events sharing the oldest timestamp may continue on the next page,
+		// so it is asked for again
+		if n < federationPageSize || added == 0 || oldest <= cursor.CreatedAt {
+			break
+		}
+		until = &oldest
+	}
+
+	slices.SortFunc(pending, func(a, b *nostr.Event) int {
+		if a.CreatedAt != b.CreatedAt {
+			return cmp.Compare(a.CreatedAt, b.CreatedAt)
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+	for _, evt := range pending {
+		if err := p.publish(ctx, rel, evt); err != nil {
+			return err
+		}
+		p.markSent(evt)
+	}
+	if len(pending) > 0 {
+		slog.Info("Federation: caught up", "peer", p.url, "events", len(pending))
+	}
+	return nil
+}
+
+func (p *federationPeer) forward(ctx context.Context, rel *nostr.Relay) {
+	rosterTicker := time.NewTicker(federationRosterEvery)
+	defer rosterTicker.Stop()
+	for {
+		select {
+		case <-rel.Context().Done():
+			return
+		case <-rosterTicker.C:
+			if err := p.sendRoster(ctx, rel); err != nil {
+				slog.Warn("Federation: failed to send roster", "peer", p.url, "err", err)
+			}
+		case evt := <-p.queue:
+			err := p.sendQueued(evt,
+				func(evt *nostr.Event) error { return p.publish(ctx, rel, evt) },
+				func() error { return p.catchUp(ctx, rel) })
+			if err != nil {
+				eventLogger(ctx, evt).Warn("Federation: send failed, left to the next catch-up", "peer", p.url, "err", err)
+				if !rel.IsConnected() {
+					return
+				}
+			}
+		}
+	}
+}
+
+// sendQueued publishes a queued event, catching up first when the peer is
+// behind. A failed publish leaves the peer behind, so the event goes out with
+// the catch-up before the next one.
+func (p *federationPeer) sendQueued(evt *nostr.Event, publish func(*nostr.Event) error, catchUp func() error) error {
+	if p.behind.Load() {
+		if err := catchUp(); err != nil {
+			return err
+		}
+	}
+	if err := publish(evt); err != nil {
+		p.behind.Store(true)
+		return err
+	}
+	// an event dropped meanwhile may be older than evt; the cursor waits for
+	// the catch-up that sends it
+	if !p.behind.Load() {
+		p.markSent(evt)
+	}
+	return nil
+}
+
+// publish sends evt, authenticating with our service key when the peer asks.
+func (p *federationPeer) publish(ctx context.Context, rel *nostr.Relay, evt *nostr.Event) error {
+	err := rel.Publish(ctx, *evt)
+	if err != nil && strings.Contains(err.Error(), "auth-required") {
+		if authErr := rel.Auth(ctx, func(ae *nostr.Event) error { return deriver.SignEvent(uint32(config.FederationServiceIndex), ae) }); authErr != nil {
+			return authErr
+		}
+		err = rel.Publish(ctx, *evt)
+	}
+	return err
+}
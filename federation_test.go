@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestFederationSendQueued(t *testing.T) {
+	p := &federationPeer{url: "wss://peer.example.com", cursor: federationCursor{CreatedAt: 100}}
+	event := func(id string, createdAt nostr.Timestamp) *nostr.Event {
+		return &nostr.Event{ID: id, CreatedAt: createdAt}
+	}
+	failed, next, later := event("aa", 200), event("bb", 300), event("cc", 400)
+
+	var published []string
+	catchUps := 0
+	publish := func(evt *nostr.Event) error {
+		if evt == failed {
+			return errors.New("connection reset")
+		}
+		published = append(published, evt.ID)
+		return nil
+	}
+	// the catch-up sends the failed event and everything after it
+	catchUp := func() error {
+		catchUps++
+		p.behind.Store(false)
+		for _, evt := range []*nostr.Event{failed, next} {
+			published = append(published, evt.ID)
+			p.markSent(evt)
+		}
+		return nil
+	}
+	stalledCatchUp := func() error {
+		catchUps++
+		return errors.New("query failed")
+	}
+
+	if err := p.sendQueued(failed, publish, catchUp); err == nil {
+		t.Fatalf("sendQueued of the failed event succeeded")
+	}
+	if !p.behind.Load() {
+		t.Fatalf("peer not behind after a failed publish")
+	}
+
+	// a catch-up that fails sends nothing and leaves the peer behind
+	if err := p.sendQueued(next, publish, stalledCatchUp); err == nil {
+		t.Fatalf("sendQueued succeeded though the catch-up failed")
+	}
+	if !p.behind.Load() || p.currentCursor().CreatedAt != 100 {
+		t.Fatalf("behind = %v, cursor = %v after a failed catch-up", p.behind.Load(), p.currentCursor())
+	}
+
+	// the next event runs the catch-up first, which sends the failed one
+	if err := p.sendQueued(next, publish, catchUp); err != nil {
+		t.Fatalf("sendQueued: %v", err)
+	}
+	if catchUps != 2 {
+		t.Fatalf("catch-up ran %d times, want 2", catchUps)
+	}
+	if len(published) < 1 || published[0] != failed.ID {
+		t.Fatalf("published %v, want the failed event first", published)
+	}
+	if c := p.currentCursor(); c.CreatedAt != next.CreatedAt || c.ID != next.ID {
+		t.Fatalf("cursor = %v, want %s", c, next.ID)
+	}
+
+	if err := p.sendQueued(later, publish, catchUp); err != nil {
+		t.Fatalf("sendQueued: %v", err)
+	}
+	if catchUps != 2 {
+		t.Fatalf("catch-up ran though the peer was not behind")
+	}
+	if c := p.currentCursor(); c.ID != later.ID {
+		t.Fatalf("cursor = %v, want %s", c, later.ID)
+	}
+}
+
+func TestFederationCursorHoldsWhileBehind(t *testing.T) {
+	p := &federationPeer{url: "wss://peer.example.com", cursor: federationCursor{CreatedAt: 100}}
+	failed := &nostr.Event{ID: "aa", CreatedAt: 200}
+	next := &nostr.Event{ID: "bb", CreatedAt: 300}
+
+	publish := func(evt *nostr.Event) error {
+		if evt == failed {
+			return errors.New("rate-limited")
+		}
+		return nil
+	}
+	// a catch-up that hasn't managed to send anything yet
+	noop := func() error { return nil }
+
+	if err := p.sendQueued(failed, publish, noop); err == nil {
+		t.Fatalf("sendQueued of the failed event succeeded")
+	}
+	if err := p.sendQueued(next, publish, noop); err != nil {
+		t.Fatalf("sendQueued: %v", err)
+	}
+	if c := p.currentCursor(); c.CreatedAt != 100 {
+		t.Fatalf("cursor moved to %v, past the failed event", c)
+	}
+}
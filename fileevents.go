@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Checks on events that point at blobs hosted here: kind 1063 file metadata
+// and imeta tags whose URL is on this server must name a blob that is stored,
+// and their "x" hash must be the one in the URL. FILE_EVENT_BLOB_CHECK=warn
+// only logs offending events, reject refuses them, off skips the check.
+
+const (
+	fileEventCheckOff    = "off"
+	fileEventCheckWarn   = "warn"
+	fileEventCheckReject = "reject"
+)
+
+// localBlobReference is a URL on this server as an event declares it.
+type localBlobReference struct {
+	url    string
+	sha256 string // from the URL
+	x      string // declared hash, empty when the event gives none
+}
+
+// localBlobReferences returns the URLs of event that point at this server.
+func localBlobReferences(event *nostr.Event) []localBlobReference {
+	ownURL := strings.TrimSuffix(*config.BlossomURL, "/") + "/"
+	var refs []localBlobReference
+	add := func(url, x string) {
+		if !strings.HasPrefix(url, ownURL) {
+			return
+		}
+		refs = append(refs, localBlobReference{url: url, sha256: extractSha256FromURL(url), x: strings.ToLower(x)})
+	}
+
+	for _, tag := range event.Tags {
+		if len(tag) < 2 {
+			continue
+		}
+		switch {
+		case tag[0] == "imeta":
+			var url, x string
+			for _, entry := range tag[1:] {
+				key, value, _ := strings.Cut(entry, " ")
+				switch key {
+				case "url":
+					url = value
+				case "x":
+					x = value
+				}
+			}
+			add(url, x)
+		case tag[0] == "url" && event.Kind == 1063:
+			var x string
+			if xTag := event.Tags.GetFirst([]string{"x", ""}); xTag != nil {
+				x = (*xTag)[1]
+			}
+			add(tag[1], x)
+		}
+	}
+	return refs
+}
+
+// checkFileEventBlobs returns why event's references to local blobs are
+// wrong, or nil when they are fine.
+func checkFileEventBlobs(event *nostr.Event) error {
+	for _, ref := range localBlobReferences(event) {
+		if ref.sha256 == "" {
+			return fmt.Errorf("%s is not a blob URL", ref.url)
+		}
+		if ref.x != "" && ref.x != ref.sha256 {
+			return fmt.Errorf("x tag %s doesn't match the blob at %s", ref.x, ref.url)
+		}
+		if !blobExists(ref.sha256) {
+			return fmt.Errorf("blob %s is not stored here", ref.sha256)
+		}
+	}
+	return nil
+}
+
+// setupFileEventBlobCheck checks the blob references of incoming events.
+func setupFileEventBlobCheck(relay *khatru.Relay) {
+	relay.RejectEvent = append(relay.RejectEvent, func(ctx context.Context, event *nostr.Event) (bool, string) {
+		err := checkFileEventBlobs(event)
+		if err == nil {
+			return false, ""
+		}
+		if config.FileEventBlobCheck == fileEventCheckReject {
+			return true, "invalid: " + err.Error()
+		}
+		logger(ctx).Warn("File event references a bad local blob", "event", event.ID, "kind", event.Kind, "pubkey", event.PubKey, "err", err)
+		return false, ""
+	})
+	slog.Info("File event blob check: ENABLED", "mode", config.FileEventBlobCheck)
+}
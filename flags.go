@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+)
+
+// Command-line overrides. Every setting read from the environment can also be
+// given as a flag named after it in kebab case, e.g. --db-engine postgres for
+// DB_ENGINE or --blossom-enabled=true for BLOSSOM_ENABLED. Flags take
+// precedence over the environment, which takes precedence over the .env file.
+
+// cliFlags holds the parsed command line.
+type cliFlags struct {
+	EnvFile   string            // --env-file, default .env
+	Port      string            // --port, replaces the port of the first listener
+	Overrides map[string]string // environment variable -> value
+}
+
+var flags = cliFlags{EnvFile: ".env"}
+
+var errHelp = errors.New("help requested")
+
+// configKeysRead records every environment variable the configuration looked
+// at, so overrides that don't match any setting can be reported.
+var configKeysRead = map[string]bool{}
+
+// flagEnvKey converts a flag name to its environment variable: db-engine -> DB_ENGINE.
+func flagEnvKey(name string) string {
+	return strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// parseFlags parses "--name value" and "--name=value" arguments. Values are
+// always required, booleans included, so a flag never swallows the next one.
+func parseFlags(args []string) (cliFlags, error) {
+	parsed := cliFlags{EnvFile: ".env", Overrides: map[string]string{}}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "-h" || arg == "--help" || arg == "-help" {
+			return parsed, errHelp
+		}
+		if !strings.HasPrefix(arg, "-") {
+			return parsed, fmt.Errorf("unexpected argument %q", arg)
+		}
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if name == "" {
+			return parsed, fmt.Errorf("invalid flag %q", arg)
+		}
+		if !hasValue {
+			if i+1 >= len(args) {
+				return parsed, fmt.Errorf("flag --%s needs a value", name)
+			}
+			i++
+			value = args[i]
+		}
+
+		switch name {
+		case "env-file":
+			parsed.EnvFile = value
+		case "port":
+			if _, err := net.LookupPort("tcp", value); err != nil {
+				return parsed, fmt.Errorf("invalid --port %q", value)
+			}
+			parsed.Port = value
+		default:
+			parsed.Overrides[flagEnvKey(name)] = value
+		}
+	}
+	return parsed, nil
+}
+
+func printUsage() {
+	fmt.Fprintf(os.Stderr, `Usage: %s [serve] [flags]
+
+Every setting from .env.example can be given as a flag, named after the
+environment variable in kebab case. Flags override the environment and the
+.env file.
+
+  --env-file PATH      configuration file to load (default .env)
+  --port PORT          port of the first listener (default 3334)
+  --db-engine ENGINE   same as DB_ENGINE=ENGINE
+  --blossom-path DIR   same as BLOSSOM_PATH=DIR
+  --reads-restricted true|false
+
+Example: %s serve --port 8080 --db-engine postgres --blossom-path /data/blobs
+`, os.Args[0], os.Args[0])
+}
+
+// applyFlags parses the serve command line and exports the overrides to the
+// environment, before LoadConfig reads it.
+func applyFlags(args []string) {
+	parsed, err := parseFlags(args)
+	if err == errHelp {
+		printUsage()
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n\n", err)
+		printUsage()
+		os.Exit(2)
+	}
+	for key, value := range parsed.Overrides {
+		os.Setenv(key, value)
+	}
+	flags = parsed
+}
+
+// checkFlags rejects overrides that no setting read and applies --port.
+func checkFlags(cfg *Config) {
+	for key := range flags.Overrides {
+		if !configKeysRead[key] {
+			log.Fatalf("Unknown flag --%s", strings.ToLower(strings.ReplaceAll(key, "_", "-")))
+		}
+	}
+	if flags.Port != "" && len(cfg.Profiles) > 0 {
+		host, _, err := net.SplitHostPort(cfg.Profiles[0].Addr)
+		if err != nil {
+			host = ""
+		}
+		cfg.Profiles[0].Addr = net.JoinHostPort(host, flags.Port)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Flood protection against misbehaving clients. Within FLOOD_WINDOW_SECONDS,
+// one pubkey may publish at most FLOOD_MAX_COPIES events with near-identical
+// content (the same letters once case, digits, punctuation and whitespace are
+// ignored, so appending a counter doesn't help), and all pubkeys together at
+// most FLOOD_BURST_LIMIT events with exactly the same content. Beyond that,
+// FLOOD_POLICY "reject" refuses the event and "dedupe" answers OK without
+// storing or broadcasting it, for clients that retry on every refusal. Only
+// regular events from client connections with some text to them are
+// counted; reactions and other one-word events are never duplicates.
+
+const (
+	floodReject = "reject"
+	floodDedupe = "dedupe"
+
+	// content with fewer letters than this is not checked
+	floodMinLetters = 8
+)
+
+// floodGuard counts recent content per pubkey and across pubkeys.
+type floodGuard struct {
+	window time.Duration
+
+	mu      sync.Mutex
+	copies  map[string]*requestWindow // pubkey and normalized content
+	content map[string]*requestWindow // exact content
+}
+
+// contentFingerprint hashes content as is and with only its letters kept,
+// lowercased. ok is false when content is too short to be judged.
+func contentFingerprint(content string) (exact, near string, ok bool) {
+	var b strings.Builder
+	for _, r := range content {
+		if unicode.IsLetter(r) {
+			b.WriteRune(unicode.ToLower(r))
+		}
+	}
+	if b.Len() < floodMinLetters {
+		return "", "", false
+	}
+	e := sha256.Sum256([]byte(content))
+	n := sha256.Sum256([]byte(b.String()))
+	return hex.EncodeToString(e[:16]), hex.EncodeToString(n[:16]), true
+}
+
+// count bumps the window of key, returning the count so far in it.
+func (g *floodGuard) count(windows map[string]*requestWindow, key string, now time.Time) int {
+	win := windows[key]
+	if win == nil || now.Sub(win.start) >= g.window {
+		win = &requestWindow{start: now}
+		windows[key] = win
+	}
+	win.count++
+	return win.count
+}
+
+// check counts event and returns why it is a flood, if it is.
+func (g *floodGuard) check(ctx context.Context, event *nostr.Event) string {
+	if khatru.GetConnection(ctx) == nil || isFederatedPeer(ctx) {
+		return ""
+	}
+	return g.checkAt(event, time.Now())
+}
+
+// checkAt is check for an event from a client, received at now.
+func (g *floodGuard) checkAt(event *nostr.Event, now time.Time) string {
+	if !nostr.IsRegularKind(event.Kind) || event.Kind == nostr.KindGiftWrap {
+		return ""
+	}
+	exact, near, ok := contentFingerprint(event.Content)
+	if !ok {
+		return ""
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if config.FloodMaxCopies > 0 && g.count(g.copies, event.PubKey+":"+near, now) > config.FloodMaxCopies {
+		return fmt.Sprintf("you already posted this %d times in the last %d seconds", config.FloodMaxCopies, config.FloodWindowSeconds)
+	}
+	if config.FloodBurstLimit > 0 && g.count(g.content, exact, now) > config.FloodBurstLimit {
+		return fmt.Sprintf("this content was posted %d times in the last %d seconds", config.FloodBurstLimit, config.FloodWindowSeconds)
+	}
+	return ""
+}
+
+// prune drops expired windows.
+func (g *floodGuard) prune() {
+	now := time.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, windows := range []map[string]*requestWindow{g.copies, g.content} {
+		for key, win := range windows {
+			if now.Sub(win.start) >= g.window {
+				delete(windows, key)
+			}
+		}
+	}
+}
+
+// setupFloodProtection installs the guard. With FLOOD_POLICY "reject" it is a
+// RejectEvent hook, so it must come after the other event policies: events
+// they refuse should not count. With "dedupe" it runs before storage.
+func setupFloodProtection(relay *khatru.Relay) {
+	g := &floodGuard{
+		window:  time.Duration(config.FloodWindowSeconds) * time.Second,
+		copies:  map[string]*requestWindow{},
+		content: map[string]*requestWindow{},
+	}
+	go func() {
+		for range time.Tick(g.window) {
+			g.prune()
+		}
+	}()
+
+	if config.FloodPolicy == floodDedupe {
+		relay.StoreEvent = append([]func(context.Context, *nostr.Event) error{func(ctx context.Context, event *nostr.Event) error {
+			if reason := g.check(ctx, event); reason != "" {
+				logger(ctx).Debug("Flood: duplicate dropped", "pubkey", event.PubKey, "kind", event.Kind, "reason", reason)
+				return eventstore.ErrDupEvent
+			}
+			return nil
+		}}, relay.StoreEvent...)
+	} else {
+		relay.RejectEvent = append(relay.RejectEvent, func(ctx context.Context, event *nostr.Event) (bool, string) {
+			if reason := g.check(ctx, event); reason != "" {
+				return true, "rate-limited: " + reason
+			}
+			return false, ""
+		})
+	}
+
+	slog.Info("Flood protection: ENABLED", "policy", config.FloodPolicy, "window_seconds", config.FloodWindowSeconds,
+		"max_copies", config.FloodMaxCopies, "burst_limit", config.FloodBurstLimit)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestContentFingerprint(t *testing.T) {
+	cases := []struct {
+		a, b        string
+		exact, near bool // whether a and b share each fingerprint
+	}{
+		{"Hello team, see you at 10", "Hello team, see you at 10", true, true},
+		{"Hello team, see you at 10", "hello TEAM see you at 11!!", false, true},
+		{"buy cheap followers now 1", "buy cheap followers now 2", false, true},
+		{"buy cheap followers now", "buy cheap followers today", false, false},
+		{"Привет команда, встреча", "привет КОМАНДА встреча 2", false, true},
+	}
+	for _, tc := range cases {
+		ea, na, oka := contentFingerprint(tc.a)
+		eb, nb, okb := contentFingerprint(tc.b)
+		if !oka || !okb {
+			t.Errorf("contentFingerprint(%q, %q) not ok", tc.a, tc.b)
+			continue
+		}
+		if (ea == eb) != tc.exact {
+			t.Errorf("exact fingerprints of %q and %q: equal = %v, want %v", tc.a, tc.b, ea == eb, tc.exact)
+		}
+		if (na == nb) != tc.near {
+			t.Errorf("near fingerprints of %q and %q: equal = %v, want %v", tc.a, tc.b, na == nb, tc.near)
+		}
+	}
+
+	for _, short := range []string{"", "+", "🤙🤙🤙", "gm gm gm", "12345678901234", "ok ok ok!"} {
+		if _, _, ok := contentFingerprint(short); ok {
+			t.Errorf("contentFingerprint(%q) ok, want too short", short)
+		}
+	}
+	if _, _, ok := contentFingerprint("abcdefgh"); !ok {
+		t.Errorf("contentFingerprint of %d letters not ok", floodMinLetters)
+	}
+}
+
+func TestFloodGuardCheck(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config.FloodWindowSeconds = 60
+	config.FloodMaxCopies = 2
+	config.FloodBurstLimit = 3
+
+	const alice, bob, carol, dave = "alice", "bob", "carol", "dave"
+	note := func(pubkey, content string) *nostr.Event {
+		return &nostr.Event{PubKey: pubkey, Kind: nostr.KindTextNote, Content: content}
+	}
+	start := time.Unix(1700000000, 0)
+	at := func(seconds int) time.Time { return start.Add(time.Duration(seconds) * time.Second) }
+
+	steps := []struct {
+		name  string
+		event *nostr.Event
+		at    time.Time
+		want  string // substring of the reason, "" when accepted
+	}{
+		{"first copy", note(alice, "join my channel now 1"), at(0), ""},
+		{"second copy", note(alice, "JOIN my channel now 2"), at(10), ""},
+		{"third copy", note(alice, "join my channel, now!! 3"), at(20), "you already posted this 2 times"},
+		{"other pubkey", note(bob, "join my channel now 1"), at(25), ""},
+		{"window rolled over", note(alice, "join my channel now 4"), at(60), ""},
+		{"copy in new window", note(alice, "join my channel now 5"), at(70), ""},
+		{"limit in new window", note(alice, "join my channel now 6"), at(80), "you already posted this 2 times"},
+
+		{"burst 1", note(alice, "free sats for everyone"), at(100), ""},
+		{"burst 2", note(bob, "free sats for everyone"), at(101), ""},
+		{"burst 3", note(carol, "free sats for everyone"), at(102), ""},
+		{"burst 4", note(dave, "free sats for everyone"), at(103), "this content was posted 3 times"},
+		{"burst rolled over", note(dave, "free sats for everyone"), at(160), ""},
+
+		{"short content", note(alice, "gm"), at(161), ""},
+		{"replaceable kind", &nostr.Event{PubKey: alice, Kind: nostr.KindProfileMetadata, Content: "join my channel now 7"}, at(162), ""},
+	}
+
+	g := &floodGuard{
+		window:  time.Duration(config.FloodWindowSeconds) * time.Second,
+		copies:  map[string]*requestWindow{},
+		content: map[string]*requestWindow{},
+	}
+	for _, step := range steps {
+		got := g.checkAt(step.event, step.at)
+		if step.want == "" && got != "" || step.want != "" && !strings.Contains(got, step.want) {
+			t.Errorf("%s: checkAt = %q, want %q", step.name, got, step.want)
+		}
+	}
+
+	// events not from a client connection are never counted
+	for range 5 {
+		if reason := g.check(context.Background(), note(alice, "free sats for everyone")); reason != "" {
+			t.Fatalf("check without a connection = %q", reason)
+		}
+	}
+}
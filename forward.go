@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Outbound forwarding republishes accepted events to upstream relays, making
+// higher a write-through edge relay. Every event waiting for an upstream is
+// recorded as an internal queue entry, so events accepted while an upstream
+// is unreachable (or before a restart) are still delivered once it is back.
+
+// upstreamRelay is one FORWARD_RELAYS entry.
+type upstreamRelay struct {
+	url  string
+	wake chan struct{}
+}
+
+var upstreamRelays []*upstreamRelay
+
+// shouldForward applies FORWARD_KINDS and FORWARD_MEMBERS_ONLY.
+func shouldForward(evt *nostr.Event) bool {
+	if len(config.ForwardKinds) > 0 && !slices.Contains(config.ForwardKinds, evt.Kind) {
+		return false
+	}
+	return !config.ForwardMembersOnly || isMember(evt.PubKey)
+}
+
+// setupForwarding starts a worker per upstream and queues every stored event
+// that should be forwarded.
+func setupForwarding(relay *khatru.Relay) {
+	for _, url := range config.ForwardRelays {
+		url = nostr.NormalizeURL(url)
+		if url == "" {
+			continue
+		}
+		upstreamRelays = append(upstreamRelays, &upstreamRelay{url: url, wake: make(chan struct{}, 1)})
+	}
+
+	relay.OnEventSaved = append(relay.OnEventSaved, func(ctx context.Context, evt *nostr.Event) {
+		if !shouldForward(evt) {
+			return
+		}
+		for _, u := range upstreamRelays {
+			if err := u.enqueue(context.Background(), evt); err != nil {
+				eventLogger(ctx, evt).Error("Forwarding: failed to queue event", "upstream", u.url, "err", err)
+				continue
+			}
+			select {
+			case u.wake <- struct{}{}:
+			default:
+			}
+		}
+	})
+
+	for _, u := range upstreamRelays {
+		go u.run(context.Background())
+	}
+
+	slog.Info("Forwarding: ENABLED", "upstreams", len(upstreamRelays))
+}
+
+// enqueue records that evt still has to be sent to u.
+func (u *upstreamRelay) enqueue(ctx context.Context, evt *nostr.Event) error {
+	return saveInternalEvent(ctx, &nostr.Event{
+		Kind:      kindForwardQueue,
+		CreatedAt: evt.CreatedAt,
+		Tags:      nostr.Tags{{"r", u.url}, {"e", evt.ID}},
+	})
+}
+
+// pending returns u's queue entries, oldest first.
+func (u *upstreamRelay) pending(ctx context.Context) ([]*nostr.Event, error) {
+	entries, err := queryInternalEvents(ctx, kindForwardQueue, nostr.TagMap{"r": []string{u.url}})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].CreatedAt < entries[j].CreatedAt })
+	return entries, nil
+}
+
+// run keeps a connection to the upstream open and drains the queue whenever
+// new entries arrive, reconnecting with backoff when the connection drops.
+func (u *upstreamRelay) run(ctx context.Context) {
+	backoff := time.Second
+	for {
+		rel, err := nostr.RelayConnect(ctx, u.url)
+		if err != nil {
+			slog.Warn("Forwarding: failed to connect", "upstream", u.url, "err", err)
+			time.Sleep(backoff)
+			backoff = min(backoff*2, 5*time.Minute)
+			continue
+		}
+		backoff = time.Second
+
+		for u.drain(ctx, rel) {
+			select {
+			case <-u.wake:
+			case <-rel.Context().Done():
+			}
+		}
+		rel.Close()
+	}
+}
+
+// drain publishes every queued event. It reports false once the connection
+// is lost, leaving the remaining entries for the next connection.
+func (u *upstreamRelay) drain(ctx context.Context, rel *nostr.Relay) bool {
+	for {
+		entries, err := u.pending(ctx)
+		if err != nil {
+			slog.Error("Forwarding: failed to read queue", "upstream", u.url, "err", err)
+			return rel.IsConnected()
+		}
+		if len(entries) == 0 {
+			return rel.IsConnected()
+		}
+
+		for _, entry := range entries {
+			evt := u.queuedEvent(ctx, entry)
+			if evt != nil {
+				if err := rel.Publish(ctx, *evt); err != nil {
+					if !rel.IsConnected() {
+						slog.Warn("Forwarding: lost connection", "upstream", u.url, "err", err)
+						return false
+					}
+					// the upstream refused it, retrying won't help
+					eventLogger(ctx, evt).Warn("Forwarding: upstream rejected event", "upstream", u.url, "err", err)
+				}
+			}
+			db.DeleteEvent(ctx, entry)
+		}
+	}
+}
+
+// queuedEvent loads the event an entry refers to, nil if it is gone.
+func (u *upstreamRelay) queuedEvent(ctx context.Context, entry *nostr.Event) *nostr.Event {
+	tag := entry.Tags.GetFirst([]string{"e", ""})
+	if tag == nil {
+		return nil
+	}
+	ch, err := db.QueryEvents(ctx, nostr.Filter{IDs: []string{(*tag)[1]}})
+	if err != nil {
+		return nil
+	}
+	var evt *nostr.Event
+	for e := range ch {
+		evt = e
+	}
+	return evt
+}
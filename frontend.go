@@ -1,14 +1,33 @@
 package main
 
 import (
+	"fmt"
 	"html/template"
+	"log/slog"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/fiatjaf/khatru"
 )
 
+// The front page is rendered from the embedded template below, or from
+// FRONTPAGE_TEMPLATE_DIR when set: every *.html file in it is parsed and
+// index.html is executed with FrontPageData, so partials can be split out;
+// humanBytes formats byte counts.
+// The directory is re-parsed whenever a file in it changes; a template that
+// fails to parse is logged and the previous one keeps being served.
+
+var (
+	frontPageMu   sync.RWMutex
+	frontPageTmpl *template.Template
+	startedAt     = time.Now()
+)
+
 const frontPageTemplate = `<!DOCTYPE html>
 <html lang="en">
 <head>
@@ -20,14 +39,14 @@ const frontPageTemplate = `<!DOCTYPE html>
     <meta property="og:type" content="website">
     <meta property="og:title" content="{{.RelayName}} - Nostr Relay & Blossom Server">
     <meta property="og:description" content="{{.RelayDescription}} - Team-based Nostr relay with Blossom file storage">
-    <meta property="og:image" content="https://higher.bitkarrot.co/public/TeamHigher.jpg">
+    {{if .PreviewImageURL}}<meta property="og:image" content="{{.PreviewImageURL}}">{{end}}
     <meta property="og:url" content="https://{{.TeamDomain}}">
     
     <!-- Twitter Card Meta Tags -->
     <meta name="twitter:card" content="summary">
     <meta name="twitter:title" content="{{.RelayName}} - Nostr Relay & Blossom Server">
     <meta name="twitter:description" content="{{.RelayDescription}} - Team-based Nostr relay with Blossom file storage">
-    <meta name="twitter:image" content="https://higher.bitkarrot.co/public/TeamHigher.jpg">
+    {{if .PreviewImageURL}}<meta name="twitter:image" content="{{.PreviewImageURL}}">{{end}}
     
     <style>
         * {
@@ -69,6 +88,14 @@ const frontPageTemplate = `<!DOCTYPE html>
             object-fit: contain;
         }
         
+        .header-banner {
+            width: 100%;
+            max-height: 240px;
+            object-fit: cover;
+            border-radius: 12px;
+            margin-bottom: 1.5rem;
+        }
+        
         .header h1 {
             font-size: 3rem;
             margin-bottom: 0.5rem;
@@ -206,8 +233,9 @@ const frontPageTemplate = `<!DOCTYPE html>
 <body>
     <div class="container">
         <div class="header">
+            {{if .BannerURL}}<img src="{{.BannerURL}}" alt="{{.RelayName}} banner" class="header-banner">{{end}}
             <div class="header-content">
-                <img src="/public/TeamHigher.jpg" alt="TeamHive Logo" class="header-logo">
+                {{if .IconURL}}<img src="{{.IconURL}}" alt="{{.RelayName}} logo" class="header-logo">{{end}}
                 <h1>{{.RelayName}}</h1>
             </div>
             <p>{{.RelayDescription}}</p>
@@ -266,14 +294,26 @@ const frontPageTemplate = `<!DOCTYPE html>
                 </div>
             </div>
             
+            <div class="endpoint">
+                <div class="endpoint-title">
+                    <span class="method get">GET</span>
+                    <span class="path">/upload/status/{id}</span>
+                </div>
+                <div class="description">
+                    Progress of an in-flight upload (bytes received, hash progress, ETA), keyed by the
+                    upload's authorization event ID. Stream the same data over WebSocket at /upload/progress/{id}.
+                </div>
+            </div>
+            
             <div class="endpoint">
                 <div class="endpoint-title">
                     <span class="method get">GET</span>
                     <span class="path">/list/{pubkey}</span>
                 </div>
                 <div class="description">
-                    List all blobs with metadata including SHA256, size, MIME type, and upload timestamp.
-                    Used by Sakura for health checks and blob discovery.
+                    List the blobs uploaded by {pubkey} with metadata including SHA256, size, MIME type, and upload timestamp.
+                    Requires NIP-98 or Blossom (t=list) authorization by {pubkey} or an admin. Page with since, until, limit and
+                    the cursor returned in the X-Next-Cursor header. Used by Sakura for health checks and blob discovery.
                 </div>
             </div>
             
@@ -322,6 +362,44 @@ const frontPageTemplate = `<!DOCTYPE html>
             </div>
         </div>
         
+        <div class="card">
+            <h2>📈 Live Stats</h2>
+            <div class="status-info">
+                <div class="status-item">
+                    <div class="status-label">Events Stored</div>
+                    <div class="status-value">{{.Stats.Events}}</div>
+                </div>
+                <div class="status-item">
+                    <div class="status-label">Events (last 24h)</div>
+                    <div class="status-value">{{.Stats.RecentEvents}}</div>
+                </div>
+                <div class="status-item">
+                    <div class="status-label">Members</div>
+                    <div class="status-value">{{.Stats.Members}}</div>
+                </div>
+                {{if .BlossomEnabled}}
+                <div class="status-item">
+                    <div class="status-label">Blobs Stored</div>
+                    <div class="status-value">{{.Stats.Blobs}} ({{humanBytes .Stats.BlobBytes}})</div>
+                </div>
+                {{end}}
+                <div class="status-item">
+                    <div class="status-label">Uptime</div>
+                    <div class="status-value">{{.Uptime}}</div>
+                </div>
+            </div>
+            {{if .Stats.RecentKinds}}
+            <div class="status-info">
+                {{range .Stats.RecentKinds}}
+                <div class="status-item">
+                    <div class="status-label">Kind {{.Kind}} (24h)</div>
+                    <div class="status-value">{{.Count}}</div>
+                </div>
+                {{end}}
+            </div>
+            {{end}}
+        </div>
+        
         <div class="footer">
             <p>
                  Built by <a href="https://nostr.at/npub18pudjhdhhp2v8gxnkttt00um729nv93tuepjda2jrwn3eua5tf5s80a699" target="_blank">@Bitkarrot</a> ❤️ |  
@@ -347,9 +425,106 @@ type FrontPageData struct {
 	WellKnownURL     string
 	HasMasterKey     bool
 	HasTeamDomain    bool
+	IconURL          string
+	BannerURL        string
+	PreviewImageURL  string // banner for link previews, else the icon
+	// Extra fields for custom templates
+	EventCount int64
+	Uptime     string
+	StartedAt  time.Time
+	Stats      RelayStats
+}
+
+var frontPageFuncs = template.FuncMap{"humanBytes": humanBytes}
+
+// humanBytes renders n bytes as e.g. "1.5 GB".
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// loadFrontPageTemplate parses the embedded template, or dir's templates.
+func loadFrontPageTemplate(dir string) (*template.Template, error) {
+	if dir == "" {
+		return template.New("index.html").Funcs(frontPageFuncs).Parse(frontPageTemplate)
+	}
+	tmpl, err := template.New("").Funcs(frontPageFuncs).ParseGlob(filepath.Join(dir, "*.html"))
+	if err != nil {
+		return nil, err
+	}
+	if tmpl.Lookup("index.html") == nil {
+		return nil, fmt.Errorf("%s has no index.html", dir)
+	}
+	return tmpl, nil
+}
+
+// templateDirVersion summarizes the files of dir so changes can be noticed
+// by polling.
+func templateDirVersion(dir string) string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+	var b strings.Builder
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil {
+			fmt.Fprintf(&b, "%s:%d:%d;", entry.Name(), info.Size(), info.ModTime().UnixNano())
+		}
+	}
+	return b.String()
+}
+
+// watchFrontPageTemplate re-parses dir when its files change.
+func watchFrontPageTemplate(dir string) {
+	version := templateDirVersion(dir)
+	for range time.Tick(2 * time.Second) {
+		current := templateDirVersion(dir)
+		if current == version {
+			continue
+		}
+		version = current
+		tmpl, err := loadFrontPageTemplate(dir)
+		if err != nil {
+			slog.Error("Front page: template reload failed, keeping the previous one", "dir", dir, "err", err)
+			continue
+		}
+		frontPageMu.Lock()
+		frontPageTmpl = tmpl
+		frontPageMu.Unlock()
+		slog.Info("Front page: template reloaded", "dir", dir)
+	}
+}
+
+// formatUptime renders d as e.g. "3d 4h 12m".
+func formatUptime(d time.Duration) string {
+	days := int(d.Hours()) / 24
+	hours := int(d.Hours()) % 24
+	minutes := int(d.Minutes()) % 60
+	if days > 0 {
+		return fmt.Sprintf("%dd %dh %dm", days, hours, minutes)
+	}
+	return fmt.Sprintf("%dh %dm", hours, minutes)
 }
 
 func setupFrontPageHandler(relay *khatru.Relay, config Config) {
+	tmpl, err := loadFrontPageTemplate(config.FrontPageTemplateDir)
+	if err != nil {
+		fatal("Failed to parse front page template", "dir", config.FrontPageTemplateDir, "err", err)
+	}
+	frontPageTmpl = tmpl
+	if config.FrontPageTemplateDir != "" {
+		go watchFrontPageTemplate(config.FrontPageTemplateDir)
+		slog.Info("Front page: serving custom template", "dir", config.FrontPageTemplateDir)
+	}
+
 	relay.Router().HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		// Only serve the front page for GET requests to the root path
 		if r.Method != "GET" || r.URL.Path != "/" {
@@ -379,6 +554,12 @@ func setupFrontPageHandler(relay *khatru.Relay, config Config) {
 			MaxUploadSizeMB:  config.MaxUploadSizeMB,
 			WebSocketURL:     wsURL,
 			WellKnownURL:     "https://" + config.TeamDomain + "/.well-known/nostr.json",
+			IconURL:          config.Branding.Icon(),
+			BannerURL:        config.Branding.Banner(),
+		}
+		data.PreviewImageURL = data.BannerURL
+		if data.PreviewImageURL == "" {
+			data.PreviewImageURL = data.IconURL
 		}
 
 		// Flags for conditional rendering
@@ -405,15 +586,17 @@ func setupFrontPageHandler(relay *khatru.Relay, config Config) {
 			data.AllowedKindsStr = strings.Join(kindStrs, ", ")
 		}
 
-		// Parse and execute template
-		tmpl, err := template.New("frontpage").Parse(frontPageTemplate)
-		if err != nil {
-			http.Error(w, "Template error", http.StatusInternalServerError)
-			return
-		}
+		data.StartedAt = startedAt
+		data.Uptime = formatUptime(time.Since(startedAt))
+		data.Stats = relayStats()
+		data.EventCount = data.Stats.Events
+
+		frontPageMu.RLock()
+		tmpl := frontPageTmpl
+		frontPageMu.RUnlock()
 
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		if err := tmpl.Execute(w, data); err != nil {
+		if err := tmpl.ExecuteTemplate(w, "index.html", data); err != nil {
 			http.Error(w, "Template execution error", http.StatusInternalServerError)
 			return
 		}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// Blob gallery: /gallery lets team members browse the images and videos on
+// the media server, newest first. Like the moderation dashboard, the page is
+// public and its API calls are signed with the visitor's NIP-07 extension;
+// the listing itself requires a member or admin key.
+
+const (
+	galleryPageSize    = 48
+	galleryMaxPageSize = 200
+)
+
+var errGalleryPageFull = errors.New("gallery page full")
+
+// GalleryItem is one blob in the gallery listing.
+type GalleryItem struct {
+	SHA256    string `json:"sha256"`
+	URL       string `json:"url"`
+	Thumbnail string `json:"thumbnail,omitempty"`
+	Type      string `json:"type"`
+	Size      int    `json:"size"`
+	Uploaded  int64  `json:"uploaded"`
+	Uploader  string `json:"uploader"` // npub
+}
+
+// galleryPage is a page of the listing. Next is the until value for the
+// following page, zero on the last one.
+type galleryPage struct {
+	Items []GalleryItem `json:"items"`
+	Next  int64         `json:"next,omitempty"`
+}
+
+// thumbnailHashes returns the hashes of all stored thumbnail variants, which
+// the gallery shows with their original instead of on their own.
+func thumbnailHashes(ctx context.Context) map[string]bool {
+	hashes := map[string]bool{}
+	events, err := queryInternalEvents(ctx, kindThumbnails, nil)
+	if err != nil {
+		slog.Warn("Gallery: failed to load thumbnails", "err", err)
+		return hashes
+	}
+	for _, evt := range events {
+		for _, tag := range evt.Tags {
+			if len(tag) >= 2 && tag[0] == "thumb" {
+				hashes[tag[1]] = true
+			}
+		}
+	}
+	return hashes
+}
+
+// listGallery walks the blob index newest first from until (inclusive, zero
+// for now), collecting up to limit images and videos.
+func listGallery(ctx context.Context, bl *blossom.BlossomServer, until nostr.Timestamp, limit int) (galleryPage, error) {
+	page := galleryPage{Items: []GalleryItem{}}
+	thumbs := thumbnailHashes(ctx)
+	seen := map[string]bool{}
+
+	filter := nostr.Filter{Kinds: []int{24242}}
+	if until > 0 {
+		filter.Until = &until
+	}
+	err := forEachEvent(ctx, filter, func(evt *nostr.Event) error {
+		sha := evt.Tags.GetFirst([]string{"x", ""})
+		mimetype := evt.Tags.GetFirst([]string{"type", ""})
+		if sha == nil || mimetype == nil || seen[(*sha)[1]] || thumbs[(*sha)[1]] || isHiddenPubkey(evt.PubKey) {
+			return nil
+		}
+		if !strings.HasPrefix((*mimetype)[1], "image/") && !strings.HasPrefix((*mimetype)[1], "video/") {
+			return nil
+		}
+		if len(page.Items) == limit {
+			page.Next = int64(evt.CreatedAt)
+			return errGalleryPageFull
+		}
+		seen[(*sha)[1]] = true
+
+		item := GalleryItem{
+			SHA256:   (*sha)[1],
+			Type:     (*mimetype)[1],
+			Uploaded: int64(evt.CreatedAt),
+		}
+		if size := evt.Tags.GetFirst([]string{"size", ""}); size != nil {
+			item.Size, _ = strconv.Atoi((*size)[1])
+		}
+		if bd, err := bl.Store.Get(ctx, item.SHA256); err == nil && bd != nil {
+			item.URL = bd.URL
+		} else {
+			item.URL = bl.ServiceURL + "/" + item.SHA256
+		}
+		if npub, err := nip19.EncodePublicKey(evt.PubKey); err == nil {
+			item.Uploader = npub
+		}
+		if variants := thumbnailsFor(ctx, item.SHA256); len(variants) > 0 {
+			item.Thumbnail = variants[0].URL
+		} else if strings.HasPrefix(item.Type, "image/") {
+			item.Thumbnail = item.URL
+		}
+		page.Items = append(page.Items, item)
+		return nil
+	})
+	if err != nil && !errors.Is(err, errGalleryPageFull) {
+		return page, err
+	}
+	return page, nil
+}
+
+// setupGallery serves the gallery page and its API:
+//
+//	GET /gallery                          the page
+//	GET /gallery/api[?until=ts&limit=n]   a page of images and videos
+func setupGallery(relay *khatru.Relay, bl *blossom.BlossomServer) {
+	relay.Router().HandleFunc("/gallery/api", requireMember(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		limit := galleryPageSize
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				http.Error(w, "Invalid limit", http.StatusBadRequest)
+				return
+			}
+			limit = min(n, galleryMaxPageSize)
+		}
+		var until nostr.Timestamp
+		if v := r.URL.Query().Get("until"); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				http.Error(w, "Invalid until", http.StatusBadRequest)
+				return
+			}
+			until = nostr.Timestamp(n)
+		}
+
+		page, err := listGallery(r.Context(), bl, until, limit)
+		if err != nil {
+			logger(r.Context()).Error("Gallery: failed to list blobs", "err", err)
+			http.Error(w, "Failed to list blobs", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(page)
+	}))
+
+	relay.Router().HandleFunc("/gallery", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, galleryPageHTML)
+	})
+
+	slog.Info("Gallery: ENABLED", "page", "/gallery")
+}
+
+const galleryPageHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>Media gallery</title>
+    <style>
+        body { font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, sans-serif; background: #0f172a; color: #e5e7eb; margin: 0; padding: 2rem; }
+        h1 { margin-top: 0; }
+        #grid { display: grid; grid-template-columns: repeat(auto-fill, minmax(200px, 1fr)); gap: 1rem; margin: 1rem 0; }
+        .item { background: #1f2937; border-radius: 8px; overflow: hidden; }
+        .thumb { display: block; width: 100%; height: 180px; object-fit: cover; background: #111827; }
+        .placeholder { display: flex; align-items: center; justify-content: center; color: #9ca3af; }
+        .meta { color: #9ca3af; font-size: 0.8rem; padding: 0.5rem; word-break: break-all; }
+        button { background: #7c3aed; color: white; border: 0; border-radius: 4px; padding: 0.4rem 0.8rem; margin-right: 0.5rem; cursor: pointer; }
+        #status { color: #fbbf24; }
+    </style>
+</head>
+<body>
+    <h1>Media gallery</h1>
+    <p id="status">Sign in with your NIP-07 extension to browse the media server.</p>
+    <button onclick="load(true)">Load gallery</button>
+    <div id="grid"></div>
+    <button id="more" onclick="load(false)" hidden>Load more</button>
+<script>
+let next = 0;
+const shown = new Set();
+
+async function authHeader(path, method) {
+    const event = await window.nostr.signEvent({
+        kind: 27235,
+        created_at: Math.floor(Date.now() / 1000),
+        tags: [["u", location.origin + path], ["method", method]],
+        content: ""
+    });
+    return "Nostr " + btoa(JSON.stringify(event));
+}
+
+async function api(path, method) {
+    const res = await fetch(path, { method: method, headers: { "Authorization": await authHeader(path, method) } });
+    if (!res.ok) throw new Error(await res.text());
+    return res.json();
+}
+
+function el(tag, text, cls) {
+    const e = document.createElement(tag);
+    if (text) e.textContent = text;
+    if (cls) e.className = cls;
+    return e;
+}
+
+function humanBytes(n) {
+    const units = ["B", "KB", "MB", "GB", "TB"];
+    let i = 0;
+    while (n >= 1024 && i < units.length - 1) { n /= 1024; i++; }
+    return (i ? n.toFixed(1) : n) + " " + units[i];
+}
+
+async function load(reset) {
+    const status = document.getElementById("status");
+    if (!window.nostr) { status.textContent = "No NIP-07 extension found."; return; }
+    if (reset) { next = 0; shown.clear(); document.getElementById("grid").replaceChildren(); }
+    try {
+        const page = await api("/gallery/api" + (next ? "?until=" + next : ""), "GET");
+        render(page.items);
+        next = page.next || 0;
+        document.getElementById("more").hidden = !next;
+        status.textContent = shown.size + " files";
+    } catch (e) {
+        status.textContent = e.message;
+    }
+}
+
+function render(items) {
+    const grid = document.getElementById("grid");
+    for (const item of items) {
+        if (shown.has(item.sha256)) continue;
+        shown.add(item.sha256);
+        const div = el("div", "", "item");
+        const link = el("a");
+        link.href = item.url;
+        link.target = "_blank";
+        link.rel = "noopener";
+        if (item.thumbnail) {
+            const img = el("img", "", "thumb");
+            img.src = item.thumbnail;
+            img.loading = "lazy";
+            img.alt = item.sha256;
+            link.appendChild(img);
+        } else {
+            link.appendChild(el("div", item.type, "thumb placeholder"));
+        }
+        div.appendChild(link);
+        const meta = el("div", "", "meta");
+        meta.appendChild(el("div", item.uploader));
+        meta.appendChild(el("div", humanBytes(item.size) + " · " + item.type));
+        meta.appendChild(el("div", new Date(item.uploaded * 1000).toLocaleString()));
+        div.appendChild(meta);
+        grid.appendChild(div);
+    }
+}
+</script>
+</body>
+</html>
+`
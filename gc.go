@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// GCReport summarizes a blob garbage collection run.
+type GCReport struct {
+	DryRun           bool     `json:"dry_run"`
+	Scanned          int      `json:"scanned"`
+	Referenced       int      `json:"referenced"`
+	InGracePeriod    int      `json:"in_grace_period"`
+	Reclaimable      []string `json:"reclaimable"`
+	ReclaimableBytes int64    `json:"reclaimable_bytes"`
+	Deleted          int      `json:"deleted"`
+	At               int64    `json:"at"`
+}
+
+var (
+	gcMu       sync.Mutex // one run at a time
+	blobHashRe = regexp.MustCompile(`[0-9a-fA-F]{64}`)
+)
+
+// referencedBlobs collects every blob hash referenced by a stored event: "x"
+// tags (e.g. kind 1063 file metadata), "imeta" entries and links to this
+// server in content. Blossom's own upload index (kind 24242) only records
+// ownership and does not count as a reference, nor does the metadata we
+// publish ourselves.
+func referencedBlobs(ctx context.Context) (map[string]bool, error) {
+	refs := make(map[string]bool)
+	blossomURL := strings.TrimSuffix(*config.BlossomURL, "/") + "/"
+
+	addURLs := func(text string) {
+		for {
+			i := strings.Index(text, blossomURL)
+			if i < 0 {
+				return
+			}
+			text = text[i+len(blossomURL):]
+			if len(text) >= 64 && isBlobHash(text[:64]) {
+				refs[strings.ToLower(text[:64])] = true
+			}
+		}
+	}
+
+	// our own auto-published NIP-94 metadata describes blobs, it doesn't use them
+	err := forEachEvent(ctx, nostr.Filter{}, func(evt *nostr.Event) error {
+		if evt.Kind == 24242 || isInternalKind(evt.Kind) || (fileMetadataPubkey != "" && evt.PubKey == fileMetadataPubkey) {
+			return nil
+		}
+		for _, tag := range evt.Tags {
+			if len(tag) < 2 {
+				continue
+			}
+			switch tag[0] {
+			case "x":
+				if isBlobHash(tag[1]) {
+					refs[strings.ToLower(tag[1])] = true
+				}
+			case "imeta":
+				for _, entry := range tag[1:] {
+					if strings.HasPrefix(entry, "x ") || strings.HasPrefix(entry, "url ") {
+						for _, h := range blobHashRe.FindAllString(entry, -1) {
+							refs[strings.ToLower(h)] = true
+						}
+					}
+				}
+			default:
+				addURLs(tag[1])
+			}
+		}
+		addURLs(evt.Content)
+		return nil
+	})
+	if err != nil {
+		return refs, err
+	}
+
+	// variants are kept as long as their original is
+	for hash := range refs {
+		for _, t := range thumbnailsFor(ctx, hash) {
+			refs[t.SHA256] = true
+		}
+	}
+	return refs, nil
+}
+
+// runBlobGC finds blobs that no stored event references and that are older
+// than the grace period, and deletes them unless dryRun is set.
+func runBlobGC(ctx context.Context, dryRun bool) (GCReport, error) {
+	gcMu.Lock()
+	defer gcMu.Unlock()
+
+	report := GCReport{DryRun: dryRun, Reclaimable: []string{}, At: time.Now().Unix()}
+
+	refs, err := referencedBlobs(ctx)
+	if err != nil {
+		return report, err
+	}
+	stored, err := blobStore.List(ctx)
+	if err != nil {
+		return report, err
+	}
+
+	cutoff := time.Now().Add(-time.Duration(config.BlobGCGraceHours) * time.Hour)
+	for _, blob := range stored {
+		report.Scanned++
+		if refs[blob.SHA256] {
+			report.Referenced++
+			continue
+		}
+		// frozen blobs are kept on purpose until their owner's cleanup is resolved
+		if blob.Modified.After(cutoff) || isFrozenBlob(blob.SHA256) {
+			report.InGracePeriod++
+			continue
+		}
+		report.Reclaimable = append(report.Reclaimable, blob.SHA256)
+		report.ReclaimableBytes += blob.Size
+
+		if dryRun {
+			continue
+		}
+		for _, owner := range blobOwners(ctx, blob.SHA256) {
+			if err := blossomServer.Store.Delete(ctx, blob.SHA256, owner); err != nil {
+				blobLogger(ctx, blob.SHA256).Error("Blob GC: failed to unindex", "owner", owner, "err", err)
+			}
+		}
+		if err := blobStore.Delete(ctx, blob.SHA256); err != nil {
+			blobLogger(ctx, blob.SHA256).Error("Blob GC: failed to delete", "err", err)
+			continue
+		}
+		report.Deleted++
+	}
+
+	if !dryRun {
+		slog.Info("Blob GC: sweep finished", "scanned", report.Scanned, "deleted", report.Deleted, "bytes", report.ReclaimableBytes)
+	}
+	return report, nil
+}
+
+// setupBlobGC runs the collector periodically when BLOB_GC is enabled and
+// exposes GET /admin/blobs/gc (dry run) and POST /admin/blobs/gc (run now).
+func setupBlobGC(relay *khatru.Relay) {
+	relay.Router().HandleFunc("/admin/blobs/gc", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		var dryRun bool
+		switch r.Method {
+		case "GET":
+			dryRun = true
+		case "POST":
+			dryRun = false
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		report, err := runBlobGC(r.Context(), dryRun)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	}))
+
+	if !config.BlobGC {
+		return
+	}
+	go func() {
+		for {
+			time.Sleep(time.Duration(config.BlobGCIntervalHours) * time.Hour)
+			if _, err := runBlobGC(context.Background(), false); err != nil {
+				slog.Error("Blob GC: sweep failed", "err", err)
+			}
+		}
+	}()
+	slog.Info("Blob GC: ENABLED", "interval_hours", config.BlobGCIntervalHours, "grace_hours", config.BlobGCGraceHours)
+}
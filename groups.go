@@ -0,0 +1,507 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/bitkarrot/higher/keyderivation"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+	"github.com/nbd-wtf/go-nostr/nip29"
+)
+
+// NIP-29 relay-based groups. Members and admins create groups with kind 9007;
+// new groups are private and closed, and start out with the team (the derived
+// roster and the team domain's names) as members. Group admins manage them
+// with the moderation kinds 9000-9009, anyone may ask to join or leave with
+// 9021/9022 (team members are let into closed groups without an invite), and
+// the relay publishes the resulting metadata, admins, members and roles
+// (39000-39003) signed with the key derived at GROUPS_SIGNER_INDEX. Events in
+// a group carry its id in an "h" tag and may only be written by its members;
+// those of private groups are only served to members who authenticated
+// (NIP-42).
+
+const groupAdminRole = "admin"
+
+var groupIDPattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// TeamGroup is the relay's record of one group.
+type TeamGroup struct {
+	ID        string              `json:"id"`
+	Name      string              `json:"name"`
+	About     string              `json:"about,omitempty"`
+	Picture   string              `json:"picture,omitempty"`
+	Private   bool                `json:"private"`
+	Closed    bool                `json:"closed"`
+	Members   map[string][]string `json:"members"` // pubkey -> roles
+	Invites   map[string]bool     `json:"invites,omitempty"`
+	CreatedAt int64               `json:"created_at"`
+}
+
+var (
+	groupsMu    sync.RWMutex
+	groups      = map[string]*TeamGroup{}
+	groupSigner string // pubkey the group metadata is signed with
+)
+
+func (g *TeamGroup) isMember(pubkey string) bool {
+	_, ok := g.Members[pubkey]
+	return ok
+}
+
+func (g *TeamGroup) isAdmin(pubkey string) bool {
+	return slices.Contains(g.Members[pubkey], groupAdminRole)
+}
+
+// nip29 converts the record for go-nostr's event builders.
+func (g *TeamGroup) nip29() nip29.Group {
+	admin := &nip29.Role{Name: groupAdminRole, Description: "Manages members, metadata and content"}
+	ng := nip29.Group{
+		Address: nip29.GroupAddress{Relay: relayHTTPURL(), ID: g.ID},
+		Name:    g.Name,
+		About:   g.About,
+		Picture: g.Picture,
+		Private: g.Private,
+		Closed:  g.Closed,
+		Members: make(map[string][]*nip29.Role, len(g.Members)),
+		Roles:   []*nip29.Role{admin},
+	}
+	for pubkey, roles := range g.Members {
+		for _, role := range roles {
+			ng.Members[pubkey] = append(ng.Members[pubkey], ng.GetRoleByName(role))
+		}
+		if _, ok := ng.Members[pubkey]; !ok {
+			ng.Members[pubkey] = nil
+		}
+	}
+	return ng
+}
+
+// groupOf returns the group an event or filter value refers to, nil if unknown.
+func groupOf(id string) *TeamGroup {
+	groupsMu.RLock()
+	defer groupsMu.RUnlock()
+	return groups[id]
+}
+
+func groupTag(evt *nostr.Event) string {
+	if h := evt.Tags.GetFirst([]string{"h", ""}); h != nil {
+		return (*h)[1]
+	}
+	return ""
+}
+
+func isGroupModerationKind(kind int) bool {
+	return kind >= 9000 && kind <= 9030
+}
+
+func isGroupMetadataKind(kind int) bool {
+	return kind >= nostr.KindSimpleGroupMetadata && kind <= nostr.KindSimpleGroupRoles
+}
+
+// isGroupEvent reports whether event belongs to a group hosted here. Group
+// members need not be on the team, so these bypass the team check once
+// rejectGroupEvent has let them through.
+func isGroupEvent(event *nostr.Event) bool {
+	if !config.GroupsEnabled {
+		return false
+	}
+	id := groupTag(event)
+	return id != "" && (groupOf(id) != nil || event.Kind == nostr.KindSimpleGroupCreateGroup)
+}
+
+func persistGroups(ctx context.Context) {
+	groupsMu.RLock()
+	defer groupsMu.RUnlock()
+	if err := saveState(ctx, "groups", groups); err != nil {
+		slog.Error("Groups: failed to persist groups", "err", err)
+	}
+}
+
+// rejectGroupEvent enforces who may write what to which group.
+func rejectGroupEvent(ctx context.Context, event *nostr.Event) (bool, string) {
+	if isGroupMetadataKind(event.Kind) {
+		return true, "blocked: group metadata is published by the relay"
+	}
+	id := groupTag(event)
+	if id == "" {
+		if isGroupModerationKind(event.Kind) {
+			return true, "invalid: missing h tag"
+		}
+		return false, ""
+	}
+
+	if event.Kind == nostr.KindSimpleGroupCreateGroup {
+		if !groupIDPattern.MatchString(id) {
+			return true, "invalid: group ids are 1-64 letters, digits, - or _"
+		}
+		if groupOf(id) != nil {
+			return true, "duplicate: group already exists"
+		}
+		if !isMember(event.PubKey) && !isAdmin(event.PubKey) {
+			return true, "restricted: only team members can create groups"
+		}
+		return false, ""
+	}
+
+	g := groupOf(id)
+	if g == nil {
+		return true, "invalid: unknown group"
+	}
+
+	groupsMu.RLock()
+	defer groupsMu.RUnlock()
+	switch event.Kind {
+	case nostr.KindSimpleGroupJoinRequest:
+		if g.isMember(event.PubKey) {
+			return true, "duplicate: already a member"
+		}
+		if g.Closed && !isMember(event.PubKey) {
+			code := event.Tags.GetFirst([]string{"code", ""})
+			if code == nil || !g.Invites[(*code)[1]] {
+				return true, "restricted: group is closed, ask an admin for an invite"
+			}
+		}
+	case nostr.KindSimpleGroupLeaveRequest:
+		if !g.isMember(event.PubKey) {
+			return true, "invalid: not a member"
+		}
+	case nostr.KindSimpleGroupPutUser, nostr.KindSimpleGroupRemoveUser, nostr.KindSimpleGroupEditMetadata,
+		nostr.KindSimpleGroupDeleteEvent, nostr.KindSimpleGroupDeleteGroup, nostr.KindSimpleGroupCreateInvite:
+		if !g.isAdmin(event.PubKey) && !isAdmin(event.PubKey) {
+			return true, "restricted: only group admins can moderate"
+		}
+	default:
+		if isGroupModerationKind(event.Kind) {
+			return true, fmt.Sprintf("invalid: unsupported group kind %d", event.Kind)
+		}
+		if !g.isMember(event.PubKey) {
+			return true, "restricted: not a member of this group"
+		}
+	}
+	return false, ""
+}
+
+// applyGroupEvent updates the group once a moderation event is stored and
+// republishes its metadata.
+func applyGroupEvent(ctx context.Context, event *nostr.Event) {
+	id := groupTag(event)
+	if id == "" || !isGroupModerationKind(event.Kind) {
+		return
+	}
+	log := eventLogger(ctx, event).With("group", id)
+
+	groupsMu.Lock()
+	g := groups[id]
+	if g == nil && event.Kind != nostr.KindSimpleGroupCreateGroup {
+		groupsMu.Unlock()
+		return
+	}
+	switch event.Kind {
+	case nostr.KindSimpleGroupCreateGroup:
+		if g != nil {
+			groupsMu.Unlock()
+			return
+		}
+		g = &TeamGroup{
+			ID:        id,
+			Name:      id,
+			Private:   true,
+			Closed:    true,
+			Members:   map[string][]string{},
+			Invites:   map[string]bool{},
+			CreatedAt: int64(event.CreatedAt),
+		}
+		for _, pubkey := range memberPubkeys() {
+			g.Members[pubkey] = nil
+		}
+		g.Members[event.PubKey] = []string{groupAdminRole}
+		editGroupMetadata(g, event.Tags)
+		groups[id] = g
+		log.Info("Groups: group created", "members", len(g.Members))
+
+	case nostr.KindSimpleGroupPutUser:
+		for _, tag := range event.Tags {
+			if len(tag) >= 2 && tag[0] == "p" && nostr.IsValid32ByteHex(tag[1]) {
+				g.Members[tag[1]] = append([]string{}, tag[2:]...)
+				log.Info("Groups: member added", "member", tag[1], "roles", tag[2:])
+			}
+		}
+
+	case nostr.KindSimpleGroupRemoveUser:
+		for _, tag := range event.Tags {
+			if len(tag) >= 2 && tag[0] == "p" {
+				delete(g.Members, tag[1])
+				log.Info("Groups: member removed", "member", tag[1])
+			}
+		}
+
+	case nostr.KindSimpleGroupEditMetadata:
+		editGroupMetadata(g, event.Tags)
+
+	case nostr.KindSimpleGroupCreateInvite:
+		for _, tag := range event.Tags {
+			if len(tag) >= 2 && tag[0] == "code" && tag[1] != "" {
+				g.Invites[tag[1]] = true
+			}
+		}
+
+	case nostr.KindSimpleGroupJoinRequest:
+		g.Members[event.PubKey] = nil
+		log.Info("Groups: member joined")
+
+	case nostr.KindSimpleGroupLeaveRequest:
+		delete(g.Members, event.PubKey)
+		log.Info("Groups: member left")
+
+	case nostr.KindSimpleGroupDeleteGroup:
+		delete(groups, id)
+		groupsMu.Unlock()
+		persistGroups(ctx)
+		deleteGroupMetadata(ctx, id)
+		log.Info("Groups: group deleted")
+		return
+
+	case nostr.KindSimpleGroupDeleteEvent:
+		groupsMu.Unlock()
+		deleteGroupEvents(ctx, id, event)
+		return
+	}
+	groupsMu.Unlock()
+
+	persistGroups(ctx)
+	if err := publishGroupMetadata(ctx, id); err != nil {
+		log.Error("Groups: failed to publish metadata", "err", err)
+	}
+}
+
+// editGroupMetadata applies the name, about, picture and status tags of a
+// 9002 (or 9007) event.
+func editGroupMetadata(g *TeamGroup, tags nostr.Tags) {
+	for _, tag := range tags {
+		if len(tag) == 0 {
+			continue
+		}
+		switch {
+		case len(tag) >= 2 && tag[0] == "name":
+			g.Name = tag[1]
+		case len(tag) >= 2 && tag[0] == "about":
+			g.About = tag[1]
+		case len(tag) >= 2 && tag[0] == "picture":
+			g.Picture = tag[1]
+		case tag[0] == "private":
+			g.Private = true
+		case tag[0] == "public":
+			g.Private = false
+		case tag[0] == "closed":
+			g.Closed = true
+		case tag[0] == "open":
+			g.Closed = false
+		}
+	}
+}
+
+// deleteGroupEvents removes the events a 9005 names, as long as they were
+// posted to the same group.
+func deleteGroupEvents(ctx context.Context, id string, event *nostr.Event) {
+	var ids []string
+	for _, tag := range event.Tags {
+		if len(tag) >= 2 && tag[0] == "e" {
+			ids = append(ids, tag[1])
+		}
+	}
+	if len(ids) == 0 {
+		return
+	}
+	ch, err := db.QueryEvents(ctx, nostr.Filter{IDs: ids, Tags: nostr.TagMap{"h": []string{id}}})
+	if err != nil {
+		eventLogger(ctx, event).Error("Groups: failed to look up events to delete", "err", err)
+		return
+	}
+	var targets []*nostr.Event
+	for evt := range ch {
+		targets = append(targets, evt)
+	}
+	for _, evt := range targets {
+		if err := db.DeleteEvent(ctx, evt); err != nil {
+			eventLogger(ctx, evt).Error("Groups: failed to delete event", "err", err)
+		}
+	}
+	eventLogger(ctx, event).Info("Groups: events deleted", "group", id, "count", len(targets))
+}
+
+// publishGroupMetadata stores and broadcasts the relay-signed 39000-39003
+// events describing a group.
+func publishGroupMetadata(ctx context.Context, id string) error {
+	groupsMu.RLock()
+	g := groups[id]
+	if g == nil {
+		groupsMu.RUnlock()
+		return nil
+	}
+	ng := g.nip29()
+	groupsMu.RUnlock()
+
+	now := nostr.Now()
+	for _, evt := range []*nostr.Event{ng.ToMetadataEvent(), ng.ToAdminsEvent(), ng.ToMembersEvent(), ng.ToRolesEvent()} {
+		evt.CreatedAt = now
+		if err := deriver.SignEvent(uint32(config.GroupsSignerIndex), evt); err != nil {
+			return err
+		}
+		if err := db.ReplaceEvent(ctx, evt); err != nil {
+			return err
+		}
+		relay.BroadcastEvent(evt)
+	}
+	return nil
+}
+
+func deleteGroupMetadata(ctx context.Context, id string) {
+	ch, err := db.QueryEvents(ctx, nostr.Filter{
+		Kinds:   []int{nostr.KindSimpleGroupMetadata, nostr.KindSimpleGroupAdmins, nostr.KindSimpleGroupMembers, nostr.KindSimpleGroupRoles},
+		Authors: []string{groupSigner},
+		Tags:    nostr.TagMap{"d": []string{id}},
+	})
+	if err != nil {
+		slog.Error("Groups: failed to look up metadata", "group", id, "err", err)
+		return
+	}
+	var stale []*nostr.Event
+	for evt := range ch {
+		stale = append(stale, evt)
+	}
+	for _, evt := range stale {
+		db.DeleteEvent(ctx, evt)
+	}
+}
+
+// removeFromGroups drops former team members from every group.
+func removeFromGroups(ctx context.Context, pubkeys []string) {
+	if !config.GroupsEnabled {
+		return
+	}
+	var changed []string
+	groupsMu.Lock()
+	for id, g := range groups {
+		for _, pubkey := range pubkeys {
+			if g.isMember(pubkey) {
+				delete(g.Members, pubkey)
+				changed = append(changed, id)
+			}
+		}
+	}
+	groupsMu.Unlock()
+	if len(changed) == 0 {
+		return
+	}
+	persistGroups(ctx)
+	for _, id := range slices.Compact(changed) {
+		if err := publishGroupMetadata(ctx, id); err != nil {
+			slog.Error("Groups: failed to publish metadata", "group", id, "err", err)
+		}
+	}
+}
+
+// canReadGroupEvent hides the events of private groups from everyone but
+// their authenticated members. Internal queries have no connection and see
+// everything.
+func canReadGroupEvent(ctx context.Context, evt *nostr.Event) bool {
+	if !config.GroupsEnabled || khatru.GetConnection(ctx) == nil {
+		return true
+	}
+	id := groupTag(evt)
+	if id == "" {
+		return true
+	}
+	groupsMu.RLock()
+	defer groupsMu.RUnlock()
+	g := groups[id]
+	if g == nil || !g.Private {
+		return true
+	}
+	authed := khatru.GetAuthed(ctx)
+	return g.isMember(authed) || isAdmin(authed)
+}
+
+// rejectPrivateGroupFilter asks for authentication when a filter targets a
+// private group, so clients know why they get nothing back.
+func rejectPrivateGroupFilter(ctx context.Context, filter nostr.Filter) (bool, string) {
+	authed := khatru.GetAuthed(ctx)
+	for _, id := range filter.Tags["h"] {
+		g := groupOf(id)
+		if g == nil || !g.Private {
+			continue
+		}
+		if authed == "" {
+			khatru.RequestAuth(ctx)
+			return true, "auth-required: this group is private"
+		}
+		groupsMu.RLock()
+		member := g.isMember(authed)
+		groupsMu.RUnlock()
+		if !member && !isAdmin(authed) {
+			return true, "restricted: not a member of this group"
+		}
+	}
+	return false, ""
+}
+
+// setupGroups loads the groups and installs the NIP-29 hooks.
+func setupGroups(relay *khatru.Relay) error {
+	pubkey, err := deriver.DerivePublicKey(uint32(config.GroupsSignerIndex))
+	if err != nil {
+		return err
+	}
+	if deriver.IsWatchOnly() {
+		return keyderivation.ErrWatchOnly
+	}
+	groupSigner = pubkey
+
+	var stored map[string]*TeamGroup
+	if ok, err := loadState(context.Background(), "groups", &stored); err != nil {
+		return fmt.Errorf("failed to load groups: %w", err)
+	} else if ok {
+		groupsMu.Lock()
+		for id, g := range stored {
+			if g.Members == nil {
+				g.Members = map[string][]string{}
+			}
+			if g.Invites == nil {
+				g.Invites = map[string]bool{}
+			}
+			groups[id] = g
+		}
+		groupsMu.Unlock()
+	}
+
+	relay.RejectEvent = append(relay.RejectEvent, rejectGroupEvent)
+	relay.OnEventSaved = append(relay.OnEventSaved, applyGroupEvent)
+	relay.RejectFilter = append(relay.RejectFilter, rejectPrivateGroupFilter)
+
+	// republish so the metadata is signed by the current GROUPS_SIGNER_INDEX
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		groupsMu.RLock()
+		ids := make([]string, 0, len(groups))
+		for id := range groups {
+			ids = append(ids, id)
+		}
+		groupsMu.RUnlock()
+		for _, id := range ids {
+			if err := publishGroupMetadata(ctx, id); err != nil {
+				slog.Error("Groups: failed to publish metadata", "group", id, "err", err)
+			}
+		}
+	}()
+
+	npub, _ := nip19.EncodePublicKey(groupSigner)
+	slog.Info("Groups: NIP-29 ENABLED", "groups", len(groups), "signer", npub)
+	return nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"log/slog"
+	"slices"
+	"sync"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Hot event cache: the results of the filters team clients repeat on every
+// timeline refresh, the latest N events of some kinds and/or authors, kept in
+// memory so each client doesn't hit the database for the same answer. The
+// HOT_CACHE_SIZE most recently used filters are kept, those with a limit of
+// at most HOT_CACHE_MAX_LIMIT and no tags, ids, search or time bounds. Every
+// write or delete drops the cached results it could change, whichever code
+// path it comes from, since the cache wraps db itself.
+
+// hotCacheEntry is the stored result of one filter.
+type hotCacheEntry struct {
+	key    string
+	filter nostr.Filter
+	events []*nostr.Event
+}
+
+// cachedDB answers cacheable queries from memory.
+type cachedDB struct {
+	DBBackend
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // of *hotCacheEntry, most recently used first
+	// bumped by every write, so a query racing one isn't cached
+	generation uint64
+}
+
+// hotCacheKey returns the canonical key of filter, or "" when its results
+// are not cached.
+func hotCacheKey(ctx context.Context, filter nostr.Filter) string {
+	if len(filter.IDs) > 0 || len(filter.Tags) > 0 || filter.Search != "" || filter.Since != nil || filter.Until != nil {
+		return ""
+	}
+	if len(filter.Kinds) == 0 && len(filter.Authors) == 0 {
+		return ""
+	}
+	if filter.LimitZero || filter.Limit <= 0 || filter.Limit > config.HotCacheMaxLimit || eventstore.IsNegentropySession(ctx) {
+		return ""
+	}
+	filter.Kinds = slices.Sorted(slices.Values(filter.Kinds))
+	filter.Authors = slices.Sorted(slices.Values(filter.Authors))
+	return filter.String()
+}
+
+func (c *cachedDB) QueryEvents(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	key := hotCacheKey(ctx, filter)
+	if key == "" {
+		return c.DBBackend.QueryEvents(ctx, filter)
+	}
+
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(el)
+		events := el.Value.(*hotCacheEntry).events
+		c.mu.Unlock()
+		return sendEvents(ctx, events), nil
+	}
+	generation := c.generation
+	c.mu.Unlock()
+
+	ch, err := c.DBBackend.QueryEvents(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	var events []*nostr.Event
+	for evt := range ch {
+		events = append(events, evt)
+	}
+	if ctx.Err() == nil {
+		c.store(&hotCacheEntry{key: key, filter: filter, events: events}, generation)
+	}
+	return sendEvents(ctx, events), nil
+}
+
+// sendEvents streams copies of events, so callers can't alter the cache.
+func sendEvents(ctx context.Context, events []*nostr.Event) chan *nostr.Event {
+	out := make(chan *nostr.Event)
+	go func() {
+		defer close(out)
+		for _, evt := range events {
+			e := *evt
+			select {
+			case out <- &e:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// store caches entry unless something was written since generation.
+func (c *cachedDB) store(entry *hotCacheEntry, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.generation != generation {
+		return
+	}
+	if el, ok := c.entries[entry.key]; ok {
+		el.Value = entry
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	for c.lru.Len() > config.HotCacheSize {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*hotCacheEntry).key)
+	}
+}
+
+// invalidate drops the cached results evt belongs or belonged to.
+func (c *cachedDB) invalidate(evt *nostr.Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	for key, el := range c.entries {
+		if el.Value.(*hotCacheEntry).filter.Matches(evt) {
+			c.lru.Remove(el)
+			delete(c.entries, key)
+		}
+	}
+}
+
+func (c *cachedDB) SaveEvent(ctx context.Context, evt *nostr.Event) error {
+	err := c.DBBackend.SaveEvent(ctx, evt)
+	c.invalidate(evt)
+	return err
+}
+
+// ReplaceEvent drops the results holding the older version too, as they
+// match the same kind and author.
+func (c *cachedDB) ReplaceEvent(ctx context.Context, evt *nostr.Event) error {
+	err := c.DBBackend.ReplaceEvent(ctx, evt)
+	c.invalidate(evt)
+	return err
+}
+
+func (c *cachedDB) DeleteEvent(ctx context.Context, evt *nostr.Event) error {
+	err := c.DBBackend.DeleteEvent(ctx, evt)
+	c.invalidate(evt)
+	return err
+}
+
+// setupHotCache wraps db with the cache. It must run before db is hooked into
+// the relay.
+func setupHotCache() {
+	db = &cachedDB{DBBackend: db, entries: map[string]*list.Element{}, lru: list.New()}
+	slog.Info("Hot event cache: ENABLED", "size", config.HotCacheSize, "max_limit", config.HotCacheMaxLimit)
+}
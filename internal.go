@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"strings"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// The relay keeps its own bookkeeping (state, tombstones, ...) as unsigned
+// events in the event store, the same way the blossom index does. They use
+// kinds from the ephemeral range, which khatru never stores on behalf of
+// clients, so they cannot be injected over the websocket, and they are
+// filtered out of every client query.
+const (
+	kindRelayState   = 29990
+	kindTombstone    = 29991
+	kindForwardQueue = 29992
+	kindThumbnails   = 29993
+	// 29994 is kindFederationRoster, sent between peers and never stored
+)
+
+var internalPubkey = strings.Repeat("0", 64)
+
+func isInternalKind(kind int) bool {
+	return kind >= 29990 && kind <= 29999
+}
+
+// kindBlobIndex is blossom's upload index, one record per uploader and blob.
+// It is only served through /list, which checks who is asking.
+const kindBlobIndex = 24242
+
+// isPrivateKind reports whether events of kind are kept out of client
+// queries and counts.
+func isPrivateKind(kind int) bool {
+	return isInternalKind(kind) || kind == kindBlobIndex
+}
+
+// queryEvents serves client queries, hiding internal bookkeeping events and
+// the blob index, expired events not swept yet and events of former members
+// hidden by a cleanup.
+func queryEvents(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	ctx, span := tracer.Start(ctx, "relay.query", filterAttributes(filter))
+	ch, err := db.QueryEvents(ctx, filter)
+	if err != nil {
+		endSpan(span, err)
+		return nil, err
+	}
+
+	out := make(chan *nostr.Event)
+	go func() {
+		defer close(out)
+		defer span.End()
+		forward(ctx, ch, out, func(evt *nostr.Event) bool {
+			return !isPrivateKind(evt.Kind) && !isExpired(evt) && !isHiddenPubkey(evt.PubKey) && canReadGroupEvent(ctx, evt) && canReadGiftWrap(ctx, evt)
+		})
+	}()
+	return out, nil
+}
+
+// forward passes the events of ch that keep accepts (all when keep is nil) to
+// out until ctx is done, returning how many it sent. It then drains ch: the
+// badger and lmdb backends send inside their read transaction without
+// watching ctx, so leaving ch unread would leak the transaction and stall
+// value log GC.
+func forward(ctx context.Context, ch chan *nostr.Event, out chan<- *nostr.Event, keep func(*nostr.Event) bool) int {
+	defer func() {
+		for range ch {
+		}
+	}()
+	sent := 0
+	for evt := range ch {
+		if keep != nil && !keep(evt) {
+			continue
+		}
+		select {
+		case out <- evt:
+			sent++
+		case <-ctx.Done():
+			return sent
+		}
+	}
+	return sent
+}
+
+// countEvents serves NIP-45 COUNT requests. Like queryEvents it leaves out
+// internal events, the blob index and hidden pubkeys, by subtracting what the
+// same filter matches for them. Expired events still count until swept.
+func countEvents(ctx context.Context, filter nostr.Filter) (int64, error) {
+	if len(filter.Kinds) > 0 {
+		filter.Kinds = slices.DeleteFunc(slices.Clone(filter.Kinds), isPrivateKind)
+		if len(filter.Kinds) == 0 {
+			return 0, nil
+		}
+	}
+	total, err := db.CountEvents(ctx, filter)
+	if err != nil || total == 0 {
+		return total, err
+	}
+
+	excluded := append([]string{internalPubkey}, hiddenPubkeys()...)
+	if len(filter.Authors) > 0 {
+		var requested []string
+		for _, pk := range excluded {
+			for _, a := range filter.Authors {
+				if a == pk {
+					requested = append(requested, pk)
+					break
+				}
+			}
+		}
+		excluded = requested
+	}
+
+	var hidden int64
+	if len(excluded) > 0 {
+		f := filter
+		f.Authors = excluded
+		if hidden, err = db.CountEvents(ctx, f); err != nil {
+			return 0, err
+		}
+	}
+	if len(filter.Kinds) == 0 {
+		// the blob index records of the authors not subtracted already
+		f := filter
+		f.Kinds = []int{kindBlobIndex}
+		blobs, err := db.CountEvents(ctx, f)
+		if err != nil {
+			return 0, err
+		}
+		if blobs > 0 && len(excluded) > 0 {
+			f.Authors = excluded
+			excludedBlobs, err := db.CountEvents(ctx, f)
+			if err != nil {
+				return 0, err
+			}
+			blobs -= excludedBlobs
+		}
+		hidden += blobs
+	}
+	return total - hidden, nil
+}
+
+// saveInternalEvent stores an internal event, computing its ID.
+func saveInternalEvent(ctx context.Context, evt *nostr.Event) error {
+	evt.PubKey = internalPubkey
+	if evt.CreatedAt == 0 {
+		evt.CreatedAt = nostr.Now()
+	}
+	if evt.Tags == nil {
+		evt.Tags = nostr.Tags{}
+	}
+	evt.ID = evt.GetID()
+	return db.SaveEvent(ctx, evt)
+}
+
+// queryInternalEvents returns all internal events of kind matching the given tags.
+func queryInternalEvents(ctx context.Context, kind int, tags nostr.TagMap) ([]*nostr.Event, error) {
+	ch, err := db.QueryEvents(ctx, nostr.Filter{Kinds: []int{kind}, Authors: []string{internalPubkey}, Tags: tags})
+	if err != nil {
+		return nil, err
+	}
+	var events []*nostr.Event
+	for evt := range ch {
+		events = append(events, evt)
+	}
+	return events, nil
+}
+
+// forEachEvent calls fn for every stored event matching filter, newest first.
+// Backends cap how many events one query returns, so it pages by created_at.
+func forEachEvent(ctx context.Context, filter nostr.Filter, fn func(evt *nostr.Event) error) error {
+	const pageSize = 500
+	filter.Limit = pageSize
+	boundary := map[string]bool{} // events at the page boundary, returned again by the next page
+
+	for {
+		ch, err := db.QueryEvents(ctx, filter)
+		if err != nil {
+			return err
+		}
+		var fnErr error
+		var oldest nostr.Timestamp
+		count, fresh := 0, 0
+		nextBoundary := map[string]bool{}
+		for evt := range ch {
+			count++
+			if oldest == 0 || evt.CreatedAt < oldest {
+				oldest = evt.CreatedAt
+				nextBoundary = map[string]bool{}
+			}
+			if evt.CreatedAt == oldest {
+				nextBoundary[evt.ID] = true
+			}
+			if boundary[evt.ID] || fnErr != nil {
+				continue // keep draining so the backend goroutine can finish
+			}
+			fresh++
+			fnErr = fn(evt)
+		}
+		if fnErr != nil {
+			return fnErr
+		}
+		if count < pageSize || fresh == 0 {
+			return nil
+		}
+		until := oldest
+		filter.Until = &until
+		boundary = nextBoundary
+	}
+}
+
+// saveState persists v as JSON under key, replacing any previous value.
+func saveState(ctx context.Context, key string, v any) error {
+	content, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	previous, err := queryInternalEvents(ctx, kindRelayState, nostr.TagMap{"d": []string{key}})
+	if err != nil {
+		return err
+	}
+
+	evt := &nostr.Event{
+		Kind:    kindRelayState,
+		Tags:    nostr.Tags{{"d", key}},
+		Content: string(content),
+	}
+	if err := saveInternalEvent(ctx, evt); err != nil && err != eventstore.ErrDupEvent {
+		return err
+	}
+
+	for _, old := range previous {
+		if old.ID != evt.ID {
+			db.DeleteEvent(ctx, old)
+		}
+	}
+	return nil
+}
+
+// loadState reads the JSON value stored under key into v.
+// It reports false when nothing has been stored yet.
+func loadState(ctx context.Context, key string, v any) (bool, error) {
+	events, err := queryInternalEvents(ctx, kindRelayState, nostr.TagMap{"d": []string{key}})
+	if err != nil {
+		return false, err
+	}
+	var latest *nostr.Event
+	for _, evt := range events {
+		if latest == nil || evt.CreatedAt > latest.CreatedAt {
+			latest = evt
+		}
+	}
+	if latest == nil {
+		return false, nil
+	}
+	return true, json.Unmarshal([]byte(latest.Content), v)
+}
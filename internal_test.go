@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/fiatjaf/eventstore/slicestore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestClientQueriesHidePrivateKinds(t *testing.T) {
+	saved := db
+	defer func() { db = saved }()
+	store := &slicestore.SliceStore{}
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+	db = store
+
+	alice := strings.Repeat("a", 64)
+	bob := strings.Repeat("b", 64)
+	ctx := context.Background()
+	for i, evt := range []*nostr.Event{
+		{PubKey: alice, Kind: nostr.KindTextNote, Content: "hello"},
+		{PubKey: alice, Kind: kindBlobIndex, Tags: nostr.Tags{{"x", strings.Repeat("1", 64)}}},
+		{PubKey: bob, Kind: kindBlobIndex, Tags: nostr.Tags{{"x", strings.Repeat("2", 64)}}},
+		{PubKey: internalPubkey, Kind: kindRelayState, Tags: nostr.Tags{{"d", "test"}}},
+	} {
+		evt.CreatedAt = nostr.Timestamp(1700000000 + i)
+		evt.ID = evt.GetID()
+		if err := db.SaveEvent(ctx, evt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		name   string
+		filter nostr.Filter
+		kinds  []int // kinds of the events served
+	}{
+		{"blob index of one author", nostr.Filter{Kinds: []int{kindBlobIndex}, Authors: []string{alice}}, nil},
+		{"blob index by hash", nostr.Filter{Kinds: []int{kindBlobIndex}, Tags: nostr.TagMap{"x": []string{strings.Repeat("1", 64)}}}, nil},
+		{"all of an author", nostr.Filter{Authors: []string{alice}}, []int{nostr.KindTextNote}},
+		{"mixed kinds", nostr.Filter{Kinds: []int{nostr.KindTextNote, kindBlobIndex}}, []int{nostr.KindTextNote}},
+		{"everything", nostr.Filter{}, []int{nostr.KindTextNote}},
+		{"internal state", nostr.Filter{Kinds: []int{kindRelayState}}, nil},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ch, err := queryEvents(ctx, tc.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var kinds []int
+			for evt := range ch {
+				kinds = append(kinds, evt.Kind)
+			}
+			if !slices.Equal(kinds, tc.kinds) {
+				t.Errorf("queryEvents served kinds %v, want %v", kinds, tc.kinds)
+			}
+
+			count, err := countEvents(ctx, tc.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != int64(len(tc.kinds)) {
+				t.Errorf("countEvents = %d, want %d", count, len(tc.kinds))
+			}
+		})
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+)
+
+// Connection guarding by client IP, applied before anything else sees a
+// request. Banned IPs and ranges get a 403 on every request; websocket
+// upgrades are further limited to MAX_CONNECTIONS_PER_IP open connections and
+// CONNECTION_RATE_LIMIT new connections per minute. The ban list is persisted
+// and managed at /admin/ipbans; BANNED_IPS entries are merged in at startup.
+
+// IPBan is one entry of the IP ban list, a single address or a CIDR range.
+type IPBan struct {
+	Range    string `json:"range"`
+	Reason   string `json:"reason,omitempty"`
+	BannedBy string `json:"banned_by,omitempty"` // empty for BANNED_IPS
+	BannedAt int64  `json:"banned_at"`
+
+	ipnet *net.IPNet
+}
+
+var (
+	ipBansMu sync.RWMutex
+	ipBans   = map[string]IPBan{}
+
+	connMu        sync.Mutex
+	openConns     = map[string]int{}
+	connWindows   = map[string]*connWindow{}
+	connWindowTTL = time.Minute
+)
+
+// connWindow counts the connections an IP opened in the current minute.
+type connWindow struct {
+	start time.Time
+	count int
+}
+
+// parseIPRange turns an IP or CIDR into a network, single addresses becoming
+// /32 or /128.
+func parseIPRange(entry string) (*net.IPNet, error) {
+	entry = strings.TrimSpace(entry)
+	if !strings.Contains(entry, "/") {
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP %q", entry)
+		}
+		bits := 32
+		if ip.To4() == nil {
+			bits = 128
+		}
+		entry = fmt.Sprintf("%s/%d", ip.String(), bits)
+	}
+	_, ipnet, err := net.ParseCIDR(entry)
+	if err != nil {
+		return nil, fmt.Errorf("invalid IP range %q", entry)
+	}
+	return ipnet, nil
+}
+
+func isIPBanned(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false // unix socket peers
+	}
+	ipBansMu.RLock()
+	defer ipBansMu.RUnlock()
+	for _, b := range ipBans {
+		if b.ipnet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+func persistIPBans(ctx context.Context) {
+	ipBansMu.RLock()
+	defer ipBansMu.RUnlock()
+	if err := saveState(ctx, "ip_bans", ipBans); err != nil {
+		slog.Error("IP bans: failed to persist ban list", "err", err)
+	}
+}
+
+// banIPRange adds an address or range to the ban list, returning the
+// normalized range it was stored under.
+func banIPRange(ctx context.Context, entry, reason, by string) (string, error) {
+	ipnet, err := parseIPRange(entry)
+	if err != nil {
+		return "", err
+	}
+	key := ipnet.String()
+	ipBansMu.Lock()
+	ipBans[key] = IPBan{Range: key, Reason: reason, BannedBy: by, BannedAt: time.Now().Unix(), ipnet: ipnet}
+	ipBansMu.Unlock()
+	persistIPBans(ctx)
+	return key, nil
+}
+
+// rejectBannedIPs answers every request from a banned IP with a 403. It must
+// run after trustProxies so the real client address is known.
+func rejectBannedIPs(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isIPBanned(clientIP(r)) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rejectConnection enforces the per-IP connection cap and rate limit on
+// websocket upgrades.
+func rejectConnection(r *http.Request) bool {
+	ip := clientIP(r)
+	if net.ParseIP(ip) == nil {
+		return false
+	}
+
+	connMu.Lock()
+	defer connMu.Unlock()
+
+	if config.MaxConnectionsPerIP > 0 && openConns[ip] >= config.MaxConnectionsPerIP {
+		slog.Warn("IP guard: connection refused, too many open", "ip", ip, "open", openConns[ip])
+		return true
+	}
+
+	if config.ConnectionRateLimit > 0 {
+		now := time.Now()
+		win := connWindows[ip]
+		if win == nil || now.Sub(win.start) >= connWindowTTL {
+			win = &connWindow{start: now}
+			connWindows[ip] = win
+		}
+		if win.count >= config.ConnectionRateLimit {
+			slog.Warn("IP guard: connection refused, rate limited", "ip", ip, "per_minute", config.ConnectionRateLimit)
+			return true
+		}
+		win.count++
+	}
+	return false
+}
+
+func trackConnection(ctx context.Context, delta int) {
+	conn := khatru.GetConnection(ctx)
+	if conn == nil {
+		return
+	}
+	ip := clientIP(conn.Request)
+
+	connMu.Lock()
+	defer connMu.Unlock()
+	openConns[ip] += delta
+	if openConns[ip] <= 0 {
+		delete(openConns, ip)
+	}
+}
+
+// pruneConnWindows drops rate windows that have expired so the map does not
+// grow with every address ever seen.
+func pruneConnWindows() {
+	for range time.Tick(connWindowTTL) {
+		now := time.Now()
+		connMu.Lock()
+		for ip, win := range connWindows {
+			if now.Sub(win.start) >= connWindowTTL {
+				delete(connWindows, ip)
+			}
+		}
+		connMu.Unlock()
+	}
+}
+
+// setupIPGuard loads the IP ban list, merges BANNED_IPS into it, installs the
+// connection limits and serves the admin API:
+//
+//	GET    /admin/ipbans            ban list
+//	POST   /admin/ipbans            {"ip": "203.0.113.7 or 203.0.113.0/24", "reason": "..."}
+//	DELETE /admin/ipbans/{ip or cidr}
+func setupIPGuard(relay *khatru.Relay) {
+	var stored map[string]IPBan
+	if ok, err := loadState(context.Background(), "ip_bans", &stored); err != nil {
+		slog.Error("IP bans: failed to load ban list", "err", err)
+	} else if ok {
+		ipBansMu.Lock()
+		for key, b := range stored {
+			ipnet, err := parseIPRange(b.Range)
+			if err != nil {
+				slog.Warn("IP bans: dropping stored entry", "err", err)
+				continue
+			}
+			b.ipnet = ipnet
+			ipBans[key] = b
+		}
+		ipBansMu.Unlock()
+	}
+
+	for _, entry := range config.BannedIPs {
+		ipnet, _ := parseIPRange(entry) // validated in LoadConfig
+		ipBansMu.RLock()
+		_, exists := ipBans[ipnet.String()]
+		ipBansMu.RUnlock()
+		if !exists {
+			banIPRange(context.Background(), entry, "BANNED_IPS", "")
+		}
+	}
+
+	if config.MaxConnectionsPerIP > 0 || config.ConnectionRateLimit > 0 {
+		relay.RejectConnection = append(relay.RejectConnection, rejectConnection)
+		relay.OnConnect = append(relay.OnConnect, func(ctx context.Context) { trackConnection(ctx, 1) })
+		relay.OnDisconnect = append(relay.OnDisconnect, func(ctx context.Context) { trackConnection(ctx, -1) })
+		go pruneConnWindows()
+	}
+
+	relay.Router().HandleFunc("/admin/ipbans", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			ipBansMu.RLock()
+			list := make([]IPBan, 0, len(ipBans))
+			for _, b := range ipBans {
+				list = append(list, b)
+			}
+			ipBansMu.RUnlock()
+			sort.Slice(list, func(i, j int) bool { return list[i].BannedAt > list[j].BannedAt })
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(list)
+
+		case "POST":
+			var req struct {
+				IP     string `json:"ip"`
+				Reason string `json:"reason"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid JSON", http.StatusBadRequest)
+				return
+			}
+			if ipnet, err := parseIPRange(req.IP); err == nil && ipnet.Contains(net.ParseIP(clientIP(r))) {
+				http.Error(w, "Refusing to ban your own address", http.StatusBadRequest)
+				return
+			}
+			auth, _ := readHTTPAuth(r)
+			key, err := banIPRange(r.Context(), req.IP, strings.TrimSpace(req.Reason), auth.PubKey)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			logger(r.Context()).Info("IP bans: range banned", "range", key, "by", auth.PubKey)
+			w.WriteHeader(http.StatusCreated)
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}))
+
+	relay.Router().HandleFunc("/admin/ipbans/", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "DELETE" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ipnet, err := parseIPRange(strings.TrimPrefix(r.URL.Path, "/admin/ipbans/"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		key := ipnet.String()
+		ipBansMu.Lock()
+		_, ok := ipBans[key]
+		delete(ipBans, key)
+		ipBansMu.Unlock()
+		if !ok {
+			http.Error(w, "Range is not banned", http.StatusNotFound)
+			return
+		}
+		persistIPBans(r.Context())
+		logger(r.Context()).Info("IP bans: range unbanned", "range", key)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+}
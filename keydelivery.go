@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip17"
+	"github.com/nbd-wtf/go-nostr/nip44"
+	"github.com/nbd-wtf/go-nostr/nip59"
+)
+
+// Gift-wrapped key delivery, the alternative to claim links: POST
+// /admin/provision with "deliver_to" sends the member's nsec as a NIP-17
+// direct message, gift wrapped (NIP-59), to a pubkey they already control, so
+// the key never travels over HTTP. The message comes from the key derived at
+// KEY_DELIVERY_SENDER_INDEX and goes to KEY_DELIVERY_RELAYS and to the
+// recipient's DM relays (kind 10050) published there. The index counts as
+// claimed once a relay has accepted the wrap.
+
+const keyDeliveryPublishTimeout = 15 * time.Second
+
+// keyGiftWrap returns the gift wrap carrying the key of index to recipient.
+func keyGiftWrap(index uint32, recipient string) (nostr.Event, error) {
+	senderIndex := uint32(config.KeyDeliverySenderIndex)
+	sender, err := deriver.DerivePublicKey(senderIndex)
+	if err != nil {
+		return nostr.Event{}, err
+	}
+	kp, err := deriver.DeriveKeyBIP32(index)
+	if err != nil {
+		return nostr.Event{}, err
+	}
+	shared, err := deriver.SharedSecret(senderIndex, recipient)
+	if err != nil {
+		return nostr.Event{}, err
+	}
+	ck, err := conversationKey(shared)
+	if err != nil {
+		return nostr.Event{}, err
+	}
+
+	rumor := nostr.Event{
+		PubKey:    sender,
+		CreatedAt: nostr.Now(),
+		Kind:      nostr.KindDirectMessage,
+		Tags:      nostr.Tags{{"p", recipient}},
+		Content: fmt.Sprintf("Your key for %s (%s):\n\n%s\n\nImport it into your Nostr client, then delete this message.",
+			config.RelayName, kp.PublicKeyNIP, kp.PrivateKeyNIP),
+	}
+	rumor.ID = rumor.GetID()
+
+	return nip59.GiftWrap(rumor, recipient,
+		func(plaintext string) (string, error) { return nip44.Encrypt(plaintext, ck) },
+		func(seal *nostr.Event) error { return deriver.SignEvent(senderIndex, seal) },
+		nil,
+	)
+}
+
+// deliverKey gift wraps the key of index to recipient and publishes it,
+// returning the relays that accepted it.
+func deliverKey(ctx context.Context, index uint32, recipient string) ([]string, error) {
+	wrap, err := keyGiftWrap(index, recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, keyDeliveryPublishTimeout)
+	defer cancel()
+	pool := nostr.NewSimplePool(ctx)
+	var relays []string
+	add := func(urls []string) {
+		for _, url := range urls {
+			if url = nostr.NormalizeURL(url); url != "" && !slices.Contains(relays, url) {
+				relays = append(relays, url)
+			}
+		}
+	}
+	add(config.KeyDeliveryRelays)
+	add(nip17.GetDMRelays(ctx, recipient, pool, relays))
+
+	var accepted []string
+	for result := range pool.PublishMany(ctx, relays, wrap) {
+		if result.Error != nil {
+			slog.Warn("Key delivery: relay refused the gift wrap", "relay", result.RelayURL, "err", result.Error)
+			continue
+		}
+		accepted = append(accepted, result.RelayURL)
+	}
+	if len(accepted) == 0 {
+		return nil, fmt.Errorf("no relay accepted the gift wrap (tried %d)", len(relays))
+	}
+	return accepted, nil
+}
@@ -0,0 +1,115 @@
+package keyderivation
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+)
+
+// keyCache memoizes derivation for a deriver shared by concurrent handlers.
+// The levels before {index} are the same for every key, so their extended key
+// (the account key for the default scheme) is derived once; each child key is
+// kept once derived. Changing the scheme clears the cache.
+type keyCache struct {
+	mu       sync.RWMutex
+	scheme   DerivationScheme
+	account  *hdkeychain.ExtendedKey            // key at the levels before {index}
+	children map[uint32]*hdkeychain.ExtendedKey // key at the full path, by index
+	wiped    bool
+}
+
+// childKey returns the extended key at index for the current scheme.
+func (nkd *NostrKeyDeriver) childKey(index uint32) (*hdkeychain.ExtendedKey, error) {
+	c := &nkd.cache
+	c.mu.RLock()
+	key, ok := c.children[index]
+	c.mu.RUnlock()
+	if ok {
+		return key, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if key, ok := c.children[index]; ok {
+		return key, nil
+	}
+	if c.wiped {
+		return nil, ErrWiped
+	}
+	scheme := c.scheme
+	if scheme.IsZero() {
+		scheme = SchemeIndex
+	}
+	path, err := scheme.path(index)
+	if err != nil {
+		return nil, err
+	}
+	if c.account == nil {
+		account, err := nkd.accountKey(scheme, path)
+		if err != nil {
+			return nil, err
+		}
+		if err := primePubKey(account); err != nil {
+			return nil, err
+		}
+		c.account = account
+	}
+
+	key = c.account
+	for _, child := range path[scheme.indexAt:] {
+		if key, err = key.Derive(child); err != nil {
+			return nil, fmt.Errorf("failed to derive child key at index %d: %v", index, err)
+		}
+	}
+	if err := primePubKey(key); err != nil {
+		return nil, err
+	}
+	if c.children == nil {
+		c.children = make(map[uint32]*hdkeychain.ExtendedKey)
+	}
+	c.children[index] = key
+	return key, nil
+}
+
+// accountKey derives the levels of path before the index from the master, or
+// from the xpub on a watch-only deriver.
+func (nkd *NostrKeyDeriver) accountKey(scheme DerivationScheme, path []uint32) (*hdkeychain.ExtendedKey, error) {
+	start := 0
+	if nkd.watchOnly {
+		if !scheme.publicIndex() {
+			return nil, fmt.Errorf("derivation path %s has a hardened index, which an xpub cannot derive", scheme)
+		}
+		start = int(nkd.masterKey.Depth())
+		if start != scheme.publicDepth() {
+			return nil, fmt.Errorf("xpub at depth %d does not match derivation path %s", start, scheme)
+		}
+	}
+
+	key := nkd.masterKey
+	var err error
+	for _, child := range path[start:scheme.indexAt] {
+		if key, err = key.Derive(child); err != nil {
+			return nil, fmt.Errorf("failed to derive account key: %v", err)
+		}
+	}
+	return key, nil
+}
+
+// reset switches the cache to scheme and drops everything derived so far.
+func (c *keyCache) reset(scheme DerivationScheme) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.scheme = scheme
+	c.account = nil
+	c.children = nil
+}
+
+// primePubKey computes the public key an ExtendedKey otherwise fills in lazily
+// on first use, so cached keys are only read once shared.
+func primePubKey(key *hdkeychain.ExtendedKey) error {
+	if _, err := key.ECPubKey(); err != nil {
+		return fmt.Errorf("failed to get EC public key: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package keyderivation
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+)
+
+// SharedSecret returns the ECDH shared secret (the x coordinate, as NIP-04 and
+// NIP-44 use it) between the key at index and a hex pubkey, without exposing
+// the private key.
+func (nkd *NostrKeyDeriver) SharedSecret(index uint32, pubkey string) ([]byte, error) {
+	if nkd.watchOnly {
+		return nil, ErrWatchOnly
+	}
+	pubKeyBytes, err := hex.DecodeString("02" + pubkey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pubkey %q: %v", pubkey, err)
+	}
+	pubKey, err := btcec.ParsePubKey(pubKeyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pubkey %q: %v", pubkey, err)
+	}
+
+	key, err := nkd.childKey(index)
+	if err != nil {
+		return nil, err
+	}
+	privKey, err := key.ECPrivKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get EC private key: %v", err)
+	}
+	defer privKey.Zero()
+	return btcec.GenerateSharedSecret(privKey, pubKey), nil
+}
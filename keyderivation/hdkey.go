@@ -27,60 +27,73 @@ type NostrKeyPair struct {
 // GetMasterKeyPair returns the master key (root) as a NostrKeyPair
 // This is the raw master private/public key derived from the BIP32 master extended key.
 func (nkd *NostrKeyDeriver) GetMasterKeyPair() (*NostrKeyPair, error) {
-    // Obtain EC private key from master extended key
-    privKey, err := nkd.masterKey.ECPrivKey()
-    if err != nil {
-        return nil, fmt.Errorf("failed to get master EC private key: %v", err)
-    }
-
-    // Serialize private key bytes
-    privKeyBytes := privKey.Serialize()
-    // Nostr expects 32-byte x-only pubkey; use compressed pubkey and drop prefix byte
-    pubKeyBytes := privKey.PubKey().SerializeCompressed()[1:]
-
-    // Hex encodings
-    privKeyHex := hex.EncodeToString(privKeyBytes)
-    pubKeyHex := hex.EncodeToString(pubKeyBytes)
-
-    // NIP-19 encodings
-    privKeyNIP, err := nip19.EncodePrivateKey(privKeyHex)
-    if err != nil {
-        return nil, fmt.Errorf("failed to encode master private key to NIP-19: %v", err)
-    }
-    pubKeyNIP, err := nip19.EncodePublicKey(pubKeyHex)
-    if err != nil {
-        return nil, fmt.Errorf("failed to encode master public key to NIP-19: %v", err)
-    }
-
-    return &NostrKeyPair{
-        PrivateKey:    privKeyHex,
-        PublicKey:     pubKeyHex,
-        PrivateKeyNIP: privKeyNIP,
-        PublicKeyNIP:  pubKeyNIP,
-        Index:         0,
-    }, nil
+	if nkd.isWiped() {
+		return nil, ErrWiped
+	}
+
+	// Obtain EC private key from master extended key
+	privKey, err := nkd.masterKey.ECPrivKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get master EC private key: %v", err)
+	}
+
+	// Serialize private key bytes
+	privKeyBytes := privKey.Serialize()
+	// Nostr expects 32-byte x-only pubkey; use compressed pubkey and drop prefix byte
+	pubKeyBytes := privKey.PubKey().SerializeCompressed()[1:]
+
+	// Hex encodings
+	privKeyHex := hex.EncodeToString(privKeyBytes)
+	pubKeyHex := hex.EncodeToString(pubKeyBytes)
+
+	// NIP-19 encodings
+	privKeyNIP, err := nip19.EncodePrivateKey(privKeyHex)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode master private key to NIP-19: %v", err)
+	}
+	pubKeyNIP, err := nip19.EncodePublicKey(pubKeyHex)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode master public key to NIP-19: %v", err)
+	}
+
+	return &NostrKeyPair{
+		PrivateKey:    privKeyHex,
+		PublicKey:     pubKeyHex,
+		PrivateKeyNIP: privKeyNIP,
+		PublicKeyNIP:  pubKeyNIP,
+		Index:         0,
+	}, nil
 }
 
 // GetMasterKeyPairNostr returns the master key pair in Nostr formats
 func (nkd *NostrKeyDeriver) GetMasterKeyPairNostr() (*NostrKeyPair, error) {
-    masterKeyPair, err := nkd.GetMasterKeyPair()
-    if err != nil {
-        return nil, err
-    }
+	masterKeyPair, err := nkd.GetMasterKeyPair()
+	if err != nil {
+		return nil, err
+	}
 
-    return masterKeyPair, nil
+	return masterKeyPair, nil
 }
 
 // NostrKeyDeriver handles deterministic key derivation for Nostr
 type NostrKeyDeriver struct {
 	masterKey  *hdkeychain.ExtendedKey
-	mnemonic   string
+	mnemonic   []byte
 	masterSeed []byte
 	network    *chaincfg.Params
+	watchOnly  bool // built from an xpub: masterKey is the neutered account key
+	cache      keyCache
 }
 
 // NewNostrKeyDeriver creates a new key deriver from a mnemonic
 func NewNostrKeyDeriver(mnemonic string) (*NostrKeyDeriver, error) {
+	return NewNostrKeyDeriverWithPassphrase(mnemonic, "")
+}
+
+// NewNostrKeyDeriverWithPassphrase creates a key deriver from a mnemonic and
+// a BIP39 passphrase (the "25th word"); a different passphrase gives a
+// completely different key tree
+func NewNostrKeyDeriverWithPassphrase(mnemonic, passphrase string) (*NostrKeyDeriver, error) {
 	if mnemonic == "" {
 		// Generate a new mnemonic if none provided
 		entropy, err := bip39.NewEntropy(128) // 12 words
@@ -99,8 +112,8 @@ func NewNostrKeyDeriver(mnemonic string) (*NostrKeyDeriver, error) {
 		return nil, fmt.Errorf("invalid mnemonic")
 	}
 
-	// Generate seed from mnemonic (with empty passphrase)
-	seed := bip39.NewSeed(mnemonic, "")
+	// Generate seed from mnemonic and passphrase
+	seed := bip39.NewSeed(mnemonic, passphrase)
 
 	// Use mainnet parameters (standard for most applications)
 	network := &chaincfg.MainNetParams
@@ -113,7 +126,7 @@ func NewNostrKeyDeriver(mnemonic string) (*NostrKeyDeriver, error) {
 
 	return &NostrKeyDeriver{
 		masterKey:  masterKey,
-		mnemonic:   mnemonic,
+		mnemonic:   []byte(mnemonic),
 		masterSeed: seed,
 		network:    network,
 	}, nil
@@ -135,37 +148,17 @@ func NewNostrKeyDeriverFromSeed(seed []byte) (*NostrKeyDeriver, error) {
 }
 
 // DeriveKeyBIP32 derives a Nostr key using BIP32 hierarchical derivation
-// Uses path: m/44'/1237'/0'/0/index (standard Nostr derivation path)
+// Uses the deriver's scheme, by default m/44'/1237'/0'/0/index (standard Nostr derivation path)
 func (nkd *NostrKeyDeriver) DeriveKeyBIP32(index uint32) (*NostrKeyPair, error) {
-	// BIP44 derivation path: m/44'/1237'/0'/0/index
-	// 44' = BIP44 purpose (hardened)
-	purposeKey, err := nkd.masterKey.Derive(hdkeychain.HardenedKeyStart + 44)
-	if err != nil {
-		return nil, fmt.Errorf("failed to derive purpose key: %v", err)
-	}
-
-	// 1237' = Nostr coin type (hardened) - officially registered
-	coinTypeKey, err := purposeKey.Derive(hdkeychain.HardenedKeyStart + 1237)
-	if err != nil {
-		return nil, fmt.Errorf("failed to derive coin type key: %v", err)
-	}
-
-	// 0' = Account (hardened)
-	accountKey, err := coinTypeKey.Derive(hdkeychain.HardenedKeyStart + 0)
-	if err != nil {
-		return nil, fmt.Errorf("failed to derive account key: %v", err)
-	}
-
-	// 0 = External chain (non-hardened)
-	chainKey, err := accountKey.Derive(0)
-	if err != nil {
-		return nil, fmt.Errorf("failed to derive chain key: %v", err)
+	if nkd.watchOnly {
+		return nil, ErrWatchOnly
 	}
 
-	// index = Address index (non-hardened)
-	childKey, err := chainKey.Derive(index)
+	// BIP44 derivation path: 44' = purpose, 1237' = Nostr coin type (officially
+	// registered), then account', chain and address index
+	childKey, err := nkd.childKey(index)
 	if err != nil {
-		return nil, fmt.Errorf("failed to derive child key at index %d: %v", index, err)
+		return nil, err
 	}
 
 	// Get the private key
@@ -204,6 +197,13 @@ func (nkd *NostrKeyDeriver) DeriveKeyBIP32(index uint32) (*NostrKeyPair, error)
 
 // DeriveKeySimple derives a key using simple HMAC-SHA256 approach
 func (nkd *NostrKeyDeriver) DeriveKeySimple(index uint32) (*NostrKeyPair, error) {
+	if nkd.watchOnly {
+		return nil, ErrWatchOnly
+	}
+	if nkd.isWiped() {
+		return nil, ErrWiped
+	}
+
 	// Create HMAC with master seed as key
 	h := hmac.New(sha256.New, nkd.masterSeed)
 
@@ -293,20 +293,23 @@ func (nkd *NostrKeyDeriver) CheckKeyBelongsToMaster(targetKey string, maxIndex u
 
 	// Search through derivation indices
 	for i := uint32(0); i <= maxIndex; i++ {
-		var keyPair *NostrKeyPair
+		var pubKey string
 		var err error
 
 		if useBIP32 {
-			keyPair, err = nkd.DeriveKeyBIP32(i)
+			pubKey, err = nkd.DerivePublicKey(i)
 		} else {
-			keyPair, err = nkd.DeriveKeySimple(i)
+			var keyPair *NostrKeyPair
+			if keyPair, err = nkd.DeriveKeySimple(i); err == nil {
+				pubKey = keyPair.PublicKey
+			}
 		}
 
 		if err != nil {
 			return false, 0, fmt.Errorf("failed to derive key at index %d: %v", i, err)
 		}
 
-		if keyPair.PublicKey == targetPubKey {
+		if pubKey == targetPubKey {
 			return true, i, nil
 		}
 	}
@@ -316,11 +319,6 @@ func (nkd *NostrKeyDeriver) CheckKeyBelongsToMaster(targetKey string, maxIndex u
 
 // CreateNostrEvent creates a sample Nostr event using go-nostr
 func (nkd *NostrKeyDeriver) CreateNostrEvent(keyIndex uint32, content string) (*nostr.Event, error) {
-	keyPair, err := nkd.DeriveKeyBIP32(keyIndex)
-	if err != nil {
-		return nil, fmt.Errorf("failed to derive key: %v", err)
-	}
-
 	// Create a new event
 	event := &nostr.Event{
 		Kind:      nostr.KindTextNote,
@@ -330,17 +328,30 @@ func (nkd *NostrKeyDeriver) CreateNostrEvent(keyIndex uint32, content string) (*
 	}
 
 	// Sign the event using the derived private key
-	err = event.Sign(keyPair.PrivateKey)
-	if err != nil {
+	if err := nkd.SignEvent(keyIndex, event); err != nil {
 		return nil, fmt.Errorf("failed to sign event: %v", err)
 	}
 
 	return event, nil
 }
 
-// GetMnemonic returns the mnemonic phrase (if available)
+// DeriveSecret derives a 32-byte symmetric secret for the given purpose label
+// from the master seed (HMAC-SHA256), so the relay can encrypt its own data
+// without storing any extra key material. Watch-only and wiped derivers
+// return nil.
+func (nkd *NostrKeyDeriver) DeriveSecret(label string) []byte {
+	if nkd.watchOnly || nkd.isWiped() {
+		return nil
+	}
+	h := hmac.New(sha256.New, nkd.masterSeed)
+	h.Write([]byte(label))
+	return h.Sum(nil)
+}
+
+// GetMnemonic returns the mnemonic phrase (if available). The result is a
+// copy that Wipe cannot clear, so avoid holding on to it
 func (nkd *NostrKeyDeriver) GetMnemonic() string {
-	return nkd.mnemonic
+	return string(nkd.mnemonic)
 }
 
 // GenerateRandomSeed generates a random 32-byte seed
@@ -0,0 +1,116 @@
+package keyderivation
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// KeyRegistry keeps the pubkeys derived from a master (BIP32 path
+// m/44'/1237'/0'/0/index) in memory so membership checks are a map lookup
+// instead of re-deriving every index on each call.
+type KeyRegistry struct {
+	deriver *NostrKeyDeriver
+
+	mu       sync.RWMutex
+	pubkeys  []string          // pubkey by index, for every index derived so far
+	indices  map[string]uint32 // index by pubkey
+	maxIndex uint32            // highest index that counts as a member
+}
+
+// NewKeyRegistry derives all pubkeys up to and including maxIndex.
+func NewKeyRegistry(deriver *NostrKeyDeriver, maxIndex uint32) (*KeyRegistry, error) {
+	r := &KeyRegistry{
+		deriver:  deriver,
+		indices:  make(map[string]uint32),
+		maxIndex: maxIndex,
+	}
+	if err := r.extend(maxIndex); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// extend derives the indices missing up to maxIndex. Callers must hold mu.
+func (r *KeyRegistry) extend(maxIndex uint32) error {
+	for i := uint32(len(r.pubkeys)); i <= maxIndex; i++ {
+		pubkey, err := r.deriver.DerivePublicKey(i)
+		if err != nil {
+			return fmt.Errorf("failed to derive key at index %d: %v", i, err)
+		}
+		r.pubkeys = append(r.pubkeys, pubkey)
+		r.indices[pubkey] = i
+	}
+	return nil
+}
+
+// ensure derives keys up to the current max index if it was raised since the
+// last lookup.
+func (r *KeyRegistry) ensure() error {
+	r.mu.RLock()
+	missing := uint32(len(r.pubkeys)) <= r.maxIndex
+	r.mu.RUnlock()
+	if !missing {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.extend(r.maxIndex)
+}
+
+// SetMaxIndex changes the highest index that counts as a member. Raising it
+// does not derive anything right away; the new keys are derived on the next
+// lookup. Lowering it keeps the derived keys around but stops matching them.
+func (r *KeyRegistry) SetMaxIndex(maxIndex uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.maxIndex = maxIndex
+}
+
+// MaxIndex returns the highest index that counts as a member.
+func (r *KeyRegistry) MaxIndex() uint32 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.maxIndex
+}
+
+// Lookup returns the derivation index of pubkey (hex or npub).
+func (r *KeyRegistry) Lookup(pubkey string) (uint32, bool, error) {
+	if prefix, decoded, err := nip19.Decode(pubkey); err == nil {
+		if prefix != "npub" {
+			return 0, false, fmt.Errorf("unsupported NIP-19 format: %s", prefix)
+		}
+		pubkey = decoded.(string)
+	}
+	if err := r.ensure(); err != nil {
+		return 0, false, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	index, ok := r.indices[pubkey]
+	if !ok || index > r.maxIndex {
+		return 0, false, nil
+	}
+	return index, true, nil
+}
+
+// Contains reports whether pubkey (hex or npub) is derived from the master
+// within the max index.
+func (r *KeyRegistry) Contains(pubkey string) bool {
+	_, ok, _ := r.Lookup(pubkey)
+	return ok
+}
+
+// Pubkeys returns the derived pubkeys ordered by index, up to the max index.
+func (r *KeyRegistry) Pubkeys() ([]string, error) {
+	if err := r.ensure(); err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]string(nil), r.pubkeys[:r.maxIndex+1]...), nil
+}
@@ -0,0 +1,118 @@
+package keyderivation
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+)
+
+// DerivationScheme is a BIP32 path template with exactly one {index}
+// placeholder, such as m/44'/1237'/0'/0/{index}. Different templates carve
+// separate key spaces out of the same seed.
+type DerivationScheme struct {
+	template string
+	children []uint32 // child numbers, the placeholder's slot holds its hardening offset
+	indexAt  int
+}
+
+var (
+	// SchemeIndex varies the address index: m/44'/1237'/0'/0/{index} (the default).
+	SchemeIndex = mustParseScheme("m/44'/1237'/0'/0/{index}")
+	// SchemeNIP06 varies the account, like NIP-06 wallets do: m/44'/1237'/{index}'/0/0.
+	SchemeNIP06 = mustParseScheme("m/44'/1237'/{index}'/0/0")
+)
+
+func mustParseScheme(template string) DerivationScheme {
+	s, err := ParseDerivationPath(template)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// ParseDerivationScheme accepts the preset names "index" (or "") and "nip06"
+// (or "account"), or a path template.
+func ParseDerivationScheme(s string) (DerivationScheme, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "index":
+		return SchemeIndex, nil
+	case "nip06", "nip-06", "account":
+		return SchemeNIP06, nil
+	}
+	if strings.Contains(s, "{index}") {
+		return ParseDerivationPath(s)
+	}
+	return DerivationScheme{}, fmt.Errorf("unknown derivation scheme %q (expected index, nip06 or a path template)", s)
+}
+
+// ParseDerivationPath parses a path template like m/44'/1237'/7'/0/{index}.
+// Hardened levels are marked with ' or h; the placeholder may be hardened too.
+func ParseDerivationPath(template string) (DerivationScheme, error) {
+	template = strings.TrimSpace(template)
+	s := DerivationScheme{template: template, indexAt: -1}
+	parts := strings.Split(strings.TrimPrefix(strings.TrimPrefix(template, "m"), "/"), "/")
+	for i, part := range parts {
+		var offset uint32
+		if strings.HasSuffix(part, "'") || strings.HasSuffix(part, "h") || strings.HasSuffix(part, "H") {
+			offset = hdkeychain.HardenedKeyStart
+			part = part[:len(part)-1]
+		}
+		if part == "{index}" {
+			if s.indexAt >= 0 {
+				return DerivationScheme{}, fmt.Errorf("derivation path %q has more than one {index}", template)
+			}
+			s.indexAt = i
+			s.children = append(s.children, offset)
+			continue
+		}
+		n, err := strconv.ParseUint(part, 10, 32)
+		if err != nil || n >= hdkeychain.HardenedKeyStart {
+			return DerivationScheme{}, fmt.Errorf("invalid level %q in derivation path %q", parts[i], template)
+		}
+		s.children = append(s.children, offset+uint32(n))
+	}
+	if s.indexAt < 0 {
+		return DerivationScheme{}, fmt.Errorf("derivation path %q has no {index}", template)
+	}
+	return s, nil
+}
+
+// String returns the path template, e.g. m/44'/1237'/0'/0/{index}.
+func (s DerivationScheme) String() string {
+	return s.template
+}
+
+// IsZero reports whether s is the zero value, which derives like SchemeIndex.
+func (s DerivationScheme) IsZero() bool {
+	return s.template == ""
+}
+
+// path returns the child numbers leading from the master to the key at index.
+func (s DerivationScheme) path(index uint32) ([]uint32, error) {
+	if s.IsZero() {
+		s = SchemeIndex
+	}
+	if index >= hdkeychain.HardenedKeyStart {
+		return nil, fmt.Errorf("index %d out of range", index)
+	}
+	path := append([]uint32(nil), s.children...)
+	path[s.indexAt] += index
+	return path, nil
+}
+
+// SetScheme changes the derivation path template, dropping cached keys.
+func (nkd *NostrKeyDeriver) SetScheme(scheme DerivationScheme) {
+	nkd.cache.reset(scheme)
+}
+
+// Scheme returns the derivation scheme in use.
+func (nkd *NostrKeyDeriver) Scheme() DerivationScheme {
+	nkd.cache.mu.RLock()
+	defer nkd.cache.mu.RUnlock()
+	if nkd.cache.scheme.IsZero() {
+		return SchemeIndex
+	}
+	return nkd.cache.scheme
+}
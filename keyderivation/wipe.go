@@ -0,0 +1,81 @@
+package keyderivation
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ErrWiped is returned by a deriver after Wipe or Close.
+var ErrWiped = errors.New("key deriver has been wiped")
+
+// Wipe zeroes the seed, the mnemonic and every cached private key. The deriver
+// is unusable afterwards. It must not race with a SignEvent in progress.
+func (nkd *NostrKeyDeriver) Wipe() {
+	c := &nkd.cache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.wiped {
+		return
+	}
+	c.wiped = true
+
+	for _, key := range c.children {
+		key.Zero()
+	}
+	if c.account != nil {
+		c.account.Zero()
+	}
+	c.children = nil
+	c.account = nil
+
+	nkd.masterKey.Zero()
+	clear(nkd.masterSeed)
+	clear(nkd.mnemonic)
+	nkd.masterSeed = nil
+	nkd.mnemonic = nil
+}
+
+// Close wipes the deriver, so it can be released with the usual defer.
+func (nkd *NostrKeyDeriver) Close() error {
+	nkd.Wipe()
+	return nil
+}
+
+// isWiped reports whether Wipe was called.
+func (nkd *NostrKeyDeriver) isWiped() bool {
+	nkd.cache.mu.RLock()
+	defer nkd.cache.mu.RUnlock()
+	return nkd.cache.wiped
+}
+
+// SignEvent signs evt with the key at index. Unlike DeriveKeyBIP32 it never
+// turns the private key into a hex string, and the key is zeroed when done.
+func (nkd *NostrKeyDeriver) SignEvent(index uint32, evt *nostr.Event) error {
+	if nkd.watchOnly {
+		return ErrWatchOnly
+	}
+	key, err := nkd.childKey(index)
+	if err != nil {
+		return err
+	}
+	privKey, err := key.ECPrivKey()
+	if err != nil {
+		return fmt.Errorf("failed to get EC private key: %v", err)
+	}
+	defer privKey.Zero()
+
+	evt.PubKey = hex.EncodeToString(privKey.PubKey().SerializeCompressed()[1:])
+	id := evt.GetID()
+	idBytes, _ := hex.DecodeString(id)
+	sig, err := schnorr.Sign(privKey, idBytes)
+	if err != nil {
+		return fmt.Errorf("failed to sign event: %v", err)
+	}
+	evt.ID = id
+	evt.Sig = hex.EncodeToString(sig.Serialize())
+	return nil
+}
@@ -0,0 +1,105 @@
+package keyderivation
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/btcsuite/btcd/chaincfg"
+)
+
+// ErrWatchOnly is returned for operations that need private keys on a
+// deriver built from an extended public key.
+var ErrWatchOnly = errors.New("watch-only deriver has no private keys")
+
+// NewNostrKeyDeriverFromXPub creates a watch-only deriver from a neutered
+// account xpub, e.g. the key at m/44'/1237'/0' for the default scheme. It can
+// derive and recognize member pubkeys, but never holds a seed or private key.
+// Only schemes whose levels below the xpub are all non-hardened can be used.
+func NewNostrKeyDeriverFromXPub(xpub string) (*NostrKeyDeriver, error) {
+	key, err := hdkeychain.NewKeyFromString(xpub)
+	if err != nil {
+		return nil, fmt.Errorf("invalid extended public key: %v", err)
+	}
+	if key.IsPrivate() {
+		return nil, fmt.Errorf("expected an extended public key (xpub), got a private one")
+	}
+	return &NostrKeyDeriver{
+		masterKey: key,
+		network:   &chaincfg.MainNetParams,
+		watchOnly: true,
+	}, nil
+}
+
+// IsWatchOnly reports whether the deriver was built from an xpub.
+func (nkd *NostrKeyDeriver) IsWatchOnly() bool {
+	return nkd.watchOnly
+}
+
+// AccountXPub returns the neutered extended key at the deepest hardened level
+// of the scheme (m/44'/1237'/0' by default), to set up a watch-only relay.
+func (nkd *NostrKeyDeriver) AccountXPub() (string, error) {
+	if nkd.isWiped() {
+		return "", ErrWiped
+	}
+	if nkd.watchOnly {
+		return nkd.masterKey.String(), nil
+	}
+	if !nkd.Scheme().publicIndex() {
+		return "", fmt.Errorf("derivation path %s has a hardened index, which an xpub cannot derive", nkd.Scheme())
+	}
+	path, err := nkd.Scheme().path(0)
+	if err != nil {
+		return "", err
+	}
+	key := nkd.masterKey
+	for _, child := range path[:nkd.Scheme().publicDepth()] {
+		if key, err = key.Derive(child); err != nil {
+			return "", fmt.Errorf("failed to derive account key: %v", err)
+		}
+	}
+	pub, err := key.Neuter()
+	if err != nil {
+		return "", err
+	}
+	return pub.String(), nil
+}
+
+// DerivePublicKey returns the hex pubkey at index. Unlike DeriveKeyBIP32 it
+// works on watch-only derivers.
+func (nkd *NostrKeyDeriver) DerivePublicKey(index uint32) (string, error) {
+	key, err := nkd.childKey(index)
+	if err != nil {
+		return "", err
+	}
+	pubKey, err := key.ECPubKey()
+	if err != nil {
+		return "", fmt.Errorf("failed to get EC public key: %v", err)
+	}
+	return hex.EncodeToString(pubKey.SerializeCompressed()[1:]), nil
+}
+
+// publicDepth returns how many leading levels of the path an xpub must cover:
+// everything up to and including the last hardened level.
+func (s DerivationScheme) publicDepth() int {
+	if s.IsZero() {
+		s = SchemeIndex
+	}
+	depth := 0
+	for i, child := range s.children {
+		if child >= hdkeychain.HardenedKeyStart {
+			depth = i + 1
+		}
+	}
+	return depth
+}
+
+// publicIndex reports whether the index sits below every hardened level, so
+// keys can be derived from an xpub.
+func (s DerivationScheme) publicIndex() bool {
+	if s.IsZero() {
+		s = SchemeIndex
+	}
+	return s.indexAt >= s.publicDepth()
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip11"
+)
+
+// Event size limits: the serialized size of an event, the length of its
+// content (in characters) and the number of its tags. MAX_EVENT_SIZE,
+// MAX_CONTENT_LENGTH and MAX_EVENT_TAGS apply to every kind; EVENT_LIMITS
+// overrides them for some kinds, e.g. to allow larger long-form articles.
+
+// EventLimits bounds what a single event may contain. Zero means unlimited.
+type EventLimits struct {
+	MaxSize    int
+	MaxContent int
+	MaxTags    int
+}
+
+func loadEventLimits() EventLimits {
+	return EventLimits{
+		MaxSize:    getEnvIntWithDefault("MAX_EVENT_SIZE", 0),
+		MaxContent: getEnvIntWithDefault("MAX_CONTENT_LENGTH", 0),
+		MaxTags:    getEnvIntWithDefault("MAX_EVENT_TAGS", 0),
+	}
+}
+
+// KindLimits are the limits that replace the defaults for some kinds.
+type KindLimits struct {
+	Kinds []int
+	EventLimits
+}
+
+// parseKindLimits parses EVENT_LIMITS: rules separated by ";", each
+// "kinds:max_size:max_content:max_tags", e.g. "30023:1048576:500000:0".
+// Within a rule 0 keeps the default limit.
+func parseKindLimits(value *string) ([]KindLimits, error) {
+	if value == nil || strings.TrimSpace(*value) == "" {
+		return nil, nil
+	}
+	var rules []KindLimits
+	for _, spec := range strings.Split(*value, ";") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		parts := strings.Split(spec, ":")
+		if len(parts) != 4 {
+			return nil, fmt.Errorf("invalid event limit %q, expected kinds:max_size:max_content:max_tags", spec)
+		}
+		rule := KindLimits{Kinds: parseAllowedKinds(&parts[0])}
+		if len(rule.Kinds) == 0 {
+			return nil, fmt.Errorf("event limit %q has no kinds", spec)
+		}
+		var values [3]int
+		for i, part := range parts[1:] {
+			n, err := strconv.Atoi(strings.TrimSpace(part))
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid number %q in event limit %q", part, spec)
+			}
+			values[i] = n
+		}
+		rule.MaxSize, rule.MaxContent, rule.MaxTags = values[0], values[1], values[2]
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// limitsFor returns the limits that apply to kind.
+func limitsFor(kind int) EventLimits {
+	limits := config.EventLimits
+	for _, rule := range config.KindLimits {
+		if !slices.Contains(rule.Kinds, kind) {
+			continue
+		}
+		if rule.MaxSize > 0 {
+			limits.MaxSize = rule.MaxSize
+		}
+		if rule.MaxContent > 0 {
+			limits.MaxContent = rule.MaxContent
+		}
+		if rule.MaxTags > 0 {
+			limits.MaxTags = rule.MaxTags
+		}
+		break
+	}
+	return limits
+}
+
+// rejectOversizedEvent enforces the limits for the event's kind.
+func rejectOversizedEvent(ctx context.Context, event *nostr.Event) (bool, string) {
+	limits := limitsFor(event.Kind)
+	if limits.MaxTags > 0 && len(event.Tags) > limits.MaxTags {
+		return true, fmt.Sprintf("invalid: too many tags (%d, max %d for kind %d)", len(event.Tags), limits.MaxTags, event.Kind)
+	}
+	if limits.MaxContent > 0 {
+		if n := utf8.RuneCountInString(event.Content); n > limits.MaxContent {
+			return true, fmt.Sprintf("invalid: content too long (%d characters, max %d for kind %d)", n, limits.MaxContent, event.Kind)
+		}
+	}
+	if limits.MaxSize > 0 {
+		if n := len(event.String()); n > limits.MaxSize {
+			return true, fmt.Sprintf("invalid: event too large (%d bytes, max %d for kind %d)", n, limits.MaxSize, event.Kind)
+		}
+	}
+	return false, ""
+}
+
+// setupEventLimits installs the limits, advertises the defaults in NIP-11 and
+// makes sure the websocket accepts messages as large as the largest event
+// allowed.
+func setupEventLimits(relay *khatru.Relay) {
+	relay.RejectEvent = append(relay.RejectEvent, rejectOversizedEvent)
+
+	if relay.Info.Limitation == nil {
+		relay.Info.Limitation = &nip11.RelayLimitationDocument{}
+	}
+	relay.Info.Limitation.MaxContentLength = config.EventLimits.MaxContent
+	relay.Info.Limitation.MaxEventTags = config.EventLimits.MaxTags
+
+	largest := config.EventLimits.MaxSize
+	for _, rule := range config.KindLimits {
+		largest = max(largest, rule.MaxSize)
+	}
+	// room for the ["EVENT", ...] envelope
+	if needed := int64(largest) + 1024; largest > 0 && needed > relay.MaxMessageSize {
+		relay.MaxMessageSize = needed
+	}
+
+	slog.Info("Event limits: ENABLED", "max_size", config.EventLimits.MaxSize, "max_content", config.EventLimits.MaxContent,
+		"max_tags", config.EventLimits.MaxTags, "kind_rules", len(config.KindLimits))
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Logging goes through log/slog. LOG_FORMAT picks text (the default) or json
+// output and LOG_LEVEL the minimum level (debug, info, warn, error). The
+// standard logger, which khatru and some dependencies write to, is routed
+// through the same handler.
+
+type logAttrsKey struct{}
+
+// setupLogging installs the default slog logger.
+func setupLogging(format, level string) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid LOG_LEVEL %q", level)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "", "text":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("invalid LOG_FORMAT %q, expected text or json", format)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// relayLogger is what khatru's own messages (failed upgrades, unexpected
+// closes) are written to.
+func relayLogger() *log.Logger {
+	return slog.NewLogLogger(slog.Default().Handler().WithAttrs([]slog.Attr{slog.String("component", "khatru")}), slog.LevelWarn)
+}
+
+// fatal logs msg at error level and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// withLogAttrs returns a context whose logger carries the given fields in
+// addition to those already attached.
+func withLogAttrs(ctx context.Context, args ...any) context.Context {
+	prev, _ := ctx.Value(logAttrsKey{}).([]any)
+	attrs := append(append([]any{}, prev...), args...)
+	return context.WithValue(ctx, logAttrsKey{}, attrs)
+}
+
+// logger returns the default logger with the request-scoped fields of ctx:
+// those attached with withLogAttrs, or the client IP of a websocket
+// connection.
+func logger(ctx context.Context) *slog.Logger {
+	if attrs, ok := ctx.Value(logAttrsKey{}).([]any); ok {
+		return slog.With(attrs...)
+	}
+	if ws := khatru.GetConnection(ctx); ws != nil {
+		return slog.With("ip", clientIP(ws.Request))
+	}
+	return slog.Default()
+}
+
+// contextIP returns the client IP of a websocket connection or HTTP request.
+func contextIP(ctx context.Context) string {
+	if ws := khatru.GetConnection(ctx); ws != nil {
+		return clientIP(ws.Request)
+	}
+	attrs, _ := ctx.Value(logAttrsKey{}).([]any)
+	for i := 0; i+1 < len(attrs); i += 2 {
+		if attrs[i] == "ip" {
+			ip, _ := attrs[i+1].(string)
+			return ip
+		}
+	}
+	return ""
+}
+
+// withRequestLog attaches the client IP to every request's logger. It must run
+// after trustProxies.
+func withRequestLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(withLogAttrs(r.Context(), "ip", clientIP(r))))
+	})
+}
+
+// eventLogger is logger(ctx) with the event's id, author and kind.
+func eventLogger(ctx context.Context, evt *nostr.Event) *slog.Logger {
+	return logger(ctx).With("event_id", evt.ID, "pubkey", evt.PubKey, "kind", evt.Kind)
+}
+
+// blobLogger is logger(ctx) with the blob hash.
+func blobLogger(ctx context.Context, sha256 string) *slog.Logger {
+	return logger(ctx).With("blob", sha256)
+}
@@ -1,23 +1,17 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"crypto/sha256"
 	"encoding/hex"
-	"encoding/json"
 	"fmt"
 	"io"
 	"log"
-	"net/http"
+	"log/slog"
 	"os"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/bitkarrot/higher/keyderivation"
-	"github.com/fiatjaf/eventstore/badger"
-	"github.com/fiatjaf/eventstore/postgresql"
 	"github.com/fiatjaf/khatru"
 	"github.com/fiatjaf/khatru/blossom"
 	"github.com/joho/godotenv"
@@ -29,25 +23,209 @@ type Config struct {
 	RelayName        string
 	RelayPubkey      string
 	RelayDescription string
-	DBEngine         *string
-	DBPath           *string
-	PostgresUser     *string
-	PostgresPassword *string
-	PostgresDB       *string
-	PostgresHost     *string
-	PostgresPort     *string
-	TeamDomain       string
-	BlossomEnabled   bool
-	BlossomPath      *string
-	BlossomURL       *string
-	WebsocketURL     *string
-	AllowedKinds     []int
-	MaxUploadSizeMB  int
+	Branding         BrandingConfig
+	// Directory of templates replacing the embedded front page
+	FrontPageTemplateDir string
+	DBEngine             *string
+	DBPath               *string
+	PostgresUser         *string
+	PostgresPassword     *string
+	PostgresDB           *string
+	PostgresHost         *string
+	PostgresPort         *string
+	PostgresSSLMode      string
+	PostgresSSLRootCert  string
+	PostgresURL          string // overrides the settings above
+	PostgresReadURL      string // read replica for queries and counts
+	// Postgres connection pool and startup retries
+	PostgresMaxOpenConns    int
+	PostgresMaxIdleConns    int
+	PostgresConnMaxLifetime int // minutes, 0 = unlimited
+	PostgresConnectTimeout  int // seconds to keep retrying at startup
+	// Badger tuning
+	BadgerVlogFileSizeMB int    // 0 = Badger's default (1 GiB)
+	BadgerCompression    string // none, snappy or zstd
+	BadgerBlockCacheMB   int
+	BadgerIndexCacheMB   int // 0 = indexes are kept in memory
+	BadgerGCInterval     int // minutes between value log GC runs, 0 = off
+	// LMDB
+	LMDBMapSizeMB int // 0 = the backend's default (256 GiB)
+	// Team membership
+	TeamDomain         string
+	TeamRefreshMinutes int
+	TeamListKind       int // membership list published by an admin, 0 when disabled
+	TeamListD          string
+	TeamListRelays     []string
+	// NIP-05 identity document served by the relay
+	NIP05Enabled      bool
+	NIP05Names        map[string]string // name -> derivation index or pubkey
+	NIP05RosterPrefix string
+	BlossomEnabled    bool
+	BlossomPath       *string
+	BlossomStorage    string // fs or s3
+	BlossomLayout     string // flat or sharded, for fs
+	S3                S3Config
+	BlossomURL        *string
+	WebsocketURL      *string
+	ListenSocket      *string
+	ListenSocketMode  os.FileMode // permissions of the socket file
+	ListenSocketGroup string      // group that owns the socket, empty to keep the process's
+	ListenSocketOnly  bool        // don't open the first profile's TCP port
+	// Websocket keepalive and message size
+	WSPingIntervalSeconds int
+	WSPongTimeoutSeconds  int
+	WSMaxMessageSize      int
+	// OpenTelemetry tracing, enabled by an OTLP endpoint
+	TracingEndpoint    string
+	TracingServiceName string
+	TraceSampleRatio   float64
+	TLS                TLSConfig
+	CORS               CORSConfig
+	TrustedProxies     []string
+	// Per-IP connection limits and bans
+	MaxConnectionsPerIP int // open websocket connections, 0 = unlimited
+	ConnectionRateLimit int // new websocket connections per minute, 0 = unlimited
+	BannedIPs           []string
+	AllowedKinds        []int
+	MaxUploadSizeMB     int
+	AllowedTypes        []string // sniffed upload types accepted, empty = all
+	BlockedTypes        []string
+	ThumbnailSizes      []int // longest side of generated image variants
+	// Event size limits, by default and per kind
+	EventLimits EventLimits
+	KindLimits  []KindLimits
+	// Malware scanning of uploads
+	ScanBackend     string // clamd or http, empty disables scanning
+	ClamdAddress    string
+	ScanHTTPURL     string
+	ScanFailOpen    bool
+	ScanRescanHours int
+	NIP96Path       string
+	// NIP-94 file metadata published for stored blobs
+	NIP94AutoPublish bool
+	NIP94SignerIndex int
+	// Garbage collection of unreferenced blobs
+	BlobGC              bool
+	BlobGCIntervalHours int
+	BlobGCGraceHours    int
+	// Integrity verification of stored blobs
+	BlobVerifyIntervalHours int // 0 disables the periodic check
+	BlobVerifyQuarantine    bool
+	// Expiry of untouched blobs and the cold storage tier
+	BlobTiering BlobTieringConfig
+	// BUD-03 auto-mirroring of members' blobs
+	BlossomAutoMirror         bool
+	AutoMirrorIntervalMinutes int
+	// Checks on events referencing blobs hosted here: off, warn or reject
+	FileEventBlobCheck string
+	// Mirroring of media referenced in members' events
+	MirrorReferencedMedia   bool
+	MirrorReferencedWorkers int
+	// Fetching blobs from user-supplied URLs (mirror, auto-mirror)
+	MirrorTimeoutSeconds int
+	MirrorAllowPrivate   bool
+	// Uploads received at once, 0 = unlimited
+	MaxConcurrentUploads int
+	// Blossom requests per minute per client and endpoint, 0 = unlimited
+	UploadRateLimit  int
+	MirrorRateLimit  int
+	ListRateLimit    int
+	BlobGetRateLimit int
+	// NIP-65 outbox backfill
+	OutboxBackfill          bool
+	BackfillIntervalMinutes int
+	BackfillLookbackHours   int
+	BackfillBootstrapRelays []string
+	// Write access for pubkeys the team follows
+	WoTDepth          int // follow hops from the members, 0 = disabled
+	WoTRelays         []string
+	WoTRefreshMinutes int
+	// Federation with partner higher instances
+	FederationPeers        []string
+	FederationServiceIndex int
+	// NIP-46 remote signer for derived members
+	BunkerEnabled bool
+	// NIP-29 relay-based groups
+	GroupsEnabled     bool
+	GroupsSignerIndex int
+	// Gift-wrapped DMs for members (NIP-17)
+	DMRelayMode bool
+	// Webhook notifications for stored events
+	Webhooks          []*Webhook
+	WebhookSecret     string
+	WebhookMaxRetries int
+	// Outbound forwarding to upstream relays
+	ForwardRelays      []string
+	ForwardKinds       []int
+	ForwardMembersOnly bool
+	// Event retention
+	RetentionRules           []RetentionRule
+	RetentionMaxDBSizeMB     int
+	RetentionIntervalMinutes int
+	// NIP-40 expired event sweep interval
+	ExpirationSweepMinutes int
+	// NIP-13 proof of work required from non-members, 0 = none
+	MinPowDifficulty int
+	// created_at sanity, 0 disables a check
+	MaxFutureSkewSeconds int
+	MaxEventAgeDays      int
+	// Duplicate and burst flood protection, 0 disables a check
+	FloodWindowSeconds int
+	FloodMaxCopies     int
+	FloodBurstLimit    int
+	FloodPolicy        string
+	// Client query limits and slow-query logging, 0 disables each
+	QueryDefaultLimit   int
+	QueryMaxLimit       int
+	QueryTimeoutSeconds int
+	SlowQueryMS         int
+	// In-memory cache of common filter results, 0 = off
+	HotCacheSize     int
+	HotCacheMaxLimit int
+	// Encrypted backups of the event store to S3, 0 hours = off
+	BackupIntervalHours int
+	BackupKeep          int
+	BackupS3            S3Config
+	// Time allowed to drain connections on SIGINT/SIGTERM
+	ShutdownTimeoutSeconds int
+	// Paid write access for pubkeys outside the team
+	PaidAccess        bool
+	PaidAccessFeeSats int
+	PaidAccessDays    int
+	Payments          PaymentConfig
+	// invoices per IP per minute, and open invoices at once
+	PaidInvoiceRateLimit int
+	PaidMaxPending       int
+	// Admin API and archive mode
+	WhitelistedPubkeys   []string
+	BannedPubkeys        []string
+	ModerationEnabled    bool
+	AdminPubkeys         []string
+	ArchiveMode          bool
+	ArchiveRetentionDays int
+	MemberCleanupPolicy  string
 	// Key derivation / access control
 	RelayMnemonic      *string
+	MnemonicPassphrase string
 	RelaySeedHex       *string
+	RelayXPub          *string
 	MaxDerivationIndex int
+	DerivationScheme   keyderivation.DerivationScheme
 	ReadsRestricted    bool
+	ReadsPublicKinds   []int // queryable by anyone even when reads are restricted
+	// Seed rotation: keys of the retired seed stay members for the window
+	RetiredRelayMnemonic      string
+	RetiredMnemonicPassphrase string
+	RotationWindowDays        int
+	// Claim links of POST /admin/provision expire after this many hours
+	ProvisionLinkTTLHours int
+	// Gift-wrapped key delivery, the alternative to claim links
+	KeyDeliveryRelays      []string
+	KeyDeliverySenderIndex int
+	// Rejected events, filters and uploads kept for /admin/rejections, 0 = off
+	AuditLogSize int
+	// Listeners and the policy profile bound to each
+	Profiles []*PolicyProfile
 }
 
 type NostrData struct {
@@ -61,68 +239,174 @@ var db DBBackend
 var fs afero.Fs
 var config Config
 var deriver *keyderivation.NostrKeyDeriver
+var registry *keyderivation.KeyRegistry
 
-func main() {
+// runServe runs the relay, the default command.
+func runServe(args []string) {
+	applyFlags(args)
 	relay = khatru.NewRelay()
 	config = LoadConfig()
+	relay.Log = relayLogger()
+
+	// Optionally trace storage, queries and blob I/O; wraps db and blobStore
+	if config.TracingEndpoint != "" {
+		if err := setupTracing(context.Background()); err != nil {
+			fatal("Failed to initialize tracing", "err", err)
+		}
+	}
+
+	// Optionally keep the results of common timeline filters in memory; wraps db
+	if config.HotCacheSize > 0 {
+		setupHotCache()
+	}
 
 	// Initialize key deriver if configured
 	if err := initDeriver(config); err != nil {
-		log.Fatalf("Failed to initialize key deriver: %v", err)
+		fatal("Failed to initialize key deriver", "err", err)
+	}
+
+	// Precompute derived pubkeys so access checks don't re-derive on every event
+	config.MaxDerivationIndex = loadMaxDerivationIndex(context.Background(), config.MaxDerivationIndex)
+	if deriver != nil {
+		r, err := keyderivation.NewKeyRegistry(deriver, uint32(config.MaxDerivationIndex))
+		if err != nil {
+			fatal("Failed to derive member keys", "err", err)
+		}
+		registry = r
+	}
+
+	// Keep accepting the keys of a seed being rotated out
+	if err := setupSeedRotation(context.Background()); err != nil {
+		fatal("Failed to set up seed rotation", "err", err)
 	}
 
 	// Startup status log
 	if deriver != nil {
-		log.Printf("Access control: deriver ACTIVE (BIP32), MaxDerivationIndex=%d", config.MaxDerivationIndex)
+		mode := "BIP32"
+		if deriver.IsWatchOnly() {
+			mode = "BIP32 watch-only"
+		}
+		slog.Info("Access control: deriver ACTIVE", "mode", mode, "scheme", deriver.Scheme(), "max_derivation_index", config.MaxDerivationIndex)
 	} else {
-		log.Printf("Access control: deriver INACTIVE")
+		slog.Info("Access control: deriver INACTIVE")
 	}
-	if config.ReadsRestricted {
-		log.Printf("Reads restriction: ENABLED (queries must specify authors derived from master)")
-	} else {
-		log.Printf("Reads restriction: DISABLED")
+	for _, p := range config.Profiles {
+		slog.Info("Listener profile", "profile", p)
 	}
 
 	relay.StoreEvent = append(relay.StoreEvent, db.SaveEvent)
-	relay.QueryEvents = append(relay.QueryEvents, db.QueryEvents)
+	relay.ReplaceEvent = append(relay.ReplaceEvent, db.ReplaceEvent)
+	relay.QueryEvents = append(relay.QueryEvents, timeQuery(queryEvents))
+	relay.CountEvents = append(relay.CountEvents, timeCount(countEvents))
+	relay.DeleteEvent = append(relay.DeleteEvent, db.DeleteEvent)
 
-	if config.TeamDomain != "" {
-		fetchNostrData(config.TeamDomain)
+	// Default and maximum limits on client filters
+	setupQueryLimits(relay)
 
-		go func() {
-			for {
-				time.Sleep(1 * time.Hour)
-				fetchNostrData(config.TeamDomain)
-			}
-		}()
+	// Older versions of replaceable events left by earlier releases
+	go sweepReplaceableOnce()
+
+	// Websocket sessions are tracked so shutdown can close them
+	trackSessions(relay)
+
+	// Keepalive and message size of client websockets
+	setupWebSocket(relay)
+
+	// Archive mode keeps encrypted tombstones of deleted events
+	if config.ArchiveMode {
+		setupArchiveMode(relay)
 	}
 
+	// NIP-40: refuse and sweep expired events
+	setupExpiration(relay)
+
+	// Refuse events dated too far in the future or past
+	if config.MaxFutureSkewSeconds > 0 || config.MaxEventAgeDays > 0 {
+		setupTimestampPolicy(relay)
+	}
+
+	// Optionally prune events by kind, age, count per pubkey and database size
+	if len(config.RetentionRules) > 0 || config.RetentionMaxDBSizeMB > 0 {
+		setupRetention(relay)
+	}
+
+	// Cleanup policy for content of members who leave the team
+	setupMemberCleanup(relay)
+
+	// Runtime team membership management
+	setupMembersAPI(relay)
+
+	// Which derivation indices are in use and by whom, and raising the bound
+	// at runtime
+	if registry != nil {
+		setupRosterAPI(relay)
+		setupDerivationAPI(relay)
+		setupAssignmentsAPI(relay)
+	}
+
+	// One-time claim links handing members the key of a fresh index
+	if registry != nil && deriver != nil && !deriver.IsWatchOnly() {
+		setupProvisioningAPI(relay)
+	}
+
+	// Static allow/deny lists and the persisted ban list
+	setupPubkeyLists(relay)
+
+	// Per-IP connection limits and the persisted IP ban list
+	setupIPGuard(relay)
+
+	// Size, content length and tag count limits
+	if config.EventLimits != (EventLimits{}) || len(config.KindLimits) > 0 {
+		setupEventLimits(relay)
+	}
+
+	// NIP-56 reports and the moderation queue
+	if config.ModerationEnabled {
+		setupModeration(relay)
+	}
+
+	// Optionally sell write access to pubkeys outside the team
+	if config.PaidAccess {
+		setupPaidAccess(relay)
+	}
+
+	// Membership from a list published by an admin
+	if config.TeamListKind != 0 {
+		setupTeamList(relay)
+	}
+
+	// NIP-29 groups hosted for the team
+	if config.GroupsEnabled {
+		if err := setupGroups(relay); err != nil {
+			fatal("Failed to initialize groups", "err", err)
+		}
+	}
+
+	// Gift-wrapped DMs for members, read only by their recipients
+	if config.DMRelayMode {
+		setupDMRelay(relay)
+	}
+
+	// Optionally let the pubkeys the team follows write too
+	if config.WoTDepth > 0 {
+		setupWebOfTrust()
+	}
+
+	// Team membership from TEAM_DOMAIN's nostr.json, refreshed periodically
+	setupTeamRefresh(relay)
+
 	relay.RejectEvent = append(relay.RejectEvent, func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
-		// If we have a deriver and the event pubkey belongs to master, allow writes (subject to allowed kinds)
-		belongsToMaster := false
-		if deriver != nil {
-			b, _, err := deriver.CheckKeyBelongsToMaster(event.PubKey, uint32(config.MaxDerivationIndex), true)
-			if err != nil {
-				log.Printf("Error checking key against master: %v", err)
-			}
-			belongsToMaster = b
-		}
-		// If TEAM_DOMAIN is set and the key does NOT belong to master, enforce team membership; otherwise, skip this check
-		if config.TeamDomain != "" && !belongsToMaster {
-			// Check if user is part of the team
-			isTeamMember := false
-			for _, pubkey := range data.Names {
-				if event.PubKey == pubkey {
-					isTeamMember = true
-					break
-				}
-			}
-			if !isTeamMember {
-				return true, "you are not part of the team"
-			}
+		// Banned pubkeys are refused before anything else is considered
+		if isBanned(event.PubKey) {
+			return true, "blocked: pubkey is banned"
+		}
+		// Federation peers announce their members before pushing their events
+		if isFederationRoster(ctx, event) {
+			return false, ""
 		}
 
-		// Check if event kind is allowed
+		// Check if event kind is allowed; this applies to every author, so it
+		// comes before the exemptions from the team check below
 		if len(config.AllowedKinds) > 0 {
 			isKindAllowed := false
 			for _, allowedKind := range config.AllowedKinds {
@@ -136,114 +420,197 @@ func main() {
 			}
 		}
 
-		return false, "" // allow
-	})
+		// NIP-46 requests for our members come from the clients' throwaway keys
+		if isBunkerRequest(event) {
+			return false, ""
+		}
+		// Admins may publish the membership list without being members
+		if isTeamListEvent(event) {
+			return false, ""
+		}
+		// Anyone may report content stored here (NIP-56)
+		if isReportForUs(ctx, event) {
+			return false, ""
+		}
+		// Group members need not be on the team; the group hooks already checked them
+		if isGroupEvent(event) {
+			return false, ""
+		}
+		// Gift wraps are signed with throwaway keys; what matters is the recipient
+		if isGiftWrapForMember(event) {
+			return false, ""
+		}
 
-	// Optionally restrict reads: only allow filters that target authors derived from master
-	if config.ReadsRestricted {
-		relay.RejectFilter = append(relay.RejectFilter, func(ctx context.Context, filter nostr.Filter) (bool, string) {
-			if deriver == nil {
-				// If we cannot validate, reject by default when reads are restricted
-				return true, "reads are restricted but key deriver is not configured"
-			}
-			// If authors are provided, ensure all are descendants of master
-			if len(filter.Authors) > 0 {
-				for _, a := range filter.Authors {
-					belongs, _, err := deriver.CheckKeyBelongsToMaster(a, uint32(config.MaxDerivationIndex), true)
-					if err != nil {
-						return true, fmt.Sprintf("error validating author: %v", err)
-					}
-					if !belongs {
-						return true, "author not allowed by read restrictions"
-					}
+		// If TEAM_DOMAIN is set (or members were added by an admin) and the key does NOT belong to master,
+		// enforce team membership; otherwise, skip this check.
+		// Events pushed by an authenticated federation peer are accepted for the members on its roster.
+		if teamRestricted() && !traceDerivationCheck(ctx, event.PubKey) && !isPeerMemberEvent(ctx, event) {
+			if !isTeamMember(event.PubKey) && !isWhitelisted(event.PubKey) && !hasPaidAccess(event.PubKey) && !isTrusted(event.PubKey) {
+				if len(federationPeers) > 0 && khatru.GetConnection(ctx) != nil && khatru.GetAuthed(ctx) == "" {
+					// give peers a chance to identify themselves
+					khatru.RequestAuth(ctx)
+					return true, "auth-required: federated peers must authenticate"
 				}
-				return false, ""
+				if isFederatedPeer(ctx) {
+					return true, "restricted: author is not on the peer's roster"
+				}
+				if config.PaidAccess {
+					return true, "restricted: write access must be paid for at /pay"
+				}
+				return true, "you are not part of the team"
 			}
-			// If no authors specified, disallow broad reads under restriction
-			return true, "reads restricted: specify allowed authors"
-		})
-	}
-
-	// Setup front page handler
-	setupFrontPageHandler(relay, config)
+		}
 
-	// Add handler for TeamHigher.jpg
-	relay.Router().HandleFunc("/public/TeamHigher.jpg", func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, "./public/TeamHigher.jpg")
+		return false, "" // allow
 	})
 
-	if !config.BlossomEnabled {
-		// Configure HTTP server with timeouts suitable for large file uploads
-		server := &http.Server{
-			Addr:              ":3334",
-			Handler:           relay,
-			ReadTimeout:       15 * time.Minute, // Increased to 15 minutes for very large files
-			WriteTimeout:      15 * time.Minute, // Increased to 15 minutes
-			IdleTimeout:       5 * time.Minute,  // Increased idle timeout
-			ReadHeaderTimeout: 30 * time.Second, // Prevent slow header attacks
-			MaxHeaderBytes:    1 << 20,          // 1MB max header size
-		}
-
-		fmt.Println("running on :3334 with extended timeouts for large uploads")
-		server.ListenAndServe()
-		return
+	// Optionally make non-members pay for their events with proof of work
+	if config.MinPowDifficulty > 0 {
+		setupProofOfWork(relay)
 	}
 
-	bl := blossom.New(relay, *config.BlossomURL)
-	bl.Store = blossom.EventStoreBlobIndexWrapper{Store: db, ServiceURL: bl.ServiceURL}
-	bl.StoreBlob = append(bl.StoreBlob, func(ctx context.Context, sha256 string, body []byte) error {
-		// Create context with timeout for large file operations
-		storeCtx, cancel := context.WithTimeout(ctx, 10*time.Minute)
-		defer cancel()
+	// Optionally pull members' events from their NIP-65 write relays
+	if config.OutboxBackfill {
+		setupOutboxBackfill(relay)
+	}
 
-		file, err := fs.Create(*config.BlossomPath + sha256)
-		if err != nil {
-			return err
+	// Optionally exchange member events with partner higher instances
+	if len(config.FederationPeers) > 0 {
+		if err := setupFederation(relay); err != nil {
+			fatal("Failed to initialize federation", "err", err)
 		}
-		defer file.Close()
+	}
 
-		// Use streaming copy with context checking for large files
-		reader := bytes.NewReader(body)
-		buffer := make([]byte, 32*1024) // 32KB buffer for efficient copying
+	// Optionally republish accepted events to upstream relays
+	if len(config.ForwardRelays) > 0 {
+		setupForwarding(relay)
+	}
 
-		for {
-			select {
-			case <-storeCtx.Done():
-				return storeCtx.Err()
-			default:
-			}
+	// Optionally notify HTTP endpoints of stored events
+	if len(config.Webhooks) > 0 {
+		setupWebhooks(relay)
+	}
+
+	// Optionally answer NIP-46 requests with members' derived keys
+	if config.BunkerEnabled {
+		if err := setupBunker(relay); err != nil {
+			fatal("Failed to initialize bunker", "err", err)
+		}
+	}
 
-			n, err := reader.Read(buffer)
-			if n > 0 {
-				if _, writeErr := file.Write(buffer[:n]); writeErr != nil {
-					return writeErr
+	// Optionally restrict reads: only allow filters that target authors derived from master.
+	// Whether reads are restricted depends on the profile of the listener the client connected to.
+	// COUNT requests (NIP-45) go through the same checks.
+	restrictReads := func(ctx context.Context, filter nostr.Filter) (bool, string) {
+		if !activeProfile(ctx).ReadsRestricted {
+			return false, ""
+		}
+		// Authenticated federation peers may read everything
+		if isFederatedPeer(ctx) {
+			return false, ""
+		}
+		// Bunker clients wait for responses addressed to them
+		if isBunkerFilter(filter) {
+			return false, ""
+		}
+		// So do members reading their gift-wrapped DMs
+		if isOwnGiftWrapFilter(ctx, filter) {
+			return false, ""
+		}
+		// Kinds listed in READS_PUBLIC_KINDS stay readable by anyone
+		if isPublicKindFilter(filter) {
+			return false, ""
+		}
+		if deriver == nil {
+			// If we cannot validate, reject by default when reads are restricted
+			return true, "reads are restricted but key deriver is not configured"
+		}
+		// If authors are provided, ensure all are descendants of master that
+		// were not revoked
+		if len(filter.Authors) > 0 {
+			for _, a := range filter.Authors {
+				if !belongsToMaster(a) {
+					return true, "author not allowed by read restrictions"
 				}
 			}
-			if err == io.EOF {
-				break
+			return false, ""
+		}
+		// Replies, mentions and DMs addressed to members
+		if tagged := filter.Tags["p"]; len(tagged) > 0 {
+			if allMembers(tagged) {
+				return false, ""
 			}
-			if err != nil {
-				return err
+			return true, "#p not allowed by read restrictions"
+		}
+		// Events fetched by id, as long as each is by or addressed to a member
+		if len(filter.IDs) > 0 {
+			if reject, reason := rejectRestrictedIDs(ctx, filter.IDs); reject {
+				return true, reason
 			}
+			return false, ""
 		}
+		// If no authors specified, disallow broad reads under restriction
+		return true, "reads restricted: specify allowed authors"
+	}
+	relay.RejectFilter = append(relay.RejectFilter, restrictReads)
+	relay.RejectCountFilter = append(relay.RejectCountFilter, restrictReads)
 
-		return file.Sync() // Ensure data is written to disk
-	})
+	// Per-listener rate limits
+	setupProfileRateLimits(relay)
 
-	bl.LoadBlob = append(bl.LoadBlob, func(ctx context.Context, sha256 string) (io.ReadSeeker, error) {
-		filePath := *config.BlossomPath + sha256
-		log.Printf("LoadBlob: Attempting to open file at path: %s", filePath)
-		file, err := fs.Open(filePath)
-		if err != nil {
-			log.Printf("LoadBlob: Failed to open file %s: %v", filePath, err)
-			return nil, err
+	// Refuse or drop repeated content; after the event policies above so refused events don't count
+	if config.FloodWindowSeconds > 0 && (config.FloodMaxCopies > 0 || config.FloodBurstLimit > 0) {
+		setupFloodProtection(relay)
+	}
+
+	// Optionally act as the NIP-05 server for the team domain
+	if config.NIP05Enabled {
+		setupNIP05(relay)
+	}
+
+	// Setup front page handler
+	setupFrontPageHandler(relay, config)
+
+	// Relay statistics as JSON for dashboards and bots
+	setupStatsAPI(relay)
+
+	// Optionally back the event store up to S3, encrypted
+	if config.BackupIntervalHours > 0 {
+		setupBackups(relay)
+	}
+
+	// Static assets and the relay icon/banner
+	setupBranding(relay)
+
+	if !config.BlossomEnabled {
+		if config.AuditLogSize > 0 {
+			setupRejectionAudit(relay, nil)
 		}
-		log.Printf("LoadBlob: Successfully opened file %s", filePath)
-		return file, nil
+		serve(relay)
+		return
+	}
+
+	bl := blossom.New(relay, *config.BlossomURL)
+	bl.Store = blossom.EventStoreBlobIndexWrapper{Store: db, ServiceURL: bl.ServiceURL}
+	setupFrozenBlobs(bl)
+	// Blobs flagged by the malware scan or the integrity check are withheld
+	if blobScanner != nil || config.BlobVerifyQuarantine {
+		setupQuarantine(relay, bl)
+	}
+	// Scan blobs for malware before they are stored
+	if blobScanner != nil {
+		setupBlobScanning(bl)
+	}
+	bl.StoreBlob = append(bl.StoreBlob, storeBlob)
+	bl.LoadBlob = append(bl.LoadBlob, func(ctx context.Context, sha256 string) (io.ReadSeeker, error) {
+		touchBlob(sha256)
+		return blobStore.Get(ctx, sha256)
 	})
 	bl.DeleteBlob = append(bl.DeleteBlob, func(ctx context.Context, sha256 string) error {
-		return fs.Remove(*config.BlossomPath + sha256)
+		return blobStore.Delete(ctx, sha256)
 	})
+	// BUD-09 reports land in the moderation queue
+	bl.ReceiveReport = append(bl.ReceiveReport, fileBlobReport(relay))
 	bl.RejectUpload = append(bl.RejectUpload, func(ctx context.Context, event *nostr.Event, size int, ext string) (bool, string, int) {
 		// Check for configurable size limit
 		maxSize := config.MaxUploadSizeMB * 1024 * 1024
@@ -251,23 +618,24 @@ func main() {
 			return true, fmt.Sprintf("file size exceeds %dMB limit", config.MaxUploadSizeMB), 413
 		}
 
+		// Check the content type against BLOSSOM_ALLOWED_TYPES / BLOSSOM_BLOCKED_TYPES
+		if reject, reason, code := rejectBlobType(ctx, ext); reject {
+			return true, reason, code
+		}
+
+		if isBanned(event.PubKey) {
+			return true, "pubkey is banned", 403
+		}
+
 		// First allow if the event's pubkey is derived from the master key (when deriver is configured)
-		if deriver != nil {
-			belongs, _, err := deriver.CheckKeyBelongsToMaster(event.PubKey, uint32(config.MaxDerivationIndex), true)
-			if err != nil {
-				log.Printf("Error checking upload key against master: %v", err)
-			}
-			if belongs {
-				return false, ext, size
-			}
+		if traceDerivationCheck(ctx, event.PubKey) {
+			return false, ext, size
 		}
 
-		// Otherwise, if TEAM_DOMAIN is set, enforce team membership
-		if config.TeamDomain != "" {
-			for _, pubkey := range data.Names {
-				if pubkey == event.PubKey {
-					return false, ext, size
-				}
+		// Otherwise, if TEAM_DOMAIN is set or members were added by an admin, enforce team membership
+		if teamRestricted() {
+			if isTeamMember(event.PubKey) || isWhitelisted(event.PubKey) || hasPaidAccess(event.PubKey) {
+				return false, ext, size
 			}
 			return true, "you are not part of the team", 403
 		}
@@ -276,273 +644,385 @@ func main() {
 		return false, ext, size
 	})
 
-	// Add custom list endpoint for Sakura health checks
-	relay.Router().HandleFunc("/list/", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != "GET" {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
+	if config.MaxConcurrentUploads > 0 {
+		uploadSlots = make(chan struct{}, config.MaxConcurrentUploads)
+	}
 
-		// Extract pubkey from URL path
-		pubkey := strings.TrimPrefix(r.URL.Path, "/list/")
-		if pubkey == "" {
-			http.Error(w, "Missing pubkey", http.StatusBadRequest)
-			return
-		}
+	// Expose progress tracking for large uploads
+	setupUploadStatusHandlers(relay)
 
-		log.Printf("List blobs request for pubkey: %s", pubkey)
+	// Add custom list endpoint for Sakura health checks
+	setupBlobList(relay, bl)
 
-		// Read all files from the blossom directory
-		blobs := []map[string]interface{}{}
+	// BUD-04 mirror endpoint, also used by Sakura
+	setupMirrorHandler(relay, bl)
 
-		if config.BlossomPath != nil {
-			file, err := fs.Open(*config.BlossomPath)
-			if err != nil {
-				log.Printf("Error opening blossom directory: %v", err)
-			} else {
-				defer file.Close()
-				fileInfos, err := file.Readdir(-1)
-				if err != nil {
-					log.Printf("Error reading blossom directory: %v", err)
-				} else {
-					for _, fileInfo := range fileInfos {
-						if !fileInfo.IsDir() {
-							fileName := fileInfo.Name()
-							// Validate that it looks like a SHA256 hash (64 hex characters)
-							if len(fileName) == 64 {
-								isValidHash := true
-								for _, char := range fileName {
-									if !((char >= '0' && char <= '9') || (char >= 'a' && char <= 'f') || (char >= 'A' && char <= 'F')) {
-										isValidHash = false
-										break
-									}
-								}
-
-								if isValidHash {
-									// Detect MIME type by reading the first 512 bytes
-									contentType := "application/octet-stream" // Default fallback
-									filePath := *config.BlossomPath + fileName
-									if blobFile, err := fs.Open(filePath); err == nil {
-										buffer := make([]byte, 512)
-										if n, err := blobFile.Read(buffer); err == nil && n > 0 {
-											detectedType := http.DetectContentType(buffer[:n])
-											if detectedType != "" {
-												contentType = detectedType
-											}
-										}
-										blobFile.Close()
-									}
-
-									blob := map[string]interface{}{
-										"sha256":   strings.ToLower(fileName),
-										"size":     fileInfo.Size(),
-										"type":     contentType,
-										"url":      *config.BlossomURL + "/" + strings.ToLower(fileName),
-										"uploaded": fileInfo.ModTime().Unix(),
-									}
-									blobs = append(blobs, blob)
-									log.Printf("Found blob: %s (size: %d, type: %s)", fileName, fileInfo.Size(), contentType)
-								}
-							}
-						}
-					}
-				}
-			}
+	// Optionally store downscaled variants of uploaded images
+	if len(config.ThumbnailSizes) > 0 {
+		setupThumbnails(bl)
+	}
+
+	// Optionally publish kind 1063 file metadata for every stored blob
+	if config.NIP94AutoPublish {
+		if err := setupFileMetadata(relay, bl); err != nil {
+			fatal("Failed to initialize NIP-94 publishing", "err", err)
 		}
+	}
 
-		log.Printf("Returning %d blobs for pubkey %s", len(blobs), pubkey)
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(blobs)
-	})
+	// Events pointing at blobs hosted here must name stored blobs
+	if config.FileEventBlobCheck != fileEventCheckOff {
+		setupFileEventBlobCheck(relay)
+	}
 
-	// Add custom mirror endpoint handler for Sakura compatibility
-	relay.Router().HandleFunc("/mirror", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != "PUT" {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
+	// NIP-96 file storage API on the same blob store
+	if strings.Trim(config.NIP96Path, "/") != "" {
+		setupNIP96(relay, bl)
+	}
 
-		// Parse the request body to get source URL
-		var mirrorRequest struct {
-			URL string `json:"url"`
-		}
+	// Member-only web view of the stored images and videos
+	setupGallery(relay, bl)
 
-		if err := json.NewDecoder(r.Body).Decode(&mirrorRequest); err != nil {
-			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
-			return
-		}
+	// Garbage collection of blobs no stored event references
+	setupBlobGC(relay)
 
-		if mirrorRequest.URL == "" {
-			http.Error(w, "Missing source URL", http.StatusBadRequest)
-			return
-		}
+	// Periodic re-hashing of stored blobs
+	setupBlobVerify(relay)
 
-		// Extract blob hash from source URL
-		blobHash := extractSha256FromURL(mirrorRequest.URL)
-		if blobHash == "" {
-			http.Error(w, "Cannot extract blob hash from source URL", http.StatusBadRequest)
-			return
-		}
+	// Expiry of untouched blobs, or their move to the cold tier
+	setupBlobTiering(relay)
 
-		// Check if blob already exists
-		if _, err := fs.Open(*config.BlossomPath + blobHash); err == nil {
-			// Blob already exists, return success
-			response := map[string]interface{}{
-				"sha256": blobHash,
-				"url":    *config.BlossomURL + "/" + blobHash,
-				"size":   0, // We don't know the size without reading the file
-			}
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(response)
-			return
-		}
+	// Optionally mirror members' blobs from the servers in their BUD-03 lists
+	if config.BlossomAutoMirror {
+		setupServerListMirroring(relay, bl)
+	}
 
-		// Download blob from source URL
-		resp, err := http.Get(mirrorRequest.URL)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to fetch source blob: %v", err), http.StatusBadGateway)
-			return
-		}
-		defer resp.Body.Close()
+	// Optionally keep local copies of the media members' events reference
+	if config.MirrorReferencedMedia {
+		setupReferencedMediaMirroring(relay, bl)
+	}
 
-		if resp.StatusCode != http.StatusOK {
-			http.Error(w, fmt.Sprintf("Source server returned %d", resp.StatusCode), http.StatusBadGateway)
-			return
-		}
+	// Map remote media URLs to their local copies
+	if config.MirrorReferencedMedia || config.BlossomAutoMirror {
+		setupMediaResolve(relay)
+	}
 
-		// Read and verify the blob content
-		blobData, err := io.ReadAll(resp.Body)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to read blob data: %v", err), http.StatusInternalServerError)
-			return
-		}
+	// Record what the policy hooks above refuse; must come after all of them
+	if config.AuditLogSize > 0 {
+		setupRejectionAudit(relay, bl)
+	}
 
-		// Verify the hash matches
-		hasher := sha256.New()
-		hasher.Write(blobData)
-		actualHash := hex.EncodeToString(hasher.Sum(nil))
+	serve(limitEndpoints(redirectColdBlobs(bl, trackUploads(withThumbnailResponses(streamUploads(bl, deleteBlobs(bl, receiveBlobReports(bl, relay))))))))
+}
 
-		if actualHash != blobHash {
-			http.Error(w, "Blob hash mismatch", http.StatusBadRequest)
-			return
-		}
+func btoi(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
 
-		// Store the blob using the existing StoreBlob functionality
-		ctx := r.Context()
-		for _, storeFunc := range bl.StoreBlob {
-			if err := storeFunc(ctx, blobHash, blobData); err != nil {
-				http.Error(w, fmt.Sprintf("Failed to store blob: %v", err), http.StatusInternalServerError)
-				return
-			}
+func containsValue(m map[string]string, value string) bool {
+	for _, v := range m {
+		if v == value {
+			return true
 		}
+	}
+	return false
+}
 
-		// Return success response
-		response := map[string]interface{}{
-			"sha256": blobHash,
-			"url":    *config.BlossomURL + "/" + blobHash,
-			"size":   len(blobData),
-		}
+func LoadConfig() Config {
+	err := godotenv.Load(flags.EnvFile)
+	if err != nil {
+		log.Fatalf("Error loading %s file", flags.EnvFile)
+	}
+	if err := setupLogging(getEnvWithDefault("LOG_FORMAT", "text"), getEnvWithDefault("LOG_LEVEL", "info")); err != nil {
+		log.Fatalf("Configuration error: %v", err)
+	}
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(response)
+	config := Config{
+		RelayName:                 getEnv("RELAY_NAME"),
+		RelayPubkey:               getEnv("RELAY_PUBKEY"),
+		RelayDescription:          getEnv("RELAY_DESCRIPTION"),
+		TeamDomain:                getEnv("TEAM_DOMAIN"),
+		TeamRefreshMinutes:        getEnvIntWithDefault("TEAM_REFRESH_MINUTES", 60),
+		BlossomEnabled:            getEnvBool("BLOSSOM_ENABLED"),
+		BlossomPath:               getEnvNullable("BLOSSOM_PATH"),
+		BlossomStorage:            strings.ToLower(getEnvWithDefault("BLOSSOM_STORAGE", "fs")),
+		BlossomLayout:             strings.ToLower(getEnvWithDefault("BLOSSOM_LAYOUT", "flat")),
+		S3:                        loadS3Config("S3_"),
+		Branding:                  loadBrandingConfig(),
+		EventLimits:               loadEventLimits(),
+		FrontPageTemplateDir:      getEnvWithDefault("FRONTPAGE_TEMPLATE_DIR", ""),
+		BlossomURL:                getEnvNullable("BLOSSOM_URL"),
+		WebsocketURL:              getEnvNullable("WEBSOCKET_URL"),
+		ListenSocket:              getEnvNullable("LISTEN_SOCKET"),
+		ListenSocketGroup:         getEnvWithDefault("LISTEN_SOCKET_GROUP", ""),
+		ListenSocketOnly:          getEnvBool("LISTEN_SOCKET_ONLY"),
+		WSPingIntervalSeconds:     getEnvIntWithDefault("WS_PING_INTERVAL_SECONDS", 30),
+		WSPongTimeoutSeconds:      getEnvIntWithDefault("WS_PONG_TIMEOUT_SECONDS", 60),
+		WSMaxMessageSize:          getEnvIntWithDefault("WS_MAX_MESSAGE_SIZE", 512000),
+		TracingEndpoint:           getEnvWithDefault("OTEL_EXPORTER_OTLP_ENDPOINT", ""),
+		TracingServiceName:        getEnvWithDefault("OTEL_SERVICE_NAME", "higher"),
+		TrustedProxies:            parseList(getEnvNullable("TRUSTED_PROXIES")),
+		MaxConnectionsPerIP:       getEnvIntWithDefault("MAX_CONNECTIONS_PER_IP", 0),
+		ConnectionRateLimit:       getEnvIntWithDefault("CONNECTION_RATE_LIMIT", 0),
+		BannedIPs:                 parseList(getEnvNullable("BANNED_IPS")),
+		AllowedKinds:              parseAllowedKinds(getEnvNullable("ALLOWED_KINDS")),
+		MaxUploadSizeMB:           getEnvIntWithDefault("MAX_UPLOAD_SIZE_MB", 200),
+		AllowedTypes:              parseList(getEnvNullable("BLOSSOM_ALLOWED_TYPES")),
+		BlockedTypes:              parseList(getEnvNullable("BLOSSOM_BLOCKED_TYPES")),
+		ScanBackend:               strings.ToLower(getEnvWithDefault("SCAN_BACKEND", "")),
+		ClamdAddress:              getEnvWithDefault("CLAMD_ADDRESS", "unix:/var/run/clamav/clamd.ctl"),
+		ScanHTTPURL:               getEnvWithDefault("SCAN_HTTP_URL", ""),
+		ScanFailOpen:              getEnvBool("SCAN_FAIL_OPEN"),
+		ScanRescanHours:           getEnvIntWithDefault("SCAN_RESCAN_HOURS", 24),
+		NIP96Path:                 getEnvWithDefault("NIP96_PATH", "/api/v2/nip96"),
+		NIP94AutoPublish:          getEnvBool("NIP94_AUTO_PUBLISH"),
+		NIP94SignerIndex:          getEnvIntWithDefault("NIP94_SIGNER_INDEX", 1000001),
+		BlobGC:                    getEnvBool("BLOB_GC"),
+		BlobGCIntervalHours:       getEnvIntWithDefault("BLOB_GC_INTERVAL_HOURS", 24),
+		BlobGCGraceHours:          getEnvIntWithDefault("BLOB_GC_GRACE_HOURS", 72),
+		BlobVerifyIntervalHours:   getEnvIntWithDefault("BLOB_VERIFY_INTERVAL_HOURS", 0),
+		BlobVerifyQuarantine:      getEnvBool("BLOB_VERIFY_QUARANTINE"),
+		BlobTiering:               loadBlobTieringConfig(),
+		BlossomAutoMirror:         getEnvBool("BLOSSOM_AUTO_MIRROR"),
+		AutoMirrorIntervalMinutes: getEnvIntWithDefault("BLOSSOM_AUTO_MIRROR_INTERVAL_MINUTES", 360),
+		FileEventBlobCheck:        strings.ToLower(getEnvWithDefault("FILE_EVENT_BLOB_CHECK", fileEventCheckWarn)),
+		MirrorReferencedMedia:     getEnvBool("BLOSSOM_MIRROR_REFERENCED"),
+		MirrorReferencedWorkers:   getEnvIntWithDefault("BLOSSOM_MIRROR_REFERENCED_WORKERS", 2),
+		MirrorTimeoutSeconds:      getEnvIntWithDefault("MIRROR_TIMEOUT_SECONDS", 300),
+		MirrorAllowPrivate:        getEnvBool("MIRROR_ALLOW_PRIVATE"),
+		MaxConcurrentUploads:      getEnvIntWithDefault("MAX_CONCURRENT_UPLOADS", 0),
+		UploadRateLimit:           getEnvIntWithDefault("UPLOAD_RATE_LIMIT", 0),
+		MirrorRateLimit:           getEnvIntWithDefault("MIRROR_RATE_LIMIT", 0),
+		ListRateLimit:             getEnvIntWithDefault("LIST_RATE_LIMIT", 0),
+		BlobGetRateLimit:          getEnvIntWithDefault("BLOB_GET_RATE_LIMIT", 0),
+		OutboxBackfill:            getEnvBool("OUTBOX_BACKFILL"),
+		BackfillIntervalMinutes:   getEnvIntWithDefault("OUTBOX_BACKFILL_INTERVAL_MINUTES", 60),
+		BackfillLookbackHours:     getEnvIntWithDefault("OUTBOX_BACKFILL_LOOKBACK_HOURS", 24),
+		BackfillBootstrapRelays:   parseList(getEnvNullable("OUTBOX_BOOTSTRAP_RELAYS")),
+		WoTDepth:                  getEnvIntWithDefault("WOT_DEPTH", 0),
+		WoTRelays:                 parseList(getEnvNullable("WOT_RELAYS")),
+		WoTRefreshMinutes:         getEnvIntWithDefault("WOT_REFRESH_MINUTES", 360),
+		FederationPeers:           parseList(getEnvNullable("FEDERATION_PEERS")),
+		FederationServiceIndex:    getEnvIntWithDefault("FEDERATION_SERVICE_INDEX", 1000000),
+		BunkerEnabled:             getEnvBool("BUNKER_ENABLED"),
+		GroupsEnabled:             getEnvBool("GROUPS_ENABLED"),
+		GroupsSignerIndex:         getEnvIntWithDefault("GROUPS_SIGNER_INDEX", 1000002),
+		DMRelayMode:               getEnvBool("DM_RELAY_MODE"),
+		WebhookSecret:             getEnvWithDefault("WEBHOOK_SECRET", ""),
+		WebhookMaxRetries:         getEnvIntWithDefault("WEBHOOK_MAX_RETRIES", 5),
+		ForwardRelays:             parseList(getEnvNullable("FORWARD_RELAYS")),
+		ForwardKinds:              parseAllowedKinds(getEnvNullable("FORWARD_KINDS")),
+		ForwardMembersOnly:        getEnvBool("FORWARD_MEMBERS_ONLY"),
+		RetentionMaxDBSizeMB:      getEnvIntWithDefault("RETENTION_MAX_DB_SIZE_MB", 0),
+		RetentionIntervalMinutes:  getEnvIntWithDefault("RETENTION_INTERVAL_MINUTES", 60),
+		ExpirationSweepMinutes:    getEnvIntWithDefault("EXPIRATION_SWEEP_MINUTES", 10),
+		MaxFutureSkewSeconds:      getEnvIntWithDefault("MAX_FUTURE_SKEW_SECONDS", 0),
+		MaxEventAgeDays:           getEnvIntWithDefault("MAX_EVENT_AGE_DAYS", 0),
+		FloodWindowSeconds:        getEnvIntWithDefault("FLOOD_WINDOW_SECONDS", 60),
+		FloodMaxCopies:            getEnvIntWithDefault("FLOOD_MAX_COPIES", 0),
+		FloodBurstLimit:           getEnvIntWithDefault("FLOOD_BURST_LIMIT", 0),
+		FloodPolicy:               strings.ToLower(getEnvWithDefault("FLOOD_POLICY", floodReject)),
+		QueryDefaultLimit:         getEnvIntWithDefault("QUERY_DEFAULT_LIMIT", 500),
+		QueryMaxLimit:             getEnvIntWithDefault("QUERY_MAX_LIMIT", 1000),
+		QueryTimeoutSeconds:       getEnvIntWithDefault("QUERY_TIMEOUT_SECONDS", 10),
+		SlowQueryMS:               getEnvIntWithDefault("SLOW_QUERY_MS", 1000),
+		HotCacheSize:              getEnvIntWithDefault("HOT_CACHE_SIZE", 0),
+		HotCacheMaxLimit:          getEnvIntWithDefault("HOT_CACHE_MAX_LIMIT", 500),
+		BackupIntervalHours:       getEnvIntWithDefault("BACKUP_INTERVAL_HOURS", 0),
+		BackupKeep:                getEnvIntWithDefault("BACKUP_KEEP", 7),
+		BackupS3:                  loadS3Config("BACKUP_S3_"),
+		MinPowDifficulty:          getEnvIntWithDefault("MIN_POW_DIFFICULTY", 0),
+		ShutdownTimeoutSeconds:    getEnvIntWithDefault("SHUTDOWN_TIMEOUT_SECONDS", 30),
+		AdminPubkeys:              parseList(getEnvNullable("ADMIN_PUBKEYS")),
+		TeamListRelays:            parseList(getEnvNullable("TEAM_LIST_RELAYS")),
+		NIP05Enabled:              getEnvBool("NIP05_ENABLED"),
+		NIP05RosterPrefix:         strings.ToLower(getEnvWithDefault("NIP05_ROSTER_PREFIX", "")),
+		ModerationEnabled:         getEnvBool("MODERATION_ENABLED"),
+		PaidAccess:                getEnvBool("PAID_ACCESS"),
+		PaidAccessFeeSats:         getEnvIntWithDefault("PAID_ACCESS_FEE_SATS", 1000),
+		PaidAccessDays:            getEnvIntWithDefault("PAID_ACCESS_DAYS", 30),
+		PaidInvoiceRateLimit:      getEnvIntWithDefault("PAID_ACCESS_INVOICE_RATE_LIMIT", 5),
+		PaidMaxPending:            getEnvIntWithDefault("PAID_ACCESS_MAX_PENDING", 200),
+		Payments:                  loadPaymentConfig(),
+		ArchiveMode:               getEnvBool("ARCHIVE_MODE"),
+		ArchiveRetentionDays:      getEnvIntWithDefault("ARCHIVE_RETENTION_DAYS", 30),
+		MemberCleanupPolicy:       strings.ToLower(getEnvWithDefault("MEMBER_CLEANUP_POLICY", cleanupRetain)),
+		RelayMnemonic:             getEnvNullable("RELAY_MNEMONIC"),
+		MnemonicPassphrase:        getEnvWithDefault("RELAY_MNEMONIC_PASSPHRASE", ""),
+		RelaySeedHex:              getEnvNullable("RELAY_SEED_HEX"),
+		RelayXPub:                 getEnvNullable("RELAY_XPUB"),
+		MaxDerivationIndex:        getEnvIntWithDefault("MAX_DERIVATION_INDEX", 100),
+		ReadsRestricted:           getEnvBool("READS_RESTRICTED"),
+		ReadsPublicKinds:          parseAllowedKinds(getEnvNullable("READS_PUBLIC_KINDS")),
+		RetiredRelayMnemonic:      getEnvWithDefault("RETIRED_RELAY_MNEMONIC", ""),
+		RetiredMnemonicPassphrase: getEnvWithDefault("RETIRED_RELAY_MNEMONIC_PASSPHRASE", ""),
+		RotationWindowDays:        getEnvIntWithDefault("ROTATION_WINDOW_DAYS", 30),
+		ProvisionLinkTTLHours:     getEnvIntWithDefault("PROVISION_LINK_TTL_HOURS", 72),
+		KeyDeliveryRelays:         parseList(getEnvNullable("KEY_DELIVERY_RELAYS")),
+		KeyDeliverySenderIndex:    getEnvIntWithDefault("KEY_DELIVERY_SENDER_INDEX", 1000003),
+		AuditLogSize:              getEnvIntWithDefault("AUDIT_LOG_SIZE", 1000),
+	}
+	config.Profiles = parseProfiles(parseList(getEnvNullable("LISTENERS")), config.ReadsRestricted)
 
-		log.Printf("Successfully mirrored blob %s from %s", blobHash, mirrorRequest.URL)
-	})
+	// Enforce exactly one of RELAY_MNEMONIC, RELAY_SEED_HEX or RELAY_XPUB must be set
+	hasMnemonic := config.RelayMnemonic != nil && strings.TrimSpace(*config.RelayMnemonic) != ""
+	hasSeed := config.RelaySeedHex != nil && strings.TrimSpace(*config.RelaySeedHex) != ""
+	hasXPub := config.RelayXPub != nil && strings.TrimSpace(*config.RelayXPub) != ""
+	if btoi(hasMnemonic)+btoi(hasSeed)+btoi(hasXPub) != 1 {
+		fatal("Configuration error: you must set exactly one of RELAY_MNEMONIC, RELAY_SEED_HEX or RELAY_XPUB")
+	}
+	if hasXPub && config.ArchiveMode {
+		fatal("Configuration error: ARCHIVE_MODE encrypts tombstones with a seed-derived key and cannot run with RELAY_XPUB")
+	}
+	if !hasMnemonic && config.MnemonicPassphrase != "" {
+		slog.Warn("RELAY_MNEMONIC_PASSPHRASE is only used with RELAY_MNEMONIC")
+	}
+	scheme, err := keyderivation.ParseDerivationScheme(getEnvWithDefault("DERIVATION_SCHEME", "index"))
+	if err != nil {
+		fatal("Configuration error", "err", err)
+	}
+	config.DerivationScheme = scheme
 
-	// Configure HTTP server with timeouts suitable for large file uploads
-	server := &http.Server{
-		Addr:              ":3334",
-		Handler:           relay,
-		ReadTimeout:       15 * time.Minute, // Increased to 15 minutes for very large files
-		WriteTimeout:      15 * time.Minute, // Increased to 15 minutes
-		IdleTimeout:       5 * time.Minute,  // Increased idle timeout
-		ReadHeaderTimeout: 30 * time.Second, // Prevent slow header attacks
-		MaxHeaderBytes:    1 << 20,          // 1MB max header size
+	tlsConfig, err := loadTLSConfig()
+	if err != nil {
+		fatal("Invalid TLS configuration", "err", err)
 	}
+	config.TLS = tlsConfig
 
-	fmt.Println("running on :3334 with extended timeouts for large uploads")
-	server.ListenAndServe()
-}
+	corsConfig, err := loadCORSConfig()
+	if err != nil {
+		fatal("Invalid CORS configuration", "err", err)
+	}
+	config.CORS = corsConfig
 
-func fetchNostrData(teamDomain string) {
-	if teamDomain == "" {
-		log.Println("TEAM_DOMAIN not set; skipping Nostr data fetch")
-		return
+	rules, err := parseRetentionRules(getEnvNullable("RETENTION_RULES"))
+	if err != nil {
+		fatal("Configuration error", "err", err)
 	}
-	response, err := http.Get("https://" + teamDomain + "/.well-known/nostr.json")
+	config.RetentionRules = rules
+
+	config.KindLimits, err = parseKindLimits(getEnvNullable("EVENT_LIMITS"))
 	if err != nil {
-		log.Printf("Error getting well known file: %v", err)
-		return
+		fatal("Configuration error", "err", err)
 	}
-	defer response.Body.Close()
 
-	body, err := io.ReadAll(response.Body)
+	config.ThumbnailSizes, err = parseThumbnailSizes(getEnvNullable("THUMBNAIL_SIZES"))
 	if err != nil {
-		log.Printf("Error reading response body: %v", err)
-		return
+		fatal("Configuration error", "err", err)
 	}
 
-	var newData NostrData
-	err = json.Unmarshal(body, &newData)
+	webhooks, err := parseWebhooks(getEnvNullable("WEBHOOKS"))
 	if err != nil {
-		log.Printf("Error unmarshalling JSON: %v", err)
-		return
+		fatal("Configuration error", "err", err)
 	}
+	config.Webhooks = webhooks
 
-	data = newData
-	for pubkey, names := range data.Names {
-		fmt.Println(pubkey, names)
+	if config.PaidAccess {
+		backend, err := newPaymentBackend(config.Payments)
+		if err != nil {
+			fatal("Configuration error", "err", err)
+		}
+		paymentBackend = backend
 	}
 
-	log.Println("Updated NostrData from .well-known file")
-}
+	switch config.MemberCleanupPolicy {
+	case cleanupRetain, cleanupHide, cleanupPurge:
+	default:
+		fatal("Configuration error: MEMBER_CLEANUP_POLICY must be one of retain, hide, purge")
+	}
+	if config.FloodPolicy != floodReject && config.FloodPolicy != floodDedupe {
+		fatal("Configuration error: FLOOD_POLICY must be reject or dedupe")
+	}
+	if b := config.BackupS3; config.BackupIntervalHours > 0 && (b.Endpoint == "" || b.Bucket == "" || b.AccessKeyID == "" || b.SecretAccessKey == "") {
+		fatal("Configuration error: BACKUP_INTERVAL_HOURS requires BACKUP_S3_ENDPOINT, BACKUP_S3_BUCKET, BACKUP_S3_ACCESS_KEY_ID and BACKUP_S3_SECRET_ACCESS_KEY")
+	}
+	socketMode, err := strconv.ParseUint(getEnvWithDefault("LISTEN_SOCKET_MODE", "0660"), 8, 32)
+	if err != nil || socketMode > 0777 {
+		fatal("Configuration error: LISTEN_SOCKET_MODE must be octal permissions such as 0660")
+	}
+	config.ListenSocketMode = os.FileMode(socketMode)
+	if config.WSPingIntervalSeconds <= 0 || config.WSPongTimeoutSeconds <= config.WSPingIntervalSeconds {
+		fatal("Configuration error: WS_PONG_TIMEOUT_SECONDS must be longer than WS_PING_INTERVAL_SECONDS, both positive")
+	}
+	if config.WSMaxMessageSize <= 0 {
+		fatal("Configuration error: WS_MAX_MESSAGE_SIZE must be positive")
+	}
+	if config.ListenSocketOnly && (config.ListenSocket == nil || strings.TrimSpace(*config.ListenSocket) == "") {
+		fatal("Configuration error: LISTEN_SOCKET_ONLY requires LISTEN_SOCKET")
+	}
+	switch config.FileEventBlobCheck {
+	case fileEventCheckOff, fileEventCheckWarn, fileEventCheckReject:
+	default:
+		fatal("Configuration error: FILE_EVENT_BLOB_CHECK must be one of off, warn, reject")
+	}
 
-func LoadConfig() Config {
-	err := godotenv.Load(".env")
+	config.WhitelistedPubkeys, err = normalizePubkeys("WHITELISTED_PUBKEYS", parseList(getEnvNullable("WHITELISTED_PUBKEYS")))
+	if err != nil {
+		fatal("Configuration error", "err", err)
+	}
+	config.BannedPubkeys, err = normalizePubkeys("BANNED_PUBKEYS", parseList(getEnvNullable("BANNED_PUBKEYS")))
+	if err != nil {
+		fatal("Configuration error", "err", err)
+	}
+	config.TraceSampleRatio, err = parseSampleRatio(getEnvNullable("TRACE_SAMPLE_RATIO"))
 	if err != nil {
-		log.Fatalf("Error loading .env file")
+		fatal("Configuration error", "err", err)
+	}
+	if config.TeamRefreshMinutes < 1 {
+		fatal("Configuration error: TEAM_REFRESH_MINUTES must be at least 1")
+	}
+	if config.AutoMirrorIntervalMinutes < 1 {
+		fatal("Configuration error: BLOSSOM_AUTO_MIRROR_INTERVAL_MINUTES must be at least 1")
+	}
+	if config.WoTDepth < 0 || config.WoTDepth > maxWoTDepth {
+		fatal("Configuration error: WOT_DEPTH must be between 0 and 3")
+	}
+	for _, entry := range config.BannedIPs {
+		if _, err := parseIPRange(entry); err != nil {
+			fatal("Configuration error in BANNED_IPS", "err", err)
+		}
 	}
 
-	config := Config{
-		RelayName:          getEnv("RELAY_NAME"),
-		RelayPubkey:        getEnv("RELAY_PUBKEY"),
-		RelayDescription:   getEnv("RELAY_DESCRIPTION"),
-		DBEngine:           getEnvNullable("DB_ENGINE"),
-		DBPath:             getEnvNullable("DB_PATH"),
-		PostgresUser:       getEnvNullable("POSTGRES_USER"),
-		PostgresPassword:   getEnvNullable("POSTGRES_PASSWORD"),
-		PostgresDB:         getEnvNullable("POSTGRES_DB"),
-		PostgresHost:       getEnvNullable("POSTGRES_HOST"),
-		PostgresPort:       getEnvNullable("POSTGRES_PORT"),
-		TeamDomain:         getEnv("TEAM_DOMAIN"),
-		BlossomEnabled:     getEnvBool("BLOSSOM_ENABLED"),
-		BlossomPath:        getEnvNullable("BLOSSOM_PATH"),
-		BlossomURL:         getEnvNullable("BLOSSOM_URL"),
-		WebsocketURL:       getEnvNullable("WEBSOCKET_URL"),
-		AllowedKinds:       parseAllowedKinds(getEnvNullable("ALLOWED_KINDS")),
-		MaxUploadSizeMB:    getEnvIntWithDefault("MAX_UPLOAD_SIZE_MB", 200),
-		RelayMnemonic:      getEnvNullable("RELAY_MNEMONIC"),
-		RelaySeedHex:       getEnvNullable("RELAY_SEED_HEX"),
-		MaxDerivationIndex: getEnvIntWithDefault("MAX_DERIVATION_INDEX", 100),
-		ReadsRestricted:    getEnvBool("READS_RESTRICTED"),
-	}
-
-	// Enforce exactly one of RELAY_MNEMONIC or RELAY_SEED_HEX must be set
-	hasMnemonic := config.RelayMnemonic != nil && strings.TrimSpace(*config.RelayMnemonic) != ""
-	hasSeed := config.RelaySeedHex != nil && strings.TrimSpace(*config.RelaySeedHex) != ""
-	if hasMnemonic == hasSeed { // either both true or both false
-		log.Fatalf("Configuration error: you must set exactly one of RELAY_MNEMONIC or RELAY_SEED_HEX")
+	if config.RelayPubkey != "" {
+		config.RelayPubkey = normalizePubkey(config.RelayPubkey)
+		if !nostr.IsValidPublicKey(config.RelayPubkey) {
+			slog.Warn("RELAY_PUBKEY is not a valid hex or npub pubkey", "value", config.RelayPubkey)
+		}
+	}
+
+	// The relay operator is the admin unless ADMIN_PUBKEYS says otherwise
+	if len(config.AdminPubkeys) == 0 && nostr.IsValidPublicKey(config.RelayPubkey) {
+		config.AdminPubkeys = []string{config.RelayPubkey}
+	}
+	config.AdminPubkeys, err = normalizePubkeys("ADMIN_PUBKEYS", config.AdminPubkeys)
+	if err != nil {
+		fatal("Configuration error", "err", err)
+	}
+
+	teamListKind, teamListD, err := parseTeamList(getEnvWithDefault("TEAM_LIST", ""))
+	if err != nil {
+		fatal("Configuration error", "err", err)
 	}
+	config.TeamListKind, config.TeamListD = teamListKind, teamListD
+	loadDatabaseConfig(&config)
+
+	config.NIP05Names, err = parseNIP05Names(parseList(getEnvNullable("NIP05_NAMES")))
+	if err != nil {
+		fatal("Configuration error", "err", err)
+	}
+	if config.NIP05RosterPrefix != "" && !nip05NamePattern.MatchString(config.NIP05RosterPrefix) {
+		fatal("Configuration error: invalid NIP05_ROSTER_PREFIX", "value", config.NIP05RosterPrefix)
+	}
+
+	// Command-line overrides must all match a setting
+	checkFlags(&config)
 
 	relay.Info.Name = config.RelayName
 	relay.Info.PubKey = config.RelayPubkey
 	relay.Info.Description = config.RelayDescription
-	if config.DBPath == nil {
-		defaultPath := "db/"
-		config.DBPath = &defaultPath
-	}
-
-	db = newDBBackend(*config.DBPath)
+	db = newDBBackend(&config)
 
 	if err := db.Init(); err != nil {
 		panic(err)
@@ -550,10 +1030,34 @@ func LoadConfig() Config {
 
 	fs = afero.NewOsFs()
 	if config.BlossomEnabled {
-		if config.BlossomPath == nil {
-			log.Fatalf("Blossom enabled but no path set")
+		store, err := newBlobStore(config)
+		if err != nil {
+			fatal("Blossom storage", "err", err)
+		}
+		blobStore = store
+		slog.Info("Blossom storage", "backend", config.BlossomStorage)
+
+		tiering := config.BlobTiering
+		if tiering.Action != "delete" && tiering.Action != "cold" {
+			fatal("Configuration error", "err", fmt.Errorf("unknown BLOB_TTL_ACTION %q (expected delete or cold)", tiering.Action))
 		}
-		fs.MkdirAll(*config.BlossomPath, 0755)
+		if tiering.Action == "cold" && tiering.ColdStorage == "" {
+			fatal("Configuration error: BLOB_TTL_ACTION=cold requires BLOB_COLD_STORAGE")
+		}
+		if tiering.ColdStorage != "" {
+			tiered, err := newTieredBlobStore(tiering, store)
+			if err != nil {
+				fatal("Blossom storage", "err", err)
+			}
+			blobStore = tiered
+			slog.Info("Blossom cold tier", "backend", tiering.ColdStorage)
+		}
+
+		scanner, err := newBlobScanner(config)
+		if err != nil {
+			fatal("Configuration error", "err", err)
+		}
+		blobScanner = scanner
 	}
 
 	return config
@@ -563,10 +1067,11 @@ func initDeriver(cfg Config) error {
 	// Initialize the global deriver based on mnemonic or seed hex
 	// Exactly one of these should be set by LoadConfig() validation
 	if cfg.RelayMnemonic != nil && strings.TrimSpace(*cfg.RelayMnemonic) != "" {
-		d, err := keyderivation.NewNostrKeyDeriver(strings.TrimSpace(*cfg.RelayMnemonic))
+		d, err := keyderivation.NewNostrKeyDeriverWithPassphrase(strings.TrimSpace(*cfg.RelayMnemonic), cfg.MnemonicPassphrase)
 		if err != nil {
 			return fmt.Errorf("failed to create deriver from mnemonic: %w", err)
 		}
+		d.SetScheme(cfg.DerivationScheme)
 		deriver = d
 		return nil
 	}
@@ -580,6 +1085,17 @@ func initDeriver(cfg Config) error {
 		if err != nil {
 			return fmt.Errorf("failed to create deriver from seed: %w", err)
 		}
+		d.SetScheme(cfg.DerivationScheme)
+		deriver = d
+		return nil
+	}
+
+	if cfg.RelayXPub != nil && strings.TrimSpace(*cfg.RelayXPub) != "" {
+		d, err := keyderivation.NewNostrKeyDeriverFromXPub(strings.TrimSpace(*cfg.RelayXPub))
+		if err != nil {
+			return fmt.Errorf("invalid RELAY_XPUB: %w", err)
+		}
+		d.SetScheme(cfg.DerivationScheme)
 		deriver = d
 		return nil
 	}
@@ -589,16 +1105,22 @@ func initDeriver(cfg Config) error {
 	return nil
 }
 
+// lookupEnv reads a setting, recording that it exists for checkFlags.
+func lookupEnv(key string) (string, bool) {
+	configKeysRead[key] = true
+	return os.LookupEnv(key)
+}
+
 func getEnv(key string) string {
-	value, exists := os.LookupEnv(key)
+	value, exists := lookupEnv(key)
 	if !exists {
-		log.Fatalf("Environment variable %s not set", key)
+		fatal("Environment variable not set", "key", key)
 	}
 	return value
 }
 
 func getEnvBool(key string) bool {
-	value, exists := os.LookupEnv(key)
+	value, exists := lookupEnv(key)
 	if !exists {
 		return false
 	}
@@ -606,7 +1128,7 @@ func getEnvBool(key string) bool {
 }
 
 func getEnvNullable(key string) *string {
-	value, exists := os.LookupEnv(key)
+	value, exists := lookupEnv(key)
 	if !exists {
 		return nil
 	}
@@ -614,20 +1136,20 @@ func getEnvNullable(key string) *string {
 }
 
 func getEnvIntWithDefault(key string, defaultValue int) int {
-	value, exists := os.LookupEnv(key)
+	value, exists := lookupEnv(key)
 	if !exists {
 		return defaultValue
 	}
 	intValue, err := strconv.Atoi(value)
 	if err != nil {
-		log.Printf("Warning: Invalid integer value '%s' for %s, using default %d", value, key, defaultValue)
+		slog.Warn("Invalid integer value, using default", "key", key, "value", value, "default", defaultValue)
 		return defaultValue
 	}
 	return intValue
 }
 
 func getEnvWithDefault(key string, defaultValue string) string {
-	value, exists := os.LookupEnv(key)
+	value, exists := lookupEnv(key)
 	if !exists {
 		return defaultValue
 	}
@@ -651,21 +1173,35 @@ func parseAllowedKinds(allowedKindsStr *string) []int {
 
 		kind, err := strconv.Atoi(kindStr)
 		if err != nil {
-			log.Printf("Warning: Invalid kind '%s' in ALLOWED_KINDS, skipping", kindStr)
+			slog.Warn("Invalid kind in ALLOWED_KINDS, skipping", "kind", kindStr)
 			continue
 		}
 		kinds = append(kinds, kind)
 	}
 
 	if len(kinds) > 0 {
-		log.Printf("Relay configured to only allow kinds: %v", kinds)
+		slog.Info("Relay configured to only allow kinds", "kinds", kinds)
 	} else {
-		log.Printf("Relay configured to allow all kinds")
+		slog.Info("Relay configured to allow all kinds")
 	}
 
 	return kinds
 }
 
+// parseList splits a comma-separated env value into trimmed, non-empty items.
+func parseList(listStr *string) []string {
+	if listStr == nil {
+		return nil
+	}
+	var items []string
+	for _, item := range strings.Split(*listStr, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 type DBBackend interface {
 	Init() error
 	Close()
@@ -676,43 +1212,59 @@ type DBBackend interface {
 	ReplaceEvent(ctx context.Context, evt *nostr.Event) error
 }
 
-func newDBBackend(path string) DBBackend {
+// loadDatabaseConfig reads DB_ENGINE, DB_PATH and the per-engine settings,
+// which `higher db migrate` needs without the rest of the configuration.
+func loadDatabaseConfig(cfg *Config) {
+	cfg.DBEngine = getEnvNullable("DB_ENGINE")
+	cfg.DBPath = getEnvNullable("DB_PATH")
+	cfg.PostgresUser = getEnvNullable("POSTGRES_USER")
+	cfg.PostgresPassword = getEnvNullable("POSTGRES_PASSWORD")
+	cfg.PostgresDB = getEnvNullable("POSTGRES_DB")
+	cfg.PostgresHost = getEnvNullable("POSTGRES_HOST")
+	cfg.PostgresPort = getEnvNullable("POSTGRES_PORT")
+	cfg.PostgresSSLMode = getEnvWithDefault("POSTGRES_SSLMODE", "disable")
+	cfg.PostgresSSLRootCert = getEnvWithDefault("POSTGRES_SSLROOTCERT", "")
+	cfg.PostgresURL = getEnvWithDefault("POSTGRES_URL", "")
+	cfg.PostgresReadURL = getEnvWithDefault("POSTGRES_READ_URL", "")
+	cfg.PostgresMaxOpenConns = getEnvIntWithDefault("POSTGRES_MAX_OPEN_CONNS", 80)
+	cfg.PostgresMaxIdleConns = getEnvIntWithDefault("POSTGRES_MAX_IDLE_CONNS", 10)
+	cfg.PostgresConnMaxLifetime = getEnvIntWithDefault("POSTGRES_CONN_MAX_LIFETIME_MINUTES", 30)
+	cfg.PostgresConnectTimeout = getEnvIntWithDefault("POSTGRES_CONNECT_TIMEOUT_SECONDS", 60)
+	cfg.BadgerVlogFileSizeMB = getEnvIntWithDefault("BADGER_VLOG_FILE_SIZE_MB", 0)
+	cfg.BadgerCompression = getEnvWithDefault("BADGER_COMPRESSION", "snappy")
+	cfg.BadgerBlockCacheMB = getEnvIntWithDefault("BADGER_BLOCK_CACHE_MB", 256)
+	cfg.BadgerIndexCacheMB = getEnvIntWithDefault("BADGER_INDEX_CACHE_MB", 0)
+	cfg.BadgerGCInterval = getEnvIntWithDefault("BADGER_GC_INTERVAL_MINUTES", 10)
+	cfg.LMDBMapSizeMB = getEnvIntWithDefault("LMDB_MAPSIZE_MB", 0)
+	if cfg.DBPath == nil {
+		defaultPath := "db/"
+		cfg.DBPath = &defaultPath
+	}
+}
+
+// newDBBackend builds the event store selected by DB_ENGINE. It runs while
+// the configuration is being loaded, so it takes it as an argument.
+func newDBBackend(cfg *Config) DBBackend {
 	// Default to Badger if DB_ENGINE is not set or empty
-	if config.DBEngine == nil || strings.TrimSpace(*config.DBEngine) == "" {
+	if cfg.DBEngine == nil || strings.TrimSpace(*cfg.DBEngine) == "" {
 		defaultEngine := "badger"
-		config.DBEngine = &defaultEngine
+		cfg.DBEngine = &defaultEngine
 	}
 
 	// Log chosen engine for clarity
-	log.Printf("DB engine selected: %s", *config.DBEngine)
+	slog.Info("DB engine selected", "engine", *cfg.DBEngine)
 
-	switch strings.ToLower(strings.TrimSpace(*config.DBEngine)) {
+	switch strings.ToLower(strings.TrimSpace(*cfg.DBEngine)) {
 	case "lmdb":
-		return newLMDBBackend(path)
+		return newLMDBBackend(cfg)
 	case "postgres":
-		return newPostgresBackend()
+		return newPostgresBackend(cfg)
 	case "badger":
-		return &badger.BadgerBackend{Path: path}
+		return newBadgerBackend(cfg)
 	default:
 		// Fallback to Badger for any unknown value
-		log.Printf("Unknown DB_ENGINE '%s', defaulting to badger", *config.DBEngine)
-		return &badger.BadgerBackend{Path: path}
-	}
-}
-
-func newPostgresBackend() DBBackend {
-	// Validate required Postgres settings to avoid nil pointer panics
-	if config.PostgresUser == nil || strings.TrimSpace(*config.PostgresUser) == "" ||
-		config.PostgresPassword == nil || strings.TrimSpace(*config.PostgresPassword) == "" ||
-		config.PostgresDB == nil || strings.TrimSpace(*config.PostgresDB) == "" ||
-		config.PostgresHost == nil || strings.TrimSpace(*config.PostgresHost) == "" ||
-		config.PostgresPort == nil || strings.TrimSpace(*config.PostgresPort) == "" {
-		log.Fatalf("Postgres selected but configuration is incomplete: ensure POSTGRES_USER, POSTGRES_PASSWORD, POSTGRES_DB, POSTGRES_HOST, POSTGRES_PORT are set")
-	}
-
-	return &postgresql.PostgresBackend{
-		DatabaseURL: fmt.Sprintf("postgres://%s:%s@%s:%s/%s?sslmode=disable",
-			*config.PostgresUser, *config.PostgresPassword, *config.PostgresHost, *config.PostgresPort, *config.PostgresDB),
+		slog.Warn("Unknown DB_ENGINE, defaulting to badger", "engine", *cfg.DBEngine)
+		return newBadgerBackend(cfg)
 	}
 }
 
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Media probing for NIP-94 tags: image dimensions from the image header and
+// the duration of MP4/MOV audio and video from the movie header box, read
+// straight from the blob without any external tools.
+
+// blobResponse is a blob descriptor as answered by PUT /upload and PUT
+// /mirror, with the BUD-08 "nip94" tags clients can publish as a kind 1063
+// event without probing the blob again.
+type blobResponse struct {
+	blossom.BlobDescriptor
+	NIP94 nostr.Tags `json:"nip94,omitempty"`
+}
+
+// newBlobResponse describes a stored blob, probing it for its media tags.
+func newBlobResponse(ctx context.Context, bd blossom.BlobDescriptor) blobResponse {
+	tags := nip94Tags(bd)
+	if blob, err := blobStore.Get(ctx, bd.SHA256); err == nil {
+		tags = append(tags, mediaTags(blob, bd.Type)...)
+		if closer, ok := blob.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+	tags = append(tags, thumbnailTags(ctx, bd.SHA256)...)
+	return blobResponse{BlobDescriptor: bd, NIP94: tags}
+}
+
+// mediaTags returns the "dim" of an image or the "duration" of MP4 audio
+// and video read from body, nothing for other content.
+func mediaTags(body io.ReadSeeker, mimetype string) nostr.Tags {
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return nil
+	}
+	switch {
+	case strings.HasPrefix(mimetype, "image/"):
+		if cfg, _, err := image.DecodeConfig(body); err == nil {
+			return nostr.Tags{{"dim", fmt.Sprintf("%dx%d", cfg.Width, cfg.Height)}}
+		}
+	case strings.HasPrefix(mimetype, "video/"), strings.HasPrefix(mimetype, "audio/"):
+		if seconds, ok := mp4Duration(body); ok {
+			return nostr.Tags{{"duration", strconv.FormatFloat(seconds, 'f', 3, 64)}}
+		}
+	}
+	return nil
+}
+
+// mp4Duration reads the duration of an ISO base media file (MP4, M4A, MOV)
+// from the mvhd box inside moov.
+func mp4Duration(r io.ReadSeeker) (float64, bool) {
+	end, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, false
+	}
+	return findMovieDuration(r, 0, end)
+}
+
+// findMovieDuration walks the boxes between start and end.
+func findMovieDuration(r io.ReadSeeker, start, end int64) (float64, bool) {
+	for pos := start; pos+8 <= end; {
+		if _, err := r.Seek(pos, io.SeekStart); err != nil {
+			return 0, false
+		}
+		var header struct {
+			Size uint32
+			Type [4]byte
+		}
+		if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+			return 0, false
+		}
+		size, body := int64(header.Size), pos+8
+		switch size {
+		case 0: // up to the end of the enclosing box
+			size = end - pos
+		case 1: // 64-bit size follows the type
+			var large uint64
+			if err := binary.Read(r, binary.BigEndian, &large); err != nil {
+				return 0, false
+			}
+			size, body = int64(large), body+8
+		}
+		if size < body-pos || size > end-pos {
+			return 0, false
+		}
+
+		switch string(header.Type[:]) {
+		case "moov":
+			return findMovieDuration(r, body, pos+size)
+		case "mvhd":
+			return readMovieHeader(r)
+		}
+		pos += size
+	}
+	return 0, false
+}
+
+// readMovieHeader parses the timescale and duration of an mvhd box.
+func readMovieHeader(r io.Reader) (float64, bool) {
+	var versionAndFlags uint32
+	if err := binary.Read(r, binary.BigEndian, &versionAndFlags); err != nil {
+		return 0, false
+	}
+	var timescale uint32
+	var duration uint64
+	if versionAndFlags>>24 == 1 {
+		var h struct {
+			Created, Modified uint64
+			Timescale         uint32
+			Duration          uint64
+		}
+		if err := binary.Read(r, binary.BigEndian, &h); err != nil {
+			return 0, false
+		}
+		timescale, duration = h.Timescale, h.Duration
+	} else {
+		var h struct{ Created, Modified, Timescale, Duration uint32 }
+		if err := binary.Read(r, binary.BigEndian, &h); err != nil {
+			return 0, false
+		}
+		timescale, duration = h.Timescale, uint64(h.Duration)
+	}
+	if timescale == 0 {
+		return 0, false
+	}
+	return float64(duration) / float64(timescale), true
+}
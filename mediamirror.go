@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Mirroring of media that members' events reference. Every "url" tag and
+// imeta "url" entry of an accepted member event is queued; a small pool of
+// workers downloads the blob from its origin, checks that it hashes to the
+// imeta "x" (or the hash in a Blossom URL) and stores it here, owned by the
+// author. URLs with no hash to verify against are skipped, as are blobs
+// already stored. The local copy keeps the media available after a
+// third-party host drops it.
+//
+// Stored events can't point at the local copies themselves, their signatures
+// cover the URLs. Instead GET /media/resolve?url=<remote URL> maps a remote
+// URL to the local one (302 to it with redirect=true), for clients that want
+// to fetch from the team server first. Blossom URLs resolve by their hash;
+// other URLs by the mapping recorded when the media was mirrored.
+
+const (
+	referencedMediaQueueSize = 1000
+	mediaURLsStateKey        = "mirrored_media_urls"
+	mediaURLsSaveEvery       = 10 * time.Minute
+)
+
+var (
+	mediaURLsMu    sync.Mutex
+	mediaURLs      = map[string]string{} // remote URL -> sha256
+	mediaURLsDirty bool
+)
+
+// referencedMedia is one blob to mirror.
+type referencedMedia struct {
+	url    string
+	sha256 string
+	mime   string
+	owner  string
+}
+
+type referencedMediaMirror struct {
+	bl       *blossom.BlossomServer
+	queue    chan referencedMedia
+	inflight sync.Map // sha256 -> struct{}
+}
+
+// setupReferencedMediaMirroring queues the media of saved member events and
+// starts BLOSSOM_MIRROR_REFERENCED_WORKERS workers.
+func setupReferencedMediaMirroring(relay *khatru.Relay, bl *blossom.BlossomServer) {
+	m := &referencedMediaMirror{bl: bl, queue: make(chan referencedMedia, referencedMediaQueueSize)}
+
+	relay.OnEventSaved = append(relay.OnEventSaved, func(ctx context.Context, event *nostr.Event) {
+		if event.Kind == 24242 || !isMember(event.PubKey) {
+			return
+		}
+		for _, media := range mediaReferences(event) {
+			if blobExists(media.sha256) {
+				recordMediaURL(media.url, media.sha256)
+				continue
+			}
+			select {
+			case m.queue <- media:
+			default:
+				blobLogger(ctx, media.sha256).Warn("Media mirror: queue full, skipping", "url", media.url)
+			}
+		}
+	})
+
+	for range max(config.MirrorReferencedWorkers, 1) {
+		go m.work()
+	}
+	go func() {
+		for range time.Tick(mediaURLsSaveEvery) {
+			persistMediaURLs(context.Background())
+		}
+	}()
+	slog.Info("Media mirror: ENABLED", "workers", max(config.MirrorReferencedWorkers, 1))
+}
+
+func (m *referencedMediaMirror) work() {
+	for media := range m.queue {
+		m.mirror(context.Background(), media)
+	}
+}
+
+func (m *referencedMediaMirror) mirror(ctx context.Context, media referencedMedia) {
+	if _, busy := m.inflight.LoadOrStore(media.sha256, struct{}{}); busy {
+		return
+	}
+	defer m.inflight.Delete(media.sha256)
+	if blobExists(media.sha256) {
+		recordMediaURL(media.url, media.sha256)
+		return
+	}
+
+	size, err := mirrorBlob(ctx, m.bl, media.url, media.sha256, nil)
+	if err != nil {
+		blobLogger(ctx, media.sha256).Warn("Media mirror: failed to mirror", "url", media.url, "err", err)
+		return
+	}
+	local := blossom.BlobDescriptor{
+		URL:      strings.TrimSuffix(*config.BlossomURL, "/") + "/" + media.sha256,
+		SHA256:   media.sha256,
+		Size:     size,
+		Type:     media.mime,
+		Uploaded: nostr.Now(),
+	}
+	if err := m.bl.Store.Keep(ctx, local, media.owner); err != nil {
+		blobLogger(ctx, media.sha256).Error("Media mirror: failed to index", "err", err)
+		return
+	}
+	recordMediaURL(media.url, media.sha256)
+	blobLogger(ctx, media.sha256).Info("Media mirror: mirrored", "url", media.url, "owner", media.owner, "size", size)
+}
+
+// mediaReferences returns the remote media of event that can be verified:
+// imeta entries and url tags with a hash from their "x" or from the URL.
+func mediaReferences(event *nostr.Event) []referencedMedia {
+	ownURL := strings.TrimSuffix(*config.BlossomURL, "/") + "/"
+	var found []referencedMedia
+	add := func(url, sha256, mime string) {
+		if sha256 == "" {
+			sha256 = extractSha256FromURL(url)
+		}
+		sha256 = strings.ToLower(sha256)
+		if url == "" || !isBlobHash(sha256) || strings.HasPrefix(url, ownURL) {
+			return
+		}
+		if !strings.HasPrefix(url, "https://") && !strings.HasPrefix(url, "http://") {
+			return
+		}
+		found = append(found, referencedMedia{url: url, sha256: sha256, mime: mime, owner: event.PubKey})
+	}
+
+	for _, tag := range event.Tags {
+		if len(tag) < 2 {
+			continue
+		}
+		switch tag[0] {
+		case "imeta":
+			var url, sha256, mime string
+			for _, entry := range tag[1:] {
+				key, value, _ := strings.Cut(entry, " ")
+				switch key {
+				case "url":
+					url = value
+				case "x":
+					sha256 = value
+				case "m":
+					mime = value
+				}
+			}
+			add(url, sha256, mime)
+		case "url":
+			// kind 1063 file metadata carries the hash and type in tags of their own
+			var sha256, mime string
+			if x := event.Tags.GetFirst([]string{"x", ""}); x != nil {
+				sha256 = (*x)[1]
+			}
+			if m := event.Tags.GetFirst([]string{"m", ""}); m != nil {
+				mime = (*m)[1]
+			}
+			add(tag[1], sha256, mime)
+		}
+	}
+	return found
+}
+
+func recordMediaURL(url, sha256 string) {
+	mediaURLsMu.Lock()
+	defer mediaURLsMu.Unlock()
+	if mediaURLs[url] != sha256 {
+		mediaURLs[url] = sha256
+		mediaURLsDirty = true
+	}
+}
+
+func persistMediaURLs(ctx context.Context) {
+	mediaURLsMu.Lock()
+	defer mediaURLsMu.Unlock()
+	if !mediaURLsDirty {
+		return
+	}
+	if err := saveState(ctx, mediaURLsStateKey, mediaURLs); err != nil {
+		slog.Error("Media mirror: failed to save the URL mapping", "err", err)
+		return
+	}
+	mediaURLsDirty = false
+}
+
+// resolveMediaURL returns the hash of the local copy of the media at url.
+func resolveMediaURL(url string) (string, bool) {
+	mediaURLsMu.Lock()
+	sha256, ok := mediaURLs[url]
+	mediaURLsMu.Unlock()
+	if !ok {
+		sha256 = extractSha256FromURL(url)
+	}
+	if sha256 == "" || !blobExists(sha256) {
+		return "", false
+	}
+	return sha256, true
+}
+
+// setupMediaResolve serves GET /media/resolve when mirroring is enabled.
+func setupMediaResolve(relay *khatru.Relay) {
+	if _, err := loadState(context.Background(), mediaURLsStateKey, &mediaURLs); err != nil {
+		slog.Error("Media mirror: failed to load the URL mapping", "err", err)
+	}
+
+	relay.Router().HandleFunc("/media/resolve", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		remote := r.URL.Query().Get("url")
+		if remote == "" {
+			http.Error(w, "Missing url parameter", http.StatusBadRequest)
+			return
+		}
+		sha256, ok := resolveMediaURL(remote)
+		if !ok {
+			http.Error(w, "No local copy", http.StatusNotFound)
+			return
+		}
+		local := strings.TrimSuffix(*config.BlossomURL, "/") + "/" + sha256
+		if r.URL.Query().Get("redirect") == "true" {
+			http.Redirect(w, r, local, http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"url": remote, "sha256": sha256, "local_url": local})
+	})
+}
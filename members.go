@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ManagedMember is a team member added at runtime through the admin API, on
+// top of the list fetched from TEAM_DOMAIN's nostr.json.
+type ManagedMember struct {
+	Pubkey  string `json:"pubkey"`
+	Name    string `json:"name,omitempty"`
+	AddedBy string `json:"added_by"`
+	AddedAt int64  `json:"added_at"`
+}
+
+// MemberEntry is one row of GET /admin/members.
+type MemberEntry struct {
+	Pubkey string   `json:"pubkey"`
+	Names  []string `json:"names,omitempty"`
+	Source []string `json:"source"` // "domain", "list", "admin"
+}
+
+var (
+	managedMu      sync.RWMutex
+	managedMembers = map[string]ManagedMember{}
+)
+
+func isManagedMember(pubkey string) bool {
+	managedMu.RLock()
+	defer managedMu.RUnlock()
+	_, ok := managedMembers[pubkey]
+	return ok
+}
+
+func hasManagedMembers() bool {
+	managedMu.RLock()
+	defer managedMu.RUnlock()
+	return len(managedMembers) > 0
+}
+
+func loadManagedMembers(ctx context.Context) {
+	var members []ManagedMember
+	if ok, err := loadState(ctx, "members", &members); err != nil {
+		slog.Error("Members: failed to load managed members", "err", err)
+	} else if ok {
+		managedMu.Lock()
+		for _, m := range members {
+			managedMembers[m.Pubkey] = m
+		}
+		managedMu.Unlock()
+	}
+}
+
+func persistManagedMembers(ctx context.Context) error {
+	managedMu.RLock()
+	members := make([]ManagedMember, 0, len(managedMembers))
+	for _, m := range managedMembers {
+		members = append(members, m)
+	}
+	managedMu.RUnlock()
+	return saveState(ctx, "members", members)
+}
+
+// listMembers merges the domain-fetched team with the managed members.
+func listMembers() []MemberEntry {
+	entries := map[string]*MemberEntry{}
+	get := func(pubkey string) *MemberEntry {
+		if e, ok := entries[pubkey]; ok {
+			return e
+		}
+		e := &MemberEntry{Pubkey: pubkey}
+		entries[pubkey] = e
+		return e
+	}
+
+	for name, pubkey := range data.Names {
+		e := get(pubkey)
+		e.Names = append(e.Names, name)
+		if len(e.Source) == 0 {
+			e.Source = append(e.Source, "domain")
+		}
+	}
+	for _, pk := range listedMembers() {
+		e := get(pk)
+		e.Source = append(e.Source, "list")
+	}
+	managedMu.RLock()
+	for _, m := range managedMembers {
+		e := get(m.Pubkey)
+		if m.Name != "" {
+			e.Names = append(e.Names, m.Name)
+		}
+		e.Source = append(e.Source, "admin")
+	}
+	managedMu.RUnlock()
+
+	list := make([]MemberEntry, 0, len(entries))
+	for _, e := range entries {
+		sort.Strings(e.Names)
+		list = append(list, *e)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Pubkey < list[j].Pubkey })
+	return list
+}
+
+// setupMembersAPI loads the managed members and serves the admin API:
+//
+//	GET    /admin/members           merged member list
+//	POST   /admin/members           {"pubkey": "...", "name": "..."}
+//	DELETE /admin/members/{pubkey}
+func setupMembersAPI(relay *khatru.Relay) {
+	loadManagedMembers(context.Background())
+
+	relay.Router().HandleFunc("/admin/members", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(listMembers())
+
+		case "POST":
+			var req struct {
+				Pubkey string `json:"pubkey"`
+				Name   string `json:"name"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid JSON", http.StatusBadRequest)
+				return
+			}
+			pubkey := normalizePubkey(strings.TrimSpace(req.Pubkey))
+			if !nostr.IsValidPublicKey(pubkey) {
+				http.Error(w, "Invalid pubkey", http.StatusBadRequest)
+				return
+			}
+			auth, _ := readHTTPAuth(r)
+			member := ManagedMember{
+				Pubkey:  pubkey,
+				Name:    strings.TrimSpace(req.Name),
+				AddedBy: auth.PubKey,
+				AddedAt: time.Now().Unix(),
+			}
+
+			managedMu.Lock()
+			managedMembers[pubkey] = member
+			managedMu.Unlock()
+			if err := persistManagedMembers(r.Context()); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			onMemberRestored(pubkey)
+
+			logger(r.Context()).Info("Members: member added", "pubkey", pubkey, "by", auth.PubKey)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(member)
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}))
+
+	relay.Router().HandleFunc("/admin/members/", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "DELETE" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		pubkey := normalizePubkey(strings.TrimPrefix(r.URL.Path, "/admin/members/"))
+
+		managedMu.Lock()
+		_, ok := managedMembers[pubkey]
+		delete(managedMembers, pubkey)
+		managedMu.Unlock()
+		if !ok {
+			http.Error(w, "Not a managed member", http.StatusNotFound)
+			return
+		}
+		if err := persistManagedMembers(r.Context()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// still allowed through the domain list: nothing to clean up
+		if !containsValue(data.Names, pubkey) {
+			onMembersRemoved([]string{pubkey}, "admin")
+		}
+
+		logger(r.Context()).Info("Members: member removed", "pubkey", pubkey)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// uploadRejectedError is a RejectUpload verdict, with the HTTP status to
+// answer with.
+type uploadRejectedError struct {
+	reason string
+	code   int
+}
+
+func (e *uploadRejectedError) Error() string { return e.reason }
+
+// rejectUpload runs the blossom RejectUpload hooks on behalf of auth's
+// author for a blob of the given size and sniffed type.
+func rejectUpload(ctx context.Context, bl *blossom.BlossomServer, auth *nostr.Event, size int, mimetype string) error {
+	var ext string
+	if exts, _ := mime.ExtensionsByType(mimetype); len(exts) > 0 {
+		ext = exts[0]
+	}
+	ctx = withSniffedType(ctx, mimetype)
+	for _, reject := range bl.RejectUpload {
+		if rejected, reason, code := reject(ctx, auth, size, ext); rejected {
+			return &uploadRejectedError{reason, code}
+		}
+	}
+	return nil
+}
+
+// mirrorBlob downloads the blob at sourceURL into a temporary file, capped at
+// MAX_UPLOAD_SIZE_MB and hashed as it arrives, verifies that its content
+// hashes to expectedHash and stores it through the blossom StoreBlob hooks,
+// which move the file into place. With auth set, the upload policy is applied
+// on behalf of its author first. It returns the number of bytes stored.
+func mirrorBlob(ctx context.Context, bl *blossom.BlossomServer, sourceURL string, expectedHash string, auth *nostr.Event) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", sourceURL, nil)
+	if err != nil {
+		return 0, fmt.Errorf("invalid source URL: %w", err)
+	}
+	if err := validateFetchURL(req.URL); err != nil {
+		return 0, fmt.Errorf("invalid source URL: %w", err)
+	}
+	resp, err := blobFetchClient().Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch source blob: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("source server returned %d", resp.StatusCode)
+	}
+
+	maxSize := int64(config.MaxUploadSizeMB) * 1024 * 1024
+	tooLarge := &uploadRejectedError{fmt.Sprintf("file size exceeds %dMB limit", config.MaxUploadSizeMB), http.StatusRequestEntityTooLarge}
+	if resp.ContentLength > maxSize {
+		return 0, tooLarge
+	}
+
+	staged, err := stageBlob(resp.Body, maxSize)
+	if err == errBlobTooLarge {
+		return 0, tooLarge
+	} else if err != nil {
+		return 0, fmt.Errorf("failed to download blob: %w", err)
+	}
+	defer staged.Remove()
+
+	if staged.SHA256 != expectedHash {
+		return 0, errBlobHashMismatch
+	}
+	mimetype := detectBlobType(staged.Head())
+	if auth != nil {
+		if err := rejectUpload(ctx, bl, auth, int(staged.Size), mimetype); err != nil {
+			return 0, err
+		}
+	} else if err := checkBlobType(mimetype); err != nil {
+		return 0, err
+	}
+
+	// the hooks read the staged file; the blob store hook moves it into place
+	ctx = withStagedBlob(ctx, staged)
+	for _, storeFunc := range bl.StoreBlob {
+		if err := storeFunc(ctx, expectedHash, nil); err != nil {
+			return 0, fmt.Errorf("failed to store blob: %w", err)
+		}
+	}
+
+	return int(staged.Size), nil
+}
+
+var errBlobHashMismatch = fmt.Errorf("blob hash mismatch")
+
+// blobExists reports whether a blob with the given hash is already stored.
+func blobExists(sha256 string) bool {
+	_, err := blobStore.Stat(context.Background(), sha256)
+	return err == nil
+}
+
+// maxMirrorRequest bounds the JSON body of a mirror request.
+const maxMirrorRequest = 64 << 10
+
+// readMirrorAuth authenticates a mirror request, with either a BUD-04
+// authorization (kind 24242, "t" upload and, when present, an "x" tag for the
+// blob) or a NIP-98 event for PUT /mirror, whose payload tag must match the
+// body and which is good for one request only.
+func readMirrorAuth(r *http.Request, blobHash string) (*nostr.Event, error) {
+	auth, err := readBlossomAuth(r, "upload")
+	if err != nil {
+		// not a blossom authorization; it may still be NIP-98
+		if httpAuth, httpErr := readHTTPAuth(r); httpErr == nil && httpAuth != nil {
+			if err := checkHTTPAuthUse(r, httpAuth); err != nil {
+				return nil, err
+			}
+			return httpAuth, nil
+		}
+		return nil, err
+	}
+	if auth == nil {
+		return nil, nil
+	}
+	if xs := auth.Tags.GetAll([]string{"x", ""}); len(xs) > 0 && !auth.Tags.ContainsAny("x", []string{blobHash}) {
+		return nil, fmt.Errorf("authorization is not for this blob")
+	}
+	return auth, nil
+}
+
+// setupMirrorHandler adds the BUD-04 PUT /mirror endpoint, also used by
+// Sakura. Mirroring counts as an upload by the authorized pubkey: the same
+// team and size policy applies, the blob is recorded as theirs and the answer
+// is its blob descriptor, as for uploads. Errors carry an X-Reason header.
+func setupMirrorHandler(relay *khatru.Relay, bl *blossom.BlossomServer) {
+	relay.Router().HandleFunc("/mirror", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PUT" {
+			blossomError(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		// Parse the request body to get source URL
+		var mirrorRequest struct {
+			URL string `json:"url"`
+		}
+
+		// the body is kept for checking a NIP-98 payload tag
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxMirrorRequest))
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				blossomError(w, "request body is too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			blossomError(w, "failed to read request body", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		if err := json.Unmarshal(body, &mirrorRequest); err != nil {
+			blossomError(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+
+		if mirrorRequest.URL == "" {
+			blossomError(w, "missing source URL", http.StatusBadRequest)
+			return
+		}
+
+		if u, err := url.Parse(mirrorRequest.URL); err != nil {
+			blossomError(w, "invalid source URL", http.StatusBadRequest)
+			return
+		} else if err := validateFetchURL(u); err != nil {
+			blossomError(w, "invalid source URL: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Extract blob hash from source URL
+		blobHash := extractSha256FromURL(mirrorRequest.URL)
+		if blobHash == "" {
+			blossomError(w, "cannot extract blob hash from source URL", http.StatusBadRequest)
+			return
+		}
+
+		auth, err := readMirrorAuth(r, blobHash)
+		if err != nil {
+			blossomError(w, "invalid \"Authorization\": "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if auth == nil {
+			blossomError(w, "missing \"Authorization\" header", http.StatusUnauthorized)
+			return
+		}
+		if !acquireUploadSlot() {
+			w.Header().Set("Retry-After", "5")
+			blossomError(w, "too many uploads in progress, try again shortly", http.StatusServiceUnavailable)
+			return
+		}
+		defer releaseUploadSlot()
+
+		var size int
+		if info, statErr := blobStore.Stat(r.Context(), blobHash); statErr == nil {
+			// Blob already exists; the requester still has to be allowed to upload it
+			size = int(info.Size)
+			err = rejectUpload(r.Context(), bl, auth, size, detectBlobType(storedBlobHead(r.Context(), blobHash)))
+		} else {
+			size, err = mirrorBlob(r.Context(), bl, mirrorRequest.URL, blobHash, auth)
+		}
+		var rejected *uploadRejectedError
+		if err == errBlobHashMismatch {
+			blossomError(w, "blob hash mismatch", http.StatusBadRequest)
+			return
+		} else if errors.As(err, &rejected) {
+			blossomError(w, rejected.reason, rejected.code)
+			return
+		} else if errors.Is(err, errPrivateAddress) {
+			blossomError(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			blossomError(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		head := storedBlobHead(r.Context(), blobHash)
+		mimetype := detectBlobType(head)
+		bd := blossom.BlobDescriptor{
+			URL:      bl.ServiceURL + "/" + blobHash + uploadExtension(head, mimetype),
+			SHA256:   blobHash,
+			Size:     size,
+			Type:     mimetype,
+			Uploaded: nostr.Now(),
+		}
+		if err := bl.Store.Keep(r.Context(), bd, auth.PubKey); err != nil {
+			blossomError(w, "failed to save: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// a blob the requester already had keeps its original upload time
+		if uploaded, ok := indexedUploadTime(r.Context(), blobHash, auth.PubKey); ok {
+			bd.Uploaded = uploaded
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(newBlobResponse(r.Context(), bd))
+
+		blobLogger(r.Context(), blobHash).Info("Successfully mirrored blob", "source", mirrorRequest.URL, "pubkey", auth.PubKey)
+	})
+}
+
+// storedBlobHead returns the first bytes of a stored blob, for sniffing its type.
+func storedBlobHead(ctx context.Context, sha256 string) []byte {
+	blob, err := blobStore.Get(ctx, sha256)
+	if err != nil {
+		return nil
+	}
+	if closer, ok := blob.(io.Closer); ok {
+		defer closer.Close()
+	}
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(blob, head)
+	return head[:n]
+}
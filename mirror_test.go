@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestReadMirrorAuthHTTP(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+	blobHash := strings.Repeat("ab", 32)
+	body := `{"url":"https://cdn.example.com/` + blobHash + `"}`
+	sum := sha256.Sum256([]byte(body))
+
+	sign := func(tags nostr.Tags) string {
+		evt := nostr.Event{Kind: 27235, CreatedAt: nostr.Now(),
+			Tags: append(nostr.Tags{{"u", "https://relay.example.com/mirror"}, {"method", "PUT"}}, tags...)}
+		if err := evt.Sign(sk); err != nil {
+			t.Fatal(err)
+		}
+		raw, _ := json.Marshal(evt)
+		return "Nostr " + base64.StdEncoding.EncodeToString(raw)
+	}
+	request := func(header string) error {
+		r := httptest.NewRequest("PUT", "/mirror", strings.NewReader(body))
+		r.Header.Set("Authorization", header)
+		_, err := readMirrorAuth(r, blobHash)
+		return err
+	}
+
+	valid := sign(nostr.Tags{{"payload", hex.EncodeToString(sum[:])}})
+	cases := []struct {
+		name    string
+		header  string
+		wantErr bool
+	}{
+		{"missing payload", sign(nil), true},
+		{"payload of another body", sign(nostr.Tags{{"payload", strings.Repeat("0", 64)}}), true},
+		{"matching payload", valid, false},
+		{"replayed", valid, true},
+	}
+	for _, tc := range cases {
+		if err := request(tc.header); tc.wantErr != (err != nil) {
+			t.Errorf("%s: readMirrorAuth error = %v, want error %v", tc.name, err, tc.wantErr)
+		}
+	}
+}
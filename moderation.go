@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// NIP-56 moderation: kind 1984 reports about content stored here are accepted
+// from anyone, over the websocket or BUD-09 PUT /report, and listed in an admin queue (GET /admin/reports, or the
+// dashboard at /admin/moderation). An admin resolves a report by deleting the
+// reported events and blobs, optionally banning their authors, or by
+// dismissing it.
+
+// ReportTarget is one thing a report points at.
+type ReportTarget struct {
+	Type   string `json:"type"` // "event", "blob" or "pubkey"
+	ID     string `json:"id"`
+	Reason string `json:"reason,omitempty"` // nudity, malware, spam, ...
+
+	// blobs only: the upload index entries and the reports filed against it
+	MimeType string   `json:"mime_type,omitempty"`
+	Size     int64    `json:"size,omitempty"`
+	Owners   []string `json:"owners,omitempty"`
+	Reports  int      `json:"reports,omitempty"`
+}
+
+// ReportResolution records how an admin handled a report.
+type ReportResolution struct {
+	Action string   `json:"action"` // "delete" or "dismiss"
+	Banned []string `json:"banned,omitempty"`
+	By     string   `json:"by"`
+	At     int64    `json:"at"`
+}
+
+// ModerationReport is one row of GET /admin/reports.
+type ModerationReport struct {
+	ID         string            `json:"id"`
+	Reporter   string            `json:"reporter"`
+	Content    string            `json:"content"`
+	CreatedAt  nostr.Timestamp   `json:"created_at"`
+	Targets    []ReportTarget    `json:"targets"`
+	Status     string            `json:"status"` // "open" or "resolved"
+	Resolution *ReportResolution `json:"resolution,omitempty"`
+}
+
+// moderationState is persisted so resolutions survive restarts.
+type moderationState struct {
+	Resolutions map[string]ReportResolution `json:"resolutions"`
+}
+
+var (
+	moderationMu sync.RWMutex
+	moderation   = moderationState{Resolutions: map[string]ReportResolution{}}
+)
+
+func persistModerationState(ctx context.Context) {
+	moderationMu.RLock()
+	defer moderationMu.RUnlock()
+	if err := saveState(ctx, "moderation", moderation); err != nil {
+		slog.Error("Moderation: failed to persist state", "err", err)
+	}
+}
+
+// reportTargets reads the e, x and p tags of a kind 1984 event.
+func reportTargets(evt *nostr.Event) []ReportTarget {
+	var targets []ReportTarget
+	for _, tag := range evt.Tags {
+		if len(tag) < 2 {
+			continue
+		}
+		t := ReportTarget{ID: tag[1]}
+		if len(tag) >= 3 {
+			t.Reason = tag[2]
+		}
+		switch {
+		case tag[0] == "e" && nostr.IsValid32ByteHex(tag[1]):
+			t.Type = "event"
+		case tag[0] == "x" && isBlobHash(tag[1]):
+			t.Type, t.ID = "blob", strings.ToLower(tag[1])
+		case tag[0] == "p" && nostr.IsValidPublicKey(tag[1]):
+			t.Type = "pubkey"
+		default:
+			continue
+		}
+		targets = append(targets, t)
+	}
+	return targets
+}
+
+// storedEvent loads a stored event by ID, nil when it isn't here.
+func storedEvent(ctx context.Context, id string) *nostr.Event {
+	ch, err := db.QueryEvents(ctx, nostr.Filter{IDs: []string{id}})
+	if err != nil {
+		return nil
+	}
+	var evt *nostr.Event
+	for e := range ch {
+		evt = e
+	}
+	return evt
+}
+
+// isReportForUs reports whether evt is a NIP-56 report about an event or blob
+// stored here or about a member, which is accepted from non-members too.
+func isReportForUs(ctx context.Context, evt *nostr.Event) bool {
+	if !config.ModerationEnabled || evt.Kind != nostr.KindReporting {
+		return false
+	}
+	for _, t := range reportTargets(evt) {
+		switch t.Type {
+		case "event":
+			if storedEvent(ctx, t.ID) != nil {
+				return true
+			}
+		case "blob":
+			if blobStore != nil && blobExists(t.ID) {
+				return true
+			}
+		case "pubkey":
+			if isMember(t.ID) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// listReports returns stored reports, newest first.
+func listReports(ctx context.Context, status string) ([]ModerationReport, error) {
+	reports := []ModerationReport{}
+	err := forEachEvent(ctx, nostr.Filter{Kinds: []int{nostr.KindReporting}}, func(evt *nostr.Event) error {
+		r := ModerationReport{
+			ID:        evt.ID,
+			Reporter:  evt.PubKey,
+			Content:   evt.Content,
+			CreatedAt: evt.CreatedAt,
+			Targets:   reportTargets(evt),
+			Status:    "open",
+		}
+		for i := range r.Targets {
+			if r.Targets[i].Type == "blob" {
+				describeReportedBlob(ctx, &r.Targets[i])
+			}
+		}
+		moderationMu.RLock()
+		if res, ok := moderation.Resolutions[evt.ID]; ok {
+			r.Status, r.Resolution = "resolved", &res
+		}
+		moderationMu.RUnlock()
+		if status == "" || status == r.Status {
+			reports = append(reports, r)
+		}
+		return nil
+	})
+	sort.Slice(reports, func(i, j int) bool { return reports[i].CreatedAt > reports[j].CreatedAt })
+	return reports, err
+}
+
+// actionReport deletes what a report points at and returns the authors of
+// the deleted content, which are the ones banned on request.
+func actionReport(ctx context.Context, report *nostr.Event) []string {
+	var authors []string
+	addAuthor := func(pubkey string) {
+		if !isAdmin(pubkey) && !slices.Contains(authors, pubkey) {
+			authors = append(authors, pubkey)
+		}
+	}
+
+	for _, t := range reportTargets(report) {
+		switch t.Type {
+		case "event":
+			evt := storedEvent(ctx, t.ID)
+			if evt == nil {
+				continue
+			}
+			if err := removeEvent(ctx, evt, "report "+report.ID); err != nil {
+				eventLogger(ctx, evt).Error("Moderation: failed to delete event", "report", report.ID, "err", err)
+				continue
+			}
+			addAuthor(evt.PubKey)
+		case "blob":
+			if blossomServer == nil {
+				continue
+			}
+			for _, owner := range blobOwners(ctx, t.ID) {
+				if err := blossomServer.Store.Delete(ctx, t.ID, owner); err != nil {
+					blobLogger(ctx, t.ID).Error("Moderation: failed to unindex blob", "owner", owner, "err", err)
+				}
+				addAuthor(owner)
+			}
+			for _, del := range blossomServer.DeleteBlob {
+				if err := del(ctx, t.ID); err != nil {
+					blobLogger(ctx, t.ID).Error("Moderation: failed to delete blob", "err", err)
+				}
+			}
+		case "pubkey":
+			addAuthor(t.ID)
+		}
+	}
+	return authors
+}
+
+// setupModeration loads the moderation state and exposes the moderation API
+// and dashboard. Bans go to the regular ban list.
+func setupModeration(relay *khatru.Relay) {
+	var st moderationState
+	if ok, err := loadState(context.Background(), "moderation", &st); err != nil {
+		slog.Error("Moderation: failed to load state", "err", err)
+	} else if ok {
+		if st.Resolutions == nil {
+			st.Resolutions = map[string]ReportResolution{}
+		}
+		moderationMu.Lock()
+		moderation = st
+		moderationMu.Unlock()
+	}
+
+	// GET /admin/reports[?status=open|resolved]
+	relay.Router().HandleFunc("/admin/reports", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		reports, err := listReports(r.Context(), r.URL.Query().Get("status"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(reports)
+	}))
+
+	// POST /admin/reports/{id}/resolve {"action": "delete"|"dismiss", "ban": bool}
+	relay.Router().HandleFunc("/admin/reports/", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/admin/reports/"), "/")
+		if r.Method != "POST" || action != "resolve" {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		var body struct {
+			Action string `json:"action"`
+			Ban    bool   `json:"ban"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || (body.Action != "delete" && body.Action != "dismiss") {
+			http.Error(w, "Expected {\"action\": \"delete\"|\"dismiss\", \"ban\": bool}", http.StatusBadRequest)
+			return
+		}
+		report := storedEvent(r.Context(), id)
+		if report == nil || report.Kind != nostr.KindReporting {
+			http.Error(w, "Report not found", http.StatusNotFound)
+			return
+		}
+
+		auth, _ := readHTTPAuth(r)
+		res := ReportResolution{Action: body.Action, By: auth.PubKey, At: time.Now().Unix()}
+		if body.Action == "delete" {
+			authors := actionReport(r.Context(), report)
+			if body.Ban {
+				res.Banned = authors
+			}
+		}
+
+		moderationMu.Lock()
+		moderation.Resolutions[report.ID] = res
+		moderationMu.Unlock()
+		persistModerationState(r.Context())
+		if len(res.Banned) > 0 {
+			banPubkeys(r.Context(), res.Banned, "report "+report.ID, res.By)
+		}
+
+		logger(r.Context()).Info("Moderation: report resolved", "report", report.ID, "action", res.Action, "banned", len(res.Banned), "by", res.By)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	}))
+
+	// the dashboard itself is public; its API calls are signed by the admin's
+	// NIP-07 browser extension
+	relay.Router().HandleFunc("/admin/moderation", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, moderationDashboard)
+	})
+
+	slog.Info("Moderation: ENABLED", "reports", "/admin/reports", "dashboard", "/admin/moderation")
+}
+
+const moderationDashboard = `<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>Moderation queue</title>
+    <style>
+        body { font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, sans-serif; background: #0f172a; color: #e5e7eb; margin: 0; padding: 2rem; }
+        h1 { margin-top: 0; }
+        .report { background: #1f2937; border-radius: 8px; padding: 1rem; margin-bottom: 1rem; }
+        .meta { color: #9ca3af; font-size: 0.85rem; word-break: break-all; }
+        a { color: #a78bfa; }
+        .target { font-family: monospace; font-size: 0.85rem; word-break: break-all; }
+        button { background: #7c3aed; color: white; border: 0; border-radius: 4px; padding: 0.4rem 0.8rem; margin-right: 0.5rem; cursor: pointer; }
+        button.secondary { background: #374151; }
+        #status { color: #fbbf24; }
+    </style>
+</head>
+<body>
+    <h1>Moderation queue</h1>
+    <p id="status">Sign in with your NIP-07 extension to load open reports.</p>
+    <button onclick="load()">Load reports</button>
+    <div id="reports"></div>
+<script>
+async function authHeader(path, method, body) {
+    const tags = [["u", location.origin + path], ["method", method]];
+    if (body) {
+        const hash = await crypto.subtle.digest("SHA-256", new TextEncoder().encode(body));
+        tags.push(["payload", Array.from(new Uint8Array(hash), b => b.toString(16).padStart(2, "0")).join("")]);
+    }
+    const event = await window.nostr.signEvent({
+        kind: 27235,
+        created_at: Math.floor(Date.now() / 1000),
+        tags: tags,
+        content: ""
+    });
+    return "Nostr " + btoa(JSON.stringify(event));
+}
+
+async function api(path, method, body) {
+    const data = body ? JSON.stringify(body) : undefined;
+    const res = await fetch(path, {
+        method: method,
+        headers: { "Authorization": await authHeader(path, method, data), "Content-Type": "application/json" },
+        body: data
+    });
+    if (!res.ok) throw new Error(await res.text());
+    return res.json();
+}
+
+function el(tag, text, cls) {
+    const e = document.createElement(tag);
+    if (text) e.textContent = text;
+    if (cls) e.className = cls;
+    return e;
+}
+
+async function load() {
+    const status = document.getElementById("status");
+    if (!window.nostr) { status.textContent = "No NIP-07 extension found."; return; }
+    try {
+        const reports = await api("/admin/reports?status=open", "GET");
+        render(reports);
+        status.textContent = reports.length + " open reports";
+    } catch (e) {
+        status.textContent = e.message;
+    }
+}
+
+async function resolve(id, action, ban) {
+    try {
+        await api("/admin/reports/" + id + "/resolve", "POST", { action: action, ban: ban });
+        load();
+    } catch (e) {
+        document.getElementById("status").textContent = e.message;
+    }
+}
+
+function render(reports) {
+    const list = document.getElementById("reports");
+    list.replaceChildren();
+    for (const r of reports) {
+        const div = el("div", "", "report");
+        div.appendChild(el("div", "Report " + r.id + " by " + r.reporter + " at " + new Date(r.created_at * 1000).toLocaleString(), "meta"));
+        if (r.content) div.appendChild(el("p", r.content));
+        for (const t of r.targets) {
+            div.appendChild(el("div", t.type + " " + t.id + (t.reason ? " (" + t.reason + ")" : ""), "target"));
+            if (t.type !== "blob") continue;
+            if (!t.owners) { div.appendChild(el("div", "blob no longer stored", "meta")); continue; }
+            const info = el("div", (t.mime_type || "unknown type") + ", " + t.size + " bytes, " + t.reports + " reports, uploaded by " + t.owners.join(", ") + " ", "meta");
+            const view = el("a", "view"); view.href = "/" + t.id; view.target = "_blank"; view.rel = "noreferrer";
+            info.appendChild(view);
+            div.appendChild(info);
+        }
+        const actions = el("p");
+        const del = el("button", r.targets.some(t => t.type === "blob") ? "Take down" : "Delete content"); del.onclick = () => resolve(r.id, "delete", false);
+        const ban = el("button", "Delete and ban author"); ban.onclick = () => resolve(r.id, "delete", true);
+        const dismiss = el("button", "Dismiss", "secondary"); dismiss.onclick = () => resolve(r.id, "dismiss", false);
+        actions.append(del, ban, dismiss);
+        div.appendChild(actions);
+        list.appendChild(div);
+    }
+}
+</script>
+</body>
+</html>
+`
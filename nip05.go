@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// NIP-05 identity document for the team domain, so the relay can be its own
+// nostr.json server. Names come from NIP05_NAMES (name=index or name=pubkey),
+// from the names admins gave managed members and, with NIP05_ROSTER_PREFIX,
+// from every derived index (member0, member1, ...).
+
+var nip05NamePattern = regexp.MustCompile(`^[a-z0-9._-]+$`)
+
+// parseNIP05Names parses "alice=3,bob=npub1..." into name -> index or pubkey.
+func parseNIP05Names(entries []string) (map[string]string, error) {
+	names := map[string]string{}
+	for _, entry := range entries {
+		name, target, ok := strings.Cut(entry, "=")
+		name, target = strings.ToLower(strings.TrimSpace(name)), strings.TrimSpace(target)
+		if !ok || !nip05NamePattern.MatchString(name) || target == "" {
+			return nil, fmt.Errorf("invalid NIP05_NAMES entry %q, expected name=index or name=pubkey", entry)
+		}
+		if _, err := strconv.ParseUint(target, 10, 32); err != nil {
+			target = normalizePubkey(target)
+			if !nostr.IsValidPublicKey(target) {
+				return nil, fmt.Errorf("invalid pubkey in NIP05_NAMES entry %q", entry)
+			}
+		}
+		names[name] = target
+	}
+	return names, nil
+}
+
+// nip05Names resolves the current name -> pubkey mapping. Explicit names win
+// over member names, which win over the roster.
+func nip05Names() map[string]string {
+	names := map[string]string{}
+
+	if config.NIP05RosterPrefix != "" && registry != nil {
+		pubkeys, err := registry.Pubkeys()
+		if err != nil {
+			slog.Error("NIP-05: failed to derive roster", "err", err)
+		}
+		for i, pk := range pubkeys {
+			names[config.NIP05RosterPrefix+strconv.Itoa(i)] = pk
+		}
+	}
+
+	managedMu.RLock()
+	for _, m := range managedMembers {
+		if name := strings.ToLower(m.Name); nip05NamePattern.MatchString(name) {
+			names[name] = m.Pubkey
+		}
+	}
+	managedMu.RUnlock()
+
+	for name, target := range config.NIP05Names {
+		if nostr.IsValidPublicKey(target) {
+			names[name] = target
+			continue
+		}
+		if deriver == nil {
+			continue
+		}
+		index, _ := strconv.ParseUint(target, 10, 32)
+		pk, err := deriver.DerivePublicKey(uint32(index))
+		if err != nil {
+			slog.Error("NIP-05: failed to derive name", "name", name, "err", err)
+			continue
+		}
+		names[name] = pk
+	}
+	return names
+}
+
+// setupNIP05 serves /.well-known/nostr.json. With ?name= only that name is
+// returned, as NIP-05 clients ask for.
+func setupNIP05(relay *khatru.Relay) {
+	relay.Router().HandleFunc("/.well-known/nostr.json", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		names := nip05Names()
+		if name := strings.ToLower(r.URL.Query().Get("name")); name != "" {
+			pk, ok := names[name]
+			names = map[string]string{}
+			if ok {
+				names[name] = pk
+			}
+		}
+
+		doc := NostrData{Names: names, Relays: map[string][]string{}}
+		if config.WebsocketURL != nil && *config.WebsocketURL != "" {
+			for _, pk := range names {
+				doc.Relays[pk] = []string{*config.WebsocketURL}
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		json.NewEncoder(w).Encode(doc)
+	})
+
+	slog.Info("NIP-05: serving /.well-known/nostr.json", "names", len(nip05Names()))
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+
+	"github.com/bitkarrot/higher/keyderivation"
+	"github.com/fiatjaf/khatru"
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// Auto-published NIP-94 file metadata: every blob stored through the blossom
+// hooks (uploads, NIP-96, mirrors) gets a kind 1063 event signed by a key
+// derived from the master at NIP94_SIGNER_INDEX, so uploaded media can be
+// found with regular relay queries.
+
+// fileMetadataPubkey is the pubkey of the signing key, empty when disabled.
+var fileMetadataPubkey string
+
+// publishFileMetadata stores a kind 1063 event describing the blob read from
+// body, unless one already exists.
+func publishFileMetadata(ctx context.Context, relay *khatru.Relay, bl *blossom.BlossomServer, sha256 string, body io.ReadSeeker, size int64) error {
+	ch, err := db.QueryEvents(ctx, nostr.Filter{
+		Kinds:   []int{1063},
+		Authors: []string{fileMetadataPubkey},
+		Tags:    nostr.TagMap{"x": []string{sha256}},
+		Limit:   1,
+	})
+	if err != nil {
+		return err
+	}
+	exists := false
+	for range ch {
+		exists = true
+	}
+	if exists {
+		return nil
+	}
+
+	// prefer what the upload handler recorded in the blob index
+	bd := blossom.BlobDescriptor{SHA256: sha256, Size: int(size)}
+	if indexed, err := bl.Store.Get(ctx, sha256); err == nil && indexed != nil {
+		bd.URL, bd.Type = indexed.URL, indexed.Type
+	}
+	if bd.Type == "" {
+		head := make([]byte, 512)
+		n, _ := io.ReadFull(body, head)
+		bd.Type = http.DetectContentType(head[:n])
+	}
+	if bd.URL == "" {
+		ext := ""
+		if exts, _ := mime.ExtensionsByType(bd.Type); len(exts) > 0 {
+			ext = exts[0]
+		}
+		bd.URL = bl.ServiceURL + "/" + sha256 + ext
+	}
+
+	tags := append(nip94Tags(bd), mediaTags(body, bd.Type)...)
+	tags = append(tags, thumbnailTags(ctx, sha256)...)
+
+	evt := &nostr.Event{
+		Kind:      1063,
+		CreatedAt: nostr.Now(),
+		Tags:      tags,
+	}
+	if err := deriver.SignEvent(uint32(config.NIP94SignerIndex), evt); err != nil {
+		return err
+	}
+	if err := db.SaveEvent(ctx, evt); err != nil {
+		return err
+	}
+	relay.BroadcastEvent(evt)
+	return nil
+}
+
+// setupFileMetadata derives the signing key and hooks metadata publishing
+// after the blob storage hooks.
+func setupFileMetadata(relay *khatru.Relay, bl *blossom.BlossomServer) error {
+	pubkey, err := deriver.DerivePublicKey(uint32(config.NIP94SignerIndex))
+	if err != nil {
+		return err
+	}
+	if deriver.IsWatchOnly() {
+		return keyderivation.ErrWatchOnly
+	}
+	fileMetadataPubkey = pubkey
+
+	bl.StoreBlob = append(bl.StoreBlob, func(ctx context.Context, sha256 string, body []byte) error {
+		// metadata is best effort, the blob itself is already stored
+		reader, size, err := blobReader(ctx, sha256, body)
+		if err == nil {
+			err = publishFileMetadata(ctx, relay, bl, sha256, reader, size)
+			if closer, ok := reader.(io.Closer); ok {
+				closer.Close()
+			}
+		}
+		if err != nil {
+			blobLogger(ctx, sha256).Warn("NIP-94: failed to publish metadata", "err", err)
+		}
+		return nil
+	})
+
+	npub, _ := nip19.EncodePublicKey(fileMetadataPubkey)
+	slog.Info("NIP-94: publishing file metadata", "npub", npub)
+	return nil
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// NIP-96 HTTP file storage, for clients that don't speak Blossom. Uploads go
+// through the same RejectUpload/StoreBlob hooks and blob index as Blossom, so
+// files are served by the regular /<sha256> endpoint.
+
+type nip96Response struct {
+	Status     string      `json:"status"`
+	Message    string      `json:"message"`
+	NIP94Event *nip94Event `json:"nip94_event,omitempty"`
+}
+
+type nip94Event struct {
+	Tags      nostr.Tags      `json:"tags"`
+	Content   string          `json:"content"`
+	CreatedAt nostr.Timestamp `json:"created_at,omitempty"`
+}
+
+// nip94Tags describes a stored blob with NIP-94 file metadata tags.
+func nip94Tags(bd blossom.BlobDescriptor) nostr.Tags {
+	tags := nostr.Tags{
+		{"url", bd.URL},
+		{"ox", bd.SHA256},
+		{"x", bd.SHA256},
+		{"size", strconv.Itoa(bd.Size)},
+	}
+	if bd.Type != "" {
+		tags = append(tags, nostr.Tag{"m", bd.Type})
+	}
+	return tags
+}
+
+func nip96Error(w http.ResponseWriter, msg string, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(nip96Response{Status: "error", Message: msg})
+}
+
+// setupNIP96 serves the discovery document and the upload, delete and list
+// endpoints under NIP96_PATH.
+func setupNIP96(relay *khatru.Relay, bl *blossom.BlossomServer) {
+	apiPath := "/" + strings.Trim(config.NIP96Path, "/")
+	maxSize := config.MaxUploadSizeMB * 1024 * 1024
+
+	relay.Router().HandleFunc("/.well-known/nostr/nip96.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"api_url":        strings.TrimSuffix(*config.BlossomURL, "/") + apiPath,
+			"download_url":   strings.TrimSuffix(*config.BlossomURL, "/"),
+			"supported_nips": []int{94, 96, 98},
+			"tos_url":        "",
+			"content_types":  []string{},
+			"plans": map[string]any{
+				"free": map[string]any{
+					"name":              "Team members",
+					"is_nip98_required": true,
+					"max_byte_size":     maxSize,
+				},
+			},
+		})
+	})
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		auth, err := readHTTPAuth(r)
+		if err != nil {
+			nip96Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if auth == nil {
+			nip96Error(w, "missing NIP-98 authorization", http.StatusUnauthorized)
+			return
+		}
+
+		switch r.Method {
+		case "POST":
+			handleNIP96Upload(w, r, bl, auth, maxSize)
+		case "DELETE":
+			handleNIP96Delete(w, r, bl, auth, apiPath)
+		case "GET":
+			handleNIP96List(w, r, bl, auth)
+		default:
+			nip96Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+	relay.Router().HandleFunc(apiPath, handler)
+	relay.Router().HandleFunc(apiPath+"/", handler)
+
+	slog.Info("NIP-96: serving", "path", apiPath)
+}
+
+func handleNIP96Upload(w http.ResponseWriter, r *http.Request, bl *blossom.BlossomServer, auth *nostr.Event, maxSize int) {
+	if !acquireUploadSlot() {
+		w.Header().Set("Retry-After", "5")
+		nip96Error(w, "too many uploads in progress, try again shortly", http.StatusServiceUnavailable)
+		return
+	}
+	defer releaseUploadSlot()
+
+	// leave room for the multipart envelope
+	r.Body = http.MaxBytesReader(w, r.Body, int64(maxSize)+1<<20)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		nip96Error(w, "expected a multipart upload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// spool the file to a staged file instead of buffering it; the other
+	// form fields are small
+	fields := map[string]string{}
+	var staged *stagedBlob
+	var declared string
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			nip96Error(w, "failed to read upload: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if part.FormName() != "file" || staged != nil {
+			value, _ := io.ReadAll(io.LimitReader(part, 64*1024))
+			fields[part.FormName()] = string(value)
+			continue
+		}
+		declared = part.Header.Get("Content-Type")
+		staged, err = stageBlob(part, int64(maxSize))
+		if err == errBlobTooLarge {
+			nip96Error(w, fmt.Sprintf("file size exceeds %dMB limit", config.MaxUploadSizeMB), http.StatusRequestEntityTooLarge)
+			return
+		} else if err != nil {
+			nip96Error(w, "failed to read upload: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer staged.Remove()
+	}
+	if staged == nil {
+		nip96Error(w, "missing \"file\" form field", http.StatusBadRequest)
+		return
+	}
+
+	head := staged.Head()
+	mimetype := fields["content_type"]
+	if mimetype == "" {
+		mimetype = declared
+	}
+	if mimetype == "" || mimetype == "application/octet-stream" {
+		mimetype = http.DetectContentType(head)
+	}
+	mimetype, _, _ = strings.Cut(mimetype, ";")
+	var ext string
+	if exts, _ := mime.ExtensionsByType(mimetype); len(exts) > 0 {
+		ext = exts[0]
+	}
+
+	ctx := withSniffedType(r.Context(), detectBlobType(head))
+	for _, reject := range bl.RejectUpload {
+		if rejected, reason, code := reject(ctx, auth, int(staged.Size), ext); rejected {
+			nip96Error(w, reason, code)
+			return
+		}
+	}
+
+	hhash := staged.SHA256
+	bd := blossom.BlobDescriptor{
+		URL:      bl.ServiceURL + "/" + hhash + ext,
+		SHA256:   hhash,
+		Size:     int(staged.Size),
+		Type:     mimetype,
+		Uploaded: nostr.Now(),
+	}
+	if err := bl.Store.Keep(r.Context(), bd, auth.PubKey); err != nil {
+		nip96Error(w, "failed to save: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ctx = withStagedBlob(r.Context(), staged)
+	for _, store := range bl.StoreBlob {
+		if err := store(ctx, hhash, nil); err != nil {
+			nip96Error(w, "failed to save: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	tags := newBlobResponse(r.Context(), bd).NIP94
+	if alt := fields["alt"]; alt != "" {
+		tags = append(tags, nostr.Tag{"alt", alt})
+	}
+
+	blobLogger(r.Context(), hhash).Info("NIP-96: stored blob", "size", staged.Size, "pubkey", auth.PubKey)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(nip96Response{
+		Status:  "success",
+		Message: "Upload successful.",
+		NIP94Event: &nip94Event{
+			Tags:      tags,
+			Content:   fields["caption"],
+			CreatedAt: bd.Uploaded,
+		},
+	})
+}
+
+func handleNIP96Delete(w http.ResponseWriter, r *http.Request, bl *blossom.BlossomServer, auth *nostr.Event, apiPath string) {
+	name := strings.TrimPrefix(r.URL.Path, apiPath+"/")
+	hhash, _, _ := strings.Cut(name, ".")
+	if !isBlobHash(hhash) {
+		nip96Error(w, "invalid file hash", http.StatusBadRequest)
+		return
+	}
+	hhash = strings.ToLower(hhash)
+
+	owners := blobOwners(r.Context(), hhash)
+	owned := false
+	for _, owner := range owners {
+		owned = owned || owner == auth.PubKey
+	}
+	if !owned {
+		nip96Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+
+	if err := bl.Store.Delete(r.Context(), hhash, auth.PubKey); err != nil {
+		nip96Error(w, "failed to delete: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// the content goes away only when nobody else uploaded it too
+	if len(owners) == 1 {
+		for _, del := range bl.DeleteBlob {
+			if err := del(r.Context(), hhash); err != nil {
+				blobLogger(r.Context(), hhash).Error("NIP-96: failed to delete blob", "err", err)
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(nip96Response{Status: "success", Message: "File deleted."})
+}
+
+func handleNIP96List(w http.ResponseWriter, r *http.Request, bl *blossom.BlossomServer, auth *nostr.Event) {
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	count, _ := strconv.Atoi(r.URL.Query().Get("count"))
+	if page < 0 {
+		page = 0
+	}
+	if count <= 0 || count > 100 {
+		count = 10
+	}
+
+	ch, err := bl.Store.List(r.Context(), auth.PubKey)
+	if err != nil {
+		nip96Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var all []blossom.BlobDescriptor
+	for bd := range ch {
+		all = append(all, bd)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Uploaded > all[j].Uploaded })
+
+	files := []nip94Event{}
+	for i := page * count; i < len(all) && i < (page+1)*count; i++ {
+		files = append(files, nip94Event{Tags: nip94Tags(all[i]), CreatedAt: all[i].Uploaded})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"count": len(files),
+		"total": len(all),
+		"page":  page,
+		"files": files,
+	})
+}
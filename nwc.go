@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip04"
+)
+
+// nwcBackend is a payment backend that talks to the operator's wallet over
+// Nostr Wallet Connect (NIP-47), for setups without direct node access. The
+// connection string is the one the wallet hands out, and only needs the
+// make_invoice and lookup_invoice permissions.
+type nwcBackend struct {
+	walletPubkey string
+	relayURL     string
+	secret       string
+	sharedKey    []byte
+}
+
+// parseNWCURL reads nostr+walletconnect://<wallet pubkey>?relay=...&secret=...
+func parseNWCURL(connection string) (*nwcBackend, error) {
+	u, err := url.Parse(strings.TrimSpace(connection))
+	if err != nil || u.Scheme != "nostr+walletconnect" {
+		return nil, fmt.Errorf("NWC_URL must be a nostr+walletconnect:// connection string")
+	}
+	walletPubkey := u.Host
+	if walletPubkey == "" {
+		walletPubkey = u.Opaque
+	}
+	b := &nwcBackend{
+		walletPubkey: walletPubkey,
+		relayURL:     u.Query().Get("relay"),
+		secret:       u.Query().Get("secret"),
+	}
+	if !nostr.IsValidPublicKey(b.walletPubkey) || b.relayURL == "" || !nostr.IsValid32ByteHex(b.secret) {
+		return nil, fmt.Errorf("NWC_URL is missing the wallet pubkey, relay or secret")
+	}
+	b.sharedKey, err = nip04.ComputeSharedSecret(b.walletPubkey, b.secret)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// request sends a NIP-47 request and waits for the wallet's response.
+func (b *nwcBackend) request(ctx context.Context, method string, params any, result any) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	payload, err := json.Marshal(map[string]any{"method": method, "params": params})
+	if err != nil {
+		return err
+	}
+	content, err := nip04.Encrypt(string(payload), b.sharedKey)
+	if err != nil {
+		return err
+	}
+	req := nostr.Event{
+		Kind:      23194,
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"p", b.walletPubkey}},
+		Content:   content,
+	}
+	if err := req.Sign(b.secret); err != nil {
+		return err
+	}
+
+	rel, err := nostr.RelayConnect(ctx, b.relayURL)
+	if err != nil {
+		return fmt.Errorf("failed to connect to NWC relay: %w", err)
+	}
+	defer rel.Close()
+
+	sub, err := rel.Subscribe(ctx, nostr.Filters{{
+		Kinds:   []int{23195},
+		Authors: []string{b.walletPubkey},
+		Tags:    nostr.TagMap{"e": []string{req.ID}},
+	}})
+	if err != nil {
+		return err
+	}
+	defer sub.Unsub()
+	if err := rel.Publish(ctx, req); err != nil {
+		return fmt.Errorf("failed to send NWC request: %w", err)
+	}
+
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("wallet did not answer %s: %w", method, ctx.Err())
+	case evt := <-sub.Events:
+		plain, err := nip04.Decrypt(evt.Content, b.sharedKey)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt NWC response: %w", err)
+		}
+		var resp struct {
+			Result json.RawMessage `json:"result"`
+			Error  *struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal([]byte(plain), &resp); err != nil {
+			return fmt.Errorf("invalid NWC response: %w", err)
+		}
+		if resp.Error != nil {
+			return fmt.Errorf("wallet error %s: %s", resp.Error.Code, resp.Error.Message)
+		}
+		return json.Unmarshal(resp.Result, result)
+	}
+}
+
+func (b *nwcBackend) CreateInvoice(ctx context.Context, amountSats int, memo string, expiry time.Duration) (Invoice, error) {
+	var res struct {
+		Invoice     string `json:"invoice"`
+		PaymentHash string `json:"payment_hash"`
+		ExpiresAt   int64  `json:"expires_at"`
+	}
+	params := map[string]any{"amount": amountSats * 1000, "description": memo, "expiry": int(expiry.Seconds())}
+	if err := b.request(ctx, "make_invoice", params, &res); err != nil {
+		return Invoice{}, err
+	}
+	if res.ExpiresAt == 0 {
+		res.ExpiresAt = time.Now().Add(expiry).Unix()
+	}
+	return Invoice{ID: res.PaymentHash, Bolt11: res.Invoice, Ref: res.PaymentHash, ExpiresAt: res.ExpiresAt}, nil
+}
+
+func (b *nwcBackend) IsPaid(ctx context.Context, inv Invoice) (bool, error) {
+	var res struct {
+		State     string `json:"state"`
+		SettledAt int64  `json:"settled_at"`
+	}
+	if err := b.request(ctx, "lookup_invoice", map[string]any{"payment_hash": inv.Ref}, &res); err != nil {
+		return false, err
+	}
+	return res.SettledAt > 0 || res.State == "settled", nil
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip11"
+)
+
+// Paid access: pubkeys outside the team buy write access for PAID_ACCESS_DAYS
+// by paying a Lightning invoice of PAID_ACCESS_FEE_SATS. Invoices are issued
+// at POST /pay/invoice and watched until paid or expired; the page at /pay
+// (advertised as the NIP-11 payments_url) walks users through it. Anyone may
+// ask for an invoice, so the endpoint is limited to
+// PAID_ACCESS_INVOICE_RATE_LIMIT per IP per minute and PAID_ACCESS_MAX_PENDING
+// open invoices, and a pubkey asking again gets its open invoice back.
+
+const (
+	paidInvoiceExpiry = 15 * time.Minute
+	// an open invoice is handed out again while it has this long left
+	paidInvoiceReuseMin = 3 * time.Minute
+	// open invoices per pubkey, one being about to expire
+	paidMaxPendingPerPubkey = 2
+)
+
+// Subscription is the paid write access of one pubkey.
+type Subscription struct {
+	Pubkey    string `json:"pubkey"`
+	PaidAt    int64  `json:"paid_at"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+// pendingPayment is an issued invoice waiting to be paid.
+type pendingPayment struct {
+	Invoice
+	Pubkey     string `json:"pubkey"`
+	AmountSats int    `json:"amount_sats"`
+}
+
+// paidAccessState is persisted so subscriptions and open invoices survive restarts.
+type paidAccessState struct {
+	Subscriptions map[string]Subscription   `json:"subscriptions"`
+	Pending       map[string]pendingPayment `json:"pending"`
+}
+
+var (
+	paymentBackend PaymentBackend
+
+	paidMu     sync.Mutex
+	paidAccess = paidAccessState{Subscriptions: map[string]Subscription{}, Pending: map[string]pendingPayment{}}
+	// invoices settled lately, so status checks racing the watcher still see them
+	settledPayments = map[string]settledPayment{}
+	// invoices being created at the backend, counted against the caps
+	creatingInvoices int
+)
+
+// settledPayment is a recently paid invoice.
+type settledPayment struct {
+	pubkey string
+	at     time.Time
+}
+
+// hasPaidAccess reports whether pubkey has an active subscription.
+func hasPaidAccess(pubkey string) bool {
+	if !config.PaidAccess {
+		return false
+	}
+	paidMu.Lock()
+	defer paidMu.Unlock()
+	sub, ok := paidAccess.Subscriptions[pubkey]
+	return ok && sub.ExpiresAt > time.Now().Unix()
+}
+
+func persistPaidAccess(ctx context.Context) {
+	paidMu.Lock()
+	defer paidMu.Unlock()
+	if err := saveState(ctx, "paid_access", paidAccess); err != nil {
+		slog.Error("Paid access: failed to persist state", "err", err)
+	}
+}
+
+// settlePayment checks a pending invoice and turns it into (more) access
+// when paid. It returns the resulting subscription, nil while unpaid.
+func settlePayment(ctx context.Context, id string) (*Subscription, error) {
+	paidMu.Lock()
+	pending, ok := paidAccess.Pending[id]
+	if settled, ok := settledPayments[id]; ok {
+		sub := paidAccess.Subscriptions[settled.pubkey]
+		paidMu.Unlock()
+		return &sub, nil
+	}
+	paidMu.Unlock()
+	if !ok {
+		return nil, nil
+	}
+
+	paid, err := paymentBackend.IsPaid(ctx, pending.Invoice)
+	if err != nil || !paid {
+		return nil, err
+	}
+
+	paidMu.Lock()
+	if _, still := paidAccess.Pending[id]; !still {
+		// settled concurrently
+		sub := paidAccess.Subscriptions[pending.Pubkey]
+		paidMu.Unlock()
+		return &sub, nil
+	}
+	delete(paidAccess.Pending, id)
+	settledPayments[id] = settledPayment{pubkey: pending.Pubkey, at: time.Now()}
+	now := time.Now().Unix()
+	sub := paidAccess.Subscriptions[pending.Pubkey]
+	sub.Pubkey, sub.PaidAt = pending.Pubkey, now
+	sub.ExpiresAt = max(sub.ExpiresAt, now) + int64(config.PaidAccessDays)*24*3600
+	paidAccess.Subscriptions[pending.Pubkey] = sub
+	paidMu.Unlock()
+	persistPaidAccess(ctx)
+
+	slog.Info("Paid access: payment settled", "pubkey", pending.Pubkey, "sats", pending.AmountSats, "until", time.Unix(sub.ExpiresAt, 0).UTC().Format(time.RFC3339))
+	return &sub, nil
+}
+
+// watchPayments polls open invoices and forgets expired ones, and settled
+// ones once their invoice would have expired.
+func watchPayments() {
+	for {
+		time.Sleep(10 * time.Second)
+
+		paidMu.Lock()
+		for id, settled := range settledPayments {
+			if time.Since(settled.at) > paidInvoiceExpiry {
+				delete(settledPayments, id)
+			}
+		}
+		var ids []string
+		expired := false
+		for id, p := range paidAccess.Pending {
+			if p.ExpiresAt < time.Now().Unix() {
+				delete(paidAccess.Pending, id)
+				expired = true
+				continue
+			}
+			ids = append(ids, id)
+		}
+		paidMu.Unlock()
+		if expired {
+			persistPaidAccess(context.Background())
+		}
+
+		for _, id := range ids {
+			if _, err := settlePayment(context.Background(), id); err != nil {
+				slog.Warn("Paid access: failed to check invoice", "invoice", id, "err", err)
+			}
+		}
+	}
+}
+
+// openInvoice returns an open invoice of pubkey to hand out again, or
+// reserves the creation of a new one, failing when the caps are reached.
+// paidMu must be held.
+func openInvoice(pubkey string) (*pendingPayment, error) {
+	reuseUntil := time.Now().Add(paidInvoiceReuseMin).Unix()
+	open := 0
+	for _, p := range paidAccess.Pending {
+		if p.Pubkey != pubkey {
+			continue
+		}
+		if p.ExpiresAt > reuseUntil {
+			return &p, nil
+		}
+		open++
+	}
+	if open >= paidMaxPendingPerPubkey {
+		return nil, errors.New("too many open invoices for this pubkey, pay or wait for one to expire")
+	}
+	if config.PaidMaxPending > 0 && len(paidAccess.Pending)+creatingInvoices >= config.PaidMaxPending {
+		return nil, errors.New("too many open invoices, try again later")
+	}
+	creatingInvoices++
+	return nil, nil
+}
+
+// advertisePaidAccess publishes the fee in the NIP-11 document.
+func advertisePaidAccess(relay *khatru.Relay) {
+	if relay.Info.Limitation == nil {
+		relay.Info.Limitation = &nip11.RelayLimitationDocument{}
+	}
+	relay.Info.Limitation.PaymentRequired = true
+	relay.Info.Limitation.RestrictedWrites = true
+	if relay.Info.Fees == nil {
+		relay.Info.Fees = &nip11.RelayFeesDocument{}
+	}
+	relay.Info.Fees.Subscription = append(relay.Info.Fees.Subscription, struct {
+		Amount int    `json:"amount"`
+		Unit   string `json:"unit"`
+		Period int    `json:"period"`
+	}{Amount: config.PaidAccessFeeSats * 1000, Unit: "msats", Period: config.PaidAccessDays * 24 * 3600})
+	if base := relayHTTPURL(); base != "" {
+		relay.Info.PaymentsURL = base + "/pay"
+	}
+}
+
+// setupPaidAccess loads subscriptions, starts the payment watcher and serves
+// the payment endpoints:
+//
+//	GET  /pay                  payment page
+//	POST /pay/invoice          {"pubkey": "..."} -> invoice
+//	GET  /pay/status/{id}      {"paid": bool, "expires_at": ...}
+//	GET  /admin/subscriptions  all subscriptions
+func setupPaidAccess(relay *khatru.Relay) {
+	var st paidAccessState
+	if ok, err := loadState(context.Background(), "paid_access", &st); err != nil {
+		slog.Error("Paid access: failed to load state", "err", err)
+	} else if ok {
+		if st.Subscriptions == nil {
+			st.Subscriptions = map[string]Subscription{}
+		}
+		if st.Pending == nil {
+			st.Pending = map[string]pendingPayment{}
+		}
+		paidMu.Lock()
+		paidAccess = st
+		paidMu.Unlock()
+	}
+
+	advertisePaidAccess(relay)
+	go watchPayments()
+
+	invoiceLimiter := newEndpointLimiter("pay_invoice", config.PaidInvoiceRateLimit)
+	if invoiceLimiter != nil {
+		go func() {
+			for range time.Tick(rateWindowTTL) {
+				invoiceLimiter.prune()
+			}
+		}()
+	}
+
+	relay.Router().HandleFunc("/pay", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(w, paymentPage, config.RelayName, config.PaidAccessFeeSats, config.PaidAccessDays)
+	})
+
+	relay.Router().HandleFunc("/pay/invoice", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if invoiceLimiter != nil {
+			if ok, wait := invoiceLimiter.allow(clientIP(r)); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+				http.Error(w, "Too many invoices requested, try again later", http.StatusTooManyRequests)
+				return
+			}
+		}
+		var req struct {
+			Pubkey string `json:"pubkey"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		pubkey := normalizePubkey(strings.TrimSpace(req.Pubkey))
+		if !nostr.IsValidPublicKey(pubkey) {
+			http.Error(w, "Invalid pubkey", http.StatusBadRequest)
+			return
+		}
+		if isBanned(pubkey) {
+			http.Error(w, "Pubkey is banned", http.StatusForbidden)
+			return
+		}
+
+		paidMu.Lock()
+		existing, err := openInvoice(pubkey)
+		paidMu.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		pending := existing
+		if pending == nil {
+			memo := fmt.Sprintf("%s: %d days of write access for %s", config.RelayName, config.PaidAccessDays, pubkey)
+			inv, err := paymentBackend.CreateInvoice(r.Context(), config.PaidAccessFeeSats, memo, paidInvoiceExpiry)
+			paidMu.Lock()
+			creatingInvoices--
+			if err == nil {
+				pending = &pendingPayment{Invoice: inv, Pubkey: pubkey, AmountSats: config.PaidAccessFeeSats}
+				paidAccess.Pending[inv.ID] = *pending
+			}
+			paidMu.Unlock()
+			if err != nil {
+				logger(r.Context()).Error("Paid access: failed to create invoice", "pubkey", pubkey, "err", err)
+				http.Error(w, "Failed to create invoice", http.StatusBadGateway)
+				return
+			}
+			persistPaidAccess(r.Context())
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"id":          pending.ID,
+			"invoice":     pending.Bolt11,
+			"amount_sats": pending.AmountSats,
+			"expires_at":  pending.ExpiresAt,
+		})
+	})
+
+	relay.Router().HandleFunc("/pay/status/", func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/pay/status/")
+		sub, err := settlePayment(r.Context(), id)
+		if err != nil {
+			http.Error(w, "Failed to check payment", http.StatusBadGateway)
+			return
+		}
+		status := map[string]any{"paid": sub != nil}
+		if sub != nil {
+			status["pubkey"], status["expires_at"] = sub.Pubkey, sub.ExpiresAt
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	})
+
+	relay.Router().HandleFunc("/admin/subscriptions", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		paidMu.Lock()
+		subs := make([]Subscription, 0, len(paidAccess.Subscriptions))
+		for _, s := range paidAccess.Subscriptions {
+			subs = append(subs, s)
+		}
+		paidMu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(subs)
+	}))
+
+	slog.Info("Paid access: ENABLED", "sats", config.PaidAccessFeeSats, "days", config.PaidAccessDays, "backend", config.Payments.Backend)
+}
+
+const paymentPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>%[1]s - Write access</title>
+    <style>
+        body { font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, sans-serif; background: #0f172a; color: #e5e7eb; max-width: 640px; margin: 0 auto; padding: 2rem; }
+        input { width: 100%%; padding: 0.5rem; margin: 0.5rem 0; box-sizing: border-box; }
+        button { background: #7c3aed; color: white; border: 0; border-radius: 4px; padding: 0.5rem 1rem; cursor: pointer; }
+        #invoice { word-break: break-all; font-family: monospace; font-size: 0.8rem; }
+    </style>
+</head>
+<body>
+    <h1>%[1]s</h1>
+    <p>Write access costs %[2]d sats for %[3]d days.</p>
+    <input id="pubkey" placeholder="npub or hex pubkey">
+    <button onclick="buy()">Get invoice</button>
+    <p id="status"></p>
+    <p><a id="link"></a></p>
+    <p id="invoice"></p>
+<script>
+async function buy() {
+    const status = document.getElementById("status");
+    const res = await fetch("/pay/invoice", {
+        method: "POST",
+        headers: { "Content-Type": "application/json" },
+        body: JSON.stringify({ pubkey: document.getElementById("pubkey").value })
+    });
+    if (!res.ok) { status.textContent = await res.text(); return; }
+    const inv = await res.json();
+    document.getElementById("invoice").textContent = inv.invoice;
+    const link = document.getElementById("link");
+    link.href = "lightning:" + inv.invoice;
+    link.textContent = "Open in wallet";
+    status.textContent = "Waiting for payment...";
+    const timer = setInterval(async () => {
+        const st = await (await fetch("/pay/status/" + inv.id)).json();
+        if (st.paid) {
+            clearInterval(timer);
+            status.textContent = "Paid! Write access until " + new Date(st.expires_at * 1000).toLocaleString();
+        }
+    }, 3000);
+}
+</script>
+</body>
+</html>
+`
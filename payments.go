@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Lightning payment backends used by paid access. Each creates invoices and
+// tells whether one was paid; which one is used is set by PAYMENT_BACKEND.
+
+// PaymentConfig selects and configures the payment backend.
+type PaymentConfig struct {
+	Backend      string // lnd, cln, lnurl or nwc
+	LNDURL       string // LND REST endpoint, e.g. https://127.0.0.1:8080
+	LNDMacaroon  string // hex invoice macaroon
+	CLNURL       string // CLN clnrest endpoint, e.g. https://127.0.0.1:3010
+	CLNRune      string
+	LNURLAddress string // lightning address whose server supports LUD-21 verify
+	NWCURL       string // nostr+walletconnect:// connection string
+}
+
+func loadPaymentConfig() PaymentConfig {
+	return PaymentConfig{
+		Backend:      strings.ToLower(getEnvWithDefault("PAYMENT_BACKEND", "")),
+		LNDURL:       strings.TrimSuffix(getEnvWithDefault("LND_REST_URL", ""), "/"),
+		LNDMacaroon:  getEnvWithDefault("LND_MACAROON_HEX", ""),
+		CLNURL:       strings.TrimSuffix(getEnvWithDefault("CLN_REST_URL", ""), "/"),
+		CLNRune:      getEnvWithDefault("CLN_RUNE", ""),
+		LNURLAddress: getEnvWithDefault("LNURL_ADDRESS", ""),
+		NWCURL:       getEnvWithDefault("NWC_URL", ""),
+	}
+}
+
+// Invoice is a Lightning invoice issued by a backend. Ref is whatever the
+// backend needs to look it up again.
+type Invoice struct {
+	ID        string `json:"id"`
+	Bolt11    string `json:"bolt11"`
+	Ref       string `json:"ref"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+// PaymentBackend issues invoices and checks whether they were paid.
+type PaymentBackend interface {
+	CreateInvoice(ctx context.Context, amountSats int, memo string, expiry time.Duration) (Invoice, error)
+	IsPaid(ctx context.Context, inv Invoice) (bool, error)
+}
+
+// newPaymentBackend builds the backend configured by PAYMENT_BACKEND.
+func newPaymentBackend(cfg PaymentConfig) (PaymentBackend, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	switch cfg.Backend {
+	case "lnd":
+		if cfg.LNDURL == "" || cfg.LNDMacaroon == "" {
+			return nil, fmt.Errorf("PAYMENT_BACKEND=lnd needs LND_REST_URL and LND_MACAROON_HEX")
+		}
+		return &lndBackend{url: cfg.LNDURL, macaroon: cfg.LNDMacaroon, client: client}, nil
+	case "cln":
+		if cfg.CLNURL == "" || cfg.CLNRune == "" {
+			return nil, fmt.Errorf("PAYMENT_BACKEND=cln needs CLN_REST_URL and CLN_RUNE")
+		}
+		return &clnBackend{url: cfg.CLNURL, rune: cfg.CLNRune, client: client}, nil
+	case "lnurl":
+		user, domain, ok := strings.Cut(cfg.LNURLAddress, "@")
+		if !ok || user == "" || domain == "" {
+			return nil, fmt.Errorf("PAYMENT_BACKEND=lnurl needs LNURL_ADDRESS as user@domain")
+		}
+		return &lnurlBackend{endpoint: "https://" + domain + "/.well-known/lnurlp/" + user, client: client}, nil
+	case "nwc":
+		return parseNWCURL(cfg.NWCURL)
+	default:
+		return nil, fmt.Errorf("unknown PAYMENT_BACKEND %q (expected lnd, cln, lnurl or nwc)", cfg.Backend)
+	}
+}
+
+// doJSON sends a request with an optional JSON body and decodes the JSON answer.
+func doJSON(ctx context.Context, client *http.Client, method, target string, headers map[string]string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		encoded, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s %s: status %d: %s", method, target, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(out)
+}
+
+// lndBackend talks to LND's REST API.
+type lndBackend struct {
+	url      string
+	macaroon string
+	client   *http.Client
+}
+
+func (b *lndBackend) CreateInvoice(ctx context.Context, amountSats int, memo string, expiry time.Duration) (Invoice, error) {
+	var res struct {
+		RHash          string `json:"r_hash"` // base64
+		PaymentRequest string `json:"payment_request"`
+	}
+	req := map[string]any{"value": amountSats, "memo": memo, "expiry": int(expiry.Seconds())}
+	if err := doJSON(ctx, b.client, "POST", b.url+"/v1/invoices", map[string]string{"Grpc-Metadata-macaroon": b.macaroon}, req, &res); err != nil {
+		return Invoice{}, err
+	}
+	hash, err := base64.StdEncoding.DecodeString(res.RHash)
+	if err != nil {
+		return Invoice{}, fmt.Errorf("invalid r_hash from LND: %w", err)
+	}
+	id := hex.EncodeToString(hash)
+	return Invoice{ID: id, Bolt11: res.PaymentRequest, Ref: id, ExpiresAt: time.Now().Add(expiry).Unix()}, nil
+}
+
+func (b *lndBackend) IsPaid(ctx context.Context, inv Invoice) (bool, error) {
+	var res struct {
+		State string `json:"state"`
+	}
+	if err := doJSON(ctx, b.client, "GET", b.url+"/v1/invoice/"+inv.Ref, map[string]string{"Grpc-Metadata-macaroon": b.macaroon}, nil, &res); err != nil {
+		return false, err
+	}
+	return res.State == "SETTLED", nil
+}
+
+// clnBackend talks to Core Lightning's clnrest plugin.
+type clnBackend struct {
+	url    string
+	rune   string
+	client *http.Client
+}
+
+func (b *clnBackend) CreateInvoice(ctx context.Context, amountSats int, memo string, expiry time.Duration) (Invoice, error) {
+	var res struct {
+		PaymentHash string `json:"payment_hash"`
+		Bolt11      string `json:"bolt11"`
+		ExpiresAt   int64  `json:"expires_at"`
+	}
+	req := map[string]any{
+		"amount_msat": amountSats * 1000,
+		"label":       fmt.Sprintf("higher-%d", time.Now().UnixNano()),
+		"description": memo,
+		"expiry":      int(expiry.Seconds()),
+	}
+	if err := doJSON(ctx, b.client, "POST", b.url+"/v1/invoice", map[string]string{"Rune": b.rune}, req, &res); err != nil {
+		return Invoice{}, err
+	}
+	return Invoice{ID: res.PaymentHash, Bolt11: res.Bolt11, Ref: res.PaymentHash, ExpiresAt: res.ExpiresAt}, nil
+}
+
+func (b *clnBackend) IsPaid(ctx context.Context, inv Invoice) (bool, error) {
+	var res struct {
+		Invoices []struct {
+			Status string `json:"status"`
+		} `json:"invoices"`
+	}
+	req := map[string]any{"payment_hash": inv.Ref}
+	if err := doJSON(ctx, b.client, "POST", b.url+"/v1/listinvoices", map[string]string{"Rune": b.rune}, req, &res); err != nil {
+		return false, err
+	}
+	return len(res.Invoices) > 0 && res.Invoices[0].Status == "paid", nil
+}
+
+// lnurlBackend requests invoices from a lightning address (LUD-16) and checks
+// them through the LUD-21 verify URL that comes with each invoice.
+type lnurlBackend struct {
+	endpoint string
+	client   *http.Client
+}
+
+func (b *lnurlBackend) CreateInvoice(ctx context.Context, amountSats int, memo string, expiry time.Duration) (Invoice, error) {
+	var params struct {
+		Callback       string `json:"callback"`
+		MinSendable    int64  `json:"minSendable"`
+		MaxSendable    int64  `json:"maxSendable"`
+		CommentAllowed int    `json:"commentAllowed"`
+	}
+	if err := doJSON(ctx, b.client, "GET", b.endpoint, nil, nil, &params); err != nil {
+		return Invoice{}, err
+	}
+	msat := int64(amountSats) * 1000
+	if msat < params.MinSendable || (params.MaxSendable > 0 && msat > params.MaxSendable) {
+		return Invoice{}, fmt.Errorf("amount %d sats is outside what the lightning address accepts", amountSats)
+	}
+
+	callback, err := url.Parse(params.Callback)
+	if err != nil {
+		return Invoice{}, fmt.Errorf("invalid LNURL callback: %w", err)
+	}
+	q := callback.Query()
+	q.Set("amount", fmt.Sprint(msat))
+	if params.CommentAllowed > 0 {
+		q.Set("comment", memo[:min(len(memo), params.CommentAllowed)])
+	}
+	callback.RawQuery = q.Encode()
+
+	var res struct {
+		PR     string `json:"pr"`
+		Verify string `json:"verify"`
+	}
+	if err := doJSON(ctx, b.client, "GET", callback.String(), nil, nil, &res); err != nil {
+		return Invoice{}, err
+	}
+	if res.Verify == "" {
+		return Invoice{}, fmt.Errorf("lightning address does not support LUD-21 payment verification")
+	}
+	id := sha256.Sum256([]byte(res.Verify))
+	return Invoice{ID: hex.EncodeToString(id[:]), Bolt11: res.PR, Ref: res.Verify, ExpiresAt: time.Now().Add(expiry).Unix()}, nil
+}
+
+func (b *lnurlBackend) IsPaid(ctx context.Context, inv Invoice) (bool, error) {
+	var res struct {
+		Settled bool `json:"settled"`
+	}
+	if err := doJSON(ctx, b.client, "GET", inv.Ref, nil, nil, &res); err != nil {
+		return false, err
+	}
+	return res.Settled, nil
+}
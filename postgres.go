@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/fiatjaf/eventstore/postgresql"
+	"github.com/jmoiron/sqlx"
+	"github.com/jmoiron/sqlx/reflectx"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Postgres event store. The connection comes from POSTGRES_URL or is built
+// from POSTGRES_USER, POSTGRES_PASSWORD, POSTGRES_HOST, POSTGRES_PORT and
+// POSTGRES_DB with POSTGRES_SSLMODE. At startup the server keeps retrying
+// with backoff for up to POSTGRES_CONNECT_TIMEOUT_SECONDS, so it can come up
+// alongside its database (docker compose, systemd) instead of exiting on the
+// first refused connection. With POSTGRES_READ_URL, queries and counts go to
+// a read replica while writes and deletions stay on the primary; replication
+// lag means a client may briefly not find an event it just published.
+
+const postgresRetryMax = 30 * time.Second
+
+// postgresBackend applies the connection pool settings on top of the
+// eventstore backend.
+type postgresBackend struct {
+	*postgresql.PostgresBackend
+	replica         *postgresql.PostgresBackend // nil without POSTGRES_READ_URL
+	readURL         string
+	maxOpenConns    int
+	maxIdleConns    int
+	connMaxLifetime time.Duration
+	connectTimeout  time.Duration
+}
+
+func newPostgresBackend(cfg *Config) DBBackend {
+	dsn := cfg.PostgresURL
+	if dsn == "" {
+		// Validate required Postgres settings to avoid nil pointer panics
+		if cfg.PostgresUser == nil || strings.TrimSpace(*cfg.PostgresUser) == "" ||
+			cfg.PostgresPassword == nil || strings.TrimSpace(*cfg.PostgresPassword) == "" ||
+			cfg.PostgresDB == nil || strings.TrimSpace(*cfg.PostgresDB) == "" ||
+			cfg.PostgresHost == nil || strings.TrimSpace(*cfg.PostgresHost) == "" ||
+			cfg.PostgresPort == nil || strings.TrimSpace(*cfg.PostgresPort) == "" {
+			fatal("Postgres selected but configuration is incomplete: set POSTGRES_URL, or POSTGRES_USER, POSTGRES_PASSWORD, POSTGRES_DB, POSTGRES_HOST, POSTGRES_PORT")
+		}
+		query := url.Values{"sslmode": {cfg.PostgresSSLMode}}
+		if cfg.PostgresSSLRootCert != "" {
+			query.Set("sslrootcert", cfg.PostgresSSLRootCert)
+		}
+		dsn = (&url.URL{
+			Scheme:   "postgres",
+			User:     url.UserPassword(*cfg.PostgresUser, *cfg.PostgresPassword),
+			Host:     net.JoinHostPort(*cfg.PostgresHost, *cfg.PostgresPort),
+			Path:     "/" + *cfg.PostgresDB,
+			RawQuery: query.Encode(),
+		}).String()
+	}
+	return &postgresBackend{
+		PostgresBackend: &postgresql.PostgresBackend{DatabaseURL: dsn},
+		readURL:         cfg.PostgresReadURL,
+		maxOpenConns:    cfg.PostgresMaxOpenConns,
+		maxIdleConns:    cfg.PostgresMaxIdleConns,
+		connMaxLifetime: time.Duration(cfg.PostgresConnMaxLifetime) * time.Minute,
+		connectTimeout:  time.Duration(cfg.PostgresConnectTimeout) * time.Second,
+	}
+}
+
+// Init connects to the primary and the replica, retrying with exponential
+// backoff while they are unreachable, and sizes the connection pools.
+func (b *postgresBackend) Init() error {
+	deadline := time.Now().Add(b.connectTimeout)
+	err := retryConnect("primary", deadline, func() (bool, error) {
+		err := b.PostgresBackend.Init()
+		// connected, but creating the schema failed: retrying won't help
+		return b.DB == nil, err
+	})
+	if err != nil {
+		return err
+	}
+	b.configurePool(b.DB)
+
+	if b.readURL != "" {
+		err := retryConnect("replica", deadline, func() (bool, error) {
+			return true, b.connectReplica()
+		})
+		if err != nil {
+			return err
+		}
+		b.configurePool(b.replica.DB)
+	}
+	slog.Info("Postgres: connected", "replica", b.replica != nil, "max_open_conns", b.maxOpenConns, "max_idle_conns", b.maxIdleConns,
+		"conn_max_lifetime", b.connMaxLifetime)
+	return nil
+}
+
+// retryConnect calls connect until it succeeds, it reports that retrying is
+// pointless, or the next attempt would be past deadline.
+func retryConnect(name string, deadline time.Time, connect func() (retry bool, err error)) error {
+	wait := time.Second
+	for {
+		retry, err := connect()
+		if err == nil {
+			return nil
+		}
+		if !retry || time.Now().Add(wait).After(deadline) {
+			return fmt.Errorf("postgres %s: %w", name, err)
+		}
+		slog.Warn("Postgres: database not reachable yet, retrying", "database", name, "in", wait, "err", err)
+		time.Sleep(wait)
+		wait = min(wait*2, postgresRetryMax)
+	}
+}
+
+func (b *postgresBackend) configurePool(conn *sqlx.DB) {
+	conn.SetMaxOpenConns(b.maxOpenConns)
+	conn.SetMaxIdleConns(b.maxIdleConns)
+	conn.SetConnMaxLifetime(b.connMaxLifetime)
+}
+
+// connectReplica opens the read replica. Its schema is the primary's, so
+// unlike Init it doesn't try to create it, which a replica would refuse.
+func (b *postgresBackend) connectReplica() error {
+	conn, err := sqlx.Connect("postgres", b.readURL)
+	if err != nil {
+		return err
+	}
+	conn.Mapper = reflectx.NewMapperFunc("json", sqlx.NameMapper)
+	b.replica = &postgresql.PostgresBackend{
+		DB:                conn,
+		DatabaseURL:       b.readURL,
+		QueryLimit:        b.QueryLimit,
+		QueryIDsLimit:     b.QueryIDsLimit,
+		QueryAuthorsLimit: b.QueryAuthorsLimit,
+		QueryKindsLimit:   b.QueryKindsLimit,
+		QueryTagsLimit:    b.QueryTagsLimit,
+	}
+	return nil
+}
+
+func (b *postgresBackend) QueryEvents(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	if b.replica != nil {
+		return b.replica.QueryEvents(ctx, filter)
+	}
+	return b.PostgresBackend.QueryEvents(ctx, filter)
+}
+
+func (b *postgresBackend) CountEvents(ctx context.Context, filter nostr.Filter) (int64, error) {
+	if b.replica != nil {
+		return b.replica.CountEvents(ctx, filter)
+	}
+	return b.PostgresBackend.CountEvents(ctx, filter)
+}
+
+func (b *postgresBackend) Close() {
+	if b.replica != nil {
+		b.replica.Close()
+	}
+	b.PostgresBackend.Close()
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip11"
+	"github.com/nbd-wtf/go-nostr/nip13"
+)
+
+// NIP-13 proof of work for outsiders. With MIN_POW_DIFFICULTY set, events
+// from pubkeys that are not members, admins, whitelisted, paying or in the
+// web of trust must carry a "nonce" tag committing to at least that many
+// leading zero bits of their id. Members never pay the cost, so an open relay
+// can take public posts without being flooded.
+
+// needsProofOfWork reports whether event comes from an outsider. Gift wraps
+// and bunker requests are signed with throwaway keys and are judged by their
+// recipient instead, and group events by the group's member list.
+func needsProofOfWork(event *nostr.Event) bool {
+	if isMember(event.PubKey) || isAdmin(event.PubKey) || isWhitelisted(event.PubKey) || hasPaidAccess(event.PubKey) || isTrusted(event.PubKey) {
+		return false
+	}
+	return !isGiftWrapForMember(event) && !isBunkerRequest(event) && !isGroupEvent(event)
+}
+
+// rejectInsufficientWork enforces MIN_POW_DIFFICULTY on outsiders' events.
+func rejectInsufficientWork(ctx context.Context, event *nostr.Event) (bool, string) {
+	if !needsProofOfWork(event) {
+		return false, ""
+	}
+	if nip13.CommittedDifficulty(event) < config.MinPowDifficulty {
+		return true, fmt.Sprintf("pow: difficulty %d is required for non-members", config.MinPowDifficulty)
+	}
+	return false, ""
+}
+
+// setupProofOfWork installs the requirement and advertises it in NIP-11.
+func setupProofOfWork(relay *khatru.Relay) {
+	relay.RejectEvent = append(relay.RejectEvent, rejectInsufficientWork)
+	if relay.Info.Limitation == nil {
+		relay.Info.Limitation = &nip11.RelayLimitationDocument{}
+	}
+	relay.Info.Limitation.MinPowDifficulty = config.MinPowDifficulty
+	relay.Info.AddSupportedNIP(13)
+	slog.Info("Proof of work: ENABLED for non-members", "min_difficulty", config.MinPowDifficulty)
+}
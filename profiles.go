@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/fiatjaf/khatru/policies"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// PolicyProfile is a named set of policies bound to one listener. All
+// listeners share the same storage; only the policies differ, e.g. an
+// internal port with unrestricted reads for team tooling next to a public
+// port with READS_RESTRICTED and rate limits.
+type PolicyProfile struct {
+	Name            string
+	Addr            string
+	ReadsRestricted bool
+	EventRateLimit  int // events per minute per IP, 0 = unlimited
+	FilterRateLimit int // REQs per minute per IP, 0 = unlimited
+
+	eventLimiter  func(ctx context.Context, evt *nostr.Event) (bool, string)
+	filterLimiter func(ctx context.Context, filter nostr.Filter) (bool, string)
+}
+
+type profileKey struct{}
+
+// parseProfiles reads LISTENERS ("name=addr,name=addr") and each profile's
+// PROFILE_<NAME>_* settings. Without LISTENERS a single "default" profile on
+// :3334 uses the global READS_RESTRICTED setting.
+func parseProfiles(listeners []string, readsRestricted bool) []*PolicyProfile {
+	if len(listeners) == 0 {
+		listeners = []string{"default=:3334"}
+	}
+
+	var profiles []*PolicyProfile
+	for _, entry := range listeners {
+		name, addr, ok := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.TrimSpace(addr) == "" {
+			fatal("Configuration error: invalid LISTENERS entry, expected name=addr", "entry", entry)
+		}
+		prefix := "PROFILE_" + strings.ToUpper(name) + "_"
+		p := &PolicyProfile{
+			Name:            name,
+			Addr:            strings.TrimSpace(addr),
+			ReadsRestricted: readsRestricted,
+			EventRateLimit:  getEnvIntWithDefault(prefix+"EVENT_RATE_LIMIT", 0),
+			FilterRateLimit: getEnvIntWithDefault(prefix+"FILTER_RATE_LIMIT", 0),
+		}
+		if v := getEnvNullable(prefix + "READS_RESTRICTED"); v != nil {
+			p.ReadsRestricted = *v == "true"
+		}
+		if p.EventRateLimit > 0 {
+			p.eventLimiter = policies.EventIPRateLimiter(p.EventRateLimit, time.Minute, p.EventRateLimit)
+		}
+		if p.FilterRateLimit > 0 {
+			p.filterLimiter = policies.FilterIPRateLimiter(p.FilterRateLimit, time.Minute, p.FilterRateLimit)
+		}
+		profiles = append(profiles, p)
+	}
+	return profiles
+}
+
+func (p *PolicyProfile) String() string {
+	return fmt.Sprintf("%s (%s, reads restricted: %t, events/min: %d, REQs/min: %d)",
+		p.Name, p.Addr, p.ReadsRestricted, p.EventRateLimit, p.FilterRateLimit)
+}
+
+// withProfile tags every request arriving on a listener with its profile.
+func withProfile(p *PolicyProfile, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), profileKey{}, p)))
+	})
+}
+
+// activeProfile returns the profile of the listener the request in ctx came
+// through. Websocket hooks get a khatru context, so the profile is looked up
+// on the connection's original HTTP request.
+func activeProfile(ctx context.Context) *PolicyProfile {
+	if p, ok := ctx.Value(profileKey{}).(*PolicyProfile); ok {
+		return p
+	}
+	if conn := khatru.GetConnection(ctx); conn != nil && conn.Request != nil {
+		if p, ok := conn.Request.Context().Value(profileKey{}).(*PolicyProfile); ok {
+			return p
+		}
+	}
+	return config.Profiles[0]
+}
+
+// setupProfileRateLimits enforces each profile's rate limits.
+func setupProfileRateLimits(relay *khatru.Relay) {
+	relay.RejectEvent = append(relay.RejectEvent, func(ctx context.Context, event *nostr.Event) (bool, string) {
+		if p := activeProfile(ctx); p.eventLimiter != nil {
+			return p.eventLimiter(ctx, event)
+		}
+		return false, ""
+	})
+	limitFilters := func(ctx context.Context, filter nostr.Filter) (bool, string) {
+		if p := activeProfile(ctx); p.filterLimiter != nil {
+			return p.filterLimiter(ctx, filter)
+		}
+		return false, ""
+	}
+	relay.RejectFilter = append(relay.RejectFilter, limitFilters)
+	relay.RejectCountFilter = append(relay.RejectCountFilter, limitFilters)
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+	"github.com/nbd-wtf/go-nostr/nip49"
+)
+
+// Member provisioning. POST /admin/provision allocates the next unused
+// derivation index to a named member and returns a one-time claim URL that
+// expires after PROVISION_LINK_TTL_HOURS. The member opens it and gets the
+// nsec of their index, or an ncryptsec when they pick a password, exactly
+// once; the index is then assigned for good. Only a hash of the claim token
+// is persisted. Opening the link only shows the claim page: the key is handed
+// out by the page's POST, so link previews in chat apps can't use it up.
+//
+// An index is unused when it has no events, no pending link and no entry in
+// the assignment registry. A link that expires unclaimed gives its index back, since its key
+// never left the relay.
+
+const provisionsStateKey = "provisions"
+
+// Provision is one derivation index handed out through a claim link.
+type Provision struct {
+	Index     uint32 `json:"index"`
+	Pubkey    string `json:"pubkey"`
+	Name      string `json:"name"`
+	NIP05     string `json:"nip05,omitempty"`
+	CreatedBy string `json:"created_by"`
+	CreatedAt int64  `json:"created_at"`
+	ExpiresAt int64  `json:"expires_at"`
+	ClaimedAt int64  `json:"claimed_at,omitempty"`
+	TokenHash string `json:"-"` // never served, only persisted
+	// pubkey the key was gift wrapped to instead of a claim link
+	DeliveredTo string `json:"delivered_to,omitempty"`
+}
+
+// storedProvision is how a provision is persisted, with its token hash.
+type storedProvision struct {
+	*Provision
+	TokenHash string `json:"token_hash,omitempty"`
+}
+
+func (p *Provision) pending() bool {
+	return p.ClaimedAt == 0 && time.Now().Unix() < p.ExpiresAt
+}
+
+var (
+	provisionsMu sync.Mutex
+	provisions   = map[uint32]*Provision{}
+)
+
+func hashClaimToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func loadProvisions(ctx context.Context) {
+	var list []storedProvision
+	if _, err := loadState(ctx, provisionsStateKey, &list); err != nil {
+		slog.Error("Provisioning: failed to load provisions", "err", err)
+		return
+	}
+	for _, stored := range list {
+		p := stored.Provision
+		p.TokenHash = stored.TokenHash
+		provisions[p.Index] = p
+	}
+}
+
+// persistProvisions saves the provisions; provisionsMu must be held.
+func persistProvisions(ctx context.Context) error {
+	list := make([]storedProvision, 0, len(provisions))
+	for _, p := range provisions {
+		list = append(list, storedProvision{Provision: p, TokenHash: p.TokenHash})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Index < list[j].Index })
+	return saveState(ctx, provisionsStateKey, list)
+}
+
+// nextUnusedIndex returns the lowest index that is neither provisioned nor
+// publishing; provisionsMu must be held.
+func nextUnusedIndex(ctx context.Context) (uint32, string, error) {
+	pubkeys, err := registry.Pubkeys()
+	if err != nil {
+		return 0, "", err
+	}
+	for i, pubkey := range pubkeys {
+		if p, ok := provisions[uint32(i)]; ok && (p.ClaimedAt != 0 || p.pending()) {
+			continue
+		}
+		if isAssignedIndex(uint32(i)) {
+			continue
+		}
+		roster, err := keyRoster(ctx, []string{pubkey})
+		if err != nil {
+			return 0, "", err
+		}
+		if roster[0].Events > 0 {
+			continue
+		}
+		return uint32(i), pubkey, nil
+	}
+	return 0, "", fmt.Errorf("all %d derivation indices are in use, raise the max derivation index", len(pubkeys))
+}
+
+// provisionMember allocates an index to name and returns it with the token of
+// its claim link.
+func provisionMember(ctx context.Context, name, nip05, by string) (*Provision, string, error) {
+	provisionsMu.Lock()
+	defer provisionsMu.Unlock()
+
+	index, pubkey, err := nextUnusedIndex(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+	token := hex.EncodeToString(secret)
+	now := time.Now()
+	p := &Provision{
+		Index:     index,
+		Pubkey:    pubkey,
+		Name:      name,
+		NIP05:     nip05,
+		CreatedBy: by,
+		CreatedAt: now.Unix(),
+		ExpiresAt: now.Add(time.Duration(config.ProvisionLinkTTLHours) * time.Hour).Unix(),
+		TokenHash: hashClaimToken(token),
+	}
+	provisions[index] = p
+	if err := persistProvisions(ctx); err != nil {
+		delete(provisions, index)
+		return nil, "", err
+	}
+	return p, token, nil
+}
+
+// claimProvision hands out the key of the provision of token, see claimedKey,
+// and marks it claimed. It fails for unknown, expired and already claimed
+// links.
+func claimProvision(ctx context.Context, token, password string) (*Provision, string, error) {
+	provisionsMu.Lock()
+	defer provisionsMu.Unlock()
+
+	hash := hashClaimToken(token)
+	for _, p := range provisions {
+		if p.TokenHash != hash {
+			continue
+		}
+		if !p.pending() {
+			break
+		}
+		key, err := claimedKey(p.Index, password)
+		if err != nil {
+			return nil, "", err
+		}
+		p.ClaimedAt = time.Now().Unix()
+		if err := persistProvisions(ctx); err != nil {
+			p.ClaimedAt = 0
+			return nil, "", err
+		}
+		if _, err := assignIndex(ctx, p.Index, p.Name, p.NIP05, p.CreatedBy); err != nil {
+			slog.Error("Provisioning: failed to record the assignment", "index", p.Index, "err", err)
+		}
+		return p, key, nil
+	}
+	return nil, "", errClaimUnavailable
+}
+
+// deliverProvision gift wraps the key of a new provision to recipient, see
+// deliverKey, and marks it claimed; the index is released again when no relay
+// takes the wrap.
+func deliverProvision(ctx context.Context, p *Provision, recipient string) ([]string, error) {
+	relays, err := deliverKey(ctx, p.Index, recipient)
+
+	provisionsMu.Lock()
+	defer provisionsMu.Unlock()
+	if err != nil {
+		delete(provisions, p.Index)
+	} else {
+		p.ClaimedAt = time.Now().Unix()
+		p.TokenHash = ""
+		p.DeliveredTo = recipient
+	}
+	if err := persistProvisions(ctx); err != nil {
+		return nil, err
+	}
+	if err == nil {
+		if _, err := assignIndex(ctx, p.Index, p.Name, p.NIP05, p.CreatedBy); err != nil {
+			slog.Error("Provisioning: failed to record the assignment", "index", p.Index, "err", err)
+		}
+	}
+	return relays, err
+}
+
+var errClaimUnavailable = errors.New("this link has already been used or has expired")
+
+// claimedKey returns the key of index as an nsec, or as an ncryptsec when the
+// member chose a password.
+func claimedKey(index uint32, password string) (string, error) {
+	kp, err := deriver.DeriveKeyBIP32(index)
+	if err != nil {
+		return "", err
+	}
+	if password == "" {
+		return kp.PrivateKeyNIP, nil
+	}
+	return nip49.Encrypt(kp.PrivateKey, password, 16, nip49.ClientDoesNotTrackThisData)
+}
+
+// setupProvisioningAPI serves
+//
+//	GET  /admin/provision   provisions, claimed or not
+//	POST /admin/provision   {"name": "...", "nip05": "..."}, returns the claim URL, or with
+//	                        "deliver_to" gift wraps the key instead
+//	GET  /claim/{token}     claim page
+//	POST /claim/{token}     {"password": "..."}, returns the key once
+func setupProvisioningAPI(relay *khatru.Relay) {
+	loadProvisions(context.Background())
+
+	relay.Router().HandleFunc("/admin/provision", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			provisionsMu.Lock()
+			list := make([]Provision, 0, len(provisions))
+			for _, p := range provisions {
+				list = append(list, *p)
+			}
+			provisionsMu.Unlock()
+			sort.Slice(list, func(i, j int) bool { return list[i].Index < list[j].Index })
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(list)
+
+		case "POST":
+			var req struct {
+				Name      string `json:"name"`
+				NIP05     string `json:"nip05"`
+				DeliverTo string `json:"deliver_to"` // npub or hex pubkey to gift wrap the key to
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid JSON", http.StatusBadRequest)
+				return
+			}
+			name := strings.TrimSpace(req.Name)
+			if name == "" {
+				http.Error(w, "Missing name", http.StatusBadRequest)
+				return
+			}
+			var recipient string
+			if req.DeliverTo != "" {
+				recipient = normalizePubkey(strings.TrimSpace(req.DeliverTo))
+				if !nostr.IsValidPublicKey(recipient) {
+					http.Error(w, "Invalid deliver_to pubkey", http.StatusBadRequest)
+					return
+				}
+				if len(config.KeyDeliveryRelays) == 0 {
+					http.Error(w, "Key delivery is not configured, set KEY_DELIVERY_RELAYS", http.StatusBadRequest)
+					return
+				}
+			}
+			auth, _ := readHTTPAuth(r)
+			p, token, err := provisionMember(r.Context(), name, strings.TrimSpace(req.NIP05), auth.PubKey)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			npub, _ := nip19.EncodePublicKey(p.Pubkey)
+			resp := map[string]any{
+				"index":  p.Index,
+				"pubkey": p.Pubkey,
+				"npub":   npub,
+				"name":   p.Name,
+			}
+
+			if recipient != "" {
+				relays, err := deliverProvision(r.Context(), p, recipient)
+				if err != nil {
+					logger(r.Context()).Warn("Provisioning: key delivery failed", "index", p.Index, "to", recipient, "err", err)
+					http.Error(w, "Key delivery failed: "+err.Error(), http.StatusBadGateway)
+					return
+				}
+				logger(r.Context()).Info("Provisioning: key delivered", "index", p.Index, "name", name, "to", recipient, "relays", relays, "by", auth.PubKey)
+				resp["delivered_to"], resp["relays"] = recipient, relays
+			} else {
+				logger(r.Context()).Info("Provisioning: index allocated", "index", p.Index, "name", name, "by", auth.PubKey)
+				resp["expires_at"], resp["claim_url"] = p.ExpiresAt, relayHTTPURL()+"/claim/"+token
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(resp)
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}))
+
+	relay.Router().HandleFunc("/claim/", func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.URL.Path, "/claim/")
+		w.Header().Set("Cache-Control", "no-store")
+		switch r.Method {
+		case "GET":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			fmt.Fprintf(w, claimPage, html.EscapeString(config.RelayName))
+
+		case "POST":
+			var req struct {
+				Password string `json:"password"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid JSON", http.StatusBadRequest)
+				return
+			}
+			p, key, err := claimProvision(r.Context(), token, req.Password)
+			if err == errClaimUnavailable {
+				http.Error(w, err.Error(), http.StatusGone)
+				return
+			}
+			if err != nil {
+				logger(r.Context()).Error("Provisioning: claim failed", "err", err)
+				http.Error(w, "Failed to claim the key", http.StatusInternalServerError)
+				return
+			}
+			npub, _ := nip19.EncodePublicKey(p.Pubkey)
+			logger(r.Context()).Info("Provisioning: key claimed", "index", p.Index, "name", p.Name, "encrypted", req.Password != "")
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]any{"index": p.Index, "npub": npub, "key": key})
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	slog.Info("Member provisioning: ENABLED", "link_ttl_hours", config.ProvisionLinkTTLHours)
+	if len(config.KeyDeliveryRelays) > 0 {
+		sender, err := deriver.DerivePublicKey(uint32(config.KeyDeliverySenderIndex))
+		if err != nil {
+			slog.Error("Key delivery: failed to derive the sender key", "err", err)
+			return
+		}
+		slog.Info("Key delivery: ENABLED", "relays", config.KeyDeliveryRelays, "sender_pubkey", sender)
+	}
+}
+
+const claimPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <meta name="robots" content="noindex">
+    <title>%[1]s - Claim your key</title>
+    <style>
+        body { font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, sans-serif; background: #0f172a; color: #e5e7eb; max-width: 640px; margin: 0 auto; padding: 2rem; }
+        input { width: 100%%; padding: 0.5rem; margin: 0.5rem 0; box-sizing: border-box; }
+        button { background: #7c3aed; color: white; border: 0; border-radius: 4px; padding: 0.5rem 1rem; cursor: pointer; }
+        #key { word-break: break-all; font-family: monospace; font-size: 0.9rem; }
+    </style>
+</head>
+<body>
+    <h1>%[1]s</h1>
+    <p>This link shows your Nostr key once. Save it somewhere safe before leaving the page: it can't be shown again.</p>
+    <p>Optionally pick a password to receive it encrypted (ncryptsec) instead of as a plain nsec.</p>
+    <input id="password" type="password" placeholder="password (optional)">
+    <button id="claim" onclick="claim()">Show my key</button>
+    <p id="status"></p>
+    <p id="npub"></p>
+    <p id="key"></p>
+<script>
+async function claim() {
+    const status = document.getElementById("status");
+    document.getElementById("claim").disabled = true;
+    const res = await fetch(location.pathname, {
+        method: "POST",
+        headers: { "Content-Type": "application/json" },
+        body: JSON.stringify({ password: document.getElementById("password").value })
+    });
+    if (!res.ok) { status.textContent = await res.text(); return; }
+    const claimed = await res.json();
+    status.textContent = "Your key:";
+    document.getElementById("npub").textContent = claimed.npub;
+    document.getElementById("key").textContent = claimed.key;
+}
+</script>
+</body>
+</html>
+`
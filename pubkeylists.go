@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Pubkey allow and deny lists. WHITELISTED_PUBKEYS may write and upload like
+// team members; BANNED_PUBKEYS may do neither, whatever else would allow them.
+// Bans are persisted and managed at /admin/bans (moderation adds to them too);
+// BANNED_PUBKEYS entries are merged in at startup.
+
+// Ban is one entry of the ban list.
+type Ban struct {
+	Pubkey   string `json:"pubkey"`
+	Reason   string `json:"reason,omitempty"`
+	BannedBy string `json:"banned_by,omitempty"` // empty for BANNED_PUBKEYS
+	BannedAt int64  `json:"banned_at"`
+}
+
+var (
+	bansMu sync.RWMutex
+	bans   = map[string]Ban{}
+)
+
+// isWhitelisted reports whether pubkey is in WHITELISTED_PUBKEYS.
+func isWhitelisted(pubkey string) bool {
+	return slices.Contains(config.WhitelistedPubkeys, pubkey)
+}
+
+func isBanned(pubkey string) bool {
+	bansMu.RLock()
+	defer bansMu.RUnlock()
+	_, ok := bans[pubkey]
+	return ok
+}
+
+func persistBans(ctx context.Context) {
+	bansMu.RLock()
+	defer bansMu.RUnlock()
+	if err := saveState(ctx, "bans", bans); err != nil {
+		slog.Error("Bans: failed to persist ban list", "err", err)
+	}
+}
+
+// banPubkeys adds pubkeys to the ban list. Admins are never banned.
+func banPubkeys(ctx context.Context, pubkeys []string, reason, by string) {
+	now := time.Now().Unix()
+	bansMu.Lock()
+	for _, pubkey := range pubkeys {
+		if isAdmin(pubkey) {
+			continue
+		}
+		bans[pubkey] = Ban{Pubkey: pubkey, Reason: reason, BannedBy: by, BannedAt: now}
+	}
+	bansMu.Unlock()
+	persistBans(ctx)
+}
+
+// normalizePubkeys converts a configured list of hex or npub keys to hex,
+// stopping at the first invalid one.
+func normalizePubkeys(setting string, values []string) ([]string, error) {
+	pubkeys := make([]string, 0, len(values))
+	for _, value := range values {
+		pubkey := normalizePubkey(value)
+		if !nostr.IsValidPublicKey(pubkey) {
+			return nil, fmt.Errorf("invalid pubkey %q in %s", value, setting)
+		}
+		pubkeys = append(pubkeys, pubkey)
+	}
+	return pubkeys, nil
+}
+
+// setupPubkeyLists loads the ban list, merges BANNED_PUBKEYS into it and
+// serves the admin API:
+//
+//	GET    /admin/bans            ban list
+//	POST   /admin/bans            {"pubkey": "...", "reason": "..."}
+//	DELETE /admin/bans/{pubkey}
+func setupPubkeyLists(relay *khatru.Relay) {
+	var stored map[string]Ban
+	if ok, err := loadState(context.Background(), "bans", &stored); err != nil {
+		slog.Error("Bans: failed to load ban list", "err", err)
+	} else if ok && stored != nil {
+		bansMu.Lock()
+		bans = stored
+		bansMu.Unlock()
+	}
+
+	var added []string
+	for _, pubkey := range config.BannedPubkeys {
+		if !isBanned(pubkey) {
+			added = append(added, pubkey)
+		}
+	}
+	if len(added) > 0 {
+		banPubkeys(context.Background(), added, "BANNED_PUBKEYS", "")
+	}
+
+	relay.Router().HandleFunc("/admin/bans", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			bansMu.RLock()
+			list := make([]Ban, 0, len(bans))
+			for _, b := range bans {
+				list = append(list, b)
+			}
+			bansMu.RUnlock()
+			sort.Slice(list, func(i, j int) bool { return list[i].BannedAt > list[j].BannedAt })
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(list)
+
+		case "POST":
+			var req struct {
+				Pubkey string `json:"pubkey"`
+				Reason string `json:"reason"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid JSON", http.StatusBadRequest)
+				return
+			}
+			pubkey := normalizePubkey(strings.TrimSpace(req.Pubkey))
+			if !nostr.IsValidPublicKey(pubkey) {
+				http.Error(w, "Invalid pubkey", http.StatusBadRequest)
+				return
+			}
+			if isAdmin(pubkey) {
+				http.Error(w, "Admins cannot be banned", http.StatusBadRequest)
+				return
+			}
+			auth, _ := readHTTPAuth(r)
+			banPubkeys(r.Context(), []string{pubkey}, strings.TrimSpace(req.Reason), auth.PubKey)
+			logger(r.Context()).Info("Bans: pubkey banned", "pubkey", pubkey, "by", auth.PubKey)
+			w.WriteHeader(http.StatusCreated)
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}))
+
+	relay.Router().HandleFunc("/admin/bans/", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "DELETE" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		pubkey := normalizePubkey(strings.TrimPrefix(r.URL.Path, "/admin/bans/"))
+		if !isBanned(pubkey) {
+			http.Error(w, "Pubkey is not banned", http.StatusNotFound)
+			return
+		}
+		bansMu.Lock()
+		delete(bans, pubkey)
+		bansMu.Unlock()
+		persistBans(r.Context())
+		logger(r.Context()).Info("Bans: pubkey unbanned", "pubkey", pubkey)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+}
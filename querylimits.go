@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip11"
+)
+
+// Query limits for client REQs and COUNTs. Filters without a limit get
+// QUERY_DEFAULT_LIMIT and larger limits are cut to QUERY_MAX_LIMIT (the
+// storage engine still applies its own cap on top). Each query is given
+// QUERY_TIMEOUT_SECONDS to finish, and queries slower than SLOW_QUERY_MS are
+// logged with their filter, to see which indexes the backend is missing.
+// Negentropy syncs need every matching event and are left alone.
+
+// capFilterLimit applies the default and maximum limits to filter.
+func capFilterLimit(ctx context.Context, filter *nostr.Filter) {
+	if filter.LimitZero || eventstore.IsNegentropySession(ctx) {
+		return
+	}
+	if filter.Limit <= 0 && config.QueryDefaultLimit > 0 {
+		// fetching by id needs no more than one event per id
+		filter.Limit = max(config.QueryDefaultLimit, len(filter.IDs))
+	}
+	if config.QueryMaxLimit > 0 && filter.Limit > config.QueryMaxLimit {
+		filter.Limit = config.QueryMaxLimit
+	}
+}
+
+// logSlowQuery reports a query that took longer than SLOW_QUERY_MS.
+func logSlowQuery(ctx context.Context, op string, filter nostr.Filter, took time.Duration, results int64, err error) {
+	if config.SlowQueryMS <= 0 || took < time.Duration(config.SlowQueryMS)*time.Millisecond {
+		return
+	}
+	attrs := []any{"op", op, "filter", filter.String(), "took", took, "results", results}
+	if err != nil {
+		attrs = append(attrs, "err", err)
+	}
+	logger(ctx).Warn("Slow query", attrs...)
+}
+
+// timeQuery bounds query by QUERY_TIMEOUT_SECONDS and logs it when slow. The
+// deadline is passed to the backend and covers streaming the results too, so
+// a client can't hold a query open by reading slowly; whatever the backend
+// still sends after it is drained.
+func timeQuery(query func(context.Context, nostr.Filter) (chan *nostr.Event, error)) func(context.Context, nostr.Filter) (chan *nostr.Event, error) {
+	return func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		if eventstore.IsNegentropySession(ctx) {
+			return query(ctx, filter)
+		}
+		cancel := context.CancelFunc(func() {})
+		if config.QueryTimeoutSeconds > 0 {
+			ctx, cancel = context.WithTimeout(ctx, time.Duration(config.QueryTimeoutSeconds)*time.Second)
+		}
+		start := time.Now()
+		ch, err := query(ctx, filter)
+		if err != nil {
+			cancel()
+			logSlowQuery(ctx, "query", filter, time.Since(start), 0, err)
+			return nil, err
+		}
+
+		out := make(chan *nostr.Event)
+		go func() {
+			defer close(out)
+			defer cancel()
+			n := forward(ctx, ch, out, nil)
+			logSlowQuery(ctx, "query", filter, time.Since(start), int64(n), ctx.Err())
+		}()
+		return out, nil
+	}
+}
+
+// timeCount is timeQuery for COUNT requests.
+func timeCount(count func(context.Context, nostr.Filter) (int64, error)) func(context.Context, nostr.Filter) (int64, error) {
+	return func(ctx context.Context, filter nostr.Filter) (int64, error) {
+		if config.QueryTimeoutSeconds > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, time.Duration(config.QueryTimeoutSeconds)*time.Second)
+			defer cancel()
+		}
+		start := time.Now()
+		total, err := count(ctx, filter)
+		logSlowQuery(ctx, "count", filter, time.Since(start), total, err)
+		return total, err
+	}
+}
+
+// setupQueryLimits installs the default and maximum limits and advertises
+// the maximum in NIP-11.
+func setupQueryLimits(relay *khatru.Relay) {
+	relay.OverwriteFilter = append(relay.OverwriteFilter, capFilterLimit)
+
+	if config.QueryMaxLimit > 0 {
+		if relay.Info.Limitation == nil {
+			relay.Info.Limitation = &nip11.RelayLimitationDocument{}
+		}
+		relay.Info.Limitation.MaxLimit = config.QueryMaxLimit
+	}
+
+	slog.Info("Query limits", "default_limit", config.QueryDefaultLimit, "max_limit", config.QueryMaxLimit,
+		"timeout_seconds", config.QueryTimeoutSeconds, "slow_query_ms", config.SlowQueryMS)
+}
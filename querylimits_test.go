@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestCapFilterLimit(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config.QueryDefaultLimit = 500
+	config.QueryMaxLimit = 1000
+
+	ids := func(n int) []string {
+		list := make([]string, n)
+		for i := range list {
+			list[i] = fmt.Sprintf("%064x", i)
+		}
+		return list
+	}
+
+	cases := []struct {
+		name       string
+		filter     nostr.Filter
+		negentropy bool
+		want       int
+	}{
+		{name: "no limit", filter: nostr.Filter{Kinds: []int{1}}, want: 500},
+		{name: "small limit", filter: nostr.Filter{Kinds: []int{1}, Limit: 20}, want: 20},
+		{name: "limit above max", filter: nostr.Filter{Kinds: []int{1}, Limit: 5000}, want: 1000},
+		{name: "ids only", filter: nostr.Filter{IDs: ids(3)}, want: 500},
+		{name: "ids beyond the default", filter: nostr.Filter{IDs: ids(700)}, want: 700},
+		{name: "ids beyond the max", filter: nostr.Filter{IDs: ids(1500)}, want: 1000},
+		{name: "ids with a limit", filter: nostr.Filter{IDs: ids(700), Limit: 10}, want: 10},
+		{name: "LimitZero", filter: nostr.Filter{Kinds: []int{1}, LimitZero: true}, want: 0},
+		{name: "negentropy without limit", filter: nostr.Filter{Kinds: []int{1}}, negentropy: true, want: 0},
+		{name: "negentropy above max", filter: nostr.Filter{Kinds: []int{1}, Limit: 5000}, negentropy: true, want: 5000},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tc.negentropy {
+				ctx = eventstore.SetNegentropy(ctx)
+			}
+			filter := tc.filter
+			capFilterLimit(ctx, &filter)
+			if filter.Limit != tc.want {
+				t.Errorf("limit = %d, want %d", filter.Limit, tc.want)
+			}
+			if filter.LimitZero != tc.filter.LimitZero {
+				t.Errorf("LimitZero changed to %v", filter.LimitZero)
+			}
+		})
+	}
+}
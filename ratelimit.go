@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Per-endpoint HTTP rate limits. Uploads (Blossom and NIP-96), /mirror,
+// /list and blob downloads each have their own requests-per-minute budget,
+// so a client hammering one endpoint can't starve the others. Requests
+// authenticated by a member or admin count against their pubkey, so a team
+// behind one NAT doesn't share a budget; everything else counts against the
+// client IP. Over-limit requests get a 429 with Retry-After.
+
+const rateWindowTTL = time.Minute
+
+var blobPathRe = regexp.MustCompile(`^/[0-9a-fA-F]{64}(\.[0-9A-Za-z]+)?$`)
+
+// requestWindow counts the requests of one client in the current minute.
+type requestWindow struct {
+	start time.Time
+	count int
+}
+
+// endpointLimiter is the fixed-window rate limit of one class of endpoints.
+type endpointLimiter struct {
+	name      string
+	perMinute int
+
+	mu      sync.Mutex
+	windows map[string]*requestWindow
+}
+
+func newEndpointLimiter(name string, perMinute int) *endpointLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	return &endpointLimiter{name: name, perMinute: perMinute, windows: map[string]*requestWindow{}}
+}
+
+// allow counts a request from key, returning how long to wait when the
+// budget is spent.
+func (l *endpointLimiter) allow(key string) (bool, time.Duration) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	win := l.windows[key]
+	if win == nil || now.Sub(win.start) >= rateWindowTTL {
+		win = &requestWindow{start: now}
+		l.windows[key] = win
+	}
+	if win.count >= l.perMinute {
+		return false, win.start.Add(rateWindowTTL).Sub(now)
+	}
+	win.count++
+	return true, 0
+}
+
+// prune drops expired windows so the map does not grow with every client.
+func (l *endpointLimiter) prune() {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, win := range l.windows {
+		if now.Sub(win.start) >= rateWindowTTL {
+			delete(l.windows, key)
+		}
+	}
+}
+
+// rateLimitKey identifies the client a request for a blossom action counts
+// against.
+func rateLimitKey(r *http.Request, action string) string {
+	auth, _ := readBlossomAuth(r, action)
+	if auth == nil {
+		auth, _ = readHTTPAuth(r)
+	}
+	if auth != nil && (isMember(auth.PubKey) || isAdmin(auth.PubKey)) {
+		return "pubkey:" + auth.PubKey
+	}
+	return "ip:" + clientIP(r)
+}
+
+// limitEndpoints applies UPLOAD_RATE_LIMIT, MIRROR_RATE_LIMIT,
+// LIST_RATE_LIMIT and BLOB_GET_RATE_LIMIT in front of the blossom handlers.
+func limitEndpoints(next http.Handler) http.Handler {
+	upload := newEndpointLimiter("upload", config.UploadRateLimit)
+	mirror := newEndpointLimiter("mirror", config.MirrorRateLimit)
+	list := newEndpointLimiter("list", config.ListRateLimit)
+	blobGet := newEndpointLimiter("blob_get", config.BlobGetRateLimit)
+	nip96Path := "/" + strings.Trim(config.NIP96Path, "/")
+
+	limiters := []*endpointLimiter{}
+	for _, l := range []*endpointLimiter{upload, mirror, list, blobGet} {
+		if l != nil {
+			limiters = append(limiters, l)
+		}
+	}
+	if len(limiters) == 0 {
+		return next
+	}
+	go func() {
+		for range time.Tick(rateWindowTTL) {
+			for _, l := range limiters {
+				l.prune()
+			}
+		}
+	}()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var limiter *endpointLimiter
+		var action string
+		switch {
+		case r.Method == "PUT" && r.URL.Path == "/upload",
+			r.Method == "POST" && nip96Path != "/" && r.URL.Path == nip96Path:
+			limiter, action = upload, "upload"
+		case r.Method == "PUT" && r.URL.Path == "/mirror":
+			limiter, action = mirror, "upload"
+		case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/list/"):
+			limiter, action = list, "list"
+		case (r.Method == "GET" || r.Method == "HEAD") && blobPathRe.MatchString(r.URL.Path):
+			limiter, action = blobGet, "get"
+		}
+		if limiter == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if ok, wait := limiter.allow(rateLimitKey(r, action)); !ok {
+			logger(r.Context()).Debug("Rate limit: request refused", "endpoint", limiter.name, "per_minute", limiter.perMinute)
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			blossomError(w, "rate limited, try again later", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
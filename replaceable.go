@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Replaceable (0, 3, 10000-19999) and addressable (30000-39999) events go
+// through the backend's ReplaceEvent, which drops the older version in the
+// same transaction. Before that was wired, older versions could be left
+// behind, so the store is swept once for leftover duplicates.
+
+const replaceableSweepStateKey = "replaceable_deduped"
+
+// replaceableAddress identifies the slot a replaceable or addressable event
+// occupies; empty for regular events.
+func replaceableAddress(evt *nostr.Event) string {
+	switch {
+	case nostr.IsReplaceableKind(evt.Kind):
+		return fmt.Sprintf("%d:%s", evt.Kind, evt.PubKey)
+	case nostr.IsAddressableKind(evt.Kind):
+		return fmt.Sprintf("%d:%s:%s", evt.Kind, evt.PubKey, evt.Tags.GetD())
+	}
+	return ""
+}
+
+// isOlderVersion reports whether previous is superseded by next, by
+// created_at and then by the lowest id, as the backends decide.
+func isOlderVersion(previous, next *nostr.Event) bool {
+	return previous.CreatedAt < next.CreatedAt || (previous.CreatedAt == next.CreatedAt && previous.ID > next.ID)
+}
+
+// dedupeReplaceable deletes every stored version of a replaceable or
+// addressable event but the latest.
+func dedupeReplaceable(ctx context.Context) (int, error) {
+	latest := map[string]*nostr.Event{}
+	var stale []*nostr.Event
+	err := forEachEvent(ctx, nostr.Filter{}, func(evt *nostr.Event) error {
+		addr := replaceableAddress(evt)
+		if addr == "" {
+			return nil
+		}
+		kept, ok := latest[addr]
+		switch {
+		case !ok:
+			latest[addr] = evt
+		case isOlderVersion(kept, evt):
+			stale = append(stale, kept)
+			latest[addr] = evt
+		default:
+			stale = append(stale, evt)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, evt := range stale {
+		if err := db.DeleteEvent(ctx, evt); err != nil {
+			eventLogger(ctx, evt).Error("Replaceable: failed to delete older version", "err", err)
+			continue
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// sweepReplaceableOnce runs dedupeReplaceable unless it already completed
+// on this store.
+func sweepReplaceableOnce() {
+	ctx := context.Background()
+	var done bool
+	if ok, err := loadState(ctx, replaceableSweepStateKey, &done); err != nil {
+		slog.Error("Replaceable: failed to load sweep state", "err", err)
+		return
+	} else if ok && done {
+		return
+	}
+
+	start := time.Now()
+	deleted, err := dedupeReplaceable(ctx)
+	if err != nil {
+		slog.Error("Replaceable: duplicate sweep failed", "err", err)
+		return
+	}
+	if err := saveState(ctx, replaceableSweepStateKey, true); err != nil {
+		slog.Error("Replaceable: failed to record sweep", "err", err)
+	}
+	slog.Info("Replaceable: removed older versions of replaceable events", "deleted", deleted, "took", time.Since(start).Round(time.Millisecond))
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip11"
+)
+
+// RetentionRule limits how long and how many events of some kinds are kept.
+// A rule without kinds ("*") covers every regular kind no other rule names.
+type RetentionRule struct {
+	Kinds        []int
+	MaxAge       time.Duration // 0 = forever
+	MaxPerPubkey int           // 0 = unlimited
+}
+
+// parseRetentionRules parses RETENTION_RULES: rules separated by ";", each
+// "kinds:max_age:max_per_pubkey", e.g. "1,7:30d:1000;4:7d:0;*:365d:0".
+// Ages take a d or h suffix; 0 disables a limit.
+func parseRetentionRules(value *string) ([]RetentionRule, error) {
+	if value == nil || strings.TrimSpace(*value) == "" {
+		return nil, nil
+	}
+	var rules []RetentionRule
+	for _, spec := range strings.Split(*value, ";") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		parts := strings.Split(spec, ":")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid retention rule %q, expected kinds:max_age:max_per_pubkey", spec)
+		}
+
+		var rule RetentionRule
+		if strings.TrimSpace(parts[0]) != "*" {
+			rule.Kinds = parseAllowedKinds(&parts[0])
+			if len(rule.Kinds) == 0 {
+				return nil, fmt.Errorf("retention rule %q has no kinds", spec)
+			}
+		}
+
+		age := strings.TrimSpace(parts[1])
+		if age != "0" && age != "" {
+			unit := time.Hour
+			if strings.HasSuffix(age, "d") {
+				unit = 24 * time.Hour
+			}
+			n, err := strconv.Atoi(strings.TrimRight(age, "dh"))
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid max age %q in retention rule %q", age, spec)
+			}
+			rule.MaxAge = time.Duration(n) * unit
+		}
+
+		count, err := strconv.Atoi(strings.TrimSpace(parts[2]))
+		if err != nil || count < 0 {
+			return nil, fmt.Errorf("invalid max per pubkey %q in retention rule %q", parts[2], spec)
+		}
+		rule.MaxPerPubkey = count
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// retentionExempt reports whether kind is never pruned: the relay's own
+// bookkeeping and the blossom upload index.
+func retentionExempt(kind int) bool {
+	return isInternalKind(kind) || kind == 24242
+}
+
+// ruleCovers reports whether rule applies to kind. Wildcard rules only cover
+// regular kinds not named by another rule, so profiles and other replaceable
+// events are never expired by accident.
+func ruleCovers(rule RetentionRule, kind int) bool {
+	if retentionExempt(kind) {
+		return false
+	}
+	if len(rule.Kinds) > 0 {
+		for _, k := range rule.Kinds {
+			if k == kind {
+				return true
+			}
+		}
+		return false
+	}
+	if !nostr.IsRegularKind(kind) {
+		return false
+	}
+	for _, other := range config.RetentionRules {
+		for _, k := range other.Kinds {
+			if k == kind {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// pruneRule deletes events that are too old or beyond the per-pubkey count.
+func pruneRule(ctx context.Context, rule RetentionRule) (int, error) {
+	var cutoff nostr.Timestamp
+	if rule.MaxAge > 0 {
+		cutoff = nostr.Timestamp(time.Now().Add(-rule.MaxAge).Unix())
+	}
+	perPubkey := make(map[string]int)
+
+	// collect first, deleting while paging through the same range would skip events
+	var expired []*nostr.Event
+	err := forEachEvent(ctx, nostr.Filter{Kinds: rule.Kinds}, func(evt *nostr.Event) error {
+		if !ruleCovers(rule, evt.Kind) {
+			return nil
+		}
+		perPubkey[evt.PubKey]++ // newest first
+		if (cutoff > 0 && evt.CreatedAt < cutoff) ||
+			(rule.MaxPerPubkey > 0 && perPubkey[evt.PubKey] > rule.MaxPerPubkey) {
+			expired = append(expired, evt)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, evt := range expired {
+		if err := db.DeleteEvent(ctx, evt); err != nil {
+			eventLogger(ctx, evt).Error("Retention: failed to delete", "err", err)
+			continue
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// databaseSize returns the on-disk size of the event store in bytes.
+func databaseSize(ctx context.Context) (int64, error) {
+	if pg, ok := unwrapDB().(*postgresBackend); ok {
+		var size int64
+		err := pg.DB.QueryRowContext(ctx, "SELECT pg_database_size(current_database())").Scan(&size)
+		return size, err
+	}
+	var size int64
+	err := filepath.WalkDir(*config.DBPath, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			if info, err := d.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size, err
+}
+
+// pruneToSizeCap deletes the oldest prunable events when the database is over
+// RETENTION_MAX_DB_SIZE_MB. Freed space is only reclaimed by the backend
+// later, so each run removes a share of events proportional to the overage
+// instead of deleting until the reported size drops.
+func pruneToSizeCap(ctx context.Context) (int, error) {
+	maxSize := int64(config.RetentionMaxDBSizeMB) * 1024 * 1024
+	size, err := databaseSize(ctx)
+	if err != nil || size <= maxSize {
+		return 0, err
+	}
+
+	total, err := db.CountEvents(ctx, nostr.Filter{})
+	if err != nil {
+		return 0, err
+	}
+	toDelete := int(float64(total) * float64(size-maxSize) / float64(size))
+	if toDelete < 1 {
+		toDelete = 1
+	}
+
+	// forEachEvent goes newest first, keep the tail
+	var prunable []*nostr.Event
+	err = forEachEvent(ctx, nostr.Filter{}, func(evt *nostr.Event) error {
+		if !retentionExempt(evt.Kind) {
+			prunable = append(prunable, evt)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if toDelete > len(prunable) {
+		toDelete = len(prunable)
+	}
+
+	deleted := 0
+	for _, evt := range prunable[len(prunable)-toDelete:] {
+		if err := db.DeleteEvent(ctx, evt); err == nil {
+			deleted++
+		}
+	}
+	slog.Info("Retention: database over size cap, deleted oldest events",
+		"size_mb", size/1024/1024, "cap_mb", config.RetentionMaxDBSizeMB, "deleted", deleted)
+	return deleted, nil
+}
+
+func runRetention(ctx context.Context) {
+	for _, rule := range config.RetentionRules {
+		deleted, err := pruneRule(ctx, rule)
+		if err != nil {
+			slog.Error("Retention: rule failed", "kinds", rule.Kinds, "err", err)
+			continue
+		}
+		if deleted > 0 {
+			slog.Info("Retention: pruned events", "kinds", rule.Kinds, "deleted", deleted)
+		}
+	}
+	if config.RetentionMaxDBSizeMB > 0 {
+		if _, err := pruneToSizeCap(ctx); err != nil {
+			slog.Error("Retention: size cap check failed", "err", err)
+		}
+	}
+}
+
+// setupRetention advertises the rules in NIP-11 and starts the pruning job.
+func setupRetention(relay *khatru.Relay) {
+	for _, rule := range config.RetentionRules {
+		doc := &nip11.RelayRetentionDocument{
+			Time:  int64(rule.MaxAge / time.Second),
+			Count: rule.MaxPerPubkey,
+		}
+		for _, k := range rule.Kinds {
+			doc.Kinds = append(doc.Kinds, []int{k, k})
+		}
+		relay.Info.Retention = append(relay.Info.Retention, doc)
+	}
+
+	go func() {
+		for {
+			runRetention(context.Background())
+			time.Sleep(time.Duration(config.RetentionIntervalMinutes) * time.Minute)
+		}
+	}()
+	slog.Info("Retention: ENABLED", "rules", len(config.RetentionRules),
+		"cap_mb", config.RetentionMaxDBSizeMB, "interval_minutes", config.RetentionIntervalMinutes)
+}
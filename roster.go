@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// The derived key roster: the public keys of derivation indices
+// 0..MAX_DERIVATION_INDEX with how much each has published, so operators can
+// see which slots are handed out and in use. Private keys are never part of
+// it. Served to admins at GET /admin/roster and printed by `keys roster`.
+
+// RosterEntry is one derivation index.
+type RosterEntry struct {
+	Index       uint32 `json:"index"`
+	Pubkey      string `json:"pubkey"`
+	Npub        string `json:"npub"`
+	Events      int64  `json:"events"`
+	LastEventAt int64  `json:"last_event_at,omitempty"` // created_at of the newest event
+}
+
+// keyRoster describes pubkeys, given in index order, from the event store.
+func keyRoster(ctx context.Context, pubkeys []string) ([]RosterEntry, error) {
+	roster := make([]RosterEntry, 0, len(pubkeys))
+	for i, pubkey := range pubkeys {
+		npub, _ := nip19.EncodePublicKey(pubkey)
+		entry := RosterEntry{Index: uint32(i), Pubkey: pubkey, Npub: npub}
+
+		filter := nostr.Filter{Authors: []string{pubkey}}
+		n, err := db.CountEvents(ctx, filter)
+		if err != nil {
+			return nil, err
+		}
+		entry.Events = n
+		if n > 0 {
+			filter.Limit = 1
+			ch, err := db.QueryEvents(ctx, filter)
+			if err != nil {
+				return nil, err
+			}
+			for evt := range ch {
+				entry.LastEventAt = max(entry.LastEventAt, int64(evt.CreatedAt))
+			}
+		}
+		roster = append(roster, entry)
+	}
+	return roster, nil
+}
+
+// setupRosterAPI serves GET /admin/roster; ?used=true lists only the indices
+// that have published events.
+func setupRosterAPI(relay *khatru.Relay) {
+	relay.Router().HandleFunc("/admin/roster", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		pubkeys, err := registry.Pubkeys()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		roster, err := keyRoster(r.Context(), pubkeys)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if r.URL.Query().Get("used") == "true" {
+			roster = usedRosterEntries(roster)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(roster)
+	}))
+}
+
+func usedRosterEntries(roster []RosterEntry) []RosterEntry {
+	used := roster[:0]
+	for _, entry := range roster {
+		if entry.Events > 0 {
+			used = append(used, entry)
+		}
+	}
+	return used
+}
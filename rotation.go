@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/bitkarrot/higher/keyderivation"
+)
+
+// Seed rotation. While the relay moves to a new RELAY_MNEMONIC, the seed being
+// phased out goes in RETIRED_RELAY_MNEMONIC: keys derived from it keep counting
+// as members for ROTATION_WINDOW_DAYS, so members can switch to their new keys
+// without being locked out in between. The window starts the first time the
+// relay runs with that retired seed and is persisted, so restarts don't extend
+// it. Retired keys are only ever recognized, never used to sign.
+
+const seedRotationStateKey = "seed_rotation"
+
+// seedRotation is the persisted start of the rotation window of one retired
+// seed, identified by the pubkey at index 0.
+type seedRotation struct {
+	Fingerprint string `json:"fingerprint"`
+	StartedAt   int64  `json:"started_at"`
+}
+
+var (
+	retiredRegistry *keyderivation.KeyRegistry
+	retiredUntil    time.Time
+)
+
+// setupSeedRotation derives the retired seed's keys and opens or resumes its
+// rotation window. Called after the active registry is built.
+func setupSeedRotation(ctx context.Context) error {
+	mnemonic := strings.TrimSpace(config.RetiredRelayMnemonic)
+	if mnemonic == "" {
+		return nil
+	}
+	d, err := keyderivation.NewNostrKeyDeriverWithPassphrase(mnemonic, config.RetiredMnemonicPassphrase)
+	if err != nil {
+		return fmt.Errorf("invalid RETIRED_RELAY_MNEMONIC: %w", err)
+	}
+	d.SetScheme(config.DerivationScheme)
+	r, err := keyderivation.NewKeyRegistry(d, uint32(config.MaxDerivationIndex))
+	if err != nil {
+		return fmt.Errorf("failed to derive retired keys: %w", err)
+	}
+	retired, err := r.Pubkeys()
+	if err != nil {
+		return err
+	}
+	fingerprint := retired[0]
+	if registry != nil && registry.Contains(fingerprint) {
+		return fmt.Errorf("RETIRED_RELAY_MNEMONIC derives the same keys as the active master")
+	}
+
+	var rotation seedRotation
+	if _, err := loadState(ctx, seedRotationStateKey, &rotation); err != nil {
+		return err
+	}
+	if rotation.Fingerprint != fingerprint {
+		rotation = seedRotation{Fingerprint: fingerprint, StartedAt: time.Now().Unix()}
+		if err := saveState(ctx, seedRotationStateKey, rotation); err != nil {
+			return err
+		}
+	}
+	retiredUntil = time.Unix(rotation.StartedAt, 0).AddDate(0, 0, config.RotationWindowDays)
+	if time.Now().After(retiredUntil) {
+		slog.Warn("Seed rotation: the window has ended, keys of the retired seed are no longer accepted; remove RETIRED_RELAY_MNEMONIC",
+			"ended", retiredUntil.Format(time.RFC3339))
+		return nil
+	}
+	retiredRegistry = r
+	slog.Info("Seed rotation: accepting keys of the retired seed", "until", retiredUntil.Format(time.RFC3339))
+	return nil
+}
+
+// isRetiredDerivedKey reports whether pubkey is derived from the retired seed
+// and its rotation window is still open.
+func isRetiredDerivedKey(pubkey string) bool {
+	if retiredRegistry == nil || time.Now().After(retiredUntil) {
+		return false
+	}
+	index, belongs, err := retiredRegistry.Lookup(pubkey)
+	if err != nil {
+		slog.Error("Error checking key against retired seed", "pubkey", pubkey, "err", err)
+	}
+	if belongs {
+		slog.Debug("Seed rotation: key of the retired seed accepted", "pubkey", pubkey, "index", index)
+	}
+	return belongs
+}
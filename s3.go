@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3Config configures the S3-compatible blob storage (AWS S3, MinIO, R2, ...).
+type S3Config struct {
+	Endpoint        string // e.g. https://s3.us-east-1.amazonaws.com or http://minio:9000
+	Region          string
+	Bucket          string
+	Prefix          string // optional key prefix inside the bucket
+	AccessKeyID     string
+	SecretAccessKey string
+}
+
+// loadS3Config reads <prefix>ENDPOINT, <prefix>BUCKET, ... ("S3_" for the
+// blob store, "COLD_S3_" for the cold tier).
+func loadS3Config(prefix string) S3Config {
+	return S3Config{
+		Endpoint:        strings.TrimSuffix(getEnvWithDefault(prefix+"ENDPOINT", ""), "/"),
+		Region:          getEnvWithDefault(prefix+"REGION", "us-east-1"),
+		Bucket:          getEnvWithDefault(prefix+"BUCKET", ""),
+		Prefix:          getEnvWithDefault(prefix+"PREFIX", ""),
+		AccessKeyID:     getEnvWithDefault(prefix+"ACCESS_KEY_ID", ""),
+		SecretAccessKey: getEnvWithDefault(prefix+"SECRET_ACCESS_KEY", ""),
+	}
+}
+
+// s3Client is a minimal S3 REST client signing requests with AWS Signature
+// Version 4. Buckets are addressed path-style, which every S3-compatible
+// server supports.
+type s3Client struct {
+	cfg    S3Config
+	client *http.Client
+}
+
+var emptyPayloadHash = hex.EncodeToString(sha256.New().Sum(nil))
+
+var errS3NotFound = errors.New("s3: object not found")
+
+func (c *s3Client) objectURL(key string) string {
+	return c.cfg.Endpoint + "/" + awsURIEncode(c.cfg.Bucket, true) + "/" + awsURIEncode(key, false)
+}
+
+// do signs and sends a request. payloadHash is the hex sha256 of body.
+func (c *s3Client) do(ctx context.Context, method, rawURL string, header http.Header, body []byte, payloadHash string) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	return c.doStream(ctx, method, rawURL, header, reader, int64(len(body)), payloadHash)
+}
+
+// doStream is do with the body read from r, of the given size.
+func (c *s3Client) doStream(ctx context.Context, method, rawURL string, header http.Header, r io.Reader, size int64, payloadHash string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, r)
+	if err != nil {
+		return nil, err
+	}
+	if r != nil {
+		req.ContentLength = size
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	c.sign(req, payloadHash, time.Now().UTC())
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, errS3NotFound
+	}
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3: %s %s returned %d: %s", method, req.URL.Path, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+// sign adds the SigV4 headers to req.
+func (c *s3Client) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + c.cfg.Region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.cfg.SecretAccessKey), date)
+	key = hmacSHA256(key, c.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.cfg.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// awsURIEncode encodes s as SigV4 expects: everything but unreserved
+// characters is percent-encoded, slashes only when encodeSlash is set.
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case (ch >= 'A' && ch <= 'Z') || (ch >= 'a' && ch <= 'z') || (ch >= '0' && ch <= '9'),
+			ch == '-', ch == '_', ch == '.', ch == '~':
+			b.WriteByte(ch)
+		case ch == '/' && !encodeSlash:
+			b.WriteByte(ch)
+		default:
+			fmt.Fprintf(&b, "%%%02X", ch)
+		}
+	}
+	return b.String()
+}
+
+func canonicalQuery(values url.Values) string {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		vs := append([]string(nil), values[k]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			parts = append(parts, awsURIEncode(k, true)+"="+awsURIEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// encodeQuery builds a query string with the same encoding used for signing.
+func encodeQuery(values url.Values) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return "?" + canonicalQuery(values)
+}
+
+// s3BlobStore keeps blobs as objects named by their hash.
+type s3BlobStore struct {
+	c *s3Client
+}
+
+func newS3BlobStore(cfg S3Config) (*s3BlobStore, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" || cfg.AccessKeyID == "" || cfg.SecretAccessKey == "" {
+		return nil, fmt.Errorf("BLOSSOM_STORAGE=s3 requires S3_ENDPOINT, S3_BUCKET, S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY")
+	}
+	if _, err := url.Parse(cfg.Endpoint); err != nil {
+		return nil, fmt.Errorf("invalid S3_ENDPOINT: %w", err)
+	}
+	return &s3BlobStore{c: &s3Client{cfg: cfg, client: &http.Client{}}}, nil
+}
+
+func (s *s3BlobStore) key(sha256 string) string {
+	return s.c.cfg.Prefix + sha256
+}
+
+func (s *s3BlobStore) Put(ctx context.Context, sha256 string, body []byte) error {
+	// the blob hash is the payload hash SigV4 wants
+	header := http.Header{}
+	header.Set("Content-Type", http.DetectContentType(body[:min(len(body), 512)]))
+	resp, err := s.c.do(ctx, "PUT", s.c.objectURL(s.key(sha256)), header, body, sha256)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// PutFile uploads the staged file and removes it.
+func (s *s3BlobStore) PutFile(ctx context.Context, sha256 string, path string) error {
+	file, err := fs.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fs.Remove(path)
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(file, head)
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	header := http.Header{}
+	header.Set("Content-Type", http.DetectContentType(head[:n]))
+	resp, err := s.c.doStream(ctx, "PUT", s.c.objectURL(s.key(sha256)), header, file, info.Size(), sha256)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3BlobStore) Get(ctx context.Context, sha256 string) (io.ReadSeeker, error) {
+	info, err := s.Stat(ctx, sha256)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Object{store: s, key: s.key(sha256), size: info.Size}, nil
+}
+
+func (s *s3BlobStore) Delete(ctx context.Context, sha256 string) error {
+	resp, err := s.c.do(ctx, "DELETE", s.c.objectURL(s.key(sha256)), nil, nil, emptyPayloadHash)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3BlobStore) Stat(ctx context.Context, sha256 string) (BlobInfo, error) {
+	resp, err := s.c.do(ctx, "HEAD", s.c.objectURL(s.key(sha256)), nil, nil, emptyPayloadHash)
+	if err != nil {
+		if err == errS3NotFound {
+			return BlobInfo{}, os.ErrNotExist
+		}
+		return BlobInfo{}, err
+	}
+	resp.Body.Close()
+	modified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return BlobInfo{SHA256: sha256, Size: resp.ContentLength, Modified: modified}, nil
+}
+
+// s3ListEntry is one object of a bucket listing.
+type s3ListEntry struct {
+	Key          string    `xml:"Key" json:"name"`
+	Size         int64     `xml:"Size" json:"size"`
+	LastModified time.Time `xml:"LastModified" json:"modified"`
+}
+
+type listBucketResult struct {
+	Contents              []s3ListEntry `xml:"Contents"`
+	IsTruncated           bool          `xml:"IsTruncated"`
+	NextContinuationToken string        `xml:"NextContinuationToken"`
+}
+
+// listObjects returns every object whose key starts with prefix.
+func (c *s3Client) listObjects(ctx context.Context, prefix string) ([]s3ListEntry, error) {
+	var entries []s3ListEntry
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}}
+		if prefix != "" {
+			query.Set("prefix", prefix)
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		rawURL := c.cfg.Endpoint + "/" + awsURIEncode(c.cfg.Bucket, true) + encodeQuery(query)
+		resp, err := c.do(ctx, "GET", rawURL, nil, nil, emptyPayloadHash)
+		if err != nil {
+			return nil, err
+		}
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("s3: invalid list response: %w", err)
+		}
+
+		entries = append(entries, result.Contents...)
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return entries, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (s *s3BlobStore) List(ctx context.Context) ([]BlobInfo, error) {
+	entries, err := s.c.listObjects(ctx, s.c.cfg.Prefix)
+	if err != nil {
+		return nil, err
+	}
+	var blobs []BlobInfo
+	for _, obj := range entries {
+		name := strings.TrimPrefix(obj.Key, s.c.cfg.Prefix)
+		if !isBlobHash(name) {
+			continue
+		}
+		blobs = append(blobs, BlobInfo{SHA256: strings.ToLower(name), Size: obj.Size, Modified: obj.LastModified})
+	}
+	return blobs, nil
+}
+
+// s3Object reads an object with ranged GETs so blobs can be served (and
+// seeked by http.ServeContent) without buffering them in memory.
+type s3Object struct {
+	store  *s3BlobStore
+	key    string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		o.closeBody()
+		return 0, io.EOF
+	}
+	if o.body == nil {
+		header := http.Header{}
+		header.Set("Range", "bytes="+strconv.FormatInt(o.offset, 10)+"-")
+		resp, err := o.store.c.do(context.Background(), "GET", o.store.c.objectURL(o.key), header, nil, emptyPayloadHash)
+		if err != nil {
+			return 0, err
+		}
+		o.body = resp.Body
+	}
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	if err == io.EOF {
+		o.closeBody()
+		if o.offset < o.size {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	return n, err
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = o.offset + offset
+	case io.SeekEnd:
+		abs = o.size + offset
+	default:
+		return 0, fmt.Errorf("s3: invalid whence %d", whence)
+	}
+	if abs < 0 {
+		return 0, fmt.Errorf("s3: negative position")
+	}
+	if abs != o.offset {
+		o.closeBody()
+		o.offset = abs
+	}
+	return abs, nil
+}
+
+func (o *s3Object) closeBody() {
+	if o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+}
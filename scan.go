@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Malware scanning: with SCAN_BACKEND set, every blob is scanned before it
+// reaches the blob store and flagged blobs are refused. Stored blobs are
+// re-scanned every SCAN_RESCAN_HOURS, as signatures get updated, and the ones
+// flagged then are quarantined: kept, but not served, until an admin
+// releases or deletes them.
+
+// BlobScanner checks a blob's content, streamed from body. It returns the
+// name of the detected threat, or "" when the blob is clean.
+type BlobScanner interface {
+	Scan(ctx context.Context, sha256 string, body io.Reader) (string, error)
+}
+
+// QuarantinedBlob is one row of GET /admin/quarantine.
+type QuarantinedBlob struct {
+	SHA256    string   `json:"sha256"`
+	Threat    string   `json:"threat"`
+	Owners    []string `json:"owners"`
+	FlaggedAt int64    `json:"flagged_at"`
+}
+
+var (
+	blobScanner BlobScanner
+
+	quarantineMu sync.RWMutex
+	quarantine   = map[string]QuarantinedBlob{}
+)
+
+// newBlobScanner builds the scanner configured by SCAN_BACKEND, nil when
+// scanning is disabled.
+func newBlobScanner(cfg Config) (BlobScanner, error) {
+	switch cfg.ScanBackend {
+	case "":
+		return nil, nil
+	case "clamd":
+		network, address, ok := strings.Cut(cfg.ClamdAddress, ":")
+		if !ok || (network != "unix" && network != "tcp") {
+			return nil, fmt.Errorf("invalid CLAMD_ADDRESS %q, expected unix:/path or tcp:host:port", cfg.ClamdAddress)
+		}
+		return &clamdScanner{network: network, address: address}, nil
+	case "http":
+		if cfg.ScanHTTPURL == "" {
+			return nil, fmt.Errorf("SCAN_BACKEND=http needs SCAN_HTTP_URL")
+		}
+		return &httpScanner{url: cfg.ScanHTTPURL, client: &http.Client{Timeout: 2 * time.Minute}}, nil
+	default:
+		return nil, fmt.Errorf("unknown SCAN_BACKEND %q (expected clamd or http)", cfg.ScanBackend)
+	}
+}
+
+// clamdScanner streams blobs to clamd with the INSTREAM command.
+type clamdScanner struct {
+	network string
+	address string
+}
+
+func (s *clamdScanner) Scan(ctx context.Context, sha256 string, body io.Reader) (string, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, s.network, s.address)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Minute))
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return "", err
+	}
+	const chunkSize = 64 * 1024
+	size := make([]byte, 4)
+	chunk := make([]byte, chunkSize)
+	for {
+		n, err := io.ReadFull(body, chunk)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size, uint32(n))
+			if _, err := conn.Write(size); err != nil {
+				return "", err
+			}
+			if _, err := conn.Write(chunk[:n]); err != nil {
+				return "", err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return "", err
+		}
+	}
+	binary.BigEndian.PutUint32(size, 0)
+	if _, err := conn.Write(size); err != nil {
+		return "", err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	// "stream: OK", "stream: <signature> FOUND" or "<reason> ERROR"
+	reply = strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(reply, "stream: "), "\x00"))
+	switch {
+	case reply == "OK":
+		return "", nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return strings.TrimSuffix(reply, " FOUND"), nil
+	default:
+		return "", fmt.Errorf("clamd: %s", reply)
+	}
+}
+
+// httpScanner POSTs blobs to an external scanning service, which answers
+// {"infected": bool, "threat": "..."}.
+type httpScanner struct {
+	url    string
+	client *http.Client
+}
+
+func (s *httpScanner) Scan(ctx context.Context, sha256 string, body io.Reader) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", s.url, body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-SHA256", sha256)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("scanner returned %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Infected bool   `json:"infected"`
+		Threat   string `json:"threat"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("invalid scanner response: %w", err)
+	}
+	if !result.Infected {
+		return "", nil
+	}
+	if result.Threat == "" {
+		result.Threat = "unknown"
+	}
+	return result.Threat, nil
+}
+
+func isQuarantined(sha256 string) bool {
+	quarantineMu.RLock()
+	defer quarantineMu.RUnlock()
+	_, ok := quarantine[sha256]
+	return ok
+}
+
+func persistQuarantine(ctx context.Context) {
+	quarantineMu.RLock()
+	defer quarantineMu.RUnlock()
+	if err := saveState(ctx, "quarantine", quarantine); err != nil {
+		slog.Error("Scan: failed to persist quarantine", "err", err)
+	}
+}
+
+// scanBlob runs the scanner, applying SCAN_FAIL_OPEN when it is unavailable.
+func scanBlob(ctx context.Context, sha256 string, body io.Reader) (string, error) {
+	threat, err := blobScanner.Scan(ctx, sha256, body)
+	if err != nil && config.ScanFailOpen {
+		blobLogger(ctx, sha256).Warn("Scan: scanner failed, accepting blob (SCAN_FAIL_OPEN)", "err", err)
+		return "", nil
+	}
+	return threat, err
+}
+
+// rescanBlobs scans every stored blob again and quarantines the flagged ones.
+func rescanBlobs(ctx context.Context) {
+	stored, err := blobStore.List(ctx)
+	if err != nil {
+		slog.Error("Scan: failed to list blobs", "err", err)
+		return
+	}
+
+	flagged := 0
+	for _, info := range stored {
+		if isQuarantined(info.SHA256) {
+			continue
+		}
+		reader, err := blobStore.Get(ctx, info.SHA256)
+		if err != nil {
+			continue
+		}
+		threat, err := blobScanner.Scan(ctx, info.SHA256, reader)
+		if closer, ok := reader.(io.Closer); ok {
+			closer.Close()
+		}
+		if err != nil {
+			blobLogger(ctx, info.SHA256).Warn("Scan: failed to re-scan", "err", err)
+			continue
+		}
+		if threat == "" {
+			continue
+		}
+		quarantineBlob(ctx, info.SHA256, threat)
+		blobLogger(ctx, info.SHA256).Warn("Scan: quarantined", "threat", threat)
+		flagged++
+	}
+
+	if flagged > 0 {
+		persistQuarantine(ctx)
+	}
+	slog.Info("Scan: re-scan finished", "scanned", len(stored), "quarantined", flagged)
+}
+
+// deleteQuarantinedBlob removes a quarantined blob and its index entries.
+func deleteQuarantinedBlob(ctx context.Context, bl *blossom.BlossomServer, sha256 string) error {
+	for _, owner := range blobOwners(ctx, sha256) {
+		if err := bl.Store.Delete(ctx, sha256, owner); err != nil {
+			blobLogger(ctx, sha256).Error("Scan: failed to unindex", "owner", owner, "err", err)
+		}
+	}
+	return blobStore.Delete(ctx, sha256)
+}
+
+// loadQuarantine restores the quarantine from the relay state.
+func loadQuarantine(ctx context.Context) {
+	var st map[string]QuarantinedBlob
+	if ok, err := loadState(ctx, "quarantine", &st); err != nil {
+		slog.Error("Scan: failed to load quarantine", "err", err)
+	} else if ok && st != nil {
+		quarantineMu.Lock()
+		quarantine = st
+		quarantineMu.Unlock()
+	}
+}
+
+// quarantineBlob withholds a stored blob from downloads until an admin
+// releases or deletes it.
+func quarantineBlob(ctx context.Context, sha256, threat string) {
+	quarantineMu.Lock()
+	quarantine[sha256] = QuarantinedBlob{
+		SHA256:    sha256,
+		Threat:    threat,
+		Owners:    blobOwners(ctx, sha256),
+		FlaggedAt: time.Now().Unix(),
+	}
+	quarantineMu.Unlock()
+}
+
+// setupQuarantine refuses downloads of quarantined blobs and exposes the
+// quarantine admin API: GET /admin/quarantine,
+// POST /admin/quarantine/{sha256}/release, DELETE /admin/quarantine/{sha256}
+// and, with a scanner, POST /admin/quarantine/rescan. Both malware scanning
+// and integrity verification put blobs there.
+func setupQuarantine(relay *khatru.Relay, bl *blossom.BlossomServer) {
+	loadQuarantine(context.Background())
+
+	bl.RejectGet = append(bl.RejectGet, func(ctx context.Context, auth *nostr.Event, sha256 string) (bool, string, int) {
+		if isQuarantined(sha256) {
+			return true, "blob is quarantined", http.StatusUnavailableForLegalReasons
+		}
+		return false, "", 0
+	})
+
+	relay.Router().HandleFunc("/admin/quarantine", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		quarantineMu.RLock()
+		list := make([]QuarantinedBlob, 0, len(quarantine))
+		for _, q := range quarantine {
+			list = append(list, q)
+		}
+		quarantineMu.RUnlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	}))
+
+	relay.Router().HandleFunc("/admin/quarantine/", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		sha256, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/admin/quarantine/"), "/")
+		switch {
+		case r.Method == "POST" && sha256 == "rescan" && action == "" && blobScanner != nil:
+			go rescanBlobs(context.Background())
+			w.WriteHeader(http.StatusAccepted)
+			return
+		case !isBlobHash(sha256):
+			http.Error(w, "Invalid blob hash", http.StatusBadRequest)
+			return
+		}
+		sha256 = strings.ToLower(sha256)
+		if !isQuarantined(sha256) {
+			http.Error(w, "Blob is not quarantined", http.StatusNotFound)
+			return
+		}
+
+		switch {
+		case r.Method == "POST" && action == "release":
+			blobLogger(r.Context(), sha256).Info("Scan: released from quarantine")
+		case r.Method == "DELETE" && action == "":
+			if err := deleteQuarantinedBlob(r.Context(), bl, sha256); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			blobLogger(r.Context(), sha256).Info("Scan: deleted quarantined blob")
+		default:
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		quarantineMu.Lock()
+		delete(quarantine, sha256)
+		quarantineMu.Unlock()
+		persistQuarantine(r.Context())
+		w.WriteHeader(http.StatusNoContent)
+	}))
+}
+
+// setupBlobScanning scans blobs before they are stored and schedules
+// re-scans. It must run before the blob store's StoreBlob hook is added.
+func setupBlobScanning(bl *blossom.BlossomServer) {
+	// runs before the blob reaches the store; uploads, NIP-96 and mirrors all
+	// go through the StoreBlob hooks
+	bl.StoreBlob = append(bl.StoreBlob, func(ctx context.Context, sha256 string, body []byte) error {
+		reader, _, err := blobReader(ctx, sha256, body)
+		if err != nil {
+			return err
+		}
+		threat, err := scanBlob(ctx, sha256, reader)
+		if closer, ok := reader.(io.Closer); ok {
+			closer.Close()
+		}
+		if err != nil {
+			return fmt.Errorf("malware scan failed: %w", err)
+		}
+		if threat == "" {
+			return nil
+		}
+		blobLogger(ctx, sha256).Warn("Scan: refused blob", "threat", threat)
+		// the upload was already indexed, drop it again
+		for _, owner := range blobOwners(ctx, sha256) {
+			bl.Store.Delete(ctx, sha256, owner)
+		}
+		return fmt.Errorf("blob flagged by malware scan: %s", threat)
+	})
+
+	if config.ScanRescanHours > 0 {
+		go func() {
+			for {
+				time.Sleep(time.Duration(config.ScanRescanHours) * time.Hour)
+				rescanBlobs(context.Background())
+			}
+		}()
+	}
+
+	slog.Info("Scan: ENABLED", "backend", config.ScanBackend, "rescan_hours", config.ScanRescanHours)
+}
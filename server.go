@@ -0,0 +1,326 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// serve runs one HTTP server per listener profile (":3334" by default), each
+// tagging its requests with the profile, and, when LISTEN_SOCKET is set, serves
+// the first profile on a unix domain socket as well, or only there with
+// LISTEN_SOCKET_ONLY. Profiles given a socket by systemd socket activation
+// serve it instead of opening their port. With TLS configured the TCP
+// listeners serve https/wss; the unix socket stays plain for the local proxy.
+// Requests from banned IPs are refused as soon as the client address is
+// resolved. Blocks until a listener fails or a SIGINT/SIGTERM arrives, then
+// shuts down gracefully, which also removes the socket file.
+func serve(handler http.Handler) {
+	handler = trustProxies(rejectBannedIPs(withRequestLog(withCORS(handler))))
+	var servers []*http.Server
+
+	var tlsConfig *tls.Config
+	if config.TLS.Enabled() {
+		var challenges http.Handler
+		var err error
+		tlsConfig, challenges, err = newTLSConfig()
+		if err != nil {
+			fatal("Failed to configure TLS", "err", err)
+		}
+		if challenges != nil && config.TLS.ACMEHTTPAddr != "" {
+			slog.Info("Answering ACME challenges", "addr", config.TLS.ACMEHTTPAddr)
+			acmeServer := &http.Server{Addr: config.TLS.ACMEHTTPAddr, Handler: challenges, ReadHeaderTimeout: 30 * time.Second}
+			servers = append(servers, acmeServer)
+			go func() {
+				slog.Error("ACME challenge listener stopped", "err", acmeServer.ListenAndServe())
+			}()
+		}
+	}
+
+	errs := make(chan error, len(config.Profiles)+1)
+	activated := activatedListeners(config.Profiles)
+	for i, p := range config.Profiles {
+		server := newHTTPServer(p.Addr, withProfile(p, handler))
+		server.TLSConfig = tlsConfig
+		servers = append(servers, server)
+
+		if i == 0 && config.ListenSocket != nil && strings.TrimSpace(*config.ListenSocket) != "" {
+			ln, err := listenUnix(strings.TrimSpace(*config.ListenSocket))
+			if err != nil {
+				fatal("Failed to listen on unix socket", "err", err)
+			}
+			slog.Info("Running on unix socket", "socket", ln.Addr().String(), "profile", p.Name,
+				"mode", fmt.Sprintf("%04o", config.ListenSocketMode))
+			go func() {
+				errs <- server.Serve(ln)
+			}()
+			if config.ListenSocketOnly {
+				continue
+			}
+		}
+
+		if ln := activated[i]; ln != nil {
+			slog.Info("Running on socket passed by systemd", "addr", ln.Addr().String(), "profile", p.Name, "tls", tlsConfig != nil)
+			go func() {
+				if tlsConfig != nil {
+					errs <- server.ServeTLS(ln, "", "")
+					return
+				}
+				errs <- server.Serve(ln)
+			}()
+			continue
+		}
+
+		if tlsConfig != nil {
+			slog.Info("Running with extended timeouts for large uploads", "addr", p.Addr, "profile", p.Name, "tls", true)
+			go func() {
+				// certificates come from server.TLSConfig
+				errs <- server.ListenAndServeTLS("", "")
+			}()
+			continue
+		}
+		slog.Info("Running with extended timeouts for large uploads", "addr", p.Addr, "profile", p.Name)
+		go func() {
+			errs <- server.ListenAndServe()
+		}()
+	}
+
+	sdNotify("READY=1")
+	go runWatchdog()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-errs:
+		slog.Error("Listener stopped", "err", err)
+	case sig := <-signals:
+		slog.Info("Shutting down", "signal", sig.String(), "timeout_seconds", config.ShutdownTimeoutSeconds)
+	}
+	shutdown(servers)
+}
+
+// newHTTPServer configures an HTTP server with timeouts suitable for large file uploads.
+func newHTTPServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadTimeout:       15 * time.Minute, // Increased to 15 minutes for very large files
+		WriteTimeout:      15 * time.Minute, // Increased to 15 minutes
+		IdleTimeout:       5 * time.Minute,  // Increased idle timeout
+		ReadHeaderTimeout: 30 * time.Second, // Prevent slow header attacks
+		MaxHeaderBytes:    1 << 20,          // 1MB max header size
+	}
+}
+
+// listenUnix opens a unix socket at path, removing a stale socket left over
+// from a previous run, and gives it LISTEN_SOCKET_MODE and LISTEN_SOCKET_GROUP
+// so the reverse proxy can connect. The socket file is removed when the
+// listener is closed.
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Stat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket: %w", err)
+		}
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := setSocketOwnership(path); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+func setSocketOwnership(path string) error {
+	if config.ListenSocketGroup != "" {
+		group, err := user.LookupGroup(config.ListenSocketGroup)
+		if err != nil {
+			return fmt.Errorf("unknown LISTEN_SOCKET_GROUP: %w", err)
+		}
+		gid, err := strconv.Atoi(group.Gid)
+		if err != nil {
+			return fmt.Errorf("unexpected gid %q for group %s", group.Gid, group.Name)
+		}
+		if err := os.Chown(path, -1, gid); err != nil {
+			return fmt.Errorf("failed to set socket group: %w", err)
+		}
+	}
+	if err := os.Chmod(path, config.ListenSocketMode); err != nil {
+		return fmt.Errorf("failed to set socket permissions: %w", err)
+	}
+	return nil
+}
+
+// parseTrustedProxies accepts a list of IPs and CIDR ranges.
+func parseTrustedProxies(entries []string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil {
+				bits := 32
+				if ip.To4() == nil {
+					bits = 128
+				}
+				entry = fmt.Sprintf("%s/%d", ip.String(), bits)
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(entry)
+		if err != nil {
+			slog.Warn("Invalid TRUSTED_PROXIES entry, skipping", "entry", entry)
+			continue
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets
+}
+
+var trustedProxyNets []*net.IPNet
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, n := range trustedProxyNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// trustProxies resolves the real client IP for each request. Forwarding
+// headers are only honored when the request comes from a trusted proxy (or
+// over the unix socket, which only the local proxy can reach); otherwise they
+// are stripped so clients cannot spoof their address. The resolved IP is put
+// in r.RemoteAddr, which is what khatru and our own handlers (bans, rate
+// limits, logs) read. The scheme and host a trusted proxy reports are kept
+// for khatru's NIP-42 relay URL check; from anyone else they are dropped.
+func trustProxies(next http.Handler) http.Handler {
+	trustedProxyNets = parseTrustedProxies(config.TrustedProxies)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		peer := net.ParseIP(host)
+		viaSocket := peer == nil // unix socket peers have no IP address
+
+		if viaSocket || isTrustedProxy(peer) {
+			if ip := forwardedClientIP(r); ip != nil {
+				r.RemoteAddr = net.JoinHostPort(ip.String(), "0")
+			}
+			forwardedSchemeAndHost(r)
+		} else {
+			r.Header.Del("X-Forwarded-Host")
+			r.Header.Del("X-Forwarded-Proto")
+		}
+
+		r.Header.Del("Forwarded")
+		r.Header.Del("X-Forwarded-For")
+		r.Header.Del("X-Real-IP")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// forwardedClientIP returns the client address reported by a trusted proxy:
+// the right-most hop of the RFC 7239 Forwarded header, or else of
+// X-Forwarded-For, that is not itself a trusted proxy. Proxies append to
+// these chains, so anything left of that hop may have been made up by the
+// client. X-Real-IP is only a fallback, since some proxies pass a value sent
+// by the client through untouched.
+func forwardedClientIP(r *http.Request) net.IP {
+	hops := forwardedFor(r.Header.Values("Forwarded"))
+	if len(hops) == 0 {
+		for _, value := range r.Header.Values("X-Forwarded-For") {
+			for _, hop := range strings.Split(value, ",") {
+				hops = append(hops, net.ParseIP(strings.TrimSpace(hop)))
+			}
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		if hops[i] == nil {
+			// "unknown", an obfuscated identifier or garbage: nothing
+			// further left can be trusted
+			break
+		}
+		if !isTrustedProxy(hops[i]) || i == 0 {
+			return hops[i]
+		}
+	}
+	return net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP")))
+}
+
+// forwardedFor returns the "for" addresses of Forwarded header values, in
+// order, with nil for the ones that are not IP addresses.
+func forwardedFor(values []string) []net.IP {
+	var hops []net.IP
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			if v, ok := forwardedParam(element, "for"); ok {
+				hops = append(hops, parseForwardedNode(v))
+			}
+		}
+	}
+	return hops
+}
+
+// forwardedParam returns the value of one parameter of a Forwarded element.
+func forwardedParam(element, name string) (string, bool) {
+	for _, pair := range strings.Split(element, ";") {
+		key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if ok && strings.EqualFold(key, name) {
+			return strings.Trim(value, `"`), true
+		}
+	}
+	return "", false
+}
+
+// parseForwardedNode parses a Forwarded node: an IPv4 address or a bracketed
+// IPv6 address, either with an optional port.
+func parseForwardedNode(node string) net.IP {
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		node = host
+	}
+	return net.ParseIP(strings.Trim(node, "[]"))
+}
+
+// forwardedSchemeAndHost copies the proto and host of the Forwarded header
+// into X-Forwarded-Proto and X-Forwarded-Host, which is what khatru reads,
+// when the proxy only sends the standard header.
+func forwardedSchemeAndHost(r *http.Request) {
+	values := r.Header.Values("Forwarded")
+	if len(values) == 0 {
+		return
+	}
+	// the element added by the proxy closest to us
+	elements := strings.Split(values[len(values)-1], ",")
+	last := elements[len(elements)-1]
+	if proto, ok := forwardedParam(last, "proto"); ok && r.Header.Get("X-Forwarded-Proto") == "" {
+		r.Header.Set("X-Forwarded-Proto", proto)
+	}
+	if host, ok := forwardedParam(last, "host"); ok && r.Header.Get("X-Forwarded-Host") == "" {
+		r.Header.Set("X-Forwarded-Host", host)
+	}
+}
+
+// clientIP returns the client address of a request that went through trustProxies.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestForwardedClientIP(t *testing.T) {
+	saved := trustedProxyNets
+	defer func() { trustedProxyNets = saved }()
+	trustedProxyNets = parseTrustedProxies([]string{"10.0.0.0/8", "fd00::1"})
+
+	cases := []struct {
+		name      string
+		forwarded string
+		xff       string
+		realIP    string
+		want      string
+	}{
+		{name: "single hop", xff: "203.0.113.7", want: "203.0.113.7"},
+		{name: "trusted proxy skipped", xff: "203.0.113.7, 10.0.0.2", want: "203.0.113.7"},
+		{name: "spoofed leftmost address", xff: "127.0.0.1, 203.0.113.7, 10.0.0.2", want: "203.0.113.7"},
+		{name: "untrusted hop stops the walk", xff: "198.51.100.1, 203.0.113.7", want: "203.0.113.7"},
+		{name: "untrusted hop between proxies", xff: "198.51.100.1, 203.0.113.7, 10.0.0.3, 10.0.0.2", want: "203.0.113.7"},
+		{name: "only proxies", xff: "10.0.0.5, 10.0.0.2", want: "10.0.0.5"},
+		{name: "garbage hop", xff: "198.51.100.1, bogus, 10.0.0.2", realIP: "192.0.2.9", want: "192.0.2.9"},
+		{name: "X-Real-IP fallback", realIP: "192.0.2.9", want: "192.0.2.9"},
+		{name: "nothing forwarded", want: "<nil>"},
+
+		{name: "Forwarded", forwarded: `for=127.0.0.1, for=203.0.113.7;proto=https, for=10.0.0.2`, want: "203.0.113.7"},
+		{name: "Forwarded IPv6 with port", forwarded: `for="[2001:db8::1]:4711", for="[fd00::1]"`, want: "2001:db8::1"},
+		{name: "Forwarded wins over X-Forwarded-For", forwarded: "for=203.0.113.7", xff: "198.51.100.1", want: "203.0.113.7"},
+		{name: "Forwarded unknown", forwarded: "for=198.51.100.1, for=unknown, for=10.0.0.2", realIP: "192.0.2.9", want: "192.0.2.9"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if tc.forwarded != "" {
+				r.Header.Set("Forwarded", tc.forwarded)
+			}
+			if tc.xff != "" {
+				r.Header.Set("X-Forwarded-For", tc.xff)
+			}
+			if tc.realIP != "" {
+				r.Header.Set("X-Real-IP", tc.realIP)
+			}
+			if got := forwardedClientIP(r).String(); got != tc.want {
+				t.Errorf("forwardedClientIP = %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/fiatjaf/khatru"
+)
+
+// Graceful shutdown: on SIGINT/SIGTERM the listeners stop accepting
+// connections, in-flight requests (uploads) finish, websocket clients are
+// asked to go away, pending blob writes complete and the database is closed,
+// all within SHUTDOWN_TIMEOUT_SECONDS.
+
+var (
+	sessionsMu sync.Mutex
+	sessions   = make(map[*khatru.WebSocket]struct{})
+)
+
+// trackSessions keeps the set of open websocket sessions, which http.Server
+// forgets about once they are upgraded.
+func trackSessions(relay *khatru.Relay) {
+	relay.OnConnect = append(relay.OnConnect, func(ctx context.Context) {
+		if ws := khatru.GetConnection(ctx); ws != nil {
+			sessionsMu.Lock()
+			sessions[ws] = struct{}{}
+			sessionsMu.Unlock()
+		}
+	})
+	relay.OnDisconnect = append(relay.OnDisconnect, func(ctx context.Context) {
+		if ws := khatru.GetConnection(ctx); ws != nil {
+			sessionsMu.Lock()
+			delete(sessions, ws)
+			sessionsMu.Unlock()
+		}
+	})
+}
+
+func openSessions() []*khatru.WebSocket {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	list := make([]*khatru.WebSocket, 0, len(sessions))
+	for ws := range sessions {
+		list = append(list, ws)
+	}
+	return list
+}
+
+// closeSessions sends a "going away" close frame to every websocket client
+// and waits for them to disconnect or for ctx to expire.
+func closeSessions(ctx context.Context) {
+	msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "relay shutting down")
+	for _, ws := range openSessions() {
+		ws.WriteMessage(websocket.CloseMessage, msg)
+	}
+	for len(openSessions()) > 0 {
+		select {
+		case <-ctx.Done():
+			slog.Warn("Shutdown: websocket sessions still open", "sessions", len(openSessions()))
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// waitBlobWrites waits for blob files being written to be synced and closed.
+func waitBlobWrites(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		blobWrites.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		slog.Warn("Shutdown: timed out waiting for blob writes")
+	}
+}
+
+// shutdown drains the servers and closes the storage.
+func shutdown(servers []*http.Server) {
+	sdNotify("STOPPING=1")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.ShutdownTimeoutSeconds)*time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				slog.Error("Shutdown: server did not stop cleanly", "addr", server.Addr, "err", err)
+			}
+		}()
+	}
+	closeSessions(ctx)
+	wg.Wait()
+	waitBlobWrites(ctx)
+
+	persistMediaURLs(ctx)
+	persistRejections(ctx)
+	persistFederationCursors(ctx)
+	db.Close()
+	shutdownTracing(ctx)
+	if deriver != nil {
+		deriver.Wipe()
+	}
+	slog.Info("Shutdown complete")
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Outbound blob fetches (PUT /mirror and BUD-03 auto-mirroring) take URLs
+// from users, so they go through blobFetchClient: http(s) only, at most
+// maxFetchRedirects redirects, a MIRROR_TIMEOUT_SECONDS deadline, and no
+// connections to loopback, private, link-local or other non-public
+// addresses. The address check runs on the resolved IP at dial time, so a
+// hostname can't be re-pointed at the internal network after validation.
+// MIRROR_ALLOW_PRIVATE lifts it for servers on the local network.
+//
+// Outbox backfill dials the relays members list in their kind 10002 events,
+// through go-nostr, whose dialer can't be hooked. Those URLs must be wss://
+// and resolve to public addresses only (checkRelayURL); DNS could still
+// change between the check and the dial, which the blob fetches don't allow.
+
+const maxFetchRedirects = 5
+
+var errPrivateAddress = errors.New("destination is not a public address")
+
+// nonPublicRanges are the reserved ranges the net.IP predicates don't cover.
+var nonPublicRanges = func() []*net.IPNet {
+	var ranges []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8",     // "this" network
+		"100.64.0.0/10", // carrier-grade NAT
+		"192.0.0.0/24",  // IETF protocol assignments
+		"198.18.0.0/15", // benchmarking
+		"240.0.0.0/4",   // reserved
+		"64:ff9b::/96",  // NAT64, may map onto private IPv4
+	} {
+		_, ipnet, _ := net.ParseCIDR(cidr)
+		ranges = append(ranges, ipnet)
+	}
+	return ranges
+}()
+
+// isPublicIP reports whether ip is routable on the public internet.
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+	for _, ipnet := range nonPublicRanges {
+		if ipnet.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// validateFetchURL accepts absolute http(s) URLs.
+func validateFetchURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported URL scheme %q", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return fmt.Errorf("URL has no host")
+	}
+	return nil
+}
+
+// checkDialAddress is the dialer hook refusing non-public destinations.
+func checkDialAddress(network, address string, _ syscall.RawConn) error {
+	if config.MirrorAllowPrivate {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+		return fmt.Errorf("%w: %s", errPrivateAddress, host)
+	}
+	return nil
+}
+
+// checkRelayURL accepts wss:// relay URLs whose host resolves to public
+// addresses only.
+func checkRelayURL(ctx context.Context, relayURL string) error {
+	u, err := url.Parse(relayURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "wss" {
+		return fmt.Errorf("unsupported relay URL scheme %q", u.Scheme)
+	}
+	host := u.Hostname()
+	if host == "" {
+		return fmt.Errorf("relay URL has no host")
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if !isPublicIP(ip) {
+			return fmt.Errorf("%w: %s", errPrivateAddress, host)
+		}
+		return nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if !isPublicIP(addr.IP) {
+			return fmt.Errorf("%w: %s is %s", errPrivateAddress, host, addr.IP)
+		}
+	}
+	return nil
+}
+
+// blobFetchClient is the HTTP client for fetching blobs from user-supplied URLs.
+var blobFetchClient = sync.OnceValue(func() *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second, Control: checkDialAddress}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	// an outbound proxy would be dialed instead of the destination
+	transport.Proxy = nil
+	return &http.Client{
+		Transport: transport,
+		Timeout:   time.Duration(config.MirrorTimeoutSeconds) * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxFetchRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxFetchRedirects)
+			}
+			return validateFetchURL(req.URL)
+		},
+	}
+})
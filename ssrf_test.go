@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIsPublicIP(t *testing.T) {
+	cases := []struct {
+		ip   string
+		want bool
+	}{
+		{"8.8.8.8", true},
+		{"1.1.1.1", true},
+		{"2606:4700:4700::1111", true},
+		{"100.128.0.1", true},
+
+		// loopback and unspecified
+		{"127.0.0.1", false},
+		{"127.255.0.9", false},
+		{"::1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"0.1.2.3", false},
+
+		// private
+		{"10.0.0.1", false},
+		{"172.16.5.4", false},
+		{"192.168.1.1", false},
+		{"fd00::1", false},
+
+		// link-local, including the cloud metadata address
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+
+		// IPv4-mapped IPv6 is judged by the IPv4 address
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:10.0.0.1", false},
+		{"::ffff:169.254.169.254", false},
+		{"::ffff:100.64.0.1", false},
+		{"::ffff:8.8.8.8", true},
+
+		// NAT64 reaches the IPv4 address embedded in it
+		{"64:ff9b::7f00:1", false},
+
+		// carrier-grade NAT
+		{"100.64.0.1", false},
+		{"100.127.255.254", false},
+
+		// reserved and benchmarking
+		{"192.0.0.8", false},
+		{"198.18.0.1", false},
+		{"240.0.0.1", false},
+		{"255.255.255.255", false},
+
+		// multicast
+		{"224.0.0.1", false},
+		{"ff02::1", false},
+	}
+	for _, tc := range cases {
+		ip := net.ParseIP(tc.ip)
+		if ip == nil {
+			t.Fatalf("bad test address %s", tc.ip)
+		}
+		if got := isPublicIP(ip); got != tc.want {
+			t.Errorf("isPublicIP(%s) = %v, want %v", tc.ip, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Live relay statistics for the front page. Counting walks the event store
+// and the blob index, so results are cached for statsTTL.
+//
+// GET /api/stats serves the all-time totals as JSON: events by kind and by
+// day, and distinct authors. Those are built by one scan of the store and
+// then kept up to date as events are saved; deletions are only accounted for
+// by the rescan every statsRebuildInterval, so between rescans the totals can
+// run a little high.
+
+const (
+	statsTTL             = time.Minute
+	statsRebuildInterval = 6 * time.Hour
+	statsDays            = 30
+)
+
+// KindCount is the number of events of one kind.
+type KindCount struct {
+	Kind  int
+	Count int
+}
+
+// RelayStats summarizes what the relay stores.
+type RelayStats struct {
+	Events       int64
+	RecentEvents int         // stored in the last 24h
+	RecentKinds  []KindCount // the last 24h by kind, most frequent first
+	Members      int
+	Blobs        int
+	BlobBytes    int64
+	ComputedAt   time.Time
+}
+
+var (
+	statsMu     sync.Mutex
+	cachedStats *RelayStats
+)
+
+// relayStats returns the cached statistics, recomputing them once stale.
+func relayStats() RelayStats {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	if cachedStats != nil && time.Since(cachedStats.ComputedAt) < statsTTL {
+		return *cachedStats
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	stats := computeStats(ctx)
+	cachedStats = &stats
+	return stats
+}
+
+func computeStats(ctx context.Context) RelayStats {
+	stats := RelayStats{ComputedAt: time.Now(), Members: len(memberPubkeys())}
+
+	total, err := countEvents(ctx, nostr.Filter{})
+	if err != nil {
+		slog.Warn("Stats: failed to count events", "err", err)
+	}
+	stats.Events = total
+
+	since := nostr.Timestamp(time.Now().Add(-24 * time.Hour).Unix())
+	byKind := map[int]int{}
+	err = forEachEvent(ctx, nostr.Filter{Since: &since}, func(evt *nostr.Event) error {
+		if isInternalKind(evt.Kind) || isHiddenPubkey(evt.PubKey) {
+			return nil
+		}
+		byKind[evt.Kind]++
+		stats.RecentEvents++
+		return nil
+	})
+	if err != nil {
+		slog.Warn("Stats: failed to scan recent events", "err", err)
+	}
+	for kind, count := range byKind {
+		stats.RecentKinds = append(stats.RecentKinds, KindCount{Kind: kind, Count: count})
+	}
+	sort.Slice(stats.RecentKinds, func(i, j int) bool {
+		if stats.RecentKinds[i].Count != stats.RecentKinds[j].Count {
+			return stats.RecentKinds[i].Count > stats.RecentKinds[j].Count
+		}
+		return stats.RecentKinds[i].Kind < stats.RecentKinds[j].Kind
+	})
+
+	if blobStore != nil {
+		stats.Blobs, stats.BlobBytes, err = indexedBlobTotals(ctx)
+		if err != nil {
+			slog.Warn("Stats: failed to count indexed blobs", "err", err)
+		}
+	}
+	return stats
+}
+
+// eventTotals is the incrementally maintained part of the statistics.
+type eventTotals struct {
+	Events  int64
+	ByKind  map[int]int64
+	ByDay   map[string]int64 // UTC date of created_at, 2006-01-02
+	Authors map[string]bool
+	// addresses of the replaceable events counted, so a newer version
+	// isn't counted again
+	Addresses map[string]bool
+	BuiltAt   time.Time
+}
+
+var (
+	totalsMu sync.RWMutex
+	totals   *eventTotals // nil until the first scan finishes
+)
+
+func newEventTotals() *eventTotals {
+	return &eventTotals{ByKind: map[int]int64{}, ByDay: map[string]int64{}, Authors: map[string]bool{}, Addresses: map[string]bool{}}
+}
+
+func (t *eventTotals) add(evt *nostr.Event) {
+	if isInternalKind(evt.Kind) || isHiddenPubkey(evt.PubKey) {
+		return
+	}
+	if nostr.IsReplaceableKind(evt.Kind) || nostr.IsAddressableKind(evt.Kind) {
+		address := fmt.Sprintf("%d:%s:%s", evt.Kind, evt.PubKey, evt.Tags.GetD())
+		if t.Addresses[address] {
+			return
+		}
+		t.Addresses[address] = true
+	}
+	t.Events++
+	t.ByKind[evt.Kind]++
+	t.ByDay[evt.CreatedAt.Time().UTC().Format(time.DateOnly)]++
+	t.Authors[evt.PubKey] = true
+}
+
+// rebuildEventTotals scans every stored event into fresh totals.
+func rebuildEventTotals(ctx context.Context) error {
+	start := time.Now()
+	fresh := newEventTotals()
+	if err := forEachEvent(ctx, nostr.Filter{}, func(evt *nostr.Event) error {
+		fresh.add(evt)
+		return nil
+	}); err != nil {
+		return err
+	}
+	fresh.BuiltAt = time.Now()
+
+	totalsMu.Lock()
+	totals = fresh
+	totalsMu.Unlock()
+	slog.Info("Stats: event totals rebuilt", "events", fresh.Events, "authors", len(fresh.Authors), "duration", time.Since(start))
+	return nil
+}
+
+// countSavedEvent is the OnEventSaved hook keeping the totals current.
+func countSavedEvent(ctx context.Context, evt *nostr.Event) {
+	totalsMu.Lock()
+	defer totalsMu.Unlock()
+	if totals != nil {
+		totals.add(evt)
+	}
+}
+
+// DayCount is the number of events created on one UTC day.
+type DayCount struct {
+	Date   string `json:"date"`
+	Events int64  `json:"events"`
+}
+
+// StatsResponse is the /api/stats document.
+type StatsResponse struct {
+	Events        int64         `json:"events"`
+	EventsByKind  map[int]int64 `json:"events_by_kind"`
+	EventsByDay   []DayCount    `json:"events_by_day"` // the last 30 days, oldest first
+	Authors       int           `json:"authors"`
+	Members       int           `json:"members"`
+	Blobs         int           `json:"blobs"`
+	BlobBytes     int64         `json:"blob_bytes"`
+	UptimeSeconds int64         `json:"uptime_seconds"`
+	StartedAt     int64         `json:"started_at"`
+	TotalsAt      int64         `json:"totals_rebuilt_at"`
+}
+
+func statsResponse() (StatsResponse, bool) {
+	// the blob totals may take a while to recount, don't hold up saves meanwhile
+	stats := relayStats()
+	totalsMu.RLock()
+	defer totalsMu.RUnlock()
+	if totals == nil {
+		return StatsResponse{}, false
+	}
+	resp := StatsResponse{
+		Events:        totals.Events,
+		EventsByKind:  make(map[int]int64, len(totals.ByKind)),
+		Authors:       len(totals.Authors),
+		Members:       stats.Members,
+		Blobs:         stats.Blobs,
+		BlobBytes:     stats.BlobBytes,
+		UptimeSeconds: int64(time.Since(startedAt).Seconds()),
+		StartedAt:     startedAt.Unix(),
+		TotalsAt:      totals.BuiltAt.Unix(),
+	}
+	for kind, count := range totals.ByKind {
+		resp.EventsByKind[kind] = count
+	}
+	today := time.Now().UTC()
+	for i := statsDays - 1; i >= 0; i-- {
+		date := today.AddDate(0, 0, -i).Format(time.DateOnly)
+		resp.EventsByDay = append(resp.EventsByDay, DayCount{Date: date, Events: totals.ByDay[date]})
+	}
+	return resp, true
+}
+
+// setupStatsAPI serves /api/stats and keeps its totals current.
+func setupStatsAPI(relay *khatru.Relay) {
+	relay.OnEventSaved = append(relay.OnEventSaved, countSavedEvent)
+
+	relay.Router().HandleFunc("/api/stats", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		resp, ok := statsResponse()
+		if !ok {
+			w.Header().Set("Retry-After", "30")
+			http.Error(w, "Statistics are still being computed", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "max-age=60")
+		json.NewEncoder(w).Encode(resp)
+	})
+
+	go func() {
+		for {
+			if err := rebuildEventTotals(context.Background()); err != nil {
+				slog.Error("Stats: failed to scan events", "err", err)
+			}
+			time.Sleep(statsRebuildInterval)
+		}
+	}()
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Systemd integration, without a dependency on libsystemd. When started by a
+// .socket unit, the relay serves the sockets systemd passes (LISTEN_FDS)
+// instead of opening its own: a socket whose FileDescriptorName= is a profile
+// name serves that profile, unnamed ones serve the remaining profiles in
+// order. Under Type=notify it reports READY=1 once the listeners are up and
+// STOPPING=1 when it shuts down, and with WatchdogSec= it pings the watchdog
+// as long as the database still answers, so systemd restarts a hung relay.
+
+// listenFDsStart is the first file descriptor passed by systemd.
+const listenFDsStart = 3
+
+// activatedListeners returns the listeners systemd passed, by index of the
+// profile they serve; nil entries are for profiles that open their own port.
+func activatedListeners(profiles []*PolicyProfile) []net.Listener {
+	listeners := make([]net.Listener, len(profiles))
+	if pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID")); pid != os.Getpid() {
+		return listeners
+	}
+	n, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	// keep children (thumbnailers, migrations) from seeing them
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	var unnamed []net.Listener
+	for i := range n {
+		fd := listenFDsStart + i
+		syscall.CloseOnExec(fd)
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		file := os.NewFile(uintptr(fd), "systemd:"+name)
+		ln, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			fatal("Failed to use socket passed by systemd", "fd", fd, "name", name, "err", err)
+		}
+
+		matched := false
+		for j, p := range profiles {
+			if p.Name == name && listeners[j] == nil {
+				listeners[j] = ln
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			unnamed = append(unnamed, ln)
+		}
+	}
+
+	for j := range listeners {
+		if listeners[j] == nil && len(unnamed) > 0 {
+			listeners[j], unnamed = unnamed[0], unnamed[1:]
+		}
+	}
+	for _, ln := range unnamed {
+		slog.Warn("Socket passed by systemd has no profile to serve, closing it", "addr", ln.Addr().String())
+		ln.Close()
+	}
+	return listeners
+}
+
+// sdNotify sends state to the systemd notification socket, if there is one.
+func sdNotify(state string) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return
+	}
+	if addr[0] == '@' {
+		// abstract socket
+		addr = "\x00" + addr[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		slog.Warn("Failed to notify systemd", "state", state, "err", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		slog.Warn("Failed to notify systemd", "state", state, "err", err)
+	}
+}
+
+// watchdogInterval returns how often to ping the systemd watchdog: half of
+// WatchdogSec=, or 0 when the watchdog is off or meant for another process.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// runWatchdog pings the systemd watchdog while the relay is healthy. A
+// database that stops answering is the hang worth restarting for; a ping
+// skipped for it lets systemd step in once WatchdogSec= runs out.
+func runWatchdog() {
+	interval := watchdogInterval()
+	if interval == 0 {
+		return
+	}
+	slog.Info("Systemd watchdog: ENABLED", "interval", interval)
+	for range time.Tick(interval) {
+		if err := checkHealth(interval); err != nil {
+			slog.Error("Systemd watchdog: relay unhealthy, not pinging", "err", err)
+			continue
+		}
+		sdNotify("WATCHDOG=1")
+	}
+}
+
+// checkHealth queries the database, failing if it takes longer than timeout.
+func checkHealth(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		ch, err := db.QueryEvents(ctx, nostr.Filter{Limit: 1})
+		if err == nil {
+			for range ch {
+			}
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("database didn't answer within %s", timeout)
+	}
+}
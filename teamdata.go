@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Team membership from TEAM_DOMAIN's /.well-known/nostr.json. It is fetched
+// at startup and every TEAM_REFRESH_MINUTES; failed fetches are retried with
+// exponential backoff while the last good list stays in use, with a warning
+// once it is older than three refresh intervals. Admins can force a refresh
+// at /admin/team/refresh. The last good list is kept in the relay state, so
+// a restart while the domain is unreachable doesn't lock the team out.
+// Refreshes are conditional (If-None-Match/If-Modified-Since), and responses
+// must be JSON and at most maxTeamDataSize bytes.
+
+const (
+	teamRetryMin     = time.Minute
+	teamDataStateKey = "team_data"
+	maxTeamDataSize  = 1 << 20
+)
+
+// cachedTeamData is the persisted copy of the last good nostr.json, with the
+// validators to revalidate it.
+type cachedTeamData struct {
+	Data         NostrData `json:"data"`
+	FetchedAt    int64     `json:"fetched_at"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+}
+
+// TeamDataStatus is the state of the nostr.json refresh, as served at
+// GET /admin/team.
+type TeamDataStatus struct {
+	Domain      string `json:"domain"`
+	Members     int    `json:"members"`
+	UpdatedAt   int64  `json:"updated_at,omitempty"` // last successful fetch
+	LastAttempt int64  `json:"last_attempt,omitempty"`
+	LastError   string `json:"last_error,omitempty"`
+	Stale       bool   `json:"stale"`
+}
+
+var (
+	teamRefreshMu sync.Mutex // one fetch at a time
+	teamStatusMu  sync.RWMutex
+	teamStatus    TeamDataStatus
+
+	// validators of the current list, guarded by teamRefreshMu
+	teamETag, teamLastModified string
+	teamHTTPClient             = &http.Client{Timeout: 30 * time.Second}
+)
+
+func teamRefreshInterval() time.Duration {
+	return time.Duration(config.TeamRefreshMinutes) * time.Minute
+}
+
+// fetchNostrData fetches nostr.json and installs the new list. An unchanged
+// list (304) leaves everything as is.
+func fetchNostrData(teamDomain string) error {
+	req, err := http.NewRequest("GET", "https://"+teamDomain+"/.well-known/nostr.json", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if len(data.Names) > 0 {
+		if teamETag != "" {
+			req.Header.Set("If-None-Match", teamETag)
+		}
+		if teamLastModified != "" {
+			req.Header.Set("If-Modified-Since", teamLastModified)
+		}
+	}
+	response, err := teamHTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error getting well known file: %w", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotModified {
+		slog.Debug("Team data: nostr.json unchanged", "members", len(data.Names))
+		return nil
+	}
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("well known file returned %s", response.Status)
+	}
+	if mediatype, _, _ := mime.ParseMediaType(response.Header.Get("Content-Type")); mediatype != "application/json" && !strings.HasSuffix(mediatype, "+json") {
+		return fmt.Errorf("well known file has content type %q, expected application/json", response.Header.Get("Content-Type"))
+	}
+	if response.ContentLength > maxTeamDataSize {
+		return fmt.Errorf("well known file is too large (%d bytes)", response.ContentLength)
+	}
+	body, err := io.ReadAll(io.LimitReader(response.Body, maxTeamDataSize+1))
+	if err != nil {
+		return fmt.Errorf("error reading well known file: %w", err)
+	}
+	if len(body) > maxTeamDataSize {
+		return fmt.Errorf("well known file is larger than %d bytes", maxTeamDataSize)
+	}
+
+	var newData NostrData
+	if err := json.Unmarshal(body, &newData); err != nil {
+		return fmt.Errorf("error unmarshalling well known file: %w", err)
+	}
+	normalizeNostrData(&newData)
+
+	// Diff against the previous team set so removed members can be cleaned up
+	if len(data.Names) > 0 {
+		var removed []string
+		for _, pubkey := range data.Names {
+			if !containsValue(newData.Names, pubkey) {
+				removed = append(removed, pubkey)
+			}
+		}
+		for _, pubkey := range newData.Names {
+			if !containsValue(data.Names, pubkey) {
+				onMemberRestored(pubkey)
+			}
+		}
+		onMembersRemoved(removed, "team_domain")
+	}
+
+	data = newData
+	teamETag, teamLastModified = response.Header.Get("ETag"), response.Header.Get("Last-Modified")
+	for pubkey, names := range data.Names {
+		slog.Debug("Team member", "pubkey", pubkey, "names", names)
+	}
+
+	slog.Info("Updated NostrData from .well-known file", "members", len(data.Names))
+	return nil
+}
+
+// normalizeNostrData converts npub values in names to hex, dropping entries
+// that are not pubkeys at all, so a hand-edited nostr.json doesn't silently
+// lock members out.
+func normalizeNostrData(d *NostrData) {
+	for name, value := range d.Names {
+		pubkey := normalizePubkey(value)
+		if !nostr.IsValidPublicKey(pubkey) {
+			slog.Warn("Team data: ignoring invalid pubkey in nostr.json", "name", name, "value", value)
+			delete(d.Names, name)
+			continue
+		}
+		d.Names[name] = pubkey
+	}
+}
+
+// refreshTeamData fetches nostr.json once and records the outcome.
+func refreshTeamData() TeamDataStatus {
+	teamRefreshMu.Lock()
+	defer teamRefreshMu.Unlock()
+
+	err := fetchNostrData(config.TeamDomain)
+	now := time.Now()
+
+	teamStatusMu.Lock()
+	defer teamStatusMu.Unlock()
+	teamStatus.Domain = config.TeamDomain
+	teamStatus.LastAttempt = now.Unix()
+	if err != nil {
+		teamStatus.LastError = err.Error()
+		slog.Error("Team data: refresh failed, keeping the last good list", "domain", config.TeamDomain, "members", len(data.Names), "err", err)
+	} else {
+		teamStatus.LastError = ""
+		teamStatus.UpdatedAt = now.Unix()
+		cached := cachedTeamData{Data: data, FetchedAt: now.Unix(), ETag: teamETag, LastModified: teamLastModified}
+		if err := saveState(context.Background(), teamDataStateKey, cached); err != nil {
+			slog.Error("Team data: failed to cache membership list", "err", err)
+		}
+	}
+	teamStatus.Members = len(data.Names)
+	teamStatus.Stale = now.Sub(time.Unix(teamStatus.UpdatedAt, 0)) > 3*teamRefreshInterval()
+	if err != nil && teamStatus.Stale {
+		since := "never fetched"
+		if teamStatus.UpdatedAt > 0 {
+			since = time.Unix(teamStatus.UpdatedAt, 0).UTC().Format(time.RFC3339)
+		}
+		slog.Warn("Team data: membership list is stale", "domain", config.TeamDomain, "last_success", since)
+	}
+	return teamStatus
+}
+
+// loadCachedTeamData restores the last good list from the relay state.
+func loadCachedTeamData() {
+	var cached cachedTeamData
+	ok, err := loadState(context.Background(), teamDataStateKey, &cached)
+	if err != nil {
+		slog.Error("Team data: failed to load cached membership list", "err", err)
+		return
+	}
+	if !ok {
+		return
+	}
+	data = cached.Data
+	normalizeNostrData(&data)
+	teamETag, teamLastModified = cached.ETag, cached.LastModified
+	teamStatusMu.Lock()
+	teamStatus.UpdatedAt = cached.FetchedAt
+	teamStatus.Members = len(data.Names)
+	teamStatusMu.Unlock()
+	slog.Info("Team data: restored cached membership list", "members", len(data.Names),
+		"fetched_at", time.Unix(cached.FetchedAt, 0).UTC().Format(time.RFC3339))
+}
+
+// runTeamRefresh refreshes on the configured interval, backing off from
+// teamRetryMin up to the interval while fetches fail.
+func runTeamRefresh(status TeamDataStatus) {
+	retry := teamRetryMin
+	for {
+		wait := teamRefreshInterval()
+		if status.LastError != "" {
+			wait = min(retry, wait)
+			retry *= 2
+		} else {
+			retry = teamRetryMin
+		}
+		time.Sleep(wait)
+		status = refreshTeamData()
+	}
+}
+
+// setupTeamRefresh fetches the team list and serves the admin API:
+//
+//	GET  /admin/team           refresh status
+//	POST /admin/team/refresh   refresh now
+func setupTeamRefresh(relay *khatru.Relay) {
+	if config.TeamDomain == "" {
+		slog.Info("TEAM_DOMAIN not set; skipping Nostr data fetch")
+		return
+	}
+	loadCachedTeamData()
+	go runTeamRefresh(refreshTeamData())
+
+	relay.Router().HandleFunc("/admin/team", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		teamStatusMu.RLock()
+		status := teamStatus
+		teamStatusMu.RUnlock()
+		status.Stale = time.Since(time.Unix(status.UpdatedAt, 0)) > 3*teamRefreshInterval()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	}))
+
+	relay.Router().HandleFunc("/admin/team/refresh", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		status := refreshTeamData()
+		logger(r.Context()).Info("Team data: refresh requested by admin", "members", status.Members, "err", status.LastError)
+		w.Header().Set("Content-Type", "application/json")
+		if status.LastError != "" {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+		json.NewEncoder(w).Encode(status)
+	}))
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Team membership from a Nostr list: an admin publishes a follow set (kind
+// 30000 with a d tag) or their contact list (kind 3), and every pubkey in its
+// newest version is a team member. The list is read from the relay's own
+// store, so admins can simply publish it here, and can also be followed on
+// TEAM_LIST_RELAYS.
+
+var (
+	teamListMu      sync.RWMutex
+	teamListEvent   *nostr.Event    // newest list applied
+	teamListMembers map[string]bool // pubkeys in teamListEvent
+)
+
+// parseTeamList parses TEAM_LIST: "3" for the contact list or "30000:<d>" for
+// a follow set. Empty disables the list.
+func parseTeamList(s string) (int, string, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, "", nil
+	}
+	kindStr, d, _ := strings.Cut(s, ":")
+	kind, err := strconv.Atoi(kindStr)
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid TEAM_LIST %q", s)
+	}
+	switch {
+	case kind == nostr.KindFollowList && d == "":
+		return kind, "", nil
+	case kind == nostr.KindCategorizedPeopleList && d != "":
+		return kind, d, nil
+	}
+	return 0, "", fmt.Errorf("invalid TEAM_LIST %q, expected 3 or 30000:<d-tag>", s)
+}
+
+// teamListFilter matches the configured list published by any admin.
+func teamListFilter() nostr.Filter {
+	filter := nostr.Filter{Kinds: []int{config.TeamListKind}, Authors: config.AdminPubkeys}
+	if config.TeamListD != "" {
+		filter.Tags = nostr.TagMap{"d": []string{config.TeamListD}}
+	}
+	return filter
+}
+
+// isTeamListEvent reports whether evt is a version of the configured list.
+// Admins may publish it even when they are not members themselves.
+func isTeamListEvent(evt *nostr.Event) bool {
+	if config.TeamListKind == 0 || evt.Kind != config.TeamListKind || !isAdmin(evt.PubKey) {
+		return false
+	}
+	return config.TeamListD == "" || evt.Tags.GetD() == config.TeamListD
+}
+
+func isListedMember(pubkey string) bool {
+	teamListMu.RLock()
+	defer teamListMu.RUnlock()
+	return teamListMembers[pubkey]
+}
+
+func listedMembers() []string {
+	teamListMu.RLock()
+	defer teamListMu.RUnlock()
+	pubkeys := make([]string, 0, len(teamListMembers))
+	for pk := range teamListMembers {
+		pubkeys = append(pubkeys, pk)
+	}
+	return pubkeys
+}
+
+// applyTeamList replaces the listed members when evt is a newer version of
+// the list, running the cleanup policy for pubkeys that were dropped.
+func applyTeamList(evt *nostr.Event) {
+	if !isTeamListEvent(evt) {
+		return
+	}
+
+	members := map[string]bool{}
+	for _, tag := range evt.Tags {
+		if len(tag) >= 2 && tag[0] == "p" && nostr.IsValidPublicKey(tag[1]) {
+			members[tag[1]] = true
+		}
+	}
+
+	teamListMu.Lock()
+	if teamListEvent != nil && evt.CreatedAt <= teamListEvent.CreatedAt {
+		teamListMu.Unlock()
+		return
+	}
+	previous := teamListMembers
+	teamListEvent = evt
+	teamListMembers = members
+	teamListMu.Unlock()
+
+	var removed []string
+	for pk := range previous {
+		if !members[pk] && !containsValue(data.Names, pk) {
+			removed = append(removed, pk)
+		}
+	}
+	for pk := range members {
+		if !previous[pk] {
+			onMemberRestored(pk)
+		}
+	}
+	onMembersRemoved(removed, "team_list")
+
+	slog.Info("Team list: updated", "members", len(members), "pubkey", evt.PubKey,
+		"kind", evt.Kind, "created", evt.CreatedAt.Time().Format(time.RFC3339))
+}
+
+// followTeamList keeps a subscription to the list on TEAM_LIST_RELAYS and
+// imports new versions through the normal event pipeline.
+func followTeamList(relay *khatru.Relay) {
+	pool := nostr.NewSimplePool(context.Background())
+	for {
+		ctx, cancel := context.WithCancel(context.Background())
+		for ie := range pool.SubMany(ctx, config.TeamListRelays, nostr.Filters{teamListFilter()}) {
+			if ie.Event == nil || !isTeamListEvent(ie.Event) {
+				continue
+			}
+			if skipBroadcast, err := relay.AddEvent(ctx, ie.Event); err == nil && !skipBroadcast {
+				relay.BroadcastEvent(ie.Event)
+			}
+		}
+		cancel()
+		time.Sleep(time.Minute)
+	}
+}
+
+// setupTeamList loads the newest stored list and applies every newer version
+// the relay stores afterwards.
+func setupTeamList(relay *khatru.Relay) {
+	if len(config.AdminPubkeys) == 0 {
+		fatal("Configuration error: TEAM_LIST needs ADMIN_PUBKEYS or RELAY_PUBKEY")
+	}
+
+	ch, err := db.QueryEvents(context.Background(), teamListFilter())
+	if err != nil {
+		slog.Error("Team list: failed to load stored list", "err", err)
+	} else {
+		for evt := range ch {
+			applyTeamList(evt)
+		}
+	}
+
+	relay.OnEventSaved = append(relay.OnEventSaved, func(ctx context.Context, evt *nostr.Event) {
+		applyTeamList(evt)
+	})
+
+	if len(config.TeamListRelays) > 0 {
+		go followTeamList(relay)
+	}
+
+	slog.Info("Team list: ENABLED", "kind", config.TeamListKind, "d", config.TeamListD, "members", len(listedMembers()))
+}
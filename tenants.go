@@ -0,0 +1,476 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// Multi-tenant hosting: `higher host --tenants tenants.conf` serves several
+// independent team relays behind one port. The tenants file has one block per
+// team, a [name] header followed by that team's usual settings (RELAY_MNEMONIC,
+// TEAM_DOMAIN, DB_PATH or POSTGRES_DB, BLOSSOM_PATH, BLOSSOM_URL, ...) and
+// how to reach it:
+//
+//	TENANT_HOSTS        comma-separated Host names routed to the team
+//	TENANT_PATH_PREFIX  path prefix routed to the team, stripped before it
+//
+// The relay keeps its state in process-wide globals (config, database, key
+// registry), so each team runs as a child process of the same binary, in its
+// own directory under --data-dir and listening only on a unix socket there.
+// The host routes requests, websockets included, to the team's socket and
+// restarts a team that exits. No setting is inherited from a .env file or
+// the host's environment, beyond what any process needs (tenantEnvAllowlist),
+// and each team must name its own seed and storage, so teams can't share a
+// seed or a database by accident.
+
+const (
+	tenantHostsKey      = "TENANT_HOSTS"
+	tenantPathPrefixKey = "TENANT_PATH_PREFIX"
+	tenantRestartMax    = time.Minute
+)
+
+var tenantNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// tenantEnvAllowlist is what a team's relay inherits from the host's
+// environment; LC_* variables pass too.
+var tenantEnvAllowlist = map[string]bool{
+	"PATH": true, "HOME": true, "USER": true, "TZ": true, "LANG": true, "TMPDIR": true,
+	"SSL_CERT_FILE": true, "SSL_CERT_DIR": true,
+}
+
+// tenantSeedKeys are the settings one of which gives a team its seed.
+var tenantSeedKeys = []string{"RELAY_MNEMONIC", "RELAY_SEED_HEX", "RELAY_XPUB"}
+
+// tenant is one team relay run by the host.
+type tenant struct {
+	Name       string
+	Hosts      []string
+	PathPrefix string
+	Env        map[string]string // the team's settings
+	dir        string
+	socket     string
+	proxy      *httputil.ReverseProxy
+
+	mu       sync.Mutex
+	cmd      *exec.Cmd
+	stopping bool
+}
+
+// parseTenants reads the blocks of a tenants file.
+func parseTenants(content []byte) ([]*tenant, error) {
+	var tenants []*tenant
+	var block bytes.Buffer
+	flush := func() error {
+		env, err := godotenv.UnmarshalBytes(block.Bytes())
+		block.Reset()
+		if len(tenants) == 0 {
+			if err != nil || len(env) > 0 {
+				return fmt.Errorf("settings before the first [name] block")
+			}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("tenant %s: %w", tenants[len(tenants)-1].Name, err)
+		}
+		tenants[len(tenants)-1].Env = env
+		return nil
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]") {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			tenants = append(tenants, &tenant{Name: strings.TrimSpace(trimmed[1 : len(trimmed)-1])})
+			continue
+		}
+		block.WriteString(line + "\n")
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	if len(tenants) == 0 {
+		return nil, fmt.Errorf("no tenants defined")
+	}
+
+	names := map[string]bool{}
+	hosts := map[string]string{}
+	prefixes := map[string]string{}
+	seeds := map[string]string{}
+	stores := map[string]string{}
+	for _, t := range tenants {
+		if !tenantNamePattern.MatchString(t.Name) {
+			return nil, fmt.Errorf("invalid tenant name %q, use lowercase letters, digits, - and _", t.Name)
+		}
+		if names[t.Name] {
+			return nil, fmt.Errorf("tenant %s is defined twice", t.Name)
+		}
+		names[t.Name] = true
+
+		hostList := t.Env[tenantHostsKey]
+		for _, host := range parseList(&hostList) {
+			host = strings.ToLower(host)
+			if other, taken := hosts[host]; taken {
+				return nil, fmt.Errorf("host %s is routed to both %s and %s", host, other, t.Name)
+			}
+			hosts[host] = t.Name
+			t.Hosts = append(t.Hosts, host)
+		}
+		if prefix := strings.TrimSuffix(strings.TrimSpace(t.Env[tenantPathPrefixKey]), "/"); prefix != "" {
+			if !strings.HasPrefix(prefix, "/") {
+				return nil, fmt.Errorf("tenant %s: %s must start with /", t.Name, tenantPathPrefixKey)
+			}
+			if other, taken := prefixes[prefix]; taken {
+				return nil, fmt.Errorf("path prefix %s is routed to both %s and %s", prefix, other, t.Name)
+			}
+			prefixes[prefix] = t.Name
+			t.PathPrefix = prefix
+		}
+		if len(t.Hosts) == 0 && t.PathPrefix == "" {
+			return nil, fmt.Errorf("tenant %s needs %s or %s", t.Name, tenantHostsKey, tenantPathPrefixKey)
+		}
+		delete(t.Env, tenantHostsKey)
+		delete(t.Env, tenantPathPrefixKey)
+
+		seed := ""
+		for _, key := range tenantSeedKeys {
+			if value := strings.TrimSpace(t.Env[key]); value != "" {
+				seed = value
+			}
+		}
+		if seed == "" {
+			return nil, fmt.Errorf("tenant %s needs its own %s", t.Name, strings.Join(tenantSeedKeys, ", "))
+		}
+		if other, taken := seeds[seed]; taken {
+			return nil, fmt.Errorf("tenants %s and %s have the same seed", other, t.Name)
+		}
+		seeds[seed] = t.Name
+
+		store, err := tenantStore(t)
+		if err != nil {
+			return nil, err
+		}
+		if store != "" {
+			if other, taken := stores[store]; taken {
+				return nil, fmt.Errorf("tenants %s and %s use the same database %s", other, t.Name, store)
+			}
+			stores[store] = t.Name
+		}
+	}
+	return tenants, nil
+}
+
+// tenantStore checks that t names its own storage, returning what identifies
+// it across tenants: the postgres database, or DB_PATH when it is absolute
+// (relative paths are under the tenant's own directory).
+func tenantStore(t *tenant) (string, error) {
+	if strings.EqualFold(strings.TrimSpace(t.Env["DB_ENGINE"]), "postgres") {
+		if dsn := strings.TrimSpace(t.Env["POSTGRES_URL"]); dsn != "" {
+			return dsn, nil
+		}
+		name := strings.TrimSpace(t.Env["POSTGRES_DB"])
+		if name == "" {
+			return "", fmt.Errorf("tenant %s needs its own POSTGRES_DB or POSTGRES_URL", t.Name)
+		}
+		return t.Env["POSTGRES_HOST"] + ":" + t.Env["POSTGRES_PORT"] + "/" + name, nil
+	}
+	path := strings.TrimSpace(t.Env["DB_PATH"])
+	if path == "" {
+		return "", fmt.Errorf("tenant %s needs its own DB_PATH", t.Name)
+	}
+	if !filepath.IsAbs(path) {
+		return "", nil
+	}
+	return filepath.Clean(path), nil
+}
+
+// routeTenant picks the tenant for r: by Host first, then by the longest
+// matching path prefix.
+func routeTenant(tenants []*tenant, r *http.Request) *tenant {
+	host := requestHostname(r)
+	for _, t := range tenants {
+		for _, h := range t.Hosts {
+			if h == host {
+				return t
+			}
+		}
+	}
+
+	var best *tenant
+	for _, t := range tenants {
+		if t.PathPrefix == "" {
+			continue
+		}
+		if r.URL.Path != t.PathPrefix && !strings.HasPrefix(r.URL.Path, t.PathPrefix+"/") {
+			continue
+		}
+		if best == nil || len(t.PathPrefix) > len(best.PathPrefix) {
+			best = t
+		}
+	}
+	return best
+}
+
+// prepare creates the tenant's directory and its reverse proxy to the socket.
+func (t *tenant) prepare(dataDir string) error {
+	t.dir = filepath.Join(dataDir, t.Name)
+	if err := os.MkdirAll(t.dir, 0750); err != nil {
+		return err
+	}
+	t.socket = filepath.Join(t.dir, "relay.sock")
+
+	target := &url.URL{Scheme: "http", Host: t.Name}
+	t.proxy = &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			if t.PathPrefix != "" && routedByPrefix(t, r.In) {
+				r.Out.URL.Path = strings.TrimPrefix(r.Out.URL.Path, t.PathPrefix)
+				r.Out.URL.RawPath = ""
+				if r.Out.URL.Path == "" {
+					r.Out.URL.Path = "/"
+				}
+			}
+			r.SetURL(target)
+			r.Out.Host = r.In.Host
+			r.SetXForwarded()
+			// what a trusted proxy in front of the host reported
+			if proto := r.In.Header.Get("X-Forwarded-Proto"); proto != "" {
+				r.Out.Header.Set("X-Forwarded-Proto", proto)
+			}
+			if host := r.In.Header.Get("X-Forwarded-Host"); host != "" {
+				r.Out.Header.Set("X-Forwarded-Host", host)
+			}
+		},
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", t.socket)
+			},
+			MaxIdleConnsPerHost: 32,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			slog.Warn("Tenant unreachable", "tenant", t.Name, "path", r.URL.Path, "err", err)
+			http.Error(w, "Relay unavailable", http.StatusBadGateway)
+		},
+	}
+	return nil
+}
+
+// requestHostname returns the Host of r, lowercased and without a port.
+func requestHostname(r *http.Request) string {
+	host := strings.ToLower(r.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return host
+}
+
+// routedByPrefix tells whether r reached t through its path prefix rather
+// than one of its hosts.
+func routedByPrefix(t *tenant, r *http.Request) bool {
+	host := requestHostname(r)
+	for _, h := range t.Hosts {
+		if h == host {
+			return false
+		}
+	}
+	return true
+}
+
+// environ returns the environment of the tenant's relay: the allowlisted
+// part of the host's own plus the tenant's settings.
+func (t *tenant) environ() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		key, _, _ := strings.Cut(kv, "=")
+		if !tenantEnvAllowlist[key] && !strings.HasPrefix(key, "LC_") {
+			continue
+		}
+		if _, overridden := t.Env[key]; overridden {
+			continue
+		}
+		env = append(env, kv)
+	}
+	for key, value := range t.Env {
+		env = append(env, key+"="+value)
+	}
+	if _, ok := t.Env["PUBLIC_DIR"]; !ok {
+		// the tenant runs in its own directory
+		if wd, err := os.Getwd(); err == nil {
+			env = append(env, "PUBLIC_DIR="+filepath.Join(wd, "public"))
+		}
+	}
+	return append(env, "LISTEN_SOCKET="+t.socket, "LISTEN_SOCKET_ONLY=true")
+}
+
+// supervise runs the tenant's relay until stop, restarting it when it exits.
+func (t *tenant) supervise(exe string, wg *sync.WaitGroup) {
+	defer wg.Done()
+	backoff := time.Second
+	for {
+		cmd := exec.Command(exe, "serve", "--env-file", os.DevNull)
+		cmd.Dir = t.dir
+		cmd.Env = t.environ()
+		cmd.Stdout = &tenantLog{name: t.Name, out: os.Stdout}
+		cmd.Stderr = &tenantLog{name: t.Name, out: os.Stderr}
+
+		t.mu.Lock()
+		if t.stopping {
+			t.mu.Unlock()
+			return
+		}
+		err := cmd.Start()
+		if err == nil {
+			t.cmd = cmd
+		}
+		t.mu.Unlock()
+
+		started := time.Now()
+		if err == nil {
+			slog.Info("Tenant started", "tenant", t.Name, "pid", cmd.Process.Pid, "socket", t.socket)
+			err = cmd.Wait()
+		}
+
+		t.mu.Lock()
+		t.cmd = nil
+		stopping := t.stopping
+		t.mu.Unlock()
+		if stopping {
+			slog.Info("Tenant stopped", "tenant", t.Name)
+			return
+		}
+
+		if time.Since(started) > tenantRestartMax {
+			backoff = time.Second
+		}
+		slog.Error("Tenant exited, restarting", "tenant", t.Name, "err", err, "in", backoff)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, tenantRestartMax)
+	}
+}
+
+// stop asks the tenant's relay to shut down gracefully.
+func (t *tenant) stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stopping = true
+	if t.cmd != nil {
+		t.cmd.Process.Signal(syscall.SIGTERM)
+	}
+}
+
+// tenantLog prefixes each line a tenant's relay writes with its name.
+type tenantLog struct {
+	name    string
+	out     io.Writer
+	mu      sync.Mutex
+	pending []byte
+}
+
+func (l *tenantLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.pending = append(l.pending, p...)
+	for {
+		i := bytes.IndexByte(l.pending, '\n')
+		if i < 0 {
+			break
+		}
+		fmt.Fprintf(l.out, "[%s] %s\n", l.name, l.pending[:i])
+		l.pending = l.pending[i+1:]
+	}
+	return len(p), nil
+}
+
+// runHost serves the tenants of a tenants file, the host command.
+func runHost(args []string) {
+	set := newFlagSet("host", "host --tenants FILE [--listen ADDR] [--data-dir DIR]")
+	tenantsFile := set.String("tenants", "tenants.conf", "tenants file, one [name] block of settings per team")
+	listen := set.String("listen", ":3334", "address to serve all tenants on")
+	dataDir := set.String("data-dir", "tenants", "directory holding one working directory per tenant")
+	trusted := set.String("trusted-proxies", "127.0.0.1,::1", "reverse proxies whose forwarding headers are trusted")
+	set.Parse(args)
+
+	log.SetOutput(os.Stderr)
+	content, err := os.ReadFile(*tenantsFile)
+	if err != nil {
+		log.Fatalf("Failed to read tenants file: %v", err)
+	}
+	tenants, err := parseTenants(content)
+	if err != nil {
+		log.Fatalf("Invalid tenants file %s: %v", *tenantsFile, err)
+	}
+	root, err := filepath.Abs(*dataDir)
+	if err != nil {
+		log.Fatalf("Invalid --data-dir: %v", err)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		log.Fatalf("Failed to locate the relay binary: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for _, t := range tenants {
+		if err := t.prepare(root); err != nil {
+			log.Fatalf("Failed to prepare tenant %s: %v", t.Name, err)
+		}
+		wg.Add(1)
+		go t.supervise(exe, &wg)
+	}
+
+	config.TrustedProxies = parseList(trusted)
+	handler := trustProxies(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t := routeTenant(tenants, r)
+		if t == nil {
+			http.Error(w, "Unknown relay", http.StatusNotFound)
+			return
+		}
+		t.proxy.ServeHTTP(w, r)
+	}))
+	server := newHTTPServer(*listen, handler)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.ListenAndServe()
+	}()
+	slog.Info("Hosting tenants", "addr", *listen, "tenants", len(tenants), "data_dir", root)
+	sdNotify("READY=1")
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-errs:
+		slog.Error("Listener stopped", "err", err)
+	case sig := <-signals:
+		slog.Info("Shutting down tenants", "signal", sig.String())
+	}
+	sdNotify("STOPPING=1")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	server.Shutdown(ctx)
+	for _, t := range tenants {
+		t.stop()
+	}
+	wg.Wait()
+	slog.Info("Shutdown complete")
+}
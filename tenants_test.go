@@ -0,0 +1,170 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseTenants(t *testing.T) {
+	tenants, err := parseTenants([]byte(`
+[alpha]
+TENANT_HOSTS=alpha.example.com, Relay.Alpha.org
+RELAY_MNEMONIC=alpha words
+DB_PATH=db/
+
+[beta]
+TENANT_PATH_PREFIX=/beta/
+RELAY_SEED_HEX=beef
+DB_ENGINE=postgres
+POSTGRES_DB=beta
+`))
+	if err != nil {
+		t.Fatalf("parseTenants: %v", err)
+	}
+	if len(tenants) != 2 {
+		t.Fatalf("got %d tenants, want 2", len(tenants))
+	}
+	alpha, beta := tenants[0], tenants[1]
+	if alpha.Name != "alpha" || strings.Join(alpha.Hosts, " ") != "alpha.example.com relay.alpha.org" {
+		t.Errorf("alpha = %s %v", alpha.Name, alpha.Hosts)
+	}
+	if beta.Name != "beta" || beta.PathPrefix != "/beta" {
+		t.Errorf("beta = %s %q", beta.Name, beta.PathPrefix)
+	}
+	if _, ok := alpha.Env[tenantHostsKey]; ok {
+		t.Errorf("routing settings left in the tenant environment")
+	}
+	if beta.Env["POSTGRES_DB"] != "beta" {
+		t.Errorf("beta POSTGRES_DB = %q", beta.Env["POSTGRES_DB"])
+	}
+}
+
+func TestParseTenantsErrors(t *testing.T) {
+	cases := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{
+			name: "duplicate host",
+			content: `
+[alpha]
+TENANT_HOSTS=relay.example.com
+RELAY_MNEMONIC=alpha words
+DB_PATH=db/
+[beta]
+TENANT_HOSTS=other.example.com,RELAY.example.com
+RELAY_MNEMONIC=beta words
+DB_PATH=db/
+`,
+			want: "host relay.example.com is routed to both alpha and beta",
+		},
+		{
+			name: "duplicate prefix",
+			content: `
+[alpha]
+TENANT_PATH_PREFIX=/team
+RELAY_MNEMONIC=alpha words
+DB_PATH=db/
+[beta]
+TENANT_PATH_PREFIX=/team/
+RELAY_MNEMONIC=beta words
+DB_PATH=db/
+`,
+			want: "path prefix /team is routed to both alpha and beta",
+		},
+		{
+			name: "duplicate name",
+			content: `
+[alpha]
+TENANT_HOSTS=a.example.com
+RELAY_MNEMONIC=alpha words
+DB_PATH=db/
+[alpha]
+TENANT_HOSTS=b.example.com
+RELAY_MNEMONIC=beta words
+DB_PATH=db/
+`,
+			want: "tenant alpha is defined twice",
+		},
+		{
+			name:    "no route",
+			content: "[alpha]\nRELAY_MNEMONIC=alpha words\nDB_PATH=db/\n",
+			want:    "tenant alpha needs TENANT_HOSTS or TENANT_PATH_PREFIX",
+		},
+		{
+			name:    "relative prefix",
+			content: "[alpha]\nTENANT_PATH_PREFIX=team\nRELAY_MNEMONIC=alpha words\nDB_PATH=db/\n",
+			want:    "TENANT_PATH_PREFIX must start with /",
+		},
+		{
+			name:    "no seed",
+			content: "[alpha]\nTENANT_HOSTS=a.example.com\nDB_PATH=db/\n",
+			want:    "tenant alpha needs its own RELAY_MNEMONIC",
+		},
+		{
+			name: "shared seed",
+			content: `
+[alpha]
+TENANT_HOSTS=a.example.com
+RELAY_MNEMONIC=same words
+DB_PATH=db/
+[beta]
+TENANT_HOSTS=b.example.com
+RELAY_MNEMONIC=same words
+DB_PATH=db/
+`,
+			want: "tenants alpha and beta have the same seed",
+		},
+		{
+			name:    "no storage",
+			content: "[alpha]\nTENANT_HOSTS=a.example.com\nRELAY_MNEMONIC=alpha words\n",
+			want:    "tenant alpha needs its own DB_PATH",
+		},
+		{
+			name:    "no postgres database",
+			content: "[alpha]\nTENANT_HOSTS=a.example.com\nRELAY_MNEMONIC=alpha words\nDB_ENGINE=postgres\n",
+			want:    "tenant alpha needs its own POSTGRES_DB or POSTGRES_URL",
+		},
+		{
+			name: "shared database",
+			content: `
+[alpha]
+TENANT_HOSTS=a.example.com
+RELAY_MNEMONIC=alpha words
+DB_PATH=/srv/relay/db
+[beta]
+TENANT_HOSTS=b.example.com
+RELAY_MNEMONIC=beta words
+DB_PATH=/srv/relay/db/
+`,
+			want: "tenants alpha and beta use the same database /srv/relay/db",
+		},
+		{
+			name:    "settings outside a block",
+			content: "RELAY_NAME=stray\n[alpha]\nTENANT_HOSTS=a.example.com\n",
+			want:    "settings before the first [name] block",
+		},
+		{
+			name:    "bad name",
+			content: "[Alpha Team]\nTENANT_HOSTS=a.example.com\n",
+			want:    `invalid tenant name "Alpha Team"`,
+		},
+		{
+			name:    "empty",
+			content: "# nothing here\n",
+			want:    "no tenants defined",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parseTenants([]byte(tc.content))
+			if err == nil {
+				t.Fatalf("parseTenants succeeded, want error %q", tc.want)
+			}
+			if !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("parseTenants error = %q, want %q", err, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,220 @@
+package tests
+
+import (
+	"encoding/hex"
+	"sync"
+	"testing"
+
+	"github.com/bitkarrot/higher/keyderivation"
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/tyler-smith/go-bip39"
+)
+
+// NIP-06 test vector
+const nip06Mnemonic = "leader monkey parrot ring guide accident before fence cannon height naive bean"
+const nip06PrivateKey = "7f7ff03d123792d6ac594bfa67bf6d0c0ab55b6b1fdb6249303fe861f1ccba9a"
+
+const h = hdkeychain.HardenedKeyStart
+
+// pathKey derives the pubkey at path independently of the deriver.
+func pathKey(t *testing.T, mnemonic string, path ...uint32) string {
+	t.Helper()
+	key, err := hdkeychain.NewMaster(bip39.NewSeed(mnemonic, ""), &chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, child := range path {
+		if key, err = key.Derive(child); err != nil {
+			t.Fatal(err)
+		}
+	}
+	priv, err := key.ECPrivKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, _ := nostr.GetPublicKey(hex.EncodeToString(priv.Serialize()))
+	return pub
+}
+
+func TestDerivation_NIP06Scheme(t *testing.T) {
+	der, err := keyderivation.NewNostrKeyDeriver(nip06Mnemonic)
+	if err != nil {
+		t.Fatalf("failed to create deriver: %v", err)
+	}
+	der.SetScheme(keyderivation.SchemeNIP06)
+
+	kp, err := der.DeriveKeyBIP32(0)
+	if err != nil {
+		t.Fatalf("derive 0: %v", err)
+	}
+	if kp.PrivateKey != nip06PrivateKey {
+		t.Fatalf("account 0 key = %s, want NIP-06 vector %s", kp.PrivateKey, nip06PrivateKey)
+	}
+
+	// what a NIP-06 wallet derives for account 3
+	walletKey := pathKey(t, nip06Mnemonic, h+44, h+1237, h+3, 0, 0)
+	found, index, err := der.CheckKeyBelongsToMaster(walletKey, 10, true)
+	if err != nil || !found || index != 3 {
+		t.Fatalf("wallet account 3 key: found=%v index=%d err=%v", found, index, err)
+	}
+
+	// the default scheme varies the address index instead
+	der.SetScheme(keyderivation.SchemeIndex)
+	if found, _, _ := der.CheckKeyBelongsToMaster(walletKey, 10, true); found {
+		t.Fatalf("account 3 key should not match the index scheme")
+	}
+}
+
+func TestDerivation_PathTemplate(t *testing.T) {
+	der, err := keyderivation.NewNostrKeyDeriver(nip06Mnemonic)
+	if err != nil {
+		t.Fatalf("failed to create deriver: %v", err)
+	}
+	scheme, err := keyderivation.ParseDerivationScheme("m/44'/1237'/7'/0/{index}")
+	if err != nil {
+		t.Fatalf("parse template: %v", err)
+	}
+	der.SetScheme(scheme)
+
+	kp, err := der.DeriveKeyBIP32(2)
+	if err != nil {
+		t.Fatalf("derive 2: %v", err)
+	}
+	if want := pathKey(t, nip06Mnemonic, h+44, h+1237, h+7, 0, 2); kp.PublicKey != want {
+		t.Fatalf("template key = %s, want %s", kp.PublicKey, want)
+	}
+
+	for _, bad := range []string{"m/44'/1237'/0'/0/0", "m/44'/{index}/{index}", "m/44'/x/{index}", "m/2147483648/{index}"} {
+		if _, err := keyderivation.ParseDerivationScheme(bad); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestDerivation_Passphrase(t *testing.T) {
+	// BIP39 test vector: "abandon ... about" with passphrase "TREZOR"
+	mnemonic := "abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about"
+	seed, _ := hex.DecodeString("c55257c360c07c72029aebc1b53c05ed0362ada38ead3e3e9efa3708e53495531f09a6987599d18264c1e1c92f2cf141630c7a3c4ab7c81b2f001698e7463b04")
+
+	withPassphrase, err := keyderivation.NewNostrKeyDeriverWithPassphrase(mnemonic, "TREZOR")
+	if err != nil {
+		t.Fatalf("failed to create deriver: %v", err)
+	}
+	fromSeed, err := keyderivation.NewNostrKeyDeriverFromSeed(seed)
+	if err != nil {
+		t.Fatalf("failed to create deriver from seed: %v", err)
+	}
+	withoutPassphrase, err := keyderivation.NewNostrKeyDeriver(mnemonic)
+	if err != nil {
+		t.Fatalf("failed to create deriver: %v", err)
+	}
+
+	a, _ := withPassphrase.DeriveKeyBIP32(0)
+	b, _ := fromSeed.DeriveKeyBIP32(0)
+	c, _ := withoutPassphrase.DeriveKeyBIP32(0)
+	if a.PublicKey != b.PublicKey {
+		t.Fatalf("passphrase key %s does not match the vector seed's %s", a.PublicKey, b.PublicKey)
+	}
+	if a.PublicKey == c.PublicKey {
+		t.Fatalf("passphrase must change the key tree")
+	}
+}
+
+func TestDerivation_WatchOnly(t *testing.T) {
+	full, err := keyderivation.NewNostrKeyDeriver(nip06Mnemonic)
+	if err != nil {
+		t.Fatalf("failed to create deriver: %v", err)
+	}
+	xpub, err := full.AccountXPub()
+	if err != nil {
+		t.Fatalf("export xpub: %v", err)
+	}
+	watch, err := keyderivation.NewNostrKeyDeriverFromXPub(xpub)
+	if err != nil {
+		t.Fatalf("failed to create watch-only deriver: %v", err)
+	}
+	if !watch.IsWatchOnly() {
+		t.Fatalf("deriver from xpub should be watch-only")
+	}
+
+	kp, _ := full.DeriveKeyBIP32(4)
+	pub, err := watch.DerivePublicKey(4)
+	if err != nil || pub != kp.PublicKey {
+		t.Fatalf("watch-only key = %s (%v), want %s", pub, err, kp.PublicKey)
+	}
+	found, index, err := watch.CheckKeyBelongsToMaster(kp.PublicKey, 10, true)
+	if err != nil || !found || index != 4 {
+		t.Fatalf("check: found=%v index=%d err=%v", found, index, err)
+	}
+	if _, err := watch.DeriveKeyBIP32(4); err != keyderivation.ErrWatchOnly {
+		t.Fatalf("DeriveKeyBIP32 err = %v, want ErrWatchOnly", err)
+	}
+
+	// NIP-06 hardens the index, which an xpub cannot derive
+	watch.SetScheme(keyderivation.SchemeNIP06)
+	if _, err := watch.DerivePublicKey(0); err == nil {
+		t.Fatalf("expected the nip06 scheme to fail on an xpub")
+	}
+	if _, err := keyderivation.NewNostrKeyDeriverFromXPub("xprv9s21ZrQH143K3QTDL4LXw2F7HEK3wJUD2nW2nRk4stbPy6cq3jPPqjiChkVvvNKmPGJxWUtg6LnF5kejMRNNU3TGtRBeJgk33yuGBxrMPHi"); err == nil {
+		t.Fatalf("expected an xprv to be rejected")
+	}
+}
+
+func TestDerivation_ConcurrentCache(t *testing.T) {
+	der, err := keyderivation.NewNostrKeyDeriver(nip06Mnemonic)
+	if err != nil {
+		t.Fatalf("failed to create deriver: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	got := make([]string, 20)
+	for i := range got {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			got[i], _ = der.DerivePublicKey(uint32(i % 5))
+		}(i)
+	}
+	wg.Wait()
+	for i, pub := range got {
+		if want := pathKey(t, nip06Mnemonic, h+44, h+1237, h+0, 0, uint32(i%5)); pub != want {
+			t.Fatalf("key %d = %s, want %s", i, pub, want)
+		}
+	}
+
+	// switching schemes must not serve keys cached for the old one
+	der.SetScheme(keyderivation.SchemeNIP06)
+	kp, _ := der.DeriveKeyBIP32(0)
+	if kp.PrivateKey != nip06PrivateKey {
+		t.Fatalf("key after scheme change = %s, want %s", kp.PrivateKey, nip06PrivateKey)
+	}
+}
+
+func TestDerivation_SignAndWipe(t *testing.T) {
+	der, err := keyderivation.NewNostrKeyDeriver(nip06Mnemonic)
+	if err != nil {
+		t.Fatalf("failed to create deriver: %v", err)
+	}
+	kp, _ := der.DeriveKeyBIP32(2)
+
+	evt := &nostr.Event{Kind: 1, Content: "hello", CreatedAt: nostr.Now(), Tags: nostr.Tags{}}
+	if err := der.SignEvent(2, evt); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	if ok, _ := evt.CheckSignature(); !ok || evt.PubKey != kp.PublicKey {
+		t.Fatalf("bad signature or pubkey %s, want %s", evt.PubKey, kp.PublicKey)
+	}
+
+	der.Wipe()
+	if _, err := der.DeriveKeyBIP32(2); err != keyderivation.ErrWiped {
+		t.Fatalf("DeriveKeyBIP32 after wipe: err = %v, want ErrWiped", err)
+	}
+	if err := der.SignEvent(2, evt); err != keyderivation.ErrWiped {
+		t.Fatalf("SignEvent after wipe: err = %v, want ErrWiped", err)
+	}
+	if der.GetMnemonic() != "" || der.DeriveSecret("x") != nil {
+		t.Fatalf("wiped deriver still exposes secrets")
+	}
+}
@@ -0,0 +1,60 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/bitkarrot/higher/keyderivation"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestKeyRegistry_ContainsAndExtend(t *testing.T) {
+	der, err := keyderivation.NewNostrKeyDeriver("")
+	if err != nil {
+		t.Fatalf("failed to create deriver: %v", err)
+	}
+
+	reg, err := keyderivation.NewKeyRegistry(der, 5)
+	if err != nil {
+		t.Fatalf("failed to create registry: %v", err)
+	}
+
+	for i := uint32(0); i <= 5; i++ {
+		kp, err := der.DeriveKeyBIP32(i)
+		if err != nil {
+			t.Fatalf("derive %d: %v", i, err)
+		}
+		if !reg.Contains(kp.PublicKey) {
+			t.Fatalf("expected derived key %d (hex) to be contained", i)
+		}
+		if !reg.Contains(kp.PublicKeyNIP) {
+			t.Fatalf("expected derived key %d (npub) to be contained", i)
+		}
+	}
+
+	randomPub, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	if reg.Contains(randomPub) {
+		t.Fatalf("random key must not be contained")
+	}
+
+	// index 8 is out of range until the max index is raised
+	kp8, err := der.DeriveKeyBIP32(8)
+	if err != nil {
+		t.Fatalf("derive 8: %v", err)
+	}
+	if reg.Contains(kp8.PublicKey) {
+		t.Fatalf("key at index 8 must not be contained with max index 5")
+	}
+	reg.SetMaxIndex(10)
+	if index, ok, err := reg.Lookup(kp8.PublicKey); err != nil || !ok || index != 8 {
+		t.Fatalf("expected key at index 8 after raising max index, got %d %v %v", index, ok, err)
+	}
+
+	// lowering the max index stops matching the keys above it
+	reg.SetMaxIndex(3)
+	if reg.Contains(kp8.PublicKey) {
+		t.Fatalf("key at index 8 must not be contained with max index 3")
+	}
+	if pubkeys, err := reg.Pubkeys(); err != nil || len(pubkeys) != 4 {
+		t.Fatalf("expected 4 pubkeys, got %d (%v)", len(pubkeys), err)
+	}
+}
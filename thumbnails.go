@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Thumbnails: every stored image gets downscaled variants, one per
+// THUMBNAIL_SIZES entry (the longest side in pixels), stored as blobs of their
+// own. The variants of a blob are recorded in an internal event, so they can
+// be listed in upload responses and NIP-94 "thumb" tags, and are kept by the
+// garbage collector as long as the original is.
+
+// Images larger than this are not decoded, to bound memory use.
+const maxThumbnailSourcePixels = 40_000_000
+
+// Thumbnail is a downscaled variant of a stored image.
+type Thumbnail struct {
+	SHA256 string `json:"sha256"`
+	URL    string `json:"url"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// parseThumbnailSizes reads a comma-separated list of pixel sizes.
+func parseThumbnailSizes(value *string) ([]int, error) {
+	var sizes []int
+	for _, item := range parseList(value) {
+		size, err := strconv.Atoi(item)
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("invalid THUMBNAIL_SIZES entry %q", item)
+		}
+		sizes = append(sizes, size)
+	}
+	sort.Ints(sizes)
+	return sizes, nil
+}
+
+// thumbnailsFor returns the recorded variants of a blob, smallest first.
+func thumbnailsFor(ctx context.Context, sha256 string) []Thumbnail {
+	events, err := queryInternalEvents(ctx, kindThumbnails, nostr.TagMap{"x": []string{sha256}})
+	if err != nil || len(events) == 0 {
+		return nil
+	}
+	var thumbs []Thumbnail
+	for _, tag := range events[0].Tags {
+		if len(tag) < 4 || tag[0] != "thumb" {
+			continue
+		}
+		t := Thumbnail{SHA256: tag[1], URL: tag[2]}
+		fmt.Sscanf(tag[3], "%dx%d", &t.Width, &t.Height)
+		thumbs = append(thumbs, t)
+	}
+	return thumbs
+}
+
+// thumbnailTags describes the variants of a blob as NIP-94 "thumb" tags.
+func thumbnailTags(ctx context.Context, sha256 string) nostr.Tags {
+	var tags nostr.Tags
+	for _, t := range thumbnailsFor(ctx, sha256) {
+		tags = append(tags, nostr.Tag{"thumb", t.URL, t.SHA256})
+	}
+	return tags
+}
+
+// resizeImage scales src so that its longest side is size pixels, averaging
+// the source pixels covered by each destination pixel.
+func resizeImage(src image.Image, size int) *image.RGBA {
+	b := src.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	dw, dh := size, sh*size/sw
+	if sh > sw {
+		dw, dh = sw*size/sh, size
+	}
+	dw, dh = max(dw, 1), max(dh, 1)
+
+	rgba := image.NewRGBA(image.Rect(0, 0, sw, sh))
+	draw.Draw(rgba, rgba.Bounds(), src, b.Min, draw.Src)
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := y*sh/dh, max((y+1)*sh/dh, y*sh/dh+1)
+		for x := 0; x < dw; x++ {
+			x0, x1 := x*sw/dw, max((x+1)*sw/dw, x*sw/dw+1)
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				row := rgba.Pix[sy*rgba.Stride+x0*4 : sy*rgba.Stride+x1*4]
+				for i := 0; i < len(row); i += 4 {
+					sum[0] += int(row[i])
+					sum[1] += int(row[i+1])
+					sum[2] += int(row[i+2])
+					sum[3] += int(row[i+3])
+				}
+			}
+			n := (x1 - x0) * (y1 - y0)
+			i := dst.PixOffset(x, y)
+			for c := 0; c < 4; c++ {
+				dst.Pix[i+c] = uint8(sum[c] / n)
+			}
+		}
+	}
+	return dst
+}
+
+// generateThumbnails stores the variants of the image read from body and
+// records them. Non-images and images already smaller than every size are
+// left alone.
+func generateThumbnails(ctx context.Context, bl *blossom.BlossomServer, sha256sum string, body io.ReadSeeker) error {
+	cfg, format, err := image.DecodeConfig(body)
+	if err != nil || cfg.Width*cfg.Height > maxThumbnailSourcePixels {
+		return nil
+	}
+	longest := max(cfg.Width, cfg.Height)
+	if longest <= config.ThumbnailSizes[0] {
+		return nil
+	}
+	if existing := thumbnailsFor(ctx, sha256sum); len(existing) > 0 {
+		return nil
+	}
+
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	src, _, err := image.Decode(body)
+	if err != nil {
+		return err
+	}
+
+	// keep transparency for formats that have it
+	ext, mimetype := ".jpg", "image/jpeg"
+	if format == "png" || format == "gif" {
+		ext, mimetype = ".png", "image/png"
+	}
+
+	record := &nostr.Event{Kind: kindThumbnails, Tags: nostr.Tags{{"x", sha256sum}}}
+	owners := blobOwners(ctx, sha256sum)
+	for _, size := range config.ThumbnailSizes {
+		if size >= longest {
+			break
+		}
+		thumb := resizeImage(src, size)
+
+		var buf bytes.Buffer
+		if ext == ".png" {
+			err = png.Encode(&buf, thumb)
+		} else {
+			err = jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 85})
+		}
+		if err != nil {
+			return err
+		}
+
+		hash := sha256.Sum256(buf.Bytes())
+		hhash := hex.EncodeToString(hash[:])
+		if err := blobStore.Put(ctx, hhash, buf.Bytes()); err != nil {
+			return err
+		}
+
+		// the uploader owns the variants too, so they are listed and cleaned up with the original
+		bd := blossom.BlobDescriptor{
+			URL:      bl.ServiceURL + "/" + hhash + ext,
+			SHA256:   hhash,
+			Size:     buf.Len(),
+			Type:     mimetype,
+			Uploaded: nostr.Now(),
+		}
+		for _, owner := range owners {
+			if err := bl.Store.Keep(ctx, bd, owner); err != nil {
+				blobLogger(ctx, hhash).Error("Thumbnails: failed to index", "owner", owner, "err", err)
+			}
+		}
+
+		dim := fmt.Sprintf("%dx%d", thumb.Bounds().Dx(), thumb.Bounds().Dy())
+		record.Tags = append(record.Tags, nostr.Tag{"thumb", hhash, bd.URL, dim})
+	}
+	return saveInternalEvent(ctx, record)
+}
+
+// thumbnailRecorder buffers the blossom upload response so the variants can
+// be added to it.
+type thumbnailRecorder struct {
+	http.ResponseWriter
+	code int
+	body bytes.Buffer
+}
+
+func (tr *thumbnailRecorder) WriteHeader(code int) { tr.code = code }
+
+func (tr *thumbnailRecorder) Write(p []byte) (int, error) { return tr.body.Write(p) }
+
+// withThumbnailResponses adds a "thumbnails" list to successful PUT /upload
+// responses.
+func withThumbnailResponses(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PUT" || r.URL.Path != "/upload" || len(config.ThumbnailSizes) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rec := &thumbnailRecorder{ResponseWriter: w, code: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		body := rec.body.Bytes()
+		var descriptor map[string]any
+		if rec.code == http.StatusOK && json.Unmarshal(body, &descriptor) == nil {
+			if sha, ok := descriptor["sha256"].(string); ok {
+				if thumbs := thumbnailsFor(r.Context(), sha); len(thumbs) > 0 {
+					descriptor["thumbnails"] = thumbs
+					if augmented, err := json.Marshal(descriptor); err == nil {
+						body = augmented
+					}
+				}
+			}
+		}
+		w.Header().Del("Content-Length")
+		w.WriteHeader(rec.code)
+		w.Write(body)
+	})
+}
+
+// setupThumbnails generates variants for every stored image. It runs after
+// the blob store hook and before NIP-94 publishing, which lists them.
+func setupThumbnails(bl *blossom.BlossomServer) {
+	bl.StoreBlob = append(bl.StoreBlob, func(ctx context.Context, sha256 string, body []byte) error {
+		// variants are best effort, the original is already stored
+		reader, _, err := blobReader(ctx, sha256, body)
+		if err == nil {
+			err = generateThumbnails(ctx, bl, sha256, reader)
+			if closer, ok := reader.(io.Closer); ok {
+				closer.Close()
+			}
+		}
+		if err != nil {
+			blobLogger(ctx, sha256).Warn("Thumbnails: generation failed", "err", err)
+		}
+		return nil
+	})
+	slog.Info("Thumbnails: ENABLED", "sizes", config.ThumbnailSizes)
+}
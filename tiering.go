@@ -0,0 +1,393 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/fiatjaf/khatru/blossom"
+)
+
+// Blob expiry and cold storage. With BLOB_TTL_DAYS, blobs nobody uploaded or
+// downloaded for that many days are either deleted or, with
+// BLOB_TTL_ACTION=cold, moved to a cold tier (another directory or an S3
+// bucket, BLOB_COLD_STORAGE). Cold blobs stay in the blob index and keep
+// resolving: GETs are served from the cold tier, or redirected to
+// BLOB_COLD_URL when the tier is publicly reachable. Last access times are
+// kept in the relay state; blobs without one count from their file time.
+
+const (
+	tieringStateKey     = "blob_tiering"
+	blobAccessStateKey  = "blob_access"
+	tieringInterval     = time.Hour
+	blobAccessSaveEvery = 10 * time.Minute
+)
+
+// BlobTieringConfig configures blob expiry and the cold tier.
+type BlobTieringConfig struct {
+	TTLDays     int    // 0 disables expiry
+	Action      string // delete or cold
+	ColdStorage string // fs or s3, empty = no cold tier
+	ColdPath    string
+	ColdS3      S3Config
+	ColdURL     string // public base URL of the cold tier
+}
+
+func loadBlobTieringConfig() BlobTieringConfig {
+	return BlobTieringConfig{
+		TTLDays:     getEnvIntWithDefault("BLOB_TTL_DAYS", 0),
+		Action:      strings.ToLower(getEnvWithDefault("BLOB_TTL_ACTION", "delete")),
+		ColdStorage: strings.ToLower(getEnvWithDefault("BLOB_COLD_STORAGE", "")),
+		ColdPath:    getEnvWithDefault("BLOB_COLD_PATH", ""),
+		ColdS3:      loadS3Config("COLD_S3_"),
+		ColdURL:     strings.TrimSuffix(getEnvWithDefault("BLOB_COLD_URL", ""), "/"),
+	}
+}
+
+// TieringReport summarizes an expiry run.
+type TieringReport struct {
+	Scanned    int   `json:"scanned"`
+	Deleted    int   `json:"deleted"`
+	MovedCold  int   `json:"moved_cold"`
+	Bytes      int64 `json:"bytes"` // freed on the hot tier
+	Failed     int   `json:"failed"`
+	StartedAt  int64 `json:"started_at"`
+	FinishedAt int64 `json:"finished_at"`
+}
+
+// tieredBlobStore writes to the hot tier and reads from whichever tier has
+// the blob.
+type tieredBlobStore struct {
+	hot, cold BlobStore
+}
+
+// newTieredBlobStore puts the cold tier configured by BLOB_COLD_STORAGE
+// behind hot.
+func newTieredBlobStore(cfg BlobTieringConfig, hot BlobStore) (*tieredBlobStore, error) {
+	var cold BlobStore
+	switch cfg.ColdStorage {
+	case "fs":
+		if cfg.ColdPath == "" {
+			return nil, fmt.Errorf("BLOB_COLD_STORAGE=fs requires BLOB_COLD_PATH")
+		}
+		// like BLOSSOM_PATH, flat paths are the directory followed by the hash
+		path := strings.TrimSuffix(cfg.ColdPath, "/") + "/"
+		fs.MkdirAll(path, 0755)
+		cold = &fsBlobStore{fs: fs, path: path}
+	case "s3":
+		store, err := newS3BlobStore(cfg.ColdS3)
+		if err != nil {
+			return nil, fmt.Errorf("cold tier: %w", err)
+		}
+		cold = store
+	default:
+		return nil, fmt.Errorf("unknown BLOB_COLD_STORAGE %q (expected fs or s3)", cfg.ColdStorage)
+	}
+	return &tieredBlobStore{hot: hot, cold: cold}, nil
+}
+
+func (s *tieredBlobStore) Put(ctx context.Context, sha256 string, body []byte) error {
+	return s.hot.Put(ctx, sha256, body)
+}
+
+func (s *tieredBlobStore) PutFile(ctx context.Context, sha256 string, path string) error {
+	return s.hot.PutFile(ctx, sha256, path)
+}
+
+func (s *tieredBlobStore) Get(ctx context.Context, sha256 string) (io.ReadSeeker, error) {
+	reader, err := s.hot.Get(ctx, sha256)
+	if err == nil {
+		return reader, nil
+	}
+	if reader, coldErr := s.cold.Get(ctx, sha256); coldErr == nil {
+		return reader, nil
+	}
+	return nil, err
+}
+
+// Delete removes the blob from both tiers, succeeding when either had it.
+func (s *tieredBlobStore) Delete(ctx context.Context, sha256 string) error {
+	err := s.hot.Delete(ctx, sha256)
+	if coldErr := s.cold.Delete(ctx, sha256); coldErr == nil {
+		err = nil
+	}
+	return err
+}
+
+func (s *tieredBlobStore) Stat(ctx context.Context, sha256 string) (BlobInfo, error) {
+	info, err := s.hot.Stat(ctx, sha256)
+	if err == nil {
+		return info, nil
+	}
+	if info, coldErr := s.cold.Stat(ctx, sha256); coldErr == nil {
+		return info, nil
+	}
+	return BlobInfo{}, err
+}
+
+func (s *tieredBlobStore) List(ctx context.Context) ([]BlobInfo, error) {
+	blobs, err := s.hot.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cold, err := s.cold.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool, len(blobs))
+	for _, blob := range blobs {
+		seen[blob.SHA256] = true
+	}
+	for _, blob := range cold {
+		if !seen[blob.SHA256] {
+			blobs = append(blobs, blob)
+		}
+	}
+	return blobs, nil
+}
+
+// isCold reports whether the blob is only in the cold tier.
+func (s *tieredBlobStore) isCold(ctx context.Context, sha256 string) bool {
+	if _, err := s.hot.Stat(ctx, sha256); err == nil {
+		return false
+	}
+	_, err := s.cold.Stat(ctx, sha256)
+	return err == nil
+}
+
+// moveToCold copies a blob to the cold tier, checking its hash on the way,
+// and removes the hot copy.
+func (s *tieredBlobStore) moveToCold(ctx context.Context, blob BlobInfo) error {
+	sha256 := blob.SHA256
+	reader, err := s.hot.Get(ctx, sha256)
+	if err != nil {
+		return err
+	}
+	staged, err := stageBlob(reader, blob.Size)
+	if closer, ok := reader.(io.Closer); ok {
+		closer.Close()
+	}
+	if err != nil {
+		return err
+	}
+	defer staged.Remove()
+	if staged.SHA256 != sha256 {
+		return fmt.Errorf("content hashes to %s", staged.SHA256)
+	}
+	if err := s.cold.PutFile(ctx, sha256, staged.path); err != nil {
+		return err
+	}
+	return s.hot.Delete(ctx, sha256)
+}
+
+var (
+	blobAccessMu    sync.Mutex
+	blobAccess      = map[string]int64{} // sha256 -> unix time of the last upload or download
+	blobAccessDirty bool
+
+	tieringMu sync.Mutex // one run at a time
+)
+
+// touchBlob records an upload or download of a blob.
+func touchBlob(sha256 string) {
+	if config.BlobTiering.TTLDays <= 0 {
+		return
+	}
+	blobAccessMu.Lock()
+	blobAccess[sha256] = time.Now().Unix()
+	blobAccessDirty = true
+	blobAccessMu.Unlock()
+}
+
+func persistBlobAccess(ctx context.Context) {
+	blobAccessMu.Lock()
+	defer blobAccessMu.Unlock()
+	if !blobAccessDirty {
+		return
+	}
+	if err := saveState(ctx, blobAccessStateKey, blobAccess); err != nil {
+		slog.Error("Blob TTL: failed to save access times", "err", err)
+		return
+	}
+	blobAccessDirty = false
+}
+
+// lastAccess is when a blob was last uploaded or downloaded.
+func lastAccess(blob BlobInfo) time.Time {
+	blobAccessMu.Lock()
+	defer blobAccessMu.Unlock()
+	if at, ok := blobAccess[blob.SHA256]; ok && at > blob.Modified.Unix() {
+		return time.Unix(at, 0)
+	}
+	return blob.Modified
+}
+
+// expireBlobs deletes or moves to the cold tier the blobs untouched for
+// BLOB_TTL_DAYS.
+func expireBlobs(ctx context.Context) (TieringReport, error) {
+	tieringMu.Lock()
+	defer tieringMu.Unlock()
+
+	cfg := config.BlobTiering
+	report := TieringReport{StartedAt: time.Now().Unix()}
+	tiered, _ := blobStore.(*tieredBlobStore)
+
+	// blobs already in the cold tier stay there
+	source := blobStore
+	if tiered != nil && cfg.Action == "cold" {
+		source = tiered.hot
+	}
+	stored, err := source.List(ctx)
+	if err != nil {
+		return report, err
+	}
+
+	cutoff := time.Now().AddDate(0, 0, -cfg.TTLDays)
+	for _, blob := range stored {
+		if ctx.Err() != nil {
+			return report, ctx.Err()
+		}
+		report.Scanned++
+		// frozen blobs are kept on purpose until their owner's cleanup is resolved
+		if lastAccess(blob).After(cutoff) || isFrozenBlob(blob.SHA256) {
+			continue
+		}
+
+		if cfg.Action == "cold" {
+			if err := tiered.moveToCold(ctx, blob); err != nil {
+				blobLogger(ctx, blob.SHA256).Error("Blob TTL: failed to move to the cold tier", "err", err)
+				report.Failed++
+				continue
+			}
+			report.MovedCold++
+			report.Bytes += blob.Size
+			continue
+		}
+
+		for _, owner := range blobOwners(ctx, blob.SHA256) {
+			if err := blossomServer.Store.Delete(ctx, blob.SHA256, owner); err != nil {
+				blobLogger(ctx, blob.SHA256).Error("Blob TTL: failed to unindex", "owner", owner, "err", err)
+			}
+		}
+		if err := blobStore.Delete(ctx, blob.SHA256); err != nil {
+			blobLogger(ctx, blob.SHA256).Error("Blob TTL: failed to delete", "err", err)
+			report.Failed++
+			continue
+		}
+		blobAccessMu.Lock()
+		delete(blobAccess, blob.SHA256)
+		blobAccessDirty = true
+		blobAccessMu.Unlock()
+		report.Deleted++
+		report.Bytes += blob.Size
+	}
+	report.FinishedAt = time.Now().Unix()
+
+	persistBlobAccess(ctx)
+	if err := saveState(ctx, tieringStateKey, report); err != nil {
+		slog.Error("Blob TTL: failed to save report", "err", err)
+	}
+	slog.Info("Blob TTL: finished", "scanned", report.Scanned, "deleted", report.Deleted, "moved_cold", report.MovedCold,
+		"bytes", report.Bytes, "failed", report.Failed)
+	return report, nil
+}
+
+// redirectColdBlobs answers GETs of blobs that are only in the cold tier with
+// a redirect to BLOB_COLD_URL, once the RejectGet hooks allowed them.
+func redirectColdBlobs(bl *blossom.BlossomServer, next http.Handler) http.Handler {
+	tiered, ok := blobStore.(*tieredBlobStore)
+	if !ok || config.BlobTiering.ColdURL == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if (r.Method != "GET" && r.Method != "HEAD") || !blobPathRe.MatchString(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		sha256, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), ".")
+		sha256 = strings.ToLower(sha256)
+		ctx := r.Context()
+		if !tiered.isCold(ctx, sha256) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// requests the blossom handler would refuse are left to it
+		auth, err := readBlossomAuth(r, "get")
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		for _, reject := range bl.RejectGet {
+			if rejected, reason, code := reject(ctx, auth, sha256); rejected {
+				blossomError(w, reason, code)
+				return
+			}
+		}
+		touchBlob(sha256)
+		http.Redirect(w, r, config.BlobTiering.ColdURL+"/"+sha256, http.StatusFound)
+	})
+}
+
+// setupBlobTiering exposes GET /admin/blobs/ttl (last report) and
+// POST /admin/blobs/ttl (run now, in the background), and schedules the
+// hourly expiry when BLOB_TTL_DAYS is set.
+func setupBlobTiering(relay *khatru.Relay) {
+	cfg := config.BlobTiering
+	if cfg.TTLDays <= 0 {
+		return
+	}
+	if _, err := loadState(context.Background(), blobAccessStateKey, &blobAccess); err != nil {
+		slog.Error("Blob TTL: failed to load access times", "err", err)
+	}
+
+	relay.Router().HandleFunc("/admin/blobs/ttl", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			var report TieringReport
+			ok, err := loadState(r.Context(), tieringStateKey, &report)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if !ok {
+				http.Error(w, "No expiry has run yet", http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(report)
+		case "POST":
+			go func() {
+				if _, err := expireBlobs(context.Background()); err != nil {
+					slog.Error("Blob TTL: run failed", "err", err)
+				}
+			}()
+			logger(r.Context()).Info("Blob TTL: run requested by admin")
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}))
+
+	go func() {
+		for range time.Tick(blobAccessSaveEvery) {
+			persistBlobAccess(context.Background())
+		}
+	}()
+	go func() {
+		for {
+			time.Sleep(tieringInterval)
+			if _, err := expireBlobs(context.Background()); err != nil {
+				slog.Error("Blob TTL: run failed", "err", err)
+			}
+		}
+	}()
+	slog.Info("Blob TTL: ENABLED", "days", cfg.TTLDays, "action", cfg.Action, "cold_storage", cfg.ColdStorage, "cold_url", cfg.ColdURL)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Timestamp sanity: events dated more than MAX_FUTURE_SKEW_SECONDS ahead are
+// refused, as they would win every replaceable-event comparison and dodge
+// retention until their date comes. With MAX_EVENT_AGE_DAYS set, events older
+// than that are refused too; this also applies to events pulled in by outbox
+// backfill and federation.
+
+// rejectBadTimestamp enforces the future skew and the past horizon.
+func rejectBadTimestamp(ctx context.Context, event *nostr.Event) (bool, string) {
+	now := time.Now()
+	created := event.CreatedAt.Time()
+	if config.MaxFutureSkewSeconds > 0 {
+		if skew := time.Duration(config.MaxFutureSkewSeconds) * time.Second; created.After(now.Add(skew)) {
+			return true, fmt.Sprintf("invalid: created_at is more than %d seconds in the future", config.MaxFutureSkewSeconds)
+		}
+	}
+	if config.MaxEventAgeDays > 0 {
+		if horizon := now.AddDate(0, 0, -config.MaxEventAgeDays); created.Before(horizon) {
+			return true, fmt.Sprintf("invalid: created_at is more than %d days in the past", config.MaxEventAgeDays)
+		}
+	}
+	return false, ""
+}
+
+// setupTimestampPolicy installs the created_at checks.
+func setupTimestampPolicy(relay *khatru.Relay) {
+	relay.RejectEvent = append(relay.RejectEvent, rejectBadTimestamp)
+	slog.Info("Timestamp policy: ENABLED", "max_future_skew_seconds", config.MaxFutureSkewSeconds, "max_event_age_days", config.MaxEventAgeDays)
+}
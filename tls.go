@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// TLSConfig configures built-in TLS termination: either a certificate and key
+// from disk, or certificates obtained automatically from Let's Encrypt.
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+
+	ACME         bool
+	ACMEDomains  []string // defaults to the hosts of WEBSOCKET_URL and BLOSSOM_URL
+	ACMEEmail    string
+	ACMECacheDir string
+	ACMEHTTPAddr string // optional HTTP-01 challenge listener, e.g. ":80"
+}
+
+func loadTLSConfig() (TLSConfig, error) {
+	cfg := TLSConfig{
+		CertFile:     getEnvWithDefault("TLS_CERT_FILE", ""),
+		KeyFile:      getEnvWithDefault("TLS_KEY_FILE", ""),
+		ACME:         getEnvBool("ACME_ENABLED"),
+		ACMEDomains:  parseList(getEnvNullable("ACME_DOMAINS")),
+		ACMEEmail:    getEnvWithDefault("ACME_EMAIL", ""),
+		ACMECacheDir: getEnvWithDefault("ACME_CACHE_DIR", "certs/"),
+		ACMEHTTPAddr: getEnvWithDefault("ACME_HTTP_ADDR", ""),
+	}
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return cfg, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if cfg.ACME && cfg.CertFile != "" {
+		return cfg, fmt.Errorf("ACME_ENABLED cannot be combined with TLS_CERT_FILE/TLS_KEY_FILE")
+	}
+	return cfg, nil
+}
+
+// Enabled reports whether the TCP listeners should serve TLS.
+func (c TLSConfig) Enabled() bool {
+	return c.ACME || c.CertFile != ""
+}
+
+// acmeDomains returns the configured domains, or the public hostnames of the
+// relay and blossom URLs.
+func acmeDomains() []string {
+	if len(config.TLS.ACMEDomains) > 0 {
+		return config.TLS.ACMEDomains
+	}
+	var domains []string
+	for _, raw := range []*string{config.WebsocketURL, config.BlossomURL} {
+		if raw == nil {
+			continue
+		}
+		u, err := url.Parse(*raw)
+		if err != nil || u.Hostname() == "" {
+			continue
+		}
+		host := u.Hostname()
+		if host == "localhost" || net.ParseIP(host) != nil || slices.Contains(domains, host) {
+			continue
+		}
+		domains = append(domains, host)
+	}
+	return domains
+}
+
+// newTLSConfig builds the TLS configuration for the listeners. With ACME it
+// also returns the handler answering HTTP-01 challenges, which redirects
+// everything else to https.
+func newTLSConfig() (*tls.Config, http.Handler, error) {
+	if config.TLS.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.TLS.CertFile, config.TLS.KeyFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+		}
+		slog.Info("TLS: using certificate", "file", config.TLS.CertFile)
+		return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil, nil
+	}
+
+	domains := acmeDomains()
+	if len(domains) == 0 {
+		return nil, nil, fmt.Errorf("ACME_ENABLED requires ACME_DOMAINS or a public host in WEBSOCKET_URL/BLOSSOM_URL")
+	}
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Cache:      autocert.DirCache(config.TLS.ACMECacheDir),
+		Email:      config.TLS.ACMEEmail,
+	}
+	slog.Info("TLS: ACME certificates", "domains", domains, "cache", config.TLS.ACMECacheDir)
+
+	// m.TLSConfig answers TLS-ALPN-01 challenges on the listeners themselves
+	tlsConfig := m.TLSConfig()
+	tlsConfig.MinVersion = tls.VersionTLS12
+	return tlsConfig, m.HTTPHandler(nil), nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+
+	"github.com/nbd-wtf/go-nostr"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// OpenTelemetry tracing. With OTEL_EXPORTER_OTLP_ENDPOINT set, event storage,
+// queries, derivation checks and blob I/O are recorded as spans and exported
+// over OTLP/HTTP. The exporter honors the other standard OTEL_EXPORTER_OTLP_*
+// variables (headers, timeout, insecure); OTEL_SERVICE_NAME names the service
+// and TRACE_SAMPLE_RATIO keeps that fraction of traces.
+
+var (
+	tracer         = otel.Tracer("github.com/bitkarrot/higher")
+	tracerProvider *sdktrace.TracerProvider
+)
+
+// parseSampleRatio reads TRACE_SAMPLE_RATIO, a fraction between 0 and 1.
+func parseSampleRatio(value *string) (float64, error) {
+	if value == nil || *value == "" {
+		return 1, nil
+	}
+	ratio, err := strconv.ParseFloat(*value, 64)
+	if err != nil || ratio < 0 || ratio > 1 {
+		return 0, fmt.Errorf("TRACE_SAMPLE_RATIO must be between 0 and 1, got %q", *value)
+	}
+	return ratio, nil
+}
+
+// setupTracing installs the OTLP exporter and wraps the event and blob stores
+// so their operations are traced. It must run before the stores are hooked
+// into the relay.
+func setupTracing(ctx context.Context) error {
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+	tracerProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", config.TracingServiceName))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.TraceSampleRatio))),
+	)
+	otel.SetTracerProvider(tracerProvider)
+
+	db = &tracedDB{DBBackend: db}
+	if blobStore != nil {
+		blobStore = &tracedBlobStore{BlobStore: blobStore}
+	}
+
+	slog.Info("Tracing: ENABLED", "endpoint", config.TracingEndpoint, "service", config.TracingServiceName, "sample_ratio", config.TraceSampleRatio)
+	return nil
+}
+
+// shutdownTracing flushes the spans still buffered.
+func shutdownTracing(ctx context.Context) {
+	if tracerProvider == nil {
+		return
+	}
+	if err := tracerProvider.Shutdown(ctx); err != nil {
+		slog.Warn("Tracing: failed to flush spans", "err", err)
+	}
+}
+
+// endSpan records err, if any, and ends span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func eventAttributes(evt *nostr.Event) trace.SpanStartOption {
+	return trace.WithAttributes(
+		attribute.String("nostr.event.id", evt.ID),
+		attribute.String("nostr.event.pubkey", evt.PubKey),
+		attribute.Int("nostr.event.kind", evt.Kind),
+	)
+}
+
+func filterAttributes(filter nostr.Filter) trace.SpanStartOption {
+	kinds := make([]int, len(filter.Kinds))
+	copy(kinds, filter.Kinds)
+	return trace.WithAttributes(
+		attribute.IntSlice("nostr.filter.kinds", kinds),
+		attribute.Int("nostr.filter.authors", len(filter.Authors)),
+		attribute.Int("nostr.filter.ids", len(filter.IDs)),
+		attribute.Int("nostr.filter.tags", len(filter.Tags)),
+		attribute.Int("nostr.filter.limit", filter.Limit),
+		attribute.String("nostr.filter.search", filter.Search),
+	)
+}
+
+// traceDerivationCheck is belongsToMaster recorded as a span.
+func traceDerivationCheck(ctx context.Context, pubkey string) bool {
+	_, span := tracer.Start(ctx, "access.derivation_check", trace.WithAttributes(attribute.String("nostr.pubkey", pubkey)))
+	belongs := belongsToMaster(pubkey)
+	span.SetAttributes(attribute.Bool("access.derived", belongs))
+	span.End()
+	return belongs
+}
+
+// unwrapDB returns the configured backend behind the tracing and cache
+// wrappers, for backend-specific operations.
+func unwrapDB() DBBackend {
+	d := db
+	for {
+		switch w := d.(type) {
+		case *cachedDB:
+			d = w.DBBackend
+		case *tracedDB:
+			d = w.DBBackend
+		default:
+			return d
+		}
+	}
+}
+
+// tracedDB records every event store operation as a span. Query spans last
+// until the result channel has been drained.
+type tracedDB struct {
+	DBBackend
+}
+
+func (t *tracedDB) SaveEvent(ctx context.Context, evt *nostr.Event) error {
+	ctx, span := tracer.Start(ctx, "db.save_event", eventAttributes(evt))
+	err := t.DBBackend.SaveEvent(ctx, evt)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedDB) ReplaceEvent(ctx context.Context, evt *nostr.Event) error {
+	ctx, span := tracer.Start(ctx, "db.replace_event", eventAttributes(evt))
+	err := t.DBBackend.ReplaceEvent(ctx, evt)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedDB) DeleteEvent(ctx context.Context, evt *nostr.Event) error {
+	ctx, span := tracer.Start(ctx, "db.delete_event", eventAttributes(evt))
+	err := t.DBBackend.DeleteEvent(ctx, evt)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedDB) CountEvents(ctx context.Context, filter nostr.Filter) (int64, error) {
+	ctx, span := tracer.Start(ctx, "db.count_events", filterAttributes(filter))
+	count, err := t.DBBackend.CountEvents(ctx, filter)
+	span.SetAttributes(attribute.Int64("nostr.count", count))
+	endSpan(span, err)
+	return count, err
+}
+
+func (t *tracedDB) QueryEvents(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	ctx, span := tracer.Start(ctx, "db.query_events", filterAttributes(filter))
+	ch, err := t.DBBackend.QueryEvents(ctx, filter)
+	if err != nil {
+		endSpan(span, err)
+		return nil, err
+	}
+
+	out := make(chan *nostr.Event)
+	go func() {
+		defer close(out)
+		returned := forward(ctx, ch, out, nil)
+		span.SetAttributes(attribute.Int("nostr.events", returned))
+		span.End()
+	}()
+	return out, nil
+}
+
+// tracedBlobStore records blob reads and writes as spans.
+type tracedBlobStore struct {
+	BlobStore
+}
+
+func blobAttributes(sha256 string) trace.SpanStartOption {
+	return trace.WithAttributes(attribute.String("blossom.sha256", sha256))
+}
+
+func (t *tracedBlobStore) Put(ctx context.Context, sha256 string, body []byte) error {
+	ctx, span := tracer.Start(ctx, "blob.put", blobAttributes(sha256), trace.WithAttributes(attribute.Int("blossom.size", len(body))))
+	err := t.BlobStore.Put(ctx, sha256, body)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedBlobStore) PutFile(ctx context.Context, sha256 string, path string) error {
+	ctx, span := tracer.Start(ctx, "blob.put_file", blobAttributes(sha256))
+	err := t.BlobStore.PutFile(ctx, sha256, path)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedBlobStore) Get(ctx context.Context, sha256 string) (io.ReadSeeker, error) {
+	ctx, span := tracer.Start(ctx, "blob.get", blobAttributes(sha256))
+	r, err := t.BlobStore.Get(ctx, sha256)
+	endSpan(span, err)
+	return r, err
+}
+
+func (t *tracedBlobStore) Delete(ctx context.Context, sha256 string) error {
+	ctx, span := tracer.Start(ctx, "blob.delete", blobAttributes(sha256))
+	err := t.BlobStore.Delete(ctx, sha256)
+	endSpan(span, err)
+	return err
+}
+
+func (t *tracedBlobStore) Stat(ctx context.Context, sha256 string) (BlobInfo, error) {
+	ctx, span := tracer.Start(ctx, "blob.stat", blobAttributes(sha256))
+	info, err := t.BlobStore.Stat(ctx, sha256)
+	endSpan(span, err)
+	return info, err
+}
+
+func (t *tracedBlobStore) List(ctx context.Context) ([]BlobInfo, error) {
+	ctx, span := tracer.Start(ctx, "blob.list")
+	blobs, err := t.BlobStore.List(ctx)
+	span.SetAttributes(attribute.Int("blossom.blobs", len(blobs)))
+	endSpan(span, err)
+	return blobs, err
+}
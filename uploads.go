@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/fiatjaf/khatru"
+	"github.com/fiatjaf/khatru/blossom"
+	"github.com/liamg/magic"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	// how long finished upload sessions stay queryable before being forgotten
+	uploadSessionRetention = 10 * time.Minute
+	// sessions still receiving after this long are stalled and forgotten
+	uploadSessionMaxAge = time.Hour
+	// any signed authorization opens a session, so they are capped per
+	// pubkey and in total
+	maxUploadSessionsPerPubkey = 16
+	maxUploadSessions          = 4096
+)
+
+// UploadStatus is the JSON shape returned by the upload status endpoints.
+type UploadStatus struct {
+	ID            string  `json:"id"`
+	State         string  `json:"state"` // "receiving", "done" or "failed"
+	BytesReceived int64   `json:"bytes_received"`
+	BytesTotal    int64   `json:"bytes_total"`
+	BytesHashed   int64   `json:"bytes_hashed"`
+	Percent       float64 `json:"percent"`
+	RateBps       float64 `json:"rate_bps"`
+	ETASeconds    float64 `json:"eta_seconds"`
+	SHA256        string  `json:"sha256,omitempty"`
+	Error         string  `json:"error,omitempty"`
+	StartedAt     int64   `json:"started_at"`
+}
+
+// uploadSession tracks a single in-flight blossom upload.
+type uploadSession struct {
+	mu         sync.Mutex
+	id         string
+	pubkey     string
+	total      int64
+	received   int64
+	hasher     hash.Hash
+	state      string
+	sha256     string
+	err        string
+	startedAt  time.Time
+	finishedAt time.Time
+}
+
+func (s *uploadSession) status() UploadStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := UploadStatus{
+		ID:            s.id,
+		State:         s.state,
+		BytesReceived: s.received,
+		BytesTotal:    s.total,
+		BytesHashed:   s.received, // the body is hashed as it streams in
+		SHA256:        s.sha256,
+		Error:         s.err,
+		StartedAt:     s.startedAt.Unix(),
+	}
+
+	end := time.Now()
+	if !s.finishedAt.IsZero() {
+		end = s.finishedAt
+	}
+	if elapsed := end.Sub(s.startedAt).Seconds(); elapsed > 0 {
+		st.RateBps = float64(s.received) / elapsed
+	}
+	if s.total > 0 {
+		st.Percent = float64(s.received) * 100 / float64(s.total)
+		if st.RateBps > 0 && s.state == "receiving" {
+			st.ETASeconds = float64(s.total-s.received) / st.RateBps
+		}
+	}
+	return st
+}
+
+// progressReader wraps an upload body, counting and hashing bytes as they are read.
+type progressReader struct {
+	io.ReadCloser
+	session *uploadSession
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.ReadCloser.Read(p)
+	if n > 0 {
+		pr.session.mu.Lock()
+		pr.session.received += int64(n)
+		pr.session.hasher.Write(p[:n])
+		pr.session.mu.Unlock()
+	}
+	return n, err
+}
+
+// uploadTracker keeps the set of known upload sessions, keyed by the ID of the
+// authorization event used for the upload (which the client already knows).
+type uploadTracker struct {
+	mu       sync.Mutex
+	sessions map[string]*uploadSession
+}
+
+var uploads = &uploadTracker{sessions: make(map[string]*uploadSession)}
+
+func (ut *uploadTracker) get(id string) *uploadSession {
+	ut.mu.Lock()
+	defer ut.mu.Unlock()
+	return ut.sessions[id]
+}
+
+// start opens a session for an upload, or returns nil when pubkey, or
+// everyone together, already has too many. The pubkey's oldest finished
+// session makes room for the new one.
+func (ut *uploadTracker) start(id, pubkey string, total int64) *uploadSession {
+	ut.mu.Lock()
+	defer ut.mu.Unlock()
+	delete(ut.sessions, id) // a retry with the same authorization starts over
+
+	var own int
+	var oldest *uploadSession
+	for _, other := range ut.sessions {
+		if other.pubkey != pubkey {
+			continue
+		}
+		own++
+		other.mu.Lock()
+		if !other.finishedAt.IsZero() && (oldest == nil || other.finishedAt.Before(oldest.finishedAt)) {
+			oldest = other
+		}
+		other.mu.Unlock()
+	}
+	if own >= maxUploadSessionsPerPubkey {
+		if oldest == nil {
+			return nil
+		}
+		delete(ut.sessions, oldest.id)
+	}
+	if len(ut.sessions) >= maxUploadSessions {
+		return nil
+	}
+
+	s := &uploadSession{
+		id:        id,
+		pubkey:    pubkey,
+		total:     total,
+		hasher:    sha256.New(),
+		state:     "receiving",
+		startedAt: time.Now(),
+	}
+	ut.sessions[id] = s
+	return s
+}
+
+// prune forgets finished sessions past their retention and stalled ones.
+func (ut *uploadTracker) prune(now time.Time) {
+	ut.mu.Lock()
+	defer ut.mu.Unlock()
+	for key, s := range ut.sessions {
+		s.mu.Lock()
+		expired := (!s.finishedAt.IsZero() && now.Sub(s.finishedAt) > uploadSessionRetention) ||
+			(s.finishedAt.IsZero() && now.Sub(s.startedAt) > uploadSessionMaxAge)
+		s.mu.Unlock()
+		if expired {
+			delete(ut.sessions, key)
+		}
+	}
+}
+
+func (ut *uploadTracker) finish(s *uploadSession, statusCode int, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.finishedAt = time.Now()
+	if statusCode >= 200 && statusCode < 300 {
+		s.state = "done"
+		s.sha256 = hex.EncodeToString(s.hasher.Sum(nil))
+	} else {
+		s.state = "failed"
+		s.err = reason
+		if s.err == "" {
+			s.err = http.StatusText(statusCode)
+		}
+	}
+}
+
+// statusRecorder captures the response code written by the wrapped upload handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	sr.code = code
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+// trackUploads wraps the relay handler so that every authorized PUT /upload
+// gets a progress session that can be polled or streamed by the client.
+func trackUploads(next http.Handler) http.Handler {
+	go func() {
+		for range time.Tick(time.Minute) {
+			uploads.prune(time.Now())
+		}
+	}()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PUT" || r.URL.Path != "/upload" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		auth, err := readBlossomAuth(r, "upload")
+		if err != nil || auth == nil {
+			// let the blossom handler produce the proper error
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		total, _ := strconv.ParseInt(r.Header.Get("Content-Length"), 10, 64)
+		session := uploads.start(auth.ID, auth.PubKey, total)
+		if session == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		r.Body = &progressReader{ReadCloser: r.Body, session: session}
+
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		uploads.finish(session, rec.code, rec.Header().Get("X-Reason"))
+	})
+}
+
+// uploadSlots bounds the uploads received at once (MAX_CONCURRENT_UPLOADS);
+// nil when unlimited.
+var uploadSlots chan struct{}
+
+// acquireUploadSlot takes a slot without waiting, reporting false when every
+// slot is busy. Callers release it with releaseUploadSlot.
+func acquireUploadSlot() bool {
+	if uploadSlots == nil {
+		return true
+	}
+	select {
+	case uploadSlots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func releaseUploadSlot() {
+	if uploadSlots != nil {
+		<-uploadSlots
+	}
+}
+
+// blossomError reports a failure the way the blossom handlers do, in the
+// X-Reason header.
+func blossomError(w http.ResponseWriter, msg string, code int) {
+	w.Header().Add("X-Reason", msg)
+	w.WriteHeader(code)
+}
+
+// uploadExtension picks the extension of an upload from its first bytes,
+// falling back to the declared content type.
+func uploadExtension(head []byte, declared string) string {
+	if ft, _ := magic.Lookup(head); ft != nil {
+		return "." + ft.Extension
+	}
+	mimetype, _, _ := strings.Cut(declared, ";")
+	if exts, _ := mime.ExtensionsByType(mimetype); len(exts) > 0 {
+		return exts[0]
+	}
+	return ""
+}
+
+// streamUploads serves PUT /upload in place of the blossom handler, which
+// buffers the whole body: the body is spooled to a staged file and hashed as
+// it arrives, the StoreBlob hooks read it from there, and the blob store
+// moves it into place. At most MAX_CONCURRENT_UPLOADS run at once.
+func streamUploads(bl *blossom.BlossomServer, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PUT" || r.URL.Path != "/upload" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		auth, err := readBlossomAuth(r, "upload")
+		if err != nil {
+			blossomError(w, "invalid \"Authorization\": "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if auth == nil {
+			blossomError(w, "missing \"Authorization\" header", http.StatusUnauthorized)
+			return
+		}
+		if r.ContentLength <= 0 {
+			blossomError(w, "missing \"Content-Length\" header", http.StatusBadRequest)
+			return
+		}
+
+		if !acquireUploadSlot() {
+			w.Header().Set("Retry-After", "5")
+			blossomError(w, "too many uploads in progress, try again shortly", http.StatusServiceUnavailable)
+			return
+		}
+		defer releaseUploadSlot()
+
+		// judge the upload on its first bytes before receiving the rest
+		head := make([]byte, 512)
+		n, err := io.ReadFull(r.Body, head)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			blossomError(w, "failed to read upload body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		head = head[:n]
+		mimetype := detectBlobType(head)
+		ext := uploadExtension(head, r.Header.Get("Content-Type"))
+		ctx := withSniffedType(r.Context(), mimetype)
+		for _, reject := range bl.RejectUpload {
+			if rejected, reason, code := reject(ctx, auth, int(r.ContentLength), ext); rejected {
+				blossomError(w, reason, code)
+				return
+			}
+		}
+
+		maxSize := int64(config.MaxUploadSizeMB) * 1024 * 1024
+		staged, err := stageBlob(io.MultiReader(bytes.NewReader(head), r.Body), maxSize)
+		if err == errBlobTooLarge {
+			blossomError(w, fmt.Sprintf("file size exceeds %dMB limit", config.MaxUploadSizeMB), http.StatusRequestEntityTooLarge)
+			return
+		} else if err != nil {
+			blossomError(w, "failed to read upload body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer staged.Remove()
+
+		bd := blossom.BlobDescriptor{
+			URL:      bl.ServiceURL + "/" + staged.SHA256 + ext,
+			SHA256:   staged.SHA256,
+			Size:     int(staged.Size),
+			Type:     mime.TypeByExtension(ext),
+			Uploaded: nostr.Now(),
+		}
+		if bd.Type == "" {
+			bd.Type = mimetype
+		}
+		if err := bl.Store.Keep(ctx, bd, auth.PubKey); err != nil {
+			blossomError(w, "failed to save event: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		ctx = withStagedBlob(ctx, staged)
+		for _, store := range bl.StoreBlob {
+			if err := store(ctx, staged.SHA256, nil); err != nil {
+				blossomError(w, "failed to save: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(newBlobResponse(r.Context(), bd))
+	})
+}
+
+var progressUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     func(r *http.Request) bool { return true },
+}
+
+// setupUploadStatusHandlers exposes upload progress for polling
+// (GET /upload/status/{id}) and streaming (websocket /upload/progress/{id}).
+// Both require a blossom upload authorization event signed by the uploader.
+func setupUploadStatusHandlers(relay *khatru.Relay) {
+	authorize := func(w http.ResponseWriter, r *http.Request, prefix string) *uploadSession {
+		id := strings.TrimPrefix(r.URL.Path, prefix)
+		auth, err := readBlossomAuth(r, "upload")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil
+		}
+		if auth == nil {
+			http.Error(w, "Missing authorization", http.StatusUnauthorized)
+			return nil
+		}
+		session := uploads.get(id)
+		if session == nil {
+			http.Error(w, "Unknown upload", http.StatusNotFound)
+			return nil
+		}
+		if session.pubkey != auth.PubKey {
+			http.Error(w, "Upload belongs to another pubkey", http.StatusForbidden)
+			return nil
+		}
+		return session
+	}
+
+	relay.Router().HandleFunc("/upload/status/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		session := authorize(w, r, "/upload/status/")
+		if session == nil {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(session.status())
+	})
+
+	relay.Router().HandleFunc("/upload/progress/", func(w http.ResponseWriter, r *http.Request) {
+		session := authorize(w, r, "/upload/progress/")
+		if session == nil {
+			return
+		}
+		conn, err := progressUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			logger(r.Context()).Warn("Upload progress: websocket upgrade failed", "err", err)
+			return
+		}
+		defer conn.Close()
+
+		ticker := time.NewTicker(500 * time.Millisecond)
+		defer ticker.Stop()
+		for range ticker.C {
+			st := session.status()
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := conn.WriteJSON(st); err != nil {
+				return
+			}
+			if st.State != "receiving" {
+				conn.WriteMessage(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseNormalClosure, st.State))
+				return
+			}
+		}
+	})
+}
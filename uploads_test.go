@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestUploadTrackerCaps(t *testing.T) {
+	ut := &uploadTracker{sessions: map[string]*uploadSession{}}
+	for i := range maxUploadSessionsPerPubkey {
+		if ut.start(fmt.Sprintf("alice-%d", i), "alice", 10) == nil {
+			t.Fatalf("session %d refused", i)
+		}
+	}
+	if ut.start("alice-extra", "alice", 10) != nil {
+		t.Fatalf("session beyond the cap opened while all are receiving")
+	}
+	if ut.start("bob-0", "bob", 10) == nil {
+		t.Fatalf("another pubkey's session refused")
+	}
+
+	// a finished session makes room
+	ut.finish(ut.get("alice-3"), http.StatusOK, "")
+	if ut.start("alice-extra", "alice", 10) == nil {
+		t.Fatalf("session refused though one had finished")
+	}
+	if ut.get("alice-3") != nil {
+		t.Fatalf("oldest finished session kept")
+	}
+}
+
+func TestUploadTrackerPrune(t *testing.T) {
+	ut := &uploadTracker{sessions: map[string]*uploadSession{}}
+	now := time.Now()
+	for id, s := range map[string]*uploadSession{
+		"receiving":      {startedAt: now.Add(-time.Minute)},
+		"stalled":        {startedAt: now.Add(-uploadSessionMaxAge - time.Minute)},
+		"finished":       {startedAt: now.Add(-2 * time.Minute), finishedAt: now.Add(-time.Minute)},
+		"finished-older": {startedAt: now.Add(-time.Hour), finishedAt: now.Add(-uploadSessionRetention - time.Minute)},
+	} {
+		s.id = id
+		ut.sessions[id] = s
+	}
+
+	ut.prune(now)
+	for id, want := range map[string]bool{"receiving": true, "stalled": false, "finished": true, "finished-older": false} {
+		if got := ut.get(id) != nil; got != want {
+			t.Errorf("session %s kept = %v, want %v", id, got, want)
+		}
+	}
+}
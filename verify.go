@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Blob integrity verification. Blobs are named by the sha256 of their
+// content, so a file whose content hashes to something else was damaged on
+// disk or in the bucket. Every BLOB_VERIFY_INTERVAL_HOURS, on POST
+// /admin/blobs/verify or with `higher verify`, stored blobs are re-hashed;
+// corrupted ones are reported and, with BLOB_VERIFY_QUARANTINE, quarantined
+// so they are no longer served. The last report is kept in the relay state
+// and each run is recorded as a "blob.verify" span when tracing is enabled.
+
+const verifyStateKey = "blob_verify"
+
+// CorruptBlob is a stored blob whose content doesn't match its name.
+type CorruptBlob struct {
+	SHA256      string   `json:"sha256"`
+	Actual      string   `json:"actual"` // hash of the content, empty when it couldn't be read
+	Size        int64    `json:"size"`
+	Error       string   `json:"error,omitempty"`
+	Owners      []string `json:"owners"`
+	Quarantined bool     `json:"quarantined"`
+}
+
+// VerifyReport summarizes an integrity verification run.
+type VerifyReport struct {
+	Scanned    int           `json:"scanned"`
+	Bytes      int64         `json:"bytes"`
+	Corrupted  []CorruptBlob `json:"corrupted"`
+	StartedAt  int64         `json:"started_at"`
+	FinishedAt int64         `json:"finished_at"`
+}
+
+var verifyMu sync.Mutex // one run at a time
+
+// hashStoredBlob streams a stored blob through sha256.
+func hashStoredBlob(ctx context.Context, sha string) (string, int64, error) {
+	reader, err := blobStore.Get(ctx, sha)
+	if err != nil {
+		return "", 0, err
+	}
+	if closer, ok := reader.(io.Closer); ok {
+		defer closer.Close()
+	}
+	h := sha256.New()
+	n, err := io.Copy(h, reader)
+	if err != nil {
+		return "", n, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// verifyBlobs re-hashes every stored blob and, with quarantineCorrupt set,
+// quarantines the ones that don't match their name.
+func verifyBlobs(ctx context.Context, quarantineCorrupt bool) (VerifyReport, error) {
+	verifyMu.Lock()
+	defer verifyMu.Unlock()
+
+	ctx, span := tracer.Start(ctx, "blob.verify")
+	defer span.End()
+
+	start := time.Now()
+	report := VerifyReport{Corrupted: []CorruptBlob{}, StartedAt: start.Unix()}
+	stored, err := blobStore.List(ctx)
+	if err != nil {
+		endSpan(span, err)
+		return report, err
+	}
+
+	quarantined := 0
+	for _, blob := range stored {
+		if ctx.Err() != nil {
+			return report, ctx.Err()
+		}
+		actual, size, err := hashStoredBlob(ctx, blob.SHA256)
+		report.Scanned++
+		report.Bytes += size
+		if err == nil && actual == blob.SHA256 {
+			continue
+		}
+
+		corrupt := CorruptBlob{SHA256: blob.SHA256, Actual: actual, Size: size, Owners: blobOwners(ctx, blob.SHA256)}
+		if err != nil {
+			corrupt.Error = err.Error()
+		}
+		if quarantineCorrupt {
+			if !isQuarantined(blob.SHA256) {
+				quarantineBlob(ctx, blob.SHA256, "integrity: "+corruptionReason(corrupt))
+				quarantined++
+			}
+			corrupt.Quarantined = true
+		}
+		blobLogger(ctx, blob.SHA256).Error("Verify: blob content doesn't match its hash", "actual", actual, "err", err, "quarantined", corrupt.Quarantined)
+		report.Corrupted = append(report.Corrupted, corrupt)
+	}
+	report.FinishedAt = time.Now().Unix()
+
+	if quarantined > 0 {
+		persistQuarantine(ctx)
+	}
+	if err := saveState(ctx, verifyStateKey, report); err != nil {
+		slog.Error("Verify: failed to save report", "err", err)
+	}
+	span.SetAttributes(
+		attribute.Int("blossom.verify.scanned", report.Scanned),
+		attribute.Int64("blossom.verify.bytes", report.Bytes),
+		attribute.Int("blossom.verify.corrupted", len(report.Corrupted)),
+	)
+	slog.Info("Verify: finished", "scanned", report.Scanned, "bytes", report.Bytes, "corrupted", len(report.Corrupted),
+		"quarantined", quarantined, "took", time.Since(start).Round(time.Millisecond))
+	return report, nil
+}
+
+func corruptionReason(c CorruptBlob) string {
+	if c.Error != "" {
+		return "unreadable: " + c.Error
+	}
+	return fmt.Sprintf("content hashes to %s", c.Actual)
+}
+
+// setupBlobVerify exposes GET /admin/blobs/verify (last report) and
+// POST /admin/blobs/verify (run now, in the background), and schedules the
+// periodic check when BLOB_VERIFY_INTERVAL_HOURS is set.
+func setupBlobVerify(relay *khatru.Relay) {
+	relay.Router().HandleFunc("/admin/blobs/verify", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			var report VerifyReport
+			ok, err := loadState(r.Context(), verifyStateKey, &report)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if !ok {
+				http.Error(w, "No verification has run yet", http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(report)
+		case "POST":
+			go func() {
+				if _, err := verifyBlobs(context.Background(), config.BlobVerifyQuarantine); err != nil {
+					slog.Error("Verify: run failed", "err", err)
+				}
+			}()
+			logger(r.Context()).Info("Verify: run requested by admin")
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}))
+
+	if config.BlobVerifyIntervalHours <= 0 {
+		return
+	}
+	go func() {
+		for {
+			time.Sleep(time.Duration(config.BlobVerifyIntervalHours) * time.Hour)
+			if _, err := verifyBlobs(context.Background(), config.BlobVerifyQuarantine); err != nil {
+				slog.Error("Verify: run failed", "err", err)
+			}
+		}
+	}()
+	slog.Info("Verify: ENABLED", "interval_hours", config.BlobVerifyIntervalHours, "quarantine", config.BlobVerifyQuarantine)
+}
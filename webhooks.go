@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Webhooks POST every stored event matching their filter to an HTTP endpoint,
+// so bots and CI can react to relay activity. The body is the event JSON,
+// signed with WEBHOOK_SECRET in the X-Higher-Signature header
+// ("sha256=<hex hmac of the body>"). Failed deliveries are retried with
+// exponential backoff.
+
+// Webhook is one WEBHOOKS entry.
+type Webhook struct {
+	URL     string
+	Kinds   []int    // empty matches every kind
+	Authors []string // empty matches everyone
+	Members bool     // authors given as "members": any current member
+
+	queue chan *nostr.Event
+}
+
+// parseWebhooks reads ";"-separated entries of the form url|kinds|authors,
+// where kinds and authors are comma-separated and may be left empty.
+func parseWebhooks(value *string) ([]*Webhook, error) {
+	if value == nil || strings.TrimSpace(*value) == "" {
+		return nil, nil
+	}
+	var hooks []*Webhook
+	for _, spec := range strings.Split(*value, ";") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		parts := strings.Split(spec, "|")
+		if len(parts) > 3 {
+			return nil, fmt.Errorf("invalid webhook %q, expected url|kinds|authors", spec)
+		}
+		u, err := url.Parse(strings.TrimSpace(parts[0]))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid webhook URL in %q", spec)
+		}
+
+		hook := &Webhook{URL: u.String()}
+		if len(parts) > 1 {
+			hook.Kinds = parseAllowedKinds(&parts[1])
+		}
+		if len(parts) > 2 {
+			for _, author := range strings.Split(parts[2], ",") {
+				author = strings.TrimSpace(author)
+				switch {
+				case author == "":
+				case author == "members":
+					hook.Members = true
+				default:
+					pubkey := normalizePubkey(author)
+					if !nostr.IsValidPublicKey(pubkey) {
+						return nil, fmt.Errorf("invalid author %q in webhook %q", author, spec)
+					}
+					hook.Authors = append(hook.Authors, pubkey)
+				}
+			}
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks, nil
+}
+
+func (h *Webhook) matches(evt *nostr.Event) bool {
+	if len(h.Kinds) > 0 && !slices.Contains(h.Kinds, evt.Kind) {
+		return false
+	}
+	if len(h.Authors) == 0 && !h.Members {
+		return true
+	}
+	return slices.Contains(h.Authors, evt.PubKey) || (h.Members && isMember(evt.PubKey))
+}
+
+// signWebhook returns the X-Higher-Signature value for body.
+func signWebhook(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(config.WebhookSecret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliver POSTs evt, retrying with backoff until it is accepted or the
+// retries run out.
+func (h *Webhook) deliver(client *http.Client, evt *nostr.Event) {
+	body, err := json.Marshal(evt)
+	if err != nil {
+		return
+	}
+
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		err := h.post(client, evt, body)
+		if err == nil {
+			return
+		}
+		if attempt >= config.WebhookMaxRetries {
+			slog.Warn("Webhooks: giving up", "url", h.URL, "event_id", evt.ID, "err", err)
+			return
+		}
+		time.Sleep(backoff)
+		backoff = min(backoff*2, 5*time.Minute)
+	}
+}
+
+func (h *Webhook) post(client *http.Client, evt *nostr.Event, body []byte) error {
+	req, err := http.NewRequestWithContext(context.Background(), "POST", h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "higher-relay")
+	req.Header.Set("X-Higher-Event-Id", evt.ID)
+	if config.WebhookSecret != "" {
+		req.Header.Set("X-Higher-Signature", signWebhook(body))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (h *Webhook) run() {
+	client := &http.Client{Timeout: 10 * time.Second}
+	for evt := range h.queue {
+		h.deliver(client, evt)
+	}
+}
+
+// setupWebhooks starts a delivery worker per webhook and queues every stored
+// event that matches.
+func setupWebhooks(relay *khatru.Relay) {
+	for _, h := range config.Webhooks {
+		h.queue = make(chan *nostr.Event, 1000)
+		go h.run()
+	}
+
+	relay.OnEventSaved = append(relay.OnEventSaved, func(ctx context.Context, evt *nostr.Event) {
+		for _, h := range config.Webhooks {
+			if !h.matches(evt) {
+				continue
+			}
+			select {
+			case h.queue <- evt:
+			default:
+				slog.Warn("Webhooks: queue is full, dropping event", "url", h.URL, "event_id", evt.ID)
+			}
+		}
+	})
+
+	if config.WebhookSecret == "" {
+		slog.Warn("WEBHOOK_SECRET is empty, webhook requests are not signed")
+	}
+	slog.Info("Webhooks: ENABLED", "endpoints", len(config.Webhooks))
+}
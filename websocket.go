@@ -0,0 +1,29 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+)
+
+// Websocket tuning. Pings every WS_PING_INTERVAL_SECONDS keep connections
+// through NATs and proxies and let the relay notice dead clients, which are
+// dropped after WS_PONG_TIMEOUT_SECONDS of silence; mobile clients that sleep
+// often do better with longer intervals. WS_MAX_MESSAGE_SIZE bounds one
+// incoming message (it is raised to fit MAX_EVENT_SIZE and EVENT_LIMITS).
+//
+// permessage-deflate is not offered: khatru keeps its websocket upgrader
+// private and does the upgrade inside HandleWebsocket, so compression can't
+// be enabled until khatru exposes an option for it.
+
+// setupWebSocket applies the settings to the relay. It must run before
+// setupEventLimits, which may raise the message size.
+func setupWebSocket(relay *khatru.Relay) {
+	relay.PingPeriod = time.Duration(config.WSPingIntervalSeconds) * time.Second
+	relay.PongWait = time.Duration(config.WSPongTimeoutSeconds) * time.Second
+	relay.MaxMessageSize = int64(config.WSMaxMessageSize)
+
+	slog.Info("Websocket", "ping_interval_seconds", config.WSPingIntervalSeconds, "pong_timeout_seconds", config.WSPongTimeoutSeconds,
+		"max_message_size", config.WSMaxMessageSize)
+}
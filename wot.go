@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Web of trust: with WOT_DEPTH set, pubkeys the team follows (kind 3 contact
+// lists) may write too. Depth 1 trusts the members' direct follows, depth 2
+// also the follows of those, and so on. Contact lists come from the local
+// store and WOT_RELAYS, and the trusted set is rebuilt every
+// WOT_REFRESH_MINUTES.
+
+const (
+	maxWoTDepth       = 3
+	maxTrustedPubkeys = 200_000
+	contactBatchSize  = 500
+)
+
+var (
+	wotMu   sync.RWMutex
+	trusted = map[string]bool{}
+)
+
+// isTrusted reports whether pubkey is in the team's web of trust.
+func isTrusted(pubkey string) bool {
+	if config.WoTDepth == 0 {
+		return false
+	}
+	wotMu.RLock()
+	defer wotMu.RUnlock()
+	return trusted[pubkey]
+}
+
+// contactLists returns the follows of each author, from the newest kind 3
+// found locally or on WOT_RELAYS.
+func contactLists(ctx context.Context, pool *nostr.SimplePool, authors []string) map[string][]string {
+	latest := map[string]*nostr.Event{}
+	keep := func(evt *nostr.Event) {
+		if prev, ok := latest[evt.PubKey]; !ok || evt.CreatedAt > prev.CreatedAt {
+			latest[evt.PubKey] = evt
+		}
+	}
+
+	for start := 0; start < len(authors); start += contactBatchSize {
+		batch := authors[start:min(start+contactBatchSize, len(authors))]
+		filter := nostr.Filter{Kinds: []int{nostr.KindFollowList}, Authors: batch}
+		if ch, err := db.QueryEvents(ctx, filter); err == nil {
+			for evt := range ch {
+				keep(evt)
+			}
+		}
+		if len(config.WoTRelays) > 0 {
+			fetchCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+			for ie := range pool.SubManyEose(fetchCtx, config.WoTRelays, nostr.Filters{filter}) {
+				if ie.Event != nil && ie.Event.Kind == nostr.KindFollowList {
+					keep(ie.Event)
+				}
+			}
+			cancel()
+		}
+	}
+
+	follows := make(map[string][]string, len(latest))
+	for pubkey, evt := range latest {
+		for _, tag := range evt.Tags {
+			if len(tag) >= 2 && tag[0] == "p" && nostr.IsValid32ByteHex(tag[1]) {
+				follows[pubkey] = append(follows[pubkey], tag[1])
+			}
+		}
+	}
+	return follows
+}
+
+// buildWebOfTrust walks the follow graph from the members up to WOT_DEPTH hops.
+func buildWebOfTrust(ctx context.Context, pool *nostr.SimplePool) map[string]bool {
+	seen := map[string]bool{}
+	frontier := memberPubkeys()
+	for _, pubkey := range frontier {
+		seen[pubkey] = true
+	}
+
+	found := map[string]bool{}
+	for depth := 1; depth <= config.WoTDepth && len(frontier) > 0; depth++ {
+		var next []string
+		for _, follows := range contactLists(ctx, pool, frontier) {
+			for _, pubkey := range follows {
+				if seen[pubkey] {
+					continue
+				}
+				seen[pubkey] = true
+				found[pubkey] = true
+				next = append(next, pubkey)
+				if len(found) >= maxTrustedPubkeys {
+					slog.Warn("Web of trust: size cap reached, stopping early", "depth", depth, "max", maxTrustedPubkeys)
+					return found
+				}
+			}
+		}
+		frontier = next
+	}
+	return found
+}
+
+// setupWebOfTrust builds the trusted set in the background and keeps it fresh.
+func setupWebOfTrust() {
+	pool := nostr.NewSimplePool(context.Background())
+	go func() {
+		interval := time.Duration(config.WoTRefreshMinutes) * time.Minute
+		for {
+			start := time.Now()
+			set := buildWebOfTrust(context.Background(), pool)
+			wotMu.Lock()
+			trusted = set
+			wotMu.Unlock()
+			slog.Info("Web of trust: refreshed", "trusted", len(set), "took", time.Since(start).Round(time.Millisecond))
+			time.Sleep(interval)
+		}
+	}()
+
+	slog.Info("Web of trust: ENABLED", "depth", config.WoTDepth, "relays", config.WoTRelays, "refresh_minutes", config.WoTRefreshMinutes)
+}